@@ -0,0 +1,31 @@
+package context
+
+import (
+	"context"
+)
+
+type FlashKind string
+
+const (
+	FlashSuccess FlashKind = "success"
+	FlashInfo    FlashKind = "info"
+	FlashError   FlashKind = "error"
+)
+
+// Flash is a one-shot message shown on the page following a redirect.
+type Flash struct {
+	Kind    FlashKind
+	Message string
+}
+
+func WithFlashes(ctx context.Context, flashes []Flash) context.Context {
+	return context.WithValue(ctx, flashesKey, flashes)
+}
+
+func Flashes(ctx context.Context) []Flash {
+	val := ctx.Value(flashesKey)
+	if flashes, ok := val.([]Flash); ok {
+		return flashes
+	}
+	return nil
+}
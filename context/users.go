@@ -9,6 +9,7 @@ type key int
 
 const (
 	userKey key = iota
+	flashesKey
 )
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
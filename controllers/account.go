@@ -0,0 +1,297 @@
+package controllers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/context"
+	"github.com/arkadiont/lenslocked/models"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+func (u Users) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	u.renderDeleteAccount(w, r, http.StatusOK)
+}
+
+func (u Users) renderDeleteAccount(w http.ResponseWriter, r *http.Request, status int, errs ...error) {
+	var data struct {
+		Reauth reauthForm
+	}
+	var err error
+	data.Reauth, err = u.newReauthForm(r, context.User(r.Context()), "/users/me/delete")
+	if err != nil {
+		log.Printf("delete account err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	u.Templates.DeleteAccount.Execute(w, r, data, errs...)
+}
+
+// ProcessDeleteAccount schedules the deletion of the account, which can be
+// cancelled during the grace period from the link sent by email.
+func (u Users) ProcessDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := u.confirmOwner(r, user, r.FormValue("password")); err != nil {
+		var locked *models.LockedError
+		switch {
+		case errors.As(err, &locked):
+			retryAfter(w, locked)
+			u.renderDeleteAccount(w, r, http.StatusTooManyRequests, locked)
+		case errors.Is(err, models.ErrInvalidPassword):
+			u.renderDeleteAccount(w, r, http.StatusUnauthorized, publicError("Your password is incorrect."))
+		case errors.Is(err, errReauthRequired):
+			u.renderDeleteAccount(w, r, http.StatusUnauthorized, err)
+		default:
+			log.Printf("delete account err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	deletion, err := u.AccountDeletionService.Schedule(user.ID)
+	if err != nil {
+		log.Printf("delete account err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	values := url.Values{
+		"token": {deletion.Token},
+	}
+	cancelURL := u.BaseURL + "/cancel-deletion?" + values.Encode()
+	if err = u.EmailService.AccountDeletionScheduled(user.Email, deletion.DeleteAt, cancelURL); err != nil {
+		log.Printf("account deletion email err: %v", err)
+	}
+	u.Flasher.Success(w, fmt.Sprintf("Your account will be deleted on %s.", deletion.DeleteAt.Format("January 2, 2006")))
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// CancelDeletion cancels the deletion from the link sent by email, the user
+// doesn't need to be signed in.
+func (u Users) CancelDeletion(w http.ResponseWriter, r *http.Request) {
+	if _, err := u.AccountDeletionService.Cancel(r.FormValue("token")); err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			u.redirectWithError(w, r, "/signin", "This link is invalid or the deletion was already cancelled.")
+			return
+		}
+		log.Printf("cancel account deletion err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Flasher.Success(w, "Your account won't be deleted.")
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u Users) ProcessCancelDeletion(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := u.AccountDeletionService.CancelByUserID(user.ID); err != nil && !errors.Is(err, models.ErrNotFound) {
+		log.Printf("cancel account deletion err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Flasher.Success(w, "Your account won't be deleted.")
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// accountExport is the profile.json of the export.
+type accountExport struct {
+	ID               uint             `json:"id"`
+	Email            string           `json:"email"`
+	EmailVerifiedAt  *time.Time       `json:"email_verified_at"`
+	TwoFactorEnabled bool             `json:"two_factor_enabled"`
+	Galleries        []galleryExport  `json:"galleries"`
+	Identities       []identityExport `json:"identities"`
+	Passkeys         []passkeyExport  `json:"passkeys"`
+	Sessions         []sessionExport  `json:"sessions"`
+}
+
+type galleryExport struct {
+	ID           uint      `json:"id"`
+	Title        string    `json:"title"`
+	Visibility   string    `json:"visibility"`
+	KeepLocation bool      `json:"keep_location"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	// Images are the paths of the images in the archive.
+	Images []string `json:"images"`
+}
+
+type identityExport struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type passkeyExport struct {
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type sessionExport struct {
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// exportImage is an image to copy in the archive.
+type exportImage struct {
+	GalleryID uint
+	Filename  string
+	Path      string
+}
+
+// ExportAccount sends a ZIP archive with profile.json, describing the
+// account, and the original of every image of the user.
+func (u Users) ExportAccount(w http.ResponseWriter, r *http.Request) {
+	profile, images, err := u.accountExport(r)
+	if err != nil {
+		log.Printf("export account err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	// Errors can't be reported once the archive is being sent, the download
+	// ends up truncated instead.
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="lenslocked-export.zip"`)
+	archive := zip.NewWriter(w)
+	f, err := archive.Create("profile.json")
+	if err != nil {
+		log.Printf("export account err: %v", err)
+		return
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(profile); err != nil {
+		log.Printf("export account err: %v", err)
+		return
+	}
+	for _, image := range images {
+		if err = u.exportImage(archive, image); err != nil {
+			log.Printf("export account err: %v", err)
+			return
+		}
+	}
+	if err = archive.Close(); err != nil {
+		log.Printf("export account err: %v", err)
+	}
+}
+
+func (u Users) exportImage(archive *zip.Writer, image exportImage) error {
+	contents, info, err := u.ImageService.Open(image.GalleryID, image.Filename)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+	f, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     image.Path,
+		Method:   zip.Store, // images are already compressed
+		Modified: info.ModTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, contents)
+	return err
+}
+
+// accountExport gathers everything about the user before the archive is
+// sent, so errors can still be reported.
+func (u Users) accountExport(r *http.Request) (*accountExport, []exportImage, error) {
+	user := context.User(r.Context())
+	profile := accountExport{
+		ID:              user.ID,
+		Email:           user.Email,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+		Galleries:       []galleryExport{},
+		Identities:      []identityExport{},
+		Passkeys:        []passkeyExport{},
+		Sessions:        []sessionExport{},
+	}
+	var err error
+	if profile.TwoFactorEnabled, err = u.TwoFactorService.Enabled(user.ID); err != nil {
+		return nil, nil, err
+	}
+
+	galleries, err := u.GalleryService.ByUserID(user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var images []exportImage
+	for _, gallery := range galleries {
+		export := galleryExport{
+			ID:           gallery.ID,
+			Title:        gallery.Title,
+			Visibility:   string(gallery.Visibility),
+			KeepLocation: gallery.KeepLocation,
+			CreatedAt:    gallery.CreatedAt,
+			UpdatedAt:    gallery.UpdatedAt,
+			Images:       []string{},
+		}
+		galleryImages, err := u.ImageService.ByGalleryID(gallery.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, image := range galleryImages {
+			path := fmt.Sprintf("galleries/%d/%s", gallery.ID, image.Filename)
+			export.Images = append(export.Images, path)
+			images = append(images, exportImage{
+				GalleryID: gallery.ID,
+				Filename:  image.Filename,
+				Path:      path,
+			})
+		}
+		profile.Galleries = append(profile.Galleries, export)
+	}
+
+	identities, err := u.IdentityService.List(user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, identity := range identities {
+		profile.Identities = append(profile.Identities, identityExport{
+			Provider:  identity.Provider,
+			Email:     identity.Email,
+			CreatedAt: identity.CreatedAt,
+		})
+	}
+
+	if u.PasskeyService != nil {
+		passkeys, err := u.PasskeyService.List(user.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, passkey := range passkeys {
+			profile.Passkeys = append(profile.Passkeys, passkeyExport{
+				Name:       passkey.Name,
+				CreatedAt:  passkey.CreatedAt,
+				LastUsedAt: passkey.LastUsedAt,
+			})
+		}
+	}
+
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		return nil, nil, err
+	}
+	sessions, err := u.SessionService.List(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, session := range sessions {
+		profile.Sessions = append(profile.Sessions, sessionExport{
+			UserAgent:  session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+		})
+	}
+	return &profile, images, nil
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/models"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// addImage uploads a small png to a new gallery of the user, returning the
+// gallery and the stored image.
+func (o *oidcTest) addImage(t *testing.T, userID uint) (*models.Gallery, *models.Image, []byte) {
+	t.Helper()
+	gallery, err := o.users.GalleryService.Create("holidays", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	img, err := o.users.ImageService.Create(gallery, "beach.png", bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gallery, img, buf.Bytes()
+}
+
+func TestExportAccount(t *testing.T) {
+	test := newOIDCTest(t)
+	test.signedIn = test.user
+	gallery, img, contents := test.addImage(t, test.user.ID)
+	other, err := test.users.UserService.Create("other@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.addImage(t, other.ID)
+	test.twoFactor.IsEnabled = true
+	test.identities.Identities = []models.Identity{{ID: 1, UserID: test.user.ID, Provider: "stub", Email: "owner@example.com"}}
+	test.passkeys.Passkeys = []models.Passkey{{ID: 2, UserID: test.user.ID, Name: "laptop"}}
+
+	r := httptest.NewRequest(http.MethodGet, "/users/me/export", nil)
+	r.AddCookie(test.sessionCookie(t))
+	rec := httptest.NewRecorder()
+	test.router.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("status = %d, Content-Type %q, want an archive", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagePath := fmt.Sprintf("galleries/%d/%s", gallery.ID, img.Filename)
+	files := make(map[string][]byte)
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name == imagePath && f.Method != zip.Store {
+			t.Errorf("%s is compressed again", f.Name)
+		}
+	}
+	if len(files) != 2 {
+		t.Errorf("the archive holds %d files, want profile.json and the image of the user", len(files))
+	}
+	if !bytes.Equal(files[imagePath], contents) {
+		t.Errorf("%s doesn't hold the original image", imagePath)
+	}
+
+	var profile accountExport
+	if err = json.Unmarshal(files["profile.json"], &profile); err != nil {
+		t.Fatalf("profile.json: %v", err)
+	}
+	if profile.ID != test.user.ID || profile.Email != test.user.Email || !profile.TwoFactorEnabled {
+		t.Errorf("profile %d %q 2FA %t, want %d %q with 2FA", profile.ID, profile.Email, profile.TwoFactorEnabled,
+			test.user.ID, test.user.Email)
+	}
+	if len(profile.Galleries) != 1 || profile.Galleries[0].ID != gallery.ID ||
+		len(profile.Galleries[0].Images) != 1 || profile.Galleries[0].Images[0] != imagePath {
+		t.Errorf("galleries = %+v, want gallery %d with %s", profile.Galleries, gallery.ID, imagePath)
+	}
+	if len(profile.Identities) != 1 || profile.Identities[0].Provider != "stub" {
+		t.Errorf("identities = %+v, want the stub identity", profile.Identities)
+	}
+	if len(profile.Passkeys) != 1 || profile.Passkeys[0].Name != "laptop" {
+		t.Errorf("passkeys = %+v, want the laptop passkey", profile.Passkeys)
+	}
+	if len(profile.Sessions) != 1 || profile.Sessions[0].IPAddress != "192.0.2.1" {
+		t.Errorf("sessions = %+v, want the session of the request", profile.Sessions)
+	}
+	if bytes.Contains(files["profile.json"], []byte(test.user.PasswordHash)) {
+		t.Errorf("profile.json holds the password hash")
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	test := newOIDCTest(t)
+	test.signedIn = test.user
+	deletions := test.users.AccountDeletionService
+
+	rec := test.post("/users/me/delete", url.Values{"password": {"wrong password"}})
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("with a wrong password: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if _, err := deletions.ByUserID(test.user.ID); !errors.Is(err, models.ErrNotFound) {
+		t.Fatalf("a wrong password scheduled the deletion: err = %v", err)
+	}
+
+	rec = test.post("/users/me/delete", url.Values{"password": {"correct horse battery"}})
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusFound)
+	}
+	if _, err := deletions.ByUserID(test.user.ID); err != nil {
+		t.Fatalf("the deletion wasn't scheduled: %v", err)
+	}
+	if len(test.emails.Sent) != 1 {
+		t.Fatalf("%d emails sent, want the cancel link", len(test.emails.Sent))
+	}
+	prefix := "owner@example.com https://photos.example.com/cancel-deletion?"
+	cancelURL, ok := strings.CutPrefix(test.emails.Sent[0], prefix)
+	if !ok {
+		t.Fatalf("email %q, want a link starting with %q", test.emails.Sent[0], prefix)
+	}
+
+	// The link works signed out.
+	test.signedIn = nil
+	cancel := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		test.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/cancel-deletion?"+cancelURL, nil))
+		return rec
+	}
+	if rec = cancel(); rec.Code != http.StatusFound || rec.Header().Get("Location") != "/users/me" {
+		t.Fatalf("cancel: status = %d to %q, want a redirect to /users/me", rec.Code, rec.Header().Get("Location"))
+	}
+	if _, err := deletions.ByUserID(test.user.ID); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("the deletion wasn't cancelled: err = %v", err)
+	}
+	if rec = cancel(); !strings.HasPrefix(rec.Header().Get("Location"), "/signin") {
+		t.Errorf("cancel twice: redirect to %q, want the sign in page", rec.Header().Get("Location"))
+	}
+
+	// Signed in users cancel from their account page.
+	test.signedIn = test.user
+	if _, err := deletions.Schedule(test.user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if rec = test.post("/users/me/delete/cancel", nil); rec.Code != http.StatusFound {
+		t.Fatalf("cancel from the account page: status = %d, want %d", rec.Code, http.StatusFound)
+	}
+	if _, err := deletions.ByUserID(test.user.ID); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("the deletion wasn't cancelled from the account page: err = %v", err)
+	}
+}
@@ -2,7 +2,10 @@ package controllers
 
 import (
 	"fmt"
+	"github.com/arkadiont/lenslocked/models"
+	"net"
 	"net/http"
+	"time"
 )
 
 const (
@@ -24,6 +27,15 @@ func setCookie(w http.ResponseWriter, name, value string) {
 	http.SetCookie(w, cookie)
 }
 
+// setSessionCookie stores the session token in a cookie expiring together
+// with the session.
+func setSessionCookie(w http.ResponseWriter, session *models.Session) {
+	cookie := newCookie(CookieSession, session.Token)
+	cookie.Expires = session.ExpiresAt
+	cookie.MaxAge = int(time.Until(session.ExpiresAt) / time.Second)
+	http.SetCookie(w, cookie)
+}
+
 func readCookie(r *http.Request, name string) (string, error) {
 	c, err := r.Cookie(name)
 	if err != nil {
@@ -37,3 +49,13 @@ func deleteCookie(w http.ResponseWriter, name string) {
 	cookie.MaxAge = -1
 	http.SetCookie(w, cookie)
 }
+
+// clientIP returns the address of the client connected to the server,
+// without its port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
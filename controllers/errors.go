@@ -0,0 +1,13 @@
+package controllers
+
+// publicError is an error whose message can be shown to users as is, see
+// views.Template.Execute.
+type publicError string
+
+func (e publicError) Error() string {
+	return string(e)
+}
+
+func (e publicError) Public() string {
+	return string(e)
+}
@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"github.com/arkadiont/lenslocked/context"
+	"github.com/gorilla/securecookie"
+	"log"
+	"net/http"
+)
+
+const (
+	CookieFlash = "flash"
+)
+
+// Flasher carries flash messages across a redirect in a signed cookie. The
+// messages are read back by Middleware on the next request and handed to the
+// templates through the request context.
+type Flasher struct {
+	SecureCookie *securecookie.SecureCookie
+}
+
+// Flash queues messages for the next page the user sees, replacing any
+// message queued earlier in the same response.
+func (f Flasher) Flash(w http.ResponseWriter, flashes ...context.Flash) {
+	if f.SecureCookie == nil {
+		return
+	}
+	encoded, err := f.SecureCookie.Encode(CookieFlash, flashes)
+	if err != nil {
+		log.Printf("encode flash err: %v", err)
+		return
+	}
+	setCookie(w, CookieFlash, encoded)
+}
+
+// Success is a shortcut to queue a single success message.
+func (f Flasher) Success(w http.ResponseWriter, message string) {
+	f.Flash(w, context.Flash{Kind: context.FlashSuccess, Message: message})
+}
+
+// Error is a shortcut to queue a single error message.
+func (f Flasher) Error(w http.ResponseWriter, message string) {
+	f.Flash(w, context.Flash{Kind: context.FlashError, Message: message})
+}
+
+// Middleware consumes the flash cookie of the request, so every message is
+// only shown once.
+func (f Flasher) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, err := readCookie(r, CookieFlash)
+		if err != nil || f.SecureCookie == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		deleteCookie(w, CookieFlash)
+		var flashes []context.Flash
+		if err = f.SecureCookie.Decode(CookieFlash, value, &flashes); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithFlashes(r.Context(), flashes)))
+	})
+}
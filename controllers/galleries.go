@@ -0,0 +1,674 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/context"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/securecookie"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Galleries struct {
+	Templates struct {
+		New    Template
+		Index  Template
+		Show   Template
+		Edit   Template
+		Image  Template
+		Unlock Template
+	}
+	GalleryService models.GalleryService
+	ImageService   models.ImageService
+	// MaxUploadSize caps the body of a single upload request, in bytes.
+	// Default DefaultMaxUploadSize
+	MaxUploadSize int64
+	// BaseURL is prepended to the share links shown to gallery owners,
+	// e.g. https://www.lenslocked.com
+	BaseURL string
+	// SecureCookie signs the cookies granting visitors access to password
+	// protected galleries.
+	SecureCookie *securecookie.SecureCookie
+	// RequireVerifiedEmail keeps galleries of users who haven't confirmed
+	// their email address private: they can't be made public, unlisted or shared.
+	RequireVerifiedEmail bool
+	Flasher              Flasher
+}
+
+const (
+	CookieGalleryAccess = "gallery_access"
+	// galleryAccessDuration is how long a visitor stays unlocked after
+	// entering a gallery password.
+	galleryAccessDuration = 30 * 24 * time.Hour
+
+	DefaultMaxUploadSize = 50 << 20
+	// multipartMemory is how much of a multipart form is kept in memory,
+	// the rest is spooled to temporary files.
+	multipartMemory = 8 << 20
+)
+
+type galleryImage struct {
+	GalleryID uint
+	Filename  string
+	Status    models.ImageStatus
+	// URL points at the original image, ThumbURL falls back to it while
+	// the variants are being generated.
+	URL        string
+	ThumbURL   string
+	SrcSet     string
+	DetailsURL string
+}
+
+// newGalleryImage builds the urls of image below basePath, which is either
+// /galleries/{id} or the share link the gallery was reached through.
+func newGalleryImage(image models.Image, basePath string) galleryImage {
+	gi := galleryImage{
+		GalleryID: image.GalleryID,
+		Filename:  image.Filename,
+		Status:    image.Status,
+		URL:       basePath + "/images/" + image.Filename,
+	}
+	gi.ThumbURL = gi.URL
+	gi.DetailsURL = gi.URL + "/details"
+	var srcSet []string
+	for _, variant := range image.Variants {
+		variantURL := gi.URL + "?" + url.Values{"variant": {variant.Name}}.Encode()
+		if variant.Square {
+			gi.ThumbURL = variantURL
+			continue
+		}
+		srcSet = append(srcSet, fmt.Sprintf("%s %dw", variantURL, variant.Width))
+	}
+	gi.SrcSet = strings.Join(srcSet, ", ")
+	return gi
+}
+
+func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Title string
+	}
+	data.Title = r.FormValue("title")
+	g.Templates.New.Execute(w, r, data)
+}
+
+func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	title := r.FormValue("title")
+	gallery, err := g.GalleryService.Create(title, user.ID)
+	if err != nil {
+		log.Printf("create gallery err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	galleries, err := g.GalleryService.ByUserID(user.ID)
+	if err != nil {
+		log.Printf("index galleries err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Galleries []models.Gallery
+	}
+	data.Galleries = galleries
+	g.Templates.Index.Execute(w, r, data)
+}
+
+// Show renders a gallery either by id, for its owner and public galleries,
+// or through its share link.
+func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
+	gallery, basePath, err := g.viewableGallery(w, r, true)
+	if err != nil {
+		return
+	}
+	images, err := g.galleryImages(w, gallery.ID, basePath)
+	if err != nil {
+		return
+	}
+	var data struct {
+		ID      uint
+		Title   string
+		IsOwner bool
+		Images  []galleryImage
+	}
+	data.ID = gallery.ID
+	data.Title = gallery.Title
+	data.IsOwner = isGalleryOwner(r, gallery)
+	data.Images = images
+	g.Templates.Show.Execute(w, r, data)
+}
+
+func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	g.renderEdit(w, r, gallery, "", "")
+}
+
+// renderEdit renders the edit page of gallery. shareURL is only known right
+// after the share link has been regenerated, as we only store its hash.
+// passwordError is shown next to the gallery password field.
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, shareURL, passwordError string) {
+	images, err := g.galleryImages(w, gallery.ID, galleryPath(gallery))
+	if err != nil {
+		return
+	}
+	var data struct {
+		ID            uint
+		Title         string
+		Visibility    models.Visibility
+		Visibilities  []models.Visibility
+		HasShareLink  bool
+		ShareURL      string
+		HasPassword   bool
+		PasswordError string
+		KeepLocation  bool
+		Images        []galleryImage
+	}
+	data.ID = gallery.ID
+	data.Title = gallery.Title
+	data.Visibility = gallery.Visibility
+	data.Visibilities = []models.Visibility{
+		models.VisibilityPrivate, models.VisibilityUnlisted, models.VisibilityPublic,
+	}
+	data.HasShareLink = gallery.ShareTokenHash != ""
+	data.ShareURL = shareURL
+	data.HasPassword = gallery.PasswordHash != ""
+	data.PasswordError = passwordError
+	data.KeepLocation = gallery.KeepLocation
+	data.Images = images
+	if passwordError != "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	g.Templates.Edit.Execute(w, r, data)
+}
+
+func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	gallery.Title = r.FormValue("title")
+	gallery.KeepLocation = r.FormValue("keep_location") == "on"
+	if v := models.Visibility(r.FormValue("visibility")); v != "" {
+		if !v.Valid() {
+			http.Error(w, "Invalid visibility", http.StatusBadRequest)
+			return
+		}
+		gallery.Visibility = v
+	}
+	if gallery.Visibility != models.VisibilityPrivate {
+		if err = g.userMustBeVerified(w, r); err != nil {
+			return
+		}
+	}
+	if err = g.GalleryService.Update(gallery); err != nil {
+		log.Printf("update gallery err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	g.Flasher.Success(w, "Gallery saved.")
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) RegenerateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	if err = g.userMustBeVerified(w, r); err != nil {
+		return
+	}
+	token, err := g.GalleryService.RegenerateShareToken(gallery.ID)
+	if err != nil {
+		log.Printf("regenerate share link err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	// Reload so the edit page reflects the new share link.
+	gallery, err = g.GalleryService.ByID(gallery.ID)
+	if err != nil {
+		log.Printf("regenerate share link err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	g.renderEdit(w, r, gallery, g.BaseURL+sharePath(token), "")
+}
+
+func (g Galleries) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	if err = g.GalleryService.RevokeShareToken(gallery.ID); err != nil {
+		log.Printf("revoke share link err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	g.Flasher.Success(w, "The share link no longer works.")
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// SetPassword protects the gallery with the submitted password.
+func (g Galleries) SetPassword(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	if err = g.GalleryService.SetPassword(gallery.ID, r.FormValue("password")); err != nil {
+		var verr *models.ValidationError
+		if errors.As(err, &verr) {
+			g.renderEdit(w, r, gallery, "", verr.Message)
+			return
+		}
+		log.Printf("set gallery password err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	g.Flasher.Success(w, "The gallery password was set.")
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// RemovePassword lets visitors see the gallery without a password again.
+func (g Galleries) RemovePassword(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	if err = g.GalleryService.RemovePassword(gallery.ID); err != nil {
+		log.Printf("remove gallery password err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	g.Flasher.Success(w, "The gallery password was removed.")
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+// Unlock checks the password of a protected gallery and hands the visitor a
+// signed cookie, scoped to the gallery path, that grants access to it.
+func (g Galleries) Unlock(w http.ResponseWriter, r *http.Request) {
+	gallery, basePath, err := g.lookupViewableGallery(w, r)
+	if err != nil {
+		return
+	}
+	err = g.GalleryService.CheckPassword(gallery, r.FormValue("password"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidPassword) {
+			g.renderUnlock(w, r, gallery, basePath, "Invalid password, please try again.")
+			return
+		}
+		log.Printf("unlock gallery err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	access := galleryAccess{
+		GalleryID:   gallery.ID,
+		Fingerprint: passwordFingerprint(gallery.PasswordHash),
+	}
+	value, err := g.SecureCookie.Encode(CookieGalleryAccess, access)
+	if err != nil {
+		log.Printf("unlock gallery err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	cookie := newCookie(CookieGalleryAccess, value)
+	cookie.Path = basePath
+	cookie.MaxAge = int(galleryAccessDuration / time.Second)
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, basePath, http.StatusFound)
+}
+
+func (g Galleries) renderUnlock(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, basePath, errMsg string) {
+	var data struct {
+		Title  string
+		Action string
+		Error  string
+	}
+	data.Title = gallery.Title
+	data.Action = basePath + "/unlock"
+	data.Error = errMsg
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	g.Templates.Unlock.Execute(w, r, data)
+}
+
+// galleryAccess is the payload of the CookieGalleryAccess cookie.
+type galleryAccess struct {
+	GalleryID uint
+	// Fingerprint ties the cookie to the password it was granted for, so
+	// changing the password locks out every visitor.
+	Fingerprint string
+}
+
+func passwordFingerprint(passwordHash string) string {
+	sum := sha256.Sum256([]byte(passwordHash))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+func (g Galleries) hasAccess(r *http.Request, gallery *models.Gallery) bool {
+	value, err := readCookie(r, CookieGalleryAccess)
+	if err != nil {
+		return false
+	}
+	var access galleryAccess
+	if err = g.SecureCookie.Decode(CookieGalleryAccess, value, &access); err != nil {
+		return false
+	}
+	return access.GalleryID == gallery.ID &&
+		access.Fingerprint == passwordFingerprint(gallery.PasswordHash)
+}
+
+func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	if err = g.GalleryService.Delete(gallery.ID); err != nil {
+		log.Printf("delete gallery err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	// The gallery row is already gone, so a failure here only leaves orphan
+	// files behind and must not be reported as a failed delete.
+	if err = g.ImageService.DeleteAll(gallery.ID); err != nil {
+		log.Printf("delete gallery images err: %v", err)
+	}
+	g.Flasher.Success(w, fmt.Sprintf("Gallery %q deleted.", gallery.Title))
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	maxUpload := g.MaxUploadSize
+	if maxUpload <= 0 {
+		maxUpload = DefaultMaxUploadSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+	if err = r.ParseMultipartForm(multipartMemory); err != nil {
+		log.Printf("parse upload err: %v", err)
+		http.Error(w, "The upload is too large or malformed", http.StatusRequestEntityTooLarge)
+		return
+	}
+	defer func() {
+		if err := r.MultipartForm.RemoveAll(); err != nil {
+			log.Printf("remove multipart files err: %v", err)
+		}
+	}()
+	fileHeaders := r.MultipartForm.File["images"]
+	for _, fileHeader := range fileHeaders {
+		if err = g.createImage(gallery, fileHeader); err != nil {
+			switch {
+			case errors.Is(err, models.ErrInvalidImage):
+				msg := fmt.Sprintf("%q is not a jpeg, png, gif or webp image", fileHeader.Filename)
+				http.Error(w, msg, http.StatusUnsupportedMediaType)
+			case errors.Is(err, models.ErrImageTooLarge):
+				msg := fmt.Sprintf("%q is too large", fileHeader.Filename)
+				http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			default:
+				log.Printf("upload image err: %v", err)
+				http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) createImage(gallery *models.Gallery, fileHeader *multipart.FileHeader) error {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = g.ImageService.Create(gallery, fileHeader.Filename, file)
+	return err
+}
+
+func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, _, err := g.viewableGallery(w, r, false)
+	if err != nil {
+		return
+	}
+	filename := chi.URLParam(r, "filename")
+	var file io.ReadSeekCloser
+	var image *models.Image
+	if variant := r.FormValue("variant"); variant != "" {
+		file, image, err = g.ImageService.OpenVariant(gallery.ID, filename, variant)
+	} else {
+		file, image, err = g.ImageService.Open(gallery.ID, filename)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("open image err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, image.Filename, image.ModTime, file)
+}
+
+// ImageDetails renders a single image along with the camera details read
+// from its EXIF data.
+func (g Galleries) ImageDetails(w http.ResponseWriter, r *http.Request) {
+	gallery, basePath, err := g.viewableGallery(w, r, true)
+	if err != nil {
+		return
+	}
+	filename := chi.URLParam(r, "filename")
+	var image *models.Image
+	images, err := g.ImageService.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Printf("image details err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	for i := range images {
+		if images[i].Filename == filename {
+			image = &images[i]
+			break
+		}
+	}
+	if image == nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	md, err := g.ImageService.Metadata(gallery.ID, filename)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		log.Printf("image metadata err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		GalleryPath  string
+		GalleryTitle string
+		Image        galleryImage
+		Metadata     *models.ImageMetadata
+	}
+	data.GalleryPath = basePath
+	data.GalleryTitle = gallery.Title
+	data.Image = newGalleryImage(*image, basePath)
+	data.Metadata = md
+	g.Templates.Image.Execute(w, r, data)
+}
+
+func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+	err = g.ImageService.Delete(gallery.ID, chi.URLParam(r, "filename"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("delete image err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+func (g Galleries) galleryImages(w http.ResponseWriter, galleryID uint, basePath string) ([]galleryImage, error) {
+	images, err := g.ImageService.ByGalleryID(galleryID)
+	if err != nil {
+		log.Printf("gallery images err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return nil, err
+	}
+	result := make([]galleryImage, 0, len(images))
+	for _, image := range images {
+		result = append(result, newGalleryImage(image, basePath))
+	}
+	return result, nil
+}
+
+type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
+
+// galleryByID looks up the gallery referenced by the {id} url param and runs
+// every opt against it. Any error is already written to w, so callers only
+// need to return when err != nil.
+func (g Galleries) galleryByID(w http.ResponseWriter, r *http.Request, opts ...galleryOpt) (*models.Gallery, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, fmt.Errorf("invalid gallery id: %q", chi.URLParam(r, "id"))
+	}
+	gallery, err := g.GalleryService.ByID(uint(id))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return nil, err
+		}
+		log.Printf("gallery by id err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return nil, err
+	}
+	for _, opt := range opts {
+		if err = opt(w, r, gallery); err != nil {
+			return nil, err
+		}
+	}
+	return gallery, nil
+}
+
+// viewableGallery is lookupViewableGallery for galleries that may be password
+// protected. Visitors who haven't unlocked the gallery get the unlock form
+// when page is set and a plain 401 otherwise.
+func (g Galleries) viewableGallery(w http.ResponseWriter, r *http.Request, page bool) (*models.Gallery, string, error) {
+	gallery, basePath, err := g.lookupViewableGallery(w, r)
+	if err != nil {
+		return nil, "", err
+	}
+	if gallery.PasswordHash == "" || isGalleryOwner(r, gallery) || g.hasAccess(r, gallery) {
+		return gallery, basePath, nil
+	}
+	if page {
+		g.renderUnlock(w, r, gallery, basePath, "")
+	} else {
+		http.Error(w, "This gallery is password protected", http.StatusUnauthorized)
+	}
+	return nil, "", fmt.Errorf("gallery %d is locked", gallery.ID)
+}
+
+// lookupViewableGallery looks up the gallery referenced either by the {token}
+// of a share link or by its {id}, in which case only the owner can see private
+// and unlisted galleries. It returns the path the gallery was reached through,
+// which is used to build the urls of its images.
+func (g Galleries) lookupViewableGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, string, error) {
+	if token := chi.URLParam(r, "token"); token != "" {
+		gallery, err := g.GalleryService.ByShareToken(token)
+		if err != nil {
+			if errors.Is(err, models.ErrNotFound) {
+				http.Error(w, "Gallery not found", http.StatusNotFound)
+				return nil, "", err
+			}
+			log.Printf("gallery by share token err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+			return nil, "", err
+		}
+		// Keep the token out of the Referer of any link followed from the page.
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		return gallery, sharePath(token), nil
+	}
+	gallery, err := g.galleryByID(w, r, userCanViewGallery)
+	if err != nil {
+		return nil, "", err
+	}
+	return gallery, galleryPath(gallery), nil
+}
+
+func galleryPath(gallery *models.Gallery) string {
+	return fmt.Sprintf("/galleries/%d", gallery.ID)
+}
+
+func sharePath(token string) string {
+	return "/share/" + url.PathEscape(token)
+}
+
+func isGalleryOwner(r *http.Request, gallery *models.Gallery) bool {
+	user := context.User(r.Context())
+	return user != nil && gallery.UserID == user.ID
+}
+
+// userCanViewGallery lets anyone see public galleries, the rest are reported
+// as missing so their existence isn't leaked.
+func userCanViewGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if gallery.Visibility == models.VisibilityPublic || isGalleryOwner(r, gallery) {
+		return nil
+	}
+	http.Error(w, "Gallery not found", http.StatusNotFound)
+	return fmt.Errorf("gallery %d is not visible", gallery.ID)
+}
+
+// userMustBeVerified enforces RequireVerifiedEmail on the actions exposing a
+// gallery to other people.
+func (g Galleries) userMustBeVerified(w http.ResponseWriter, r *http.Request) error {
+	if !g.RequireVerifiedEmail {
+		return nil
+	}
+	if user := context.User(r.Context()); user == nil || !user.Verified() {
+		http.Error(w, "Please verify your email address before sharing galleries", http.StatusForbidden)
+		return fmt.Errorf("user email not verified")
+	}
+	return nil
+}
+
+func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if !isGalleryOwner(r, gallery) {
+		http.Error(w, "You are not authorized to access this gallery", http.StatusForbidden)
+		return fmt.Errorf("user does not own gallery %d", gallery.ID)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"fmt"
+	"github.com/arkadiont/lenslocked/context"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/securecookie"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeGalleryService holds a single gallery, its password is checked with
+// the default password policy.
+type fakeGalleryService struct {
+	models.GalleryService
+	Gallery models.Gallery
+}
+
+func (s *fakeGalleryService) ByID(id uint) (*models.Gallery, error) {
+	if id != s.Gallery.ID {
+		return nil, models.ErrNotFound
+	}
+	gallery := s.Gallery
+	return &gallery, nil
+}
+
+func (s *fakeGalleryService) SetPassword(id uint, password string) error {
+	if err := models.NewPasswordPolicy().Validate("", password); err != nil {
+		return fmt.Errorf("set gallery password: %w", err)
+	}
+	s.Gallery.PasswordHash = "hash of " + password
+	return nil
+}
+
+func (s *fakeGalleryService) RemovePassword(id uint) error {
+	s.Gallery.PasswordHash = ""
+	return nil
+}
+
+type fakeImageService struct {
+	models.ImageService
+}
+
+func (s fakeImageService) ByGalleryID(galleryID uint) ([]models.Image, error) {
+	return nil, nil
+}
+
+type galleriesTest struct {
+	galleries *fakeGalleryService
+	edit      *fakeTemplate
+	router    http.Handler
+}
+
+func newGalleriesTest(t *testing.T) *galleriesTest {
+	t.Helper()
+	owner := &models.User{ID: 1, Email: "owner@example.com"}
+	test := galleriesTest{
+		galleries: &fakeGalleryService{Gallery: models.Gallery{ID: 7, UserID: owner.ID, Title: "Holidays"}},
+		edit:      &fakeTemplate{},
+	}
+	secureCookie := securecookie.New(securecookie.GenerateRandomKey(32), nil)
+	galleriesC := Galleries{
+		GalleryService: test.galleries,
+		ImageService:   fakeImageService{},
+		SecureCookie:   secureCookie,
+		Flasher:        Flasher{SecureCookie: secureCookie},
+	}
+	galleriesC.Templates.Edit = test.edit
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithUser(r.Context(), owner)))
+		})
+	})
+	r.Post("/galleries/{id}/password", galleriesC.SetPassword)
+	r.Post("/galleries/{id}/password/remove", galleriesC.RemovePassword)
+	test.router = r
+	return &test
+}
+
+func (g *galleriesTest) post(path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	g.router.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestSetGalleryPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		// wantError is shown next to the field, nothing is saved then.
+		wantError string
+	}{
+		{"empty", "", "must be at least 8 characters long"},
+		{"too short", "short", "must be at least 8 characters long"},
+		{"too long", strings.Repeat("x", models.MaxPasswordBytes+1), "must be at most 72 bytes long"},
+		{"valid", "open sesame", ""},
+	}
+	for _, tt := range tests {
+		test := newGalleriesTest(t)
+		rec := test.post("/galleries/7/password", url.Values{"password": {tt.password}})
+		if tt.wantError == "" {
+			assertRedirect(t, rec, "/galleries/7/edit")
+			if test.galleries.Gallery.PasswordHash == "" {
+				t.Errorf("%s: the password wasn't set", tt.name)
+			}
+			continue
+		}
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, http.StatusUnprocessableEntity)
+		}
+		if test.galleries.Gallery.PasswordHash != "" {
+			t.Errorf("%s: the password was set", tt.name)
+		}
+		got := reflect.ValueOf(test.edit.Data).FieldByName("PasswordError").String()
+		if got != tt.wantError {
+			t.Errorf("%s: password error = %q, want %q", tt.name, got, tt.wantError)
+		}
+	}
+}
+
+func TestRemoveGalleryPassword(t *testing.T) {
+	test := newGalleriesTest(t)
+	test.galleries.Gallery.PasswordHash = "hash"
+	// An empty password is rejected, not taken as a removal.
+	test.post("/galleries/7/password", url.Values{"password": {""}})
+	if test.galleries.Gallery.PasswordHash != "hash" {
+		t.Fatalf("an empty password changed the gallery password")
+	}
+	rec := test.post("/galleries/7/password/remove", nil)
+	assertRedirect(t, rec, "/galleries/7/edit")
+	if test.galleries.Gallery.PasswordHash != "" {
+		t.Errorf("the password wasn't removed")
+	}
+}
+
+func TestGalleryPasswordNotOwner(t *testing.T) {
+	test := newGalleriesTest(t)
+	test.galleries.Gallery.UserID = 2
+	rec := test.post("/galleries/7/password", url.Values{"password": {"open sesame"}})
+	if rec.Code != http.StatusForbidden || test.galleries.Gallery.PasswordHash != "" {
+		t.Errorf("another user set the password: status = %d", rec.Code)
+	}
+}
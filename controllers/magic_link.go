@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/arkadiont/lenslocked/rand"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// CookieMagicLinkBrowser holds the secret binding sign-in links to the
+	// browser which asked for them, so a forwarded link is useless.
+	CookieMagicLinkBrowser = "magic_link_browser"
+)
+
+func (u Users) ProcessMagicLink(w http.ResponseWriter, r *http.Request) {
+	data := userForm{
+		Email: r.FormValue("email"),
+	}
+	browser, err := readCookie(r, CookieMagicLinkBrowser)
+	if err != nil {
+		browser, err = rand.String(32)
+		if err != nil {
+			log.Printf("magic link err: %v", err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
+		setCookie(w, CookieMagicLinkBrowser, browser)
+	}
+	link, err := u.MagicLinkService.Create(data.Email, browser)
+	if err != nil {
+		// Unknown emails get the same answer as known ones, so the form can't
+		// be used to find out who has an account.
+		if errors.Is(err, models.ErrNotFound) {
+			u.Templates.MagicLinkSent.Execute(w, r, data)
+			return
+		}
+		log.Printf("magic link err: %v", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	values := url.Values{
+		"token": {link.Token},
+	}
+	signInURL := u.BaseURL + "/signin/magic-link?" + values.Encode()
+	if err = u.EmailService.MagicLink(data.Email, signInURL); err != nil {
+		log.Printf("magic link err: %v", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.MagicLinkSent.Execute(w, r, data)
+}
+
+func (u Users) MagicLinkSignIn(w http.ResponseWriter, r *http.Request) {
+	// Without the cookie the link can't match, e.g. when it is opened by
+	// whoever it was forwarded to or by a mail scanner.
+	browser, _ := readCookie(r, CookieMagicLinkBrowser)
+	user, err := u.MagicLinkService.Consume(r.FormValue("token"), browser)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			u.redirectWithError(w, r, "/signin", "This sign-in link is invalid or was already used.")
+		case errors.Is(err, models.ErrTokenExpired):
+			u.redirectWithError(w, r, "/signin", "This sign-in link has expired, please ask for a new one.")
+		case errors.Is(err, models.ErrWrongBrowser):
+			u.redirectWithError(w, r, "/signin", "Please open your sign-in link in the browser you asked for it from.")
+		default:
+			log.Printf("magic link sign in err: %v", err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	pending, err := u.beginSignIn(w, r, user)
+	if err != nil {
+		log.Printf("magic link sign in err: %v", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if pending {
+		http.Redirect(w, r, "/signin/2fa", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
@@ -0,0 +1,366 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/context"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/arkadiont/lenslocked/rand"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/oauth2"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	CookieOAuthState = "oauth_state"
+	// oauthStateLifetime is how long users have to sign in at the provider.
+	oauthStateLifetime = 10 * time.Minute
+)
+
+// IdentityProvider is an OpenID Connect provider users can sign in with,
+// using the authorization code flow with PKCE.
+type IdentityProvider struct {
+	// Name identifies the provider in URLs and in the identities table.
+	Name        string
+	DisplayName string
+	OAuth2      oauth2.Config
+	Verifier    *oidc.IDTokenVerifier
+}
+
+// oauthState is kept in a signed cookie while the user is at the provider.
+// LinkUserID is set when a signed in user links the identity to their account.
+// ReauthUserID is set when a user without a password signs in again to
+// confirm it's them, Next is the page they come back to.
+type oauthState struct {
+	Provider     string
+	State        string
+	Verifier     string
+	Nonce        string
+	LinkUserID   uint
+	ReauthUserID uint
+	Next         string
+	ExpiresAt    time.Time
+}
+
+func (u Users) identityProvider(name string) *IdentityProvider {
+	for _, provider := range u.IdentityProviders {
+		if provider.Name == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+// redirectToProvider starts the authorization code flow, pending tells what
+// the flow is for, its other fields are set here.
+func (u Users) redirectToProvider(w http.ResponseWriter, r *http.Request, pending oauthState) {
+	provider := u.identityProvider(chi.URLParam(r, "provider"))
+	if provider == nil {
+		http.Error(w, "Provider not found", http.StatusNotFound)
+		return
+	}
+	state, err := rand.String(32)
+	if err != nil {
+		log.Printf("oauth start err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := rand.String(32)
+	if err != nil {
+		log.Printf("oauth start err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	pending.Provider = provider.Name
+	pending.State = state
+	pending.Verifier = oauth2.GenerateVerifier()
+	pending.Nonce = nonce
+	pending.ExpiresAt = time.Now().Add(oauthStateLifetime)
+	encoded, err := u.SecureCookie.Encode(CookieOAuthState, pending)
+	if err != nil {
+		log.Printf("oauth start err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	cookie := newCookie(CookieOAuthState, encoded)
+	cookie.Expires = pending.ExpiresAt
+	cookie.MaxAge = int(oauthStateLifetime / time.Second)
+	http.SetCookie(w, cookie)
+	opts := []oauth2.AuthCodeOption{
+		oauth2.S256ChallengeOption(pending.Verifier),
+		oidc.Nonce(nonce),
+	}
+	if pending.ReauthUserID != 0 {
+		// Ask the provider to sign the user in again, rather than reuse
+		// their session there, and to tell when it did in auth_time.
+		opts = append(opts,
+			oauth2.SetAuthURLParam("prompt", "login"),
+			oauth2.SetAuthURLParam("max_age", "0"),
+		)
+	}
+	authURL := provider.OAuth2.AuthCodeURL(state, opts...)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OAuthSignIn sends the user to the provider to sign in or sign up.
+func (u Users) OAuthSignIn(w http.ResponseWriter, r *http.Request) {
+	u.redirectToProvider(w, r, oauthState{})
+}
+
+// LinkIdentity sends the user to the provider to link their identity there.
+func (u Users) LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	u.redirectToProvider(w, r, oauthState{LinkUserID: user.ID})
+}
+
+// oauthClaims are the claims of the ID token we rely on.
+type oauthClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	// AuthTime is when the user last signed in at the provider, as a Unix
+	// time.
+	AuthTime int64 `json:"auth_time"`
+}
+
+func (u Users) OAuthCallback(w http.ResponseWriter, r *http.Request) {
+	provider := u.identityProvider(chi.URLParam(r, "provider"))
+	if provider == nil {
+		http.Error(w, "Provider not found", http.StatusNotFound)
+		return
+	}
+	var pending oauthState
+	value, err := readCookie(r, CookieOAuthState)
+	if err == nil {
+		deleteCookie(w, CookieOAuthState)
+		err = u.SecureCookie.Decode(CookieOAuthState, value, &pending)
+	}
+	// The state ties the callback to the browser which started the flow.
+	if err != nil || pending.Provider != provider.Name || time.Now().After(pending.ExpiresAt) ||
+		subtle.ConstantTimeCompare([]byte(pending.State), []byte(r.FormValue("state"))) != 1 {
+		u.redirectWithError(w, r, "/signin", "Your sign in took too long, please try again.")
+		return
+	}
+	failurePath := "/signin"
+	switch {
+	case pending.LinkUserID != 0:
+		failurePath = "/users/me/identities"
+	case pending.ReauthUserID != 0:
+		failurePath = pending.Next
+	}
+	if r.FormValue("error") != "" {
+		u.redirectWithError(w, r, failurePath, fmt.Sprintf("%s didn't let you in.", provider.DisplayName))
+		return
+	}
+
+	token, err := provider.OAuth2.Exchange(r.Context(), r.FormValue("code"), oauth2.VerifierOption(pending.Verifier))
+	if err != nil {
+		log.Printf("oauth callback err: %v", err)
+		u.redirectWithError(w, r, failurePath, fmt.Sprintf("%s didn't let you in.", provider.DisplayName))
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		log.Printf("oauth callback err: no id_token from %s", provider.Name)
+		u.redirectWithError(w, r, failurePath, fmt.Sprintf("%s didn't let you in.", provider.DisplayName))
+		return
+	}
+	idToken, err := provider.Verifier.Verify(r.Context(), rawIDToken)
+	if err != nil || subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(pending.Nonce)) != 1 {
+		log.Printf("oauth callback err: invalid id_token from %s: %v", provider.Name, err)
+		u.redirectWithError(w, r, failurePath, fmt.Sprintf("%s didn't let you in.", provider.DisplayName))
+		return
+	}
+	var claims oauthClaims
+	if err = idToken.Claims(&claims); err != nil {
+		log.Printf("oauth callback err: %v", err)
+		u.redirectWithError(w, r, failurePath, fmt.Sprintf("%s didn't let you in.", provider.DisplayName))
+		return
+	}
+
+	if pending.LinkUserID != 0 {
+		u.finishLinkIdentity(w, r, provider, &pending, idToken.Subject, claims)
+		return
+	}
+	if pending.ReauthUserID != 0 {
+		u.finishReauthentication(w, r, provider, &pending, idToken.Subject, claims)
+		return
+	}
+	if claims.Email == "" {
+		u.redirectWithError(w, r, failurePath, fmt.Sprintf("%s didn't share your email address.", provider.DisplayName))
+		return
+	}
+	user, err := u.IdentityService.SignIn(provider.Name, idToken.Subject, claims.Email, claims.EmailVerified)
+	if err != nil {
+		if errors.Is(err, models.ErrEmailTaken) {
+			u.redirectWithError(w, r, failurePath, fmt.Sprintf(
+				"An account already uses this email address. Sign in with your password, then link %s from your account.",
+				provider.DisplayName))
+			return
+		}
+		if errors.Is(err, models.ErrEmailNotVerified) {
+			u.redirectWithError(w, r, failurePath, fmt.Sprintf(
+				"Your email address isn't verified by %s. Verify it there, or sign up with a password.",
+				provider.DisplayName))
+			return
+		}
+		log.Printf("oauth callback err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	needsCode, err := u.beginSignIn(w, r, user)
+	if err != nil {
+		log.Printf("oauth callback err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	if needsCode {
+		http.Redirect(w, r, "/signin/2fa", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u Users) finishLinkIdentity(w http.ResponseWriter, r *http.Request, provider *IdentityProvider,
+	pending *oauthState, subject string, claims oauthClaims) {
+	// The flow must end in the account which started it.
+	user := context.User(r.Context())
+	if user == nil || user.ID != pending.LinkUserID {
+		u.redirectWithError(w, r, "/signin", "Sign in to link your account.")
+		return
+	}
+	_, err := u.IdentityService.Link(user.ID, provider.Name, subject, claims.Email)
+	if err != nil {
+		if errors.Is(err, models.ErrIdentityTaken) {
+			u.redirectWithError(w, r, "/users/me/identities", fmt.Sprintf(
+				"This %s account is linked to another account.", provider.DisplayName))
+			return
+		}
+		log.Printf("link identity err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Flasher.Success(w, fmt.Sprintf("You can now sign in with %s.", provider.DisplayName))
+	http.Redirect(w, r, "/users/me/identities", http.StatusFound)
+}
+
+func (u Users) Identities(w http.ResponseWriter, r *http.Request) {
+	u.renderIdentities(w, r, http.StatusOK)
+}
+
+func (u Users) renderIdentities(w http.ResponseWriter, r *http.Request, status int, errs ...error) {
+	user := context.User(r.Context())
+	identities, err := u.IdentityService.List(user.ID)
+	if err != nil {
+		log.Printf("list identities err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	type identity struct {
+		ID        uint
+		Provider  string
+		Email     string
+		CreatedAt time.Time
+	}
+	var data struct {
+		Identities []identity
+		Providers  []*IdentityProvider
+		Reauth     reauthForm
+	}
+	data.Reauth, err = u.newReauthForm(r, user, "/users/me/identities")
+	if err != nil {
+		log.Printf("list identities err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	for _, id := range identities {
+		name := id.Provider
+		if provider := u.identityProvider(id.Provider); provider != nil {
+			name = provider.DisplayName
+		}
+		data.Identities = append(data.Identities, identity{
+			ID:        id.ID,
+			Provider:  name,
+			Email:     id.Email,
+			CreatedAt: id.CreatedAt,
+		})
+	}
+	data.Providers = u.IdentityProviders
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	u.Templates.Identities.Execute(w, r, data, errs...)
+}
+
+// UnlinkIdentity removes an identity once the user confirmed it's them. The
+// last way to sign in to an account can't be removed, users without a
+// password or a passkey keep at least one identity.
+func (u Users) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	identities, err := u.IdentityService.List(user.ID)
+	if err != nil {
+		log.Printf("unlink identity err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	found, others := false, 0
+	for _, identity := range identities {
+		if identity.ID == uint(id) {
+			found = true
+		} else {
+			others++
+		}
+	}
+	if !found {
+		http.Error(w, "Identity not found", http.StatusNotFound)
+		return
+	}
+	if user.PasswordHash == "" && others == 0 {
+		passkeys, err := u.countPasskeys(user.ID)
+		if err != nil {
+			log.Printf("unlink identity err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+			return
+		}
+		if passkeys == 0 {
+			u.renderIdentities(w, r, http.StatusConflict, publicError(
+				"You couldn't sign in anymore, set a password or add a passkey before unlinking this account."))
+			return
+		}
+	}
+	if err = u.confirmOwner(r, user, r.FormValue("password")); err != nil {
+		var locked *models.LockedError
+		switch {
+		case errors.As(err, &locked):
+			retryAfter(w, locked)
+			u.renderIdentities(w, r, http.StatusTooManyRequests, locked)
+		case errors.Is(err, models.ErrInvalidPassword):
+			u.renderIdentities(w, r, http.StatusUnauthorized, publicError("Your password is incorrect."))
+		case errors.Is(err, errReauthRequired):
+			u.renderIdentities(w, r, http.StatusUnauthorized, err)
+		default:
+			log.Printf("unlink identity err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err = u.IdentityService.Unlink(user.ID, uint(id)); err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Identity not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("unlink identity err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Flasher.Success(w, "The account was unlinked.")
+	http.Redirect(w, r, "/users/me/identities", http.StatusFound)
+}
@@ -0,0 +1,697 @@
+package controllers
+
+import (
+	gocontext "context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/context"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	stubClientID    = "lenslocked"
+	stubRedirectURL = "http://lenslocked.test/oauth/stub/callback"
+)
+
+// stubIssuer is an OpenID Connect provider signing users in without asking
+// anything, it serves the discovery document, its keys, the authorization
+// endpoint and the token endpoint, checking PKCE.
+type stubIssuer struct {
+	*httptest.Server
+	signer jose.Signer
+	keys   jose.JSONWebKeySet
+
+	mu     sync.Mutex
+	grants map[string]stubGrant
+	// Claims go in the ID tokens issued next.
+	Subject       string
+	Email         string
+	EmailVerified bool
+	// Nonce, when set, replaces the nonce of the authorization request.
+	Nonce string
+	// AuthTime, when set, is the auth_time claim instead of the time of the
+	// exchange.
+	AuthTime time.Time
+	// Exchanges counts the codes exchanged successfully.
+	Exchanges int
+	// Authorized are the queries of the authorization requests.
+	Authorized []url.Values
+}
+
+type stubGrant struct {
+	Challenge string
+	Nonce     string
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "stub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := stubIssuer{
+		signer: signer,
+		keys: jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+			Key:       &key.PublicKey,
+			KeyID:     "stub",
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}}},
+		grants:        make(map[string]stubGrant),
+		Subject:       "stub-subject",
+		Email:         "Stub@Example.com",
+		EmailVerified: true,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(s.keys)
+	})
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return &s
+}
+
+func (s *stubIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                s.URL,
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (s *stubIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != stubClientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.Authorized = append(s.Authorized, query)
+	code := fmt.Sprintf("code-%d", len(s.Authorized))
+	s.grants[code] = stubGrant{
+		Challenge: query.Get("code_challenge"),
+		Nonce:     query.Get("nonce"),
+	}
+	s.mu.Unlock()
+	values := url.Values{
+		"code":  {code},
+		"state": {query.Get("state")},
+	}
+	http.Redirect(w, r, query.Get("redirect_uri")+"?"+values.Encode(), http.StatusFound)
+}
+
+func (s *stubIssuer) token(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grant, ok := s.grants[r.FormValue("code")]
+	delete(s.grants, r.FormValue("code"))
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.Challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	nonce := grant.Nonce
+	if s.Nonce != "" {
+		nonce = s.Nonce
+	}
+	now := time.Now()
+	authTime := now
+	if !s.AuthTime.IsZero() {
+		authTime = s.AuthTime
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iss":            s.URL,
+		"sub":            s.Subject,
+		"aud":            stubClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          s.Email,
+		"email_verified": s.EmailVerified,
+		"auth_time":      authTime.Unix(),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	signed, err := s.signer.Sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idToken, err := signed.CompactSerialize()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.Exchanges++
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "stub-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// fakeIdentityService records the identities it's given, SignIn returns
+// User or Err and List returns Identities.
+type fakeIdentityService struct {
+	models.IdentityService
+	User       *models.User
+	Err        error
+	Identities []models.Identity
+
+	SignedIn      []string
+	EmailVerified bool
+	Linked        []string
+}
+
+func (s *fakeIdentityService) SignIn(provider, subject, email string, emailVerified bool) (*models.User, error) {
+	s.SignedIn = append(s.SignedIn, provider+"/"+subject+"/"+email)
+	s.EmailVerified = emailVerified
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	return s.User, nil
+}
+
+func (s *fakeIdentityService) Link(userID uint, provider, subject, email string) (*models.Identity, error) {
+	s.Linked = append(s.Linked, fmt.Sprintf("%d/%s/%s/%s", userID, provider, subject, email))
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	return &models.Identity{UserID: userID, Provider: provider, Subject: subject, Email: email}, nil
+}
+
+func (s *fakeIdentityService) List(userID uint) ([]models.Identity, error) {
+	return s.Identities, nil
+}
+
+func (s *fakeIdentityService) Unlink(userID, identityID uint) error {
+	for i, identity := range s.Identities {
+		if identity.ID == identityID && identity.UserID == userID {
+			s.Identities = append(s.Identities[:i:i], s.Identities[i+1:]...)
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+// fakeTwoFactor is the TwoFactorService of users who enabled 2FA when
+// IsEnabled is set.
+type fakeTwoFactor struct {
+	models.TwoFactorService
+	IsEnabled bool
+	Disabled  bool
+}
+
+func (s *fakeTwoFactor) Enabled(userID uint) (bool, error) {
+	return s.IsEnabled, nil
+}
+
+func (s *fakeTwoFactor) Disable(userID uint) error {
+	s.IsEnabled = false
+	s.Disabled = true
+	return nil
+}
+
+// fakeLoginThrottle locks an email out once it failed Max times.
+type fakeLoginThrottle struct {
+	models.LoginThrottle
+	Max      int
+	Failures map[string]int
+}
+
+func (t *fakeLoginThrottle) Allowed(email, ip string) error {
+	if t.Failures[email] >= t.Max {
+		return &models.LockedError{Until: time.Now().Add(time.Minute)}
+	}
+	return nil
+}
+
+func (t *fakeLoginThrottle) Failed(email, ip string) (string, error) {
+	t.Failures[email]++
+	return "", nil
+}
+
+func (t *fakeLoginThrottle) Succeeded(email, ip string) error {
+	delete(t.Failures, email)
+	return nil
+}
+
+// fakeEmailService records the links it's asked to send.
+type fakeEmailService struct {
+	models.EmailService
+	Sent []string
+}
+
+func (s *fakeEmailService) ForgotPassword(to, resetURL string) error {
+	s.Sent = append(s.Sent, to+" "+resetURL)
+	return nil
+}
+
+func (s *fakeEmailService) PasswordChanged(to string) error {
+	s.Sent = append(s.Sent, to+" password changed")
+	return nil
+}
+
+func (s *fakeEmailService) AccountDeletionScheduled(to string, deleteAt time.Time, cancelURL string) error {
+	s.Sent = append(s.Sent, to+" "+cancelURL)
+	return nil
+}
+
+// fakeTemplate records what it last rendered.
+type fakeTemplate struct {
+	Data any
+	Errs []error
+}
+
+func (t *fakeTemplate) Execute(w http.ResponseWriter, r *http.Request, data interface{}, errs ...error) {
+	t.Data = data
+	t.Errs = errs
+}
+
+type oidcTest struct {
+	issuer        *stubIssuer
+	users         Users
+	identities    *fakeIdentityService
+	twoFactor     *fakeTwoFactor
+	twoFactorPage *fakeTemplate
+	passkeys      *fakePasskeyService
+	throttle      *fakeLoginThrottle
+	emails        *fakeEmailService
+	// pages are the templates of the other pages.
+	pages map[string]*fakeTemplate
+	user  *models.User
+	// signedIn is the user of the requests, nil when signed out.
+	signedIn *models.User
+	router   http.Handler
+}
+
+func newOIDCTest(t *testing.T) *oidcTest {
+	t.Helper()
+	issuer := newStubIssuer(t)
+	provider, err := oidc.NewProvider(gocontext.Background(), issuer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := models.NewMemoryDB()
+	userSrv := models.NewUserServiceMemory(db)
+	user, err := userSrv.Create("owner@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secureCookie := securecookie.New(securecookie.GenerateRandomKey(32), nil)
+	images := models.NewImageService(models.NewImageStoreDisk(t.TempDir()))
+	test := oidcTest{
+		issuer:        issuer,
+		identities:    &fakeIdentityService{User: user},
+		twoFactor:     &fakeTwoFactor{},
+		twoFactorPage: &fakeTemplate{},
+		passkeys:      &fakePasskeyService{},
+		throttle:      &fakeLoginThrottle{Max: 3, Failures: make(map[string]int)},
+		emails:        &fakeEmailService{},
+		pages:         make(map[string]*fakeTemplate),
+		user:          user,
+	}
+	test.users = Users{
+		UserService:      userSrv,
+		SessionService:   models.NewSessionServiceMemory(db),
+		PasswordService:  models.NewPasswordResetServiceMemory(db),
+		GalleryService:   models.NewGalleryServiceMemory(db),
+		ImageService:     images,
+		TwoFactorService: test.twoFactor,
+		IdentityService:  test.identities,
+		PasskeyService:   test.passkeys,
+		LoginThrottle:    test.throttle,
+		EmailService:     test.emails,
+
+		AccountDeletionService: models.NewAccountDeletionServiceMemory(db, images),
+		IdentityProviders: []*IdentityProvider{{
+			Name:        "stub",
+			DisplayName: "Stub",
+			OAuth2: oauth2.Config{
+				ClientID:     stubClientID,
+				ClientSecret: "secret",
+				Endpoint:     provider.Endpoint(),
+				RedirectURL:  stubRedirectURL,
+				Scopes:       []string{oidc.ScopeOpenID, "email"},
+			},
+			Verifier: provider.Verifier(&oidc.Config{ClientID: stubClientID}),
+		}},
+		BaseURL:      "https://photos.example.com",
+		SecureCookie: secureCookie,
+		Flasher:      Flasher{SecureCookie: secureCookie},
+	}
+	test.users.Templates.TwoFactor = test.twoFactorPage
+	for name, tpl := range map[string]*Template{
+		"change password":  &test.users.Templates.ChangePassword,
+		"identities":       &test.users.Templates.Identities,
+		"passkeys":         &test.users.Templates.Passkeys,
+		"check your email": &test.users.Templates.CheckYourEmail,
+		"delete account":   &test.users.Templates.DeleteAccount,
+	} {
+		test.pages[name] = &fakeTemplate{}
+		*tpl = test.pages[name]
+	}
+	r := chi.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.signedIn != nil {
+				r = r.WithContext(context.WithUser(r.Context(), test.signedIn))
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	r.Get("/oauth/{provider}", test.users.OAuthSignIn)
+	r.Get("/oauth/{provider}/callback", test.users.OAuthCallback)
+	r.Post("/users/me/identities/{provider}/link", test.users.LinkIdentity)
+	r.Post("/users/me/identities/{id}/delete", test.users.UnlinkIdentity)
+	r.Post("/users/me/reauth/{provider}", test.users.Reauthenticate)
+	r.Get("/users/me/passkeys", test.users.Passkeys)
+	r.Post("/users/me/passkeys/new", test.users.BeginPasskey)
+	r.Post("/users/me/passkeys/{id}/delete", test.users.DeletePasskey)
+	r.Post("/users/me/2fa/disable", test.users.ProcessDisableTwoFactor)
+	r.Post("/forgot-pw", test.users.ProcessForgotPassword)
+	r.Get("/users/me/password", test.users.ChangePassword)
+	r.Post("/users/me/password", test.users.ProcessChangePassword)
+	r.Get("/users/me/export", test.users.ExportAccount)
+	r.Post("/users/me/delete", test.users.ProcessDeleteAccount)
+	r.Post("/users/me/delete/cancel", test.users.ProcessCancelDeletion)
+	r.Get("/cancel-deletion", test.users.CancelDeletion)
+	test.router = r
+	return &test
+}
+
+// authorize starts the flow with a request to path, then follows the
+// redirect to the provider. It returns the query the provider sends the
+// user back with, along with the state cookie of the flow.
+func (o *oidcTest) authorize(t *testing.T, method, path string) (url.Values, *http.Cookie) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	o.router.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("%s %s: status = %d, want %d", method, path, rec.Code, http.StatusFound)
+	}
+	state := responseCookie(rec, CookieOAuthState)
+	if state == nil {
+		t.Fatalf("%s %s: no %s cookie", method, path, CookieOAuthState)
+	}
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status = %d, location %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	if got := callback.Scheme + "://" + callback.Host + callback.Path; got != stubRedirectURL {
+		t.Fatalf("authorize redirected to %s, want %s", got, stubRedirectURL)
+	}
+	return callback.Query(), state
+}
+
+func (o *oidcTest) callback(query url.Values, state *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/oauth/stub/callback?"+query.Encode(), nil)
+	if state != nil {
+		r.AddCookie(state)
+	}
+	rec := httptest.NewRecorder()
+	o.router.ServeHTTP(rec, r)
+	return rec
+}
+
+// flash returns the error flashed by rec, if any.
+func (o *oidcTest) flash(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	cookie := responseCookie(rec, CookieFlash)
+	if cookie == nil {
+		return ""
+	}
+	var flashes []context.Flash
+	if err := o.users.SecureCookie.Decode(CookieFlash, cookie.Value, &flashes); err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, flash := range flashes {
+		messages = append(messages, flash.Message)
+	}
+	return strings.Join(messages, " ")
+}
+
+func responseCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name && cookie.MaxAge >= 0 {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func assertRedirect(t *testing.T, rec *httptest.ResponseRecorder, location string) {
+	t.Helper()
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != location {
+		t.Fatalf("status = %d, location = %q, want a redirect to %s",
+			rec.Code, rec.Header().Get("Location"), location)
+	}
+}
+
+func TestOAuthCallbackSignIn(t *testing.T) {
+	test := newOIDCTest(t)
+	query, state := test.authorize(t, http.MethodGet, "/oauth/stub")
+	rec := test.callback(query, state)
+	assertRedirect(t, rec, "/users/me")
+	if responseCookie(rec, CookieSession) == nil {
+		t.Errorf("no session cookie after signing in")
+	}
+	want := []string{"stub/stub-subject/Stub@Example.com"}
+	if fmt.Sprint(test.identities.SignedIn) != fmt.Sprint(want) || !test.identities.EmailVerified {
+		t.Errorf("SignIn calls = %v (verified %v), want %v (verified)",
+			test.identities.SignedIn, test.identities.EmailVerified, want)
+	}
+	// The state cookie is consumed, the callback can't be replayed.
+	if cookie := responseCookie(rec, CookieOAuthState); cookie != nil {
+		t.Errorf("the state cookie is kept after the callback")
+	}
+}
+
+func TestOAuthCallbackStateMismatch(t *testing.T) {
+	test := newOIDCTest(t)
+	query, state := test.authorize(t, http.MethodGet, "/oauth/stub")
+	query.Set("state", "forged")
+	rec := test.callback(query, state)
+	assertRedirect(t, rec, "/signin")
+	if test.issuer.Exchanges != 0 || len(test.identities.SignedIn) != 0 {
+		t.Errorf("the code was exchanged (%d) or signed in (%v) despite the wrong state",
+			test.issuer.Exchanges, test.identities.SignedIn)
+	}
+
+	// Without the cookie of the browser which started the flow.
+	query, _ = test.authorize(t, http.MethodGet, "/oauth/stub")
+	rec = test.callback(query, nil)
+	assertRedirect(t, rec, "/signin")
+	if test.issuer.Exchanges != 0 {
+		t.Errorf("the code was exchanged without the state cookie")
+	}
+}
+
+func TestOAuthCallbackPKCE(t *testing.T) {
+	test := newOIDCTest(t)
+	query, state := test.authorize(t, http.MethodGet, "/oauth/stub")
+	// A code stolen from the redirect is useless without the verifier kept
+	// by the browser which started the flow.
+	var pending oauthState
+	if err := test.users.SecureCookie.Decode(CookieOAuthState, state.Value, &pending); err != nil {
+		t.Fatal(err)
+	}
+	pending.Verifier = oauth2.GenerateVerifier()
+	encoded, err := test.users.SecureCookie.Encode(CookieOAuthState, pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := test.callback(query, &http.Cookie{Name: CookieOAuthState, Value: encoded})
+	assertRedirect(t, rec, "/signin")
+	if len(test.identities.SignedIn) != 0 {
+		t.Errorf("signed in with the wrong PKCE verifier: %v", test.identities.SignedIn)
+	}
+}
+
+func TestOAuthCallbackNonceMismatch(t *testing.T) {
+	test := newOIDCTest(t)
+	test.issuer.Nonce = "replayed"
+	query, state := test.authorize(t, http.MethodGet, "/oauth/stub")
+	rec := test.callback(query, state)
+	assertRedirect(t, rec, "/signin")
+	if test.issuer.Exchanges != 1 {
+		t.Errorf("exchanges = %d, want 1", test.issuer.Exchanges)
+	}
+	if len(test.identities.SignedIn) != 0 {
+		t.Errorf("signed in with an ID token of another flow: %v", test.identities.SignedIn)
+	}
+	if got := test.flash(t, rec); got != "Stub didn't let you in." {
+		t.Errorf("flash = %q", got)
+	}
+}
+
+func TestOAuthCallbackLink(t *testing.T) {
+	test := newOIDCTest(t)
+	test.signedIn = test.user
+	query, state := test.authorize(t, http.MethodPost, "/users/me/identities/stub/link")
+	rec := test.callback(query, state)
+	assertRedirect(t, rec, "/users/me/identities")
+	want := []string{fmt.Sprintf("%d/stub/stub-subject/Stub@Example.com", test.user.ID)}
+	if fmt.Sprint(test.identities.Linked) != fmt.Sprint(want) {
+		t.Errorf("Link calls = %v, want %v", test.identities.Linked, want)
+	}
+	if len(test.identities.SignedIn) != 0 || responseCookie(rec, CookieSession) != nil {
+		t.Errorf("linking signed in again: %v", test.identities.SignedIn)
+	}
+
+	// The flow must end in the account which started it.
+	query, state = test.authorize(t, http.MethodPost, "/users/me/identities/stub/link")
+	test.signedIn = &models.User{ID: test.user.ID + 1, Email: "other@example.com"}
+	rec = test.callback(query, state)
+	assertRedirect(t, rec, "/signin")
+	if len(test.identities.Linked) != 1 {
+		t.Errorf("linked to another account: %v", test.identities.Linked)
+	}
+}
+
+func TestOAuthCallbackEmailTaken(t *testing.T) {
+	test := newOIDCTest(t)
+	test.identities.Err = fmt.Errorf("identity sign in: %w", models.ErrEmailTaken)
+	query, state := test.authorize(t, http.MethodGet, "/oauth/stub")
+	rec := test.callback(query, state)
+	assertRedirect(t, rec, "/signin")
+	if responseCookie(rec, CookieSession) != nil {
+		t.Errorf("signed in despite ErrEmailTaken")
+	}
+	if got := test.flash(t, rec); !strings.Contains(got, "then link Stub from your account") {
+		t.Errorf("flash = %q, want the instructions to link Stub", got)
+	}
+}
+
+func TestOAuthCallbackEmailNotVerified(t *testing.T) {
+	test := newOIDCTest(t)
+	test.issuer.EmailVerified = false
+	test.identities.Err = fmt.Errorf("identity sign in: %w", models.ErrEmailNotVerified)
+	query, state := test.authorize(t, http.MethodGet, "/oauth/stub")
+	rec := test.callback(query, state)
+	assertRedirect(t, rec, "/signin")
+	if test.identities.EmailVerified {
+		t.Errorf("email_verified=false was passed as verified")
+	}
+	if responseCookie(rec, CookieSession) != nil {
+		t.Errorf("signed in with an unverified email")
+	}
+	if got := test.flash(t, rec); !strings.Contains(got, "isn't verified by Stub") {
+		t.Errorf("flash = %q", got)
+	}
+}
+
+// reauthenticate signs the passwordless user in again at the stub provider
+// to come back to next, returning the proof.
+func (o *oidcTest) reauthenticate(t *testing.T, next string) *http.Cookie {
+	t.Helper()
+	query, state := o.authorize(t, http.MethodPost, "/users/me/reauth/stub?next="+next)
+	rec := o.callback(query, state)
+	assertRedirect(t, rec, next)
+	reauth := responseCookie(rec, CookieReauth)
+	if reauth == nil {
+		t.Fatalf("no %s cookie after signing in again", CookieReauth)
+	}
+	return reauth
+}
+
+func TestUnlinkIdentity(t *testing.T) {
+	test := newOIDCTest(t)
+	test.signedIn = test.user
+	test.identities.Identities = []models.Identity{{ID: 1, UserID: test.user.ID, Provider: "stub", Subject: "stub-subject"}}
+	rec := test.post("/users/me/identities/1/delete", url.Values{"password": {"wrong password"}})
+	if rec.Code != http.StatusUnauthorized || len(test.identities.Identities) != 1 {
+		t.Fatalf("unlink with a wrong password: status = %d, identities = %v", rec.Code, test.identities.Identities)
+	}
+	if n := test.throttle.Failures[test.user.Email]; n != 1 {
+		t.Errorf("failures after a wrong password = %d, want 1", n)
+	}
+	// Users with a password can unlink their last identity.
+	rec = test.post("/users/me/identities/1/delete", url.Values{"password": {"correct horse battery"}})
+	assertRedirect(t, rec, "/users/me/identities")
+	if len(test.identities.Identities) != 0 {
+		t.Errorf("the identity wasn't unlinked")
+	}
+	rec = test.post("/users/me/identities/1/delete", url.Values{"password": {"correct horse battery"}})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unlink an unknown identity: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestUnlinkIdentityWithoutPassword(t *testing.T) {
+	test := newPasswordlessTest(t)
+	test.identities.Identities[0].ID = 1
+	test.identities.Identities = append(test.identities.Identities, models.Identity{
+		ID: 2, UserID: test.user.ID, Provider: "stub", Subject: "another-subject",
+	})
+	rec := test.post("/users/me/identities/2/delete", nil)
+	errs := test.pages["identities"].Errs
+	if rec.Code != http.StatusUnauthorized || len(errs) != 1 || !errors.Is(errs[0], errReauthRequired) {
+		t.Fatalf("unlink without signing in again: status = %d, errors = %v", rec.Code, errs)
+	}
+	reauth := test.reauthenticate(t, "/users/me/identities")
+	rec = test.post("/users/me/identities/2/delete", nil, reauth)
+	assertRedirect(t, rec, "/users/me/identities")
+
+	// The remaining identity is the only way to sign in.
+	rec = test.post("/users/me/identities/1/delete", nil, reauth)
+	if rec.Code != http.StatusConflict || len(test.identities.Identities) != 1 {
+		t.Fatalf("unlink the last identity: status = %d, identities = %v", rec.Code, test.identities.Identities)
+	}
+	if errs := test.pages["identities"].Errs; len(errs) != 1 || !strings.Contains(errs[0].Error(), "set a password or add a passkey") {
+		t.Errorf("errors = %v, want the ways to keep signing in", errs)
+	}
+	test.passkeys.Passkeys = []models.Passkey{{ID: 1, UserID: test.user.ID}}
+	rec = test.post("/users/me/identities/1/delete", nil, reauth)
+	assertRedirect(t, rec, "/users/me/identities")
+	if len(test.identities.Identities) != 0 {
+		t.Errorf("the identity wasn't unlinked once the user had a passkey")
+	}
+}
@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/context"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CookiePasskeyCeremony keeps the WebAuthn session data, including the
+	// challenge, between the two steps of a ceremony. PasskeyService makes
+	// sure each challenge is only used once, a copy of the cookie is useless.
+	CookiePasskeyCeremony = "passkey_ceremony"
+
+	passkeyRegistration = "passkey_registration"
+	passkeyLogin        = "passkey_login"
+)
+
+// setCeremony stores session in a signed cookie, ceremony tells registrations
+// and logins apart so the data of one can't be used for the other.
+func (u Users) setCeremony(w http.ResponseWriter, ceremony string, session *webauthn.SessionData) error {
+	encoded, err := u.SecureCookie.Encode(ceremony, session)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", ceremony, err)
+	}
+	cookie := newCookie(CookiePasskeyCeremony, encoded)
+	cookie.Expires = session.Expires
+	cookie.MaxAge = int(time.Until(session.Expires) / time.Second)
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// ceremony consumes the session data stored by setCeremony.
+func (u Users) ceremony(w http.ResponseWriter, r *http.Request, ceremony string) (*webauthn.SessionData, error) {
+	value, err := readCookie(r, CookiePasskeyCeremony)
+	if err != nil {
+		return nil, err
+	}
+	deleteCookie(w, CookiePasskeyCeremony)
+	var session webauthn.SessionData
+	if err = u.SecureCookie.Decode(ceremony, value, &session); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", ceremony, err)
+	}
+	return &session, nil
+}
+
+func (u Users) Passkeys(w http.ResponseWriter, r *http.Request) {
+	u.renderPasskeys(w, r, http.StatusOK, nil)
+}
+
+// renderPasskeys lists the passkeys of the user. Once the user confirmed it's
+// them, creation holds the options of the registration to finish.
+func (u Users) renderPasskeys(w http.ResponseWriter, r *http.Request, status int,
+	creation *protocol.CredentialCreation, errs ...error) {
+	user := context.User(r.Context())
+	passkeys, err := u.PasskeyService.List(user.ID)
+	if err != nil {
+		log.Printf("list passkeys err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Passkeys []models.Passkey
+		Reauth   reauthForm
+		// Options are handed to navigator.credentials.create by the page.
+		Options *protocol.CredentialCreation
+	}
+	data.Reauth, err = u.newReauthForm(r, user, "/users/me/passkeys")
+	if err != nil {
+		log.Printf("list passkeys err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	data.Passkeys = passkeys
+	data.Options = creation
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	u.Templates.Passkeys.Execute(w, r, data, errs...)
+}
+
+// renderPasskeysNotOwner renders the error returned by confirmOwner.
+func (u Users) renderPasskeysNotOwner(w http.ResponseWriter, r *http.Request, err error) {
+	var locked *models.LockedError
+	switch {
+	case errors.As(err, &locked):
+		retryAfter(w, locked)
+		u.renderPasskeys(w, r, http.StatusTooManyRequests, nil, locked)
+	case errors.Is(err, models.ErrInvalidPassword):
+		u.renderPasskeys(w, r, http.StatusUnauthorized, nil, publicError("Your password is incorrect."))
+	case errors.Is(err, errReauthRequired):
+		u.renderPasskeys(w, r, http.StatusUnauthorized, nil, err)
+	default:
+		log.Printf("passkeys err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+	}
+}
+
+// BeginPasskey starts the registration of a passkey once the user confirmed
+// it's them, the page then asks the browser to create the passkey. Without
+// the ceremony started here, ProcessCreatePasskey refuses the passkey.
+func (u Users) BeginPasskey(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := u.confirmOwner(r, user, r.FormValue("password")); err != nil {
+		u.renderPasskeysNotOwner(w, r, err)
+		return
+	}
+	creation, session, err := u.PasskeyService.BeginRegistration(user)
+	if err != nil {
+		log.Printf("begin passkey err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	if err = u.setCeremony(w, passkeyRegistration, session); err != nil {
+		log.Printf("begin passkey err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.renderPasskeys(w, r, http.StatusOK, creation)
+}
+
+func (u Users) ProcessCreatePasskey(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	session, err := u.ceremony(w, r, passkeyRegistration)
+	if err != nil {
+		u.redirectWithError(w, r, "/users/me/passkeys", "Your passkey could not be added, please try again.")
+		return
+	}
+	response, err := protocol.ParseCredentialCreationResponseBody(strings.NewReader(r.FormValue("credential")))
+	if err != nil {
+		u.redirectWithError(w, r, "/users/me/passkeys", "Your passkey could not be added, please try again.")
+		return
+	}
+	_, err = u.PasskeyService.FinishRegistration(user, r.FormValue("name"), *session, response)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidPasskey) {
+			log.Printf("create passkey err: %v", err)
+			u.redirectWithError(w, r, "/users/me/passkeys", "Your passkey could not be added, please try again.")
+			return
+		}
+		log.Printf("create passkey err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Flasher.Success(w, "Your passkey was added, you can use it to sign in.")
+	http.Redirect(w, r, "/users/me/passkeys", http.StatusFound)
+}
+
+func (u Users) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	if err = u.confirmOwner(r, user, r.FormValue("password")); err != nil {
+		u.renderPasskeysNotOwner(w, r, err)
+		return
+	}
+	if err = u.PasskeyService.Delete(user.ID, uint(id)); err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Passkey not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("delete passkey err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Flasher.Success(w, "Your passkey was removed.")
+	http.Redirect(w, r, "/users/me/passkeys", http.StatusFound)
+}
+
+func (u Users) SignInPasskey(w http.ResponseWriter, r *http.Request) {
+	assertion, session, err := u.PasskeyService.BeginLogin()
+	if err != nil {
+		log.Printf("passkey sign in err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	if err = u.setCeremony(w, passkeyLogin, session); err != nil {
+		log.Printf("passkey sign in err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		// Options are handed to navigator.credentials.get by the page.
+		Options *protocol.CredentialAssertion
+	}
+	data.Options = assertion
+	u.Templates.SignInPasskey.Execute(w, r, data)
+}
+
+// ProcessSignInPasskey signs the user in with the same session as a password
+// sign in. 2FA isn't asked for: the passkey already proves the user holds
+// their device.
+func (u Users) ProcessSignInPasskey(w http.ResponseWriter, r *http.Request) {
+	session, err := u.ceremony(w, r, passkeyLogin)
+	if err != nil {
+		u.redirectWithError(w, r, "/signin/passkey", "Your sign in took too long, please try again.")
+		return
+	}
+	response, err := protocol.ParseCredentialRequestResponseBody(strings.NewReader(r.FormValue("credential")))
+	if err != nil {
+		u.redirectWithError(w, r, "/signin/passkey", "Your passkey was not recognized.")
+		return
+	}
+	user, err := u.PasskeyService.FinishLogin(*session, response)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidPasskey) {
+			log.Printf("passkey sign in err: %v", err)
+			u.redirectWithError(w, r, "/signin/passkey", "Your passkey was not recognized.")
+			return
+		}
+		log.Printf("passkey sign in err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	if err = u.signIn(w, r, user.ID); err != nil {
+		log.Printf("passkey sign in err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// countPasskeys returns the number of passkeys of the user, 0 when passkeys
+// are disabled.
+func (u Users) countPasskeys(userID uint) (int, error) {
+	if u.PasskeyService == nil {
+		return 0, nil
+	}
+	passkeys, err := u.PasskeyService.List(userID)
+	if err != nil {
+		return 0, err
+	}
+	return len(passkeys), nil
+}
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakePasskeyService lists Passkeys as the passkeys of every user, no
+// passkey by default. Registrations counts the ceremonies started.
+type fakePasskeyService struct {
+	models.PasskeyService
+	Passkeys      []models.Passkey
+	Registrations int
+}
+
+func (s *fakePasskeyService) List(userID uint) ([]models.Passkey, error) {
+	return s.Passkeys, nil
+}
+
+func (s *fakePasskeyService) BeginRegistration(user *models.User) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	s.Registrations++
+	session := webauthn.SessionData{
+		Challenge: "challenge",
+		UserID:    []byte{byte(user.ID)},
+		Expires:   time.Now().Add(5 * time.Minute),
+	}
+	return &protocol.CredentialCreation{}, &session, nil
+}
+
+func (s *fakePasskeyService) Delete(userID, passkeyID uint) error {
+	for i, passkey := range s.Passkeys {
+		if passkey.ID == passkeyID && passkey.UserID == userID {
+			s.Passkeys = append(s.Passkeys[:i:i], s.Passkeys[i+1:]...)
+			return nil
+		}
+	}
+	return models.ErrNotFound
+}
+
+// passkeyOptions returns the registration options the passkeys page was
+// last rendered with.
+func (o *oidcTest) passkeyOptions() *protocol.CredentialCreation {
+	options, _ := reflect.ValueOf(o.pages["passkeys"].Data).FieldByName("Options").Interface().(*protocol.CredentialCreation)
+	return options
+}
+
+func TestBeginPasskey(t *testing.T) {
+	test := newOIDCTest(t)
+	test.signedIn = test.user
+	rec := test.post("/users/me/passkeys/new", url.Values{"password": {"wrong password"}})
+	if rec.Code != http.StatusUnauthorized || test.passkeys.Registrations != 0 || test.passkeyOptions() != nil {
+		t.Fatalf("add a passkey with a wrong password: status = %d, registrations = %d",
+			rec.Code, test.passkeys.Registrations)
+	}
+	if responseCookie(rec, CookiePasskeyCeremony) != nil {
+		t.Errorf("a registration started with a wrong password")
+	}
+	if n := test.throttle.Failures[test.user.Email]; n != 1 {
+		t.Errorf("failures after a wrong password = %d, want 1", n)
+	}
+	rec = test.post("/users/me/passkeys/new", url.Values{"password": {"correct horse battery"}})
+	if rec.Code != http.StatusOK || test.passkeyOptions() == nil || responseCookie(rec, CookiePasskeyCeremony) == nil {
+		t.Errorf("add a passkey with the right password: status = %d, registrations = %d",
+			rec.Code, test.passkeys.Registrations)
+	}
+}
+
+func TestBeginPasskeyWithoutPassword(t *testing.T) {
+	test := newPasswordlessTest(t)
+	// Listing the passkeys doesn't start a registration anymore.
+	test.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/me/passkeys", nil))
+	if test.passkeys.Registrations != 0 || test.passkeyOptions() != nil {
+		t.Fatalf("listing the passkeys started a registration")
+	}
+	rec := test.post("/users/me/passkeys/new", nil)
+	errs := test.pages["passkeys"].Errs
+	if rec.Code != http.StatusUnauthorized || len(errs) != 1 || !errors.Is(errs[0], errReauthRequired) {
+		t.Fatalf("add a passkey without signing in again: status = %d, errors = %v", rec.Code, errs)
+	}
+	reauth := test.reauthenticate(t, "/users/me/passkeys")
+	rec = test.post("/users/me/passkeys/new", nil, reauth)
+	if rec.Code != http.StatusOK || test.passkeys.Registrations != 1 || responseCookie(rec, CookiePasskeyCeremony) == nil {
+		t.Errorf("add a passkey after signing in again: status = %d, registrations = %d",
+			rec.Code, test.passkeys.Registrations)
+	}
+}
+
+func TestDeletePasskey(t *testing.T) {
+	test := newOIDCTest(t)
+	test.signedIn = test.user
+	test.passkeys.Passkeys = []models.Passkey{{ID: 1, UserID: test.user.ID, Name: "phone"}}
+	rec := test.post("/users/me/passkeys/1/delete", url.Values{"password": {"wrong password"}})
+	if rec.Code != http.StatusUnauthorized || len(test.passkeys.Passkeys) != 1 {
+		t.Fatalf("remove a passkey with a wrong password: status = %d, passkeys = %v", rec.Code, test.passkeys.Passkeys)
+	}
+	rec = test.post("/users/me/passkeys/1/delete", url.Values{"password": {"correct horse battery"}})
+	assertRedirect(t, rec, "/users/me/passkeys")
+	if len(test.passkeys.Passkeys) != 0 {
+		t.Errorf("the passkey wasn't removed")
+	}
+
+	test = newPasswordlessTest(t)
+	test.passkeys.Passkeys = []models.Passkey{{ID: 1, UserID: test.user.ID, Name: "phone"}}
+	if rec = test.post("/users/me/passkeys/1/delete", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("remove a passkey without signing in again: status = %d", rec.Code)
+	}
+	rec = test.post("/users/me/passkeys/1/delete", nil, test.reauthenticate(t, "/users/me/passkeys"))
+	assertRedirect(t, rec, "/users/me/passkeys")
+	if len(test.passkeys.Passkeys) != 0 {
+		t.Errorf("the passkey wasn't removed after signing in again")
+	}
+}
@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"github.com/arkadiont/lenslocked/context"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RateLimitKey returns the bucket a request counts against, an empty key
+// skips the limit.
+type RateLimitKey func(r *http.Request) string
+
+// ByIP limits requests per client address.
+func ByIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// ByUser limits requests per signed in user, falling back to the client
+// address for visitors.
+func ByUser(r *http.Request) string {
+	if user := context.User(r.Context()); user != nil {
+		return "user:" + strconv.FormatUint(uint64(user.ID), 10)
+	}
+	return ByIP(r)
+}
+
+// ByFormValue limits requests per value of a form field, e.g. the email a
+// password reset is requested for.
+func ByFormValue(field string) RateLimitKey {
+	return func(r *http.Request) string {
+		value := strings.ToLower(strings.TrimSpace(r.FormValue(field)))
+		if value == "" {
+			return ""
+		}
+		return field + ":" + value
+	}
+}
+
+// ByURLParam limits requests per value of a route parameter, e.g. the
+// gallery a password is tried on.
+func ByURLParam(name string) RateLimitKey {
+	return func(r *http.Request) string {
+		value := chi.URLParam(r, name)
+		if value == "" {
+			return ""
+		}
+		return name + ":" + value
+	}
+}
+
+// RateLimiter throttles requests with the token buckets of Store. A request
+// must find a token in the bucket of every key to go through.
+type RateLimiter struct {
+	Store models.RateLimitStore
+	// Name keeps the buckets of different routes apart when they share a store.
+	Name  string
+	Limit models.RateLimit
+	Keys  []RateLimitKey
+}
+
+func (rl RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, key := range rl.Keys {
+			k := key(r)
+			if k == "" {
+				continue
+			}
+			ok, retryAfter, err := rl.Store.Take(rl.Name+":"+k, rl.Limit)
+			if err != nil {
+				// Don't lock everybody out because the store is unavailable.
+				log.Printf("rate limit %s err: %v", rl.Name, err)
+				continue
+			}
+			if !ok {
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				http.Error(w, "Too many requests, please try again later.", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
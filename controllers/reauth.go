@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/context"
+	"github.com/arkadiont/lenslocked/models"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// CookieReauth proves that a user without a password signed in again
+	// at a linked identity provider moments ago.
+	CookieReauth = "reauth"
+	// reauthLifetime is how long the user has to send the form they signed
+	// in again for.
+	reauthLifetime = 5 * time.Minute
+	// reauthClockSkew is tolerated between our clock and the provider's one
+	// when checking the auth_time claim.
+	reauthClockSkew = time.Minute
+)
+
+// reauthPaths are the pages users can come back to after signing in again,
+// so the flow can't be used as an open redirect.
+var reauthPaths = map[string]bool{
+	"/users/me/email":      true,
+	"/users/me/password":   true,
+	"/users/me/2fa":        true,
+	"/users/me/delete":     true,
+	"/users/me/identities": true,
+	"/users/me/passkeys":   true,
+}
+
+// errReauthRequired is returned by confirmOwner when a user without a
+// password didn't sign in again.
+var errReauthRequired = publicError("Please confirm it's you by signing in again first.")
+
+// reauthentication is kept in a signed cookie once the user signed in again.
+type reauthentication struct {
+	UserID    uint
+	ExpiresAt time.Time
+}
+
+// reauthForm replaces the password field of the forms changing the security
+// of the account, for users who signed up with an identity provider and
+// have no password: they sign in again at the provider instead.
+type reauthForm struct {
+	// Required is set for accounts without a password.
+	Required bool
+	// Confirmed is set once the user signed in again.
+	Confirmed bool
+	// Next is the page the user comes back to.
+	Next string
+	// Providers are the linked providers the user can sign in again with.
+	Providers []*IdentityProvider
+}
+
+// newReauthForm returns the reauthForm of the page at next.
+func (u Users) newReauthForm(r *http.Request, user *models.User, next string) (reauthForm, error) {
+	if user.PasswordHash != "" {
+		return reauthForm{}, nil
+	}
+	form := reauthForm{
+		Required:  true,
+		Confirmed: u.reauthenticated(r, user),
+		Next:      next,
+	}
+	identities, err := u.IdentityService.List(user.ID)
+	if err != nil {
+		return reauthForm{}, err
+	}
+	for _, identity := range identities {
+		if provider := u.identityProvider(identity.Provider); provider != nil {
+			form.Providers = append(form.Providers, provider)
+		}
+	}
+	return form, nil
+}
+
+// confirmOwner checks that the request comes from the owner of the account:
+// it authenticates password, or for accounts without a password, requires a
+// recent sign in at a linked provider. It returns models.ErrInvalidPassword
+// for a wrong password and errReauthRequired when the user has to sign in
+// again. Wrong passwords count as failed sign ins, so a stolen session can't
+// be used to guess the password: a *models.LockedError is returned once the
+// account is locked.
+func (u Users) confirmOwner(r *http.Request, user *models.User, password string) error {
+	if user.PasswordHash != "" {
+		ip := clientIP(r)
+		if err := u.LoginThrottle.Allowed(user.Email, ip); err != nil {
+			return err
+		}
+		_, err := u.UserService.Authenticate(user.Email, password)
+		switch {
+		case errors.Is(err, models.ErrInvalidPassword):
+			u.signInFailed(user.Email, ip, true)
+		case err == nil:
+			if err := u.LoginThrottle.Succeeded(user.Email, ip); err != nil {
+				log.Printf("reset login attempts err: %v", err)
+			}
+		}
+		return err
+	}
+	if !u.reauthenticated(r, user) {
+		return errReauthRequired
+	}
+	return nil
+}
+
+func (u Users) reauthenticated(r *http.Request, user *models.User) bool {
+	value, err := readCookie(r, CookieReauth)
+	if err != nil {
+		return false
+	}
+	var reauth reauthentication
+	if err = u.SecureCookie.Decode(CookieReauth, value, &reauth); err != nil {
+		return false
+	}
+	return reauth.UserID == user.ID && time.Now().Before(reauth.ExpiresAt)
+}
+
+// Reauthenticate sends a user without a password to a linked provider, so
+// they can confirm it's them before changing the security of their account.
+func (u Users) Reauthenticate(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	next := r.FormValue("next")
+	if !reauthPaths[next] {
+		next = "/users/me"
+	}
+	u.redirectToProvider(w, r, oauthState{
+		ReauthUserID: user.ID,
+		Next:         next,
+	})
+}
+
+// finishReauthentication ends the flow started by Reauthenticate. The
+// identity must be linked to the account, and the provider must have asked
+// the user to sign in during the flow, not relied on an older session.
+func (u Users) finishReauthentication(w http.ResponseWriter, r *http.Request, provider *IdentityProvider,
+	pending *oauthState, subject string, claims oauthClaims) {
+	user := context.User(r.Context())
+	if user == nil || user.ID != pending.ReauthUserID {
+		u.redirectWithError(w, r, "/signin", "Sign in to continue.")
+		return
+	}
+	startedAt := pending.ExpiresAt.Add(-oauthStateLifetime)
+	if time.Unix(claims.AuthTime, 0).Before(startedAt.Add(-reauthClockSkew)) {
+		log.Printf("reauthenticate err: stale auth_time from %s", provider.Name)
+		u.redirectWithError(w, r, pending.Next, fmt.Sprintf("%s didn't ask you to sign in again.", provider.DisplayName))
+		return
+	}
+	identities, err := u.IdentityService.List(user.ID)
+	if err != nil {
+		log.Printf("reauthenticate err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	linked := false
+	for _, identity := range identities {
+		linked = linked || identity.Provider == provider.Name && identity.Subject == subject
+	}
+	if !linked {
+		u.redirectWithError(w, r, pending.Next, fmt.Sprintf(
+			"This %s account isn't linked to yours.", provider.DisplayName))
+		return
+	}
+	reauth := reauthentication{
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(reauthLifetime),
+	}
+	encoded, err := u.SecureCookie.Encode(CookieReauth, reauth)
+	if err != nil {
+		log.Printf("reauthenticate err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	cookie := newCookie(CookieReauth, encoded)
+	cookie.Expires = reauth.ExpiresAt
+	cookie.MaxAge = int(reauthLifetime / time.Second)
+	http.SetCookie(w, cookie)
+	u.Flasher.Success(w, "Thanks for confirming it's you, you can go ahead.")
+	http.Redirect(w, r, pending.Next, http.StatusFound)
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newPasswordlessTest signs in a user who signed up with the stub provider,
+// and has 2FA enabled.
+func newPasswordlessTest(t *testing.T) *oidcTest {
+	t.Helper()
+	test := newOIDCTest(t)
+	test.signedIn = &models.User{ID: test.user.ID, Email: test.user.Email}
+	test.identities.Identities = []models.Identity{{
+		UserID:   test.user.ID,
+		Provider: "stub",
+		Subject:  "stub-subject",
+	}}
+	test.twoFactor.IsEnabled = true
+	return test
+}
+
+// disableTwoFactor posts the form disabling 2FA with the given cookies.
+func (o *oidcTest) disableTwoFactor(password string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	return o.post("/users/me/2fa/disable", url.Values{"password": {password}}, cookies...)
+}
+
+func TestReauthenticate(t *testing.T) {
+	test := newPasswordlessTest(t)
+	rec := test.disableTwoFactor("")
+	if rec.Code != http.StatusUnauthorized || test.twoFactor.Disabled {
+		t.Fatalf("disable 2FA without signing in again: status = %d, disabled = %v",
+			rec.Code, test.twoFactor.Disabled)
+	}
+	if len(test.twoFactorPage.Errs) != 1 || !errors.Is(test.twoFactorPage.Errs[0], errReauthRequired) {
+		t.Errorf("2FA page errors = %v, want errReauthRequired", test.twoFactorPage.Errs)
+	}
+	page := test.twoFactorPage.Data.(twoFactorPage)
+	if !page.Reauth.Required || page.Reauth.Confirmed || len(page.Reauth.Providers) != 1 {
+		t.Errorf("2FA page reauth = %+v, want the stub provider offered", page.Reauth)
+	}
+
+	query, state := test.authorize(t, http.MethodPost, "/users/me/reauth/stub?next=/users/me/2fa")
+	authorized := test.issuer.Authorized[len(test.issuer.Authorized)-1]
+	if authorized.Get("prompt") != "login" || authorized.Get("max_age") != "0" {
+		t.Errorf("authorization request = %v, want prompt=login and max_age=0", authorized)
+	}
+	rec = test.callback(query, state)
+	assertRedirect(t, rec, "/users/me/2fa")
+	reauth := responseCookie(rec, CookieReauth)
+	if reauth == nil {
+		t.Fatalf("no %s cookie after signing in again, flash %q", CookieReauth, test.flash(t, rec))
+	}
+	if len(test.identities.SignedIn) != 0 || responseCookie(rec, CookieSession) != nil {
+		t.Errorf("signing in again created a session: %v", test.identities.SignedIn)
+	}
+
+	// The proof belongs to the user who signed in again.
+	test.signedIn = &models.User{ID: test.user.ID + 1, Email: "other@example.com"}
+	rec = test.disableTwoFactor("", reauth)
+	if rec.Code != http.StatusUnauthorized || test.twoFactor.Disabled {
+		t.Errorf("disable 2FA of another user: status = %d, disabled = %v", rec.Code, test.twoFactor.Disabled)
+	}
+
+	test.signedIn = &models.User{ID: test.user.ID, Email: test.user.Email}
+	rec = test.disableTwoFactor("", reauth)
+	assertRedirect(t, rec, "/users/me")
+	if !test.twoFactor.Disabled {
+		t.Errorf("2FA wasn't disabled after signing in again")
+	}
+}
+
+func TestReauthenticateNotLinked(t *testing.T) {
+	test := newPasswordlessTest(t)
+	test.issuer.Subject = "someone-else"
+	query, state := test.authorize(t, http.MethodPost, "/users/me/reauth/stub?next=/users/me/2fa")
+	rec := test.callback(query, state)
+	assertRedirect(t, rec, "/users/me/2fa")
+	if responseCookie(rec, CookieReauth) != nil {
+		t.Errorf("signing in again with an identity of another account was accepted")
+	}
+	if got := test.flash(t, rec); got != "This Stub account isn't linked to yours." {
+		t.Errorf("flash = %q", got)
+	}
+}
+
+func TestReauthenticateStaleAuthTime(t *testing.T) {
+	test := newPasswordlessTest(t)
+	// The provider reused a session it opened earlier.
+	test.issuer.AuthTime = time.Now().Add(-time.Hour)
+	query, state := test.authorize(t, http.MethodPost, "/users/me/reauth/stub?next=/users/me/2fa")
+	rec := test.callback(query, state)
+	assertRedirect(t, rec, "/users/me/2fa")
+	if responseCookie(rec, CookieReauth) != nil {
+		t.Errorf("a stale auth_time was accepted")
+	}
+	if got := test.flash(t, rec); got != "Stub didn't ask you to sign in again." {
+		t.Errorf("flash = %q", got)
+	}
+}
+
+func TestReauthenticateNext(t *testing.T) {
+	test := newPasswordlessTest(t)
+	query, state := test.authorize(t, http.MethodPost, "/users/me/reauth/stub?next=https://example.com/")
+	rec := test.callback(query, state)
+	assertRedirect(t, rec, "/users/me")
+}
+
+func TestConfirmOwnerWithPassword(t *testing.T) {
+	test := newOIDCTest(t)
+	test.signedIn = test.user
+	test.twoFactor.IsEnabled = true
+	// Users with a password can't skip it by signing in again.
+	query, state := test.authorize(t, http.MethodPost, "/users/me/reauth/stub?next=/users/me/2fa")
+	test.identities.Identities = []models.Identity{{UserID: test.user.ID, Provider: "stub", Subject: "stub-subject"}}
+	reauth := responseCookie(test.callback(query, state), CookieReauth)
+	rec := test.disableTwoFactor("wrong password", reauth)
+	if rec.Code != http.StatusUnauthorized || test.twoFactor.Disabled {
+		t.Errorf("disable 2FA with a wrong password: status = %d, disabled = %v", rec.Code, test.twoFactor.Disabled)
+	}
+	rec = test.disableTwoFactor("correct horse battery")
+	assertRedirect(t, rec, "/users/me")
+	if !test.twoFactor.Disabled {
+		t.Errorf("2FA wasn't disabled with the right password")
+	}
+}
@@ -3,5 +3,6 @@ package controllers
 import "net/http"
 
 type Template interface {
-	Execute(w http.ResponseWriter, r *http.Request, data interface{})
+	// Execute renders data, errs are shown to the user above the page content.
+	Execute(w http.ResponseWriter, r *http.Request, data interface{}, errs ...error)
 }
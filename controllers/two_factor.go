@@ -0,0 +1,239 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/context"
+	"github.com/arkadiont/lenslocked/models"
+	"html/template"
+	"log"
+	"net/http"
+	"rsc.io/qr"
+	"time"
+)
+
+const (
+	CookiePendingTwoFactor = "pending_2fa"
+	// pendingTwoFactorLifetime is how long users have to enter their code
+	// once the password was accepted.
+	pendingTwoFactorLifetime = 5 * time.Minute
+)
+
+// pendingTwoFactor is kept in a signed cookie between the password and the
+// code steps of the sign in.
+type pendingTwoFactor struct {
+	UserID    uint
+	Email     string
+	ExpiresAt time.Time
+}
+
+// beginSignIn signs the user in, unless they enabled 2FA: then it only
+// stores a pending sign in and reports it, the caller must send the user to
+// /signin/2fa.
+func (u Users) beginSignIn(w http.ResponseWriter, r *http.Request, user *models.User) (bool, error) {
+	enabled, err := u.TwoFactorService.Enabled(user.ID)
+	if err != nil {
+		return false, err
+	}
+	if !enabled {
+		return false, u.signIn(w, r, user.ID)
+	}
+	pending := pendingTwoFactor{
+		UserID:    user.ID,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(pendingTwoFactorLifetime),
+	}
+	encoded, err := u.SecureCookie.Encode(CookiePendingTwoFactor, pending)
+	if err != nil {
+		return false, fmt.Errorf("encode pending 2fa: %w", err)
+	}
+	cookie := newCookie(CookiePendingTwoFactor, encoded)
+	cookie.Expires = pending.ExpiresAt
+	cookie.MaxAge = int(pendingTwoFactorLifetime / time.Second)
+	http.SetCookie(w, cookie)
+	return true, nil
+}
+
+// pendingTwoFactor returns the pending sign in of the request, or nil when
+// there's none or it expired.
+func (u Users) pendingTwoFactor(r *http.Request) *pendingTwoFactor {
+	value, err := readCookie(r, CookiePendingTwoFactor)
+	if err != nil {
+		return nil
+	}
+	var pending pendingTwoFactor
+	if err = u.SecureCookie.Decode(CookiePendingTwoFactor, value, &pending); err != nil {
+		return nil
+	}
+	if time.Now().After(pending.ExpiresAt) {
+		return nil
+	}
+	return &pending
+}
+
+func (u Users) SignInTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if u.pendingTwoFactor(r) == nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	u.Templates.SignInTwoFactor.Execute(w, r, nil)
+}
+
+func (u Users) ProcessSignInTwoFactor(w http.ResponseWriter, r *http.Request) {
+	pending := u.pendingTwoFactor(r)
+	if pending == nil {
+		deleteCookie(w, CookiePendingTwoFactor)
+		u.redirectWithError(w, r, "/signin", "Your sign in took too long, please try again.")
+		return
+	}
+	// Wrong codes count as failed sign ins, or the code could be guessed.
+	ip := clientIP(r)
+	if err := u.LoginThrottle.Allowed(pending.Email, ip); err != nil {
+		var locked *models.LockedError
+		if errors.As(err, &locked) {
+			deleteCookie(w, CookiePendingTwoFactor)
+			renderForm(w, r, u.Templates.SignIn, http.StatusTooManyRequests, userForm{Email: pending.Email}, locked)
+			return
+		}
+		log.Printf("verify 2fa err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	err := u.TwoFactorService.Verify(pending.UserID, r.FormValue("code"))
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCode) {
+			u.signInFailed(pending.Email, ip, true)
+			renderForm(w, r, u.Templates.SignInTwoFactor, http.StatusUnauthorized, userForm{},
+				publicError("Invalid code."))
+			return
+		}
+		log.Printf("verify 2fa err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	deleteCookie(w, CookiePendingTwoFactor)
+	if err = u.LoginThrottle.Succeeded(pending.Email, ip); err != nil {
+		log.Printf("reset login attempts err: %v", err)
+	}
+	if err = u.signIn(w, r, pending.UserID); err != nil {
+		log.Printf("verify 2fa err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// twoFactorPage is the data of the 2FA settings page, Enrollment and QRCode
+// are only set while 2FA is disabled.
+type twoFactorPage struct {
+	Enabled    bool
+	Enrollment *models.TOTPEnrollment
+	QRCode     template.URL
+	// Reauth confirms it's the user disabling 2FA.
+	Reauth reauthForm
+}
+
+func (u Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	u.renderTwoFactor(w, r, http.StatusOK)
+}
+
+// renderTwoFactor shows the 2FA settings page with the given status, starting
+// the enrollment when 2FA is disabled.
+func (u Users) renderTwoFactor(w http.ResponseWriter, r *http.Request, status int, errs ...error) {
+	user := context.User(r.Context())
+	var data twoFactorPage
+	var err error
+	data.Enabled, err = u.TwoFactorService.Enabled(user.ID)
+	if err != nil {
+		log.Printf("2fa page err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	if data.Enabled {
+		data.Reauth, err = u.newReauthForm(r, user, "/users/me/2fa")
+		if err != nil {
+			log.Printf("2fa page err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+			return
+		}
+	}
+	if !data.Enabled {
+		data.Enrollment, err = u.TwoFactorService.Enroll(user.ID, user.Email)
+		if err != nil {
+			log.Printf("2fa page err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+			return
+		}
+		data.QRCode, err = qrDataURI(data.Enrollment.URL)
+		if err != nil {
+			log.Printf("2fa page err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	u.Templates.TwoFactor.Execute(w, r, data, errs...)
+}
+
+func (u Users) ProcessEnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	codes, err := u.TwoFactorService.Confirm(user.ID, r.FormValue("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidCode):
+			u.renderTwoFactor(w, r, http.StatusBadRequest, publicError("Invalid code, check the clock of your device and try again."))
+		case errors.Is(err, models.ErrNotFound), errors.Is(err, models.ErrTwoFactorEnabled):
+			http.Redirect(w, r, "/users/me/2fa", http.StatusFound)
+		default:
+			log.Printf("enable 2fa err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	// The recovery codes are shown this once, they're only stored hashed.
+	var data struct {
+		RecoveryCodes []string
+	}
+	data.RecoveryCodes = codes
+	u.Templates.RecoveryCodes.Execute(w, r, data)
+}
+
+func (u Users) ProcessDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if err := u.confirmOwner(r, user, r.FormValue("password")); err != nil {
+		var locked *models.LockedError
+		switch {
+		case errors.As(err, &locked):
+			retryAfter(w, locked)
+			u.renderTwoFactor(w, r, http.StatusTooManyRequests, locked)
+		case errors.Is(err, models.ErrInvalidPassword):
+			u.renderTwoFactor(w, r, http.StatusUnauthorized, publicError("Invalid password."))
+		case errors.Is(err, errReauthRequired):
+			u.renderTwoFactor(w, r, http.StatusUnauthorized, err)
+		default:
+			log.Printf("disable 2fa err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := u.TwoFactorService.Disable(user.ID); err != nil {
+		log.Printf("disable 2fa err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Flasher.Success(w, "Two-factor authentication is now disabled.")
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// qrDataURI renders text as a QR code PNG embedded in a data URI, so no
+// third party sees the secret it contains.
+func qrDataURI(text string) (template.URL, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", fmt.Errorf("qr code: %w", err)
+	}
+	png := base64.StdEncoding.EncodeToString(code.PNG())
+	return template.URL("data:image/png;base64," + png), nil
+}
@@ -1,12 +1,17 @@
 package controllers
 
 import (
-	"fmt"
+	"errors"
 	"github.com/arkadiont/lenslocked/context"
 	"github.com/arkadiont/lenslocked/models"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/securecookie"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Users struct {
@@ -16,78 +21,287 @@ type Users struct {
 		ForgotPassword Template
 		CheckYourEmail Template
 		ResetPassword  Template
+		Sessions       Template
+		VerifyEmail    Template
+		ChangeEmail    Template
+		ChangePassword Template
+		Account        Template
+		// SignInTwoFactor asks for the code of users who enabled 2FA.
+		SignInTwoFactor Template
+		TwoFactor       Template
+		RecoveryCodes   Template
+		Passkeys        Template
+		SignInPasskey   Template
+		Identities      Template
+		MagicLinkSent   Template
+		DeleteAccount   Template
 	}
-	UserService     models.UserService
-	SessionService  models.SessionService
-	PasswordService models.PasswordResetService
-	EmailService    models.EmailService
+	UserService              models.UserService
+	SessionService           models.SessionService
+	PasswordService          models.PasswordResetService
+	EmailService             models.EmailService
+	EmailVerificationService models.EmailVerificationService
+	EmailChangeService       models.EmailChangeService
+	LoginThrottle            models.LoginThrottle
+	TwoFactorService         models.TwoFactorService
+	// PasskeyService is nil when passkeys are disabled.
+	PasskeyService         models.PasskeyService
+	IdentityService        models.IdentityService
+	MagicLinkService       models.MagicLinkService
+	AccountDeletionService models.AccountDeletionService
+	// GalleryService and ImageService gather the galleries of the account export.
+	GalleryService models.GalleryService
+	ImageService   models.ImageService
+	// IdentityProviders are the OpenID Connect providers users can sign in with.
+	IdentityProviders []*IdentityProvider
+	// SecureCookie signs the pending sign in of users who enabled 2FA and the
+	// state of passkey ceremonies.
+	SecureCookie *securecookie.SecureCookie
+	// BaseURL prefixes the links sent by email, e.g. https://lenslocked.com
+	BaseURL string
+	Flasher Flasher
+}
+
+// userForm is the data of the sign up, sign in and password forms,
+// PasswordError is shown next to the password field.
+type userForm struct {
+	Email         string
+	Token         string
+	PasswordError string
+	// Providers are offered on the sign up and sign in forms.
+	Providers []*IdentityProvider
+	// Passkeys offers to sign in with a passkey.
+	Passkeys bool
+	// Reauth replaces the password field for accounts without a password.
+	Reauth reauthForm
+}
+
+// renderForm renders tpl with the given status, used to show the form again
+// along with what was wrong.
+func renderForm(w http.ResponseWriter, r *http.Request, tpl Template, status int, data userForm, errs ...error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	tpl.Execute(w, r, data, errs...)
+}
+
+// retryAfter tells clients when they can sign in again after a lockout.
+func retryAfter(w http.ResponseWriter, locked *models.LockedError) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(locked.Until).Seconds())+1))
+}
+
+// redirectWithError sends the user to path, showing what went wrong there.
+func (u Users) redirectWithError(w http.ResponseWriter, r *http.Request, path, message string) {
+	u.Flasher.Error(w, message)
+	http.Redirect(w, r, path, http.StatusFound)
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
-	var data = struct {
-		Email string
-	}{
-		Email: r.FormValue("email"),
+	data := userForm{
+		Email:     r.FormValue("email"),
+		Providers: u.IdentityProviders,
 	}
 	u.Templates.New.Execute(w, r, data)
 }
 
 func (u Users) Create(w http.ResponseWriter, r *http.Request) {
-	email := r.FormValue("email")
-	password := r.FormValue("password")
-	user, err := u.UserService.Create(email, password)
+	data := userForm{
+		Email: r.FormValue("email"),
+	}
+	user, err := u.UserService.Create(data.Email, r.FormValue("password"))
 	if err != nil {
-		log.Printf("create user err: %v", err)
-		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		var verr *models.ValidationError
+		switch {
+		case errors.As(err, &verr):
+			data.PasswordError = verr.Message
+			renderForm(w, r, u.Templates.New, http.StatusUnprocessableEntity, data)
+		case errors.Is(err, models.ErrEmailTaken):
+			renderForm(w, r, u.Templates.New, http.StatusConflict, data,
+				publicError("An account already exists for this email address."))
+		default:
+			log.Printf("create user err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		}
 		return
 	}
-	session, err := u.SessionService.Create(user.ID)
-	if err != nil {
+	// The account is usable right away, the user can ask for another email
+	// from their account page if this one doesn't arrive.
+	if err = u.sendVerification(user); err != nil {
+		log.Printf("send verification email err: %v", err)
+	}
+	if err = u.signIn(w, r, user.ID); err != nil {
 		log.Println(err)
-		// TODO: long term, we should show a warning about not being able to sign the user in.
+		u.Flasher.Flash(w, context.Flash{
+			Kind:    context.FlashInfo,
+			Message: "Your account was created but we couldn't sign you in, please sign in again.",
+		})
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
 func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
-	var data = struct {
-		Email string
-	}{
-		Email: r.FormValue("email"),
+	data := userForm{
+		Email:     r.FormValue("email"),
+		Providers: u.IdentityProviders,
+		Passkeys:  u.PasskeyService != nil,
 	}
 	u.Templates.SignIn.Execute(w, r, data)
 }
 
 func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
-	var data = struct {
-		Email    string
-		Password string
-	}{
-		Email:    r.FormValue("email"),
-		Password: r.FormValue("password"),
+	data := userForm{
+		Email:     r.FormValue("email"),
+		Providers: u.IdentityProviders,
+		Passkeys:  u.PasskeyService != nil,
 	}
-	user, err := u.UserService.Authenticate(data.Email, data.Password)
+	ip := clientIP(r)
+	if err := u.LoginThrottle.Allowed(data.Email, ip); err != nil {
+		var locked *models.LockedError
+		if errors.As(err, &locked) {
+			retryAfter(w, locked)
+			renderForm(w, r, u.Templates.SignIn, http.StatusTooManyRequests, data, locked)
+			return
+		}
+		log.Printf("authenticate user err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	user, err := u.UserService.Authenticate(data.Email, r.FormValue("password"))
 	if err != nil {
+		// Don't tell which one was wrong, it would reveal who has an account.
+		if errors.Is(err, models.ErrNotFound) || errors.Is(err, models.ErrInvalidPassword) {
+			u.signInFailed(data.Email, ip, errors.Is(err, models.ErrInvalidPassword))
+			renderForm(w, r, u.Templates.SignIn, http.StatusUnauthorized, data,
+				publicError("Invalid email or password."))
+			return
+		}
 		log.Printf("authenticate user err: %v", err)
 		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
 		return
 	}
-	session, err := u.SessionService.Create(user.ID)
+	pending, err := u.beginSignIn(w, r, user)
 	if err != nil {
 		log.Printf("authenticate user err: %v", err)
 		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
 		return
 	}
-	setCookie(w, CookieSession, session.Token)
+	if pending {
+		// The attempt stays counted until the code is verified too.
+		http.Redirect(w, r, "/signin/2fa", http.StatusFound)
+		return
+	}
+	if err = u.LoginThrottle.Succeeded(data.Email, ip); err != nil {
+		log.Printf("reset login attempts err: %v", err)
+	}
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
+// signInFailed records a failed sign in, emailing the owner of the account
+// an unlock link when it gets locked.
+func (u Users) signInFailed(email, ip string, accountExists bool) {
+	unlockToken, err := u.LoginThrottle.Failed(email, ip)
+	if err != nil {
+		log.Printf("record failed sign in err: %v", err)
+		return
+	}
+	if unlockToken == "" || !accountExists {
+		return
+	}
+	values := url.Values{
+		"token": {unlockToken},
+	}
+	unlockURL := u.BaseURL + "/unlock-account?" + values.Encode()
+	if err = u.EmailService.AccountLocked(email, unlockURL); err != nil {
+		log.Printf("account locked email err: %v", err)
+	}
+}
+
+// UnlockAccount lifts the sign in lock of an account from the link emailed
+// when it got locked.
+func (u Users) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	if err := u.LoginThrottle.Unlock(r.FormValue("token")); err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Invalid or already used unlock link", http.StatusBadRequest)
+			return
+		}
+		log.Printf("unlock account err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Flasher.Success(w, "Your account is unlocked, you can sign in again.")
+	http.Redirect(w, r, "/signin", http.StatusFound)
+}
+
+// CurrentUser renders the account page of the signed in user.
 func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		User *models.User
+		// Deletion is set when the account is scheduled for deletion.
+		Deletion *models.AccountDeletion
+		Passkeys bool
+	}
+	data.User = context.User(r.Context())
+	data.Passkeys = u.PasskeyService != nil
+	deletion, err := u.AccountDeletionService.ByUserID(data.User.ID)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		log.Printf("account deletion err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	data.Deletion = deletion
+	u.Templates.Account.Execute(w, r, data)
+}
+
+// sendVerification emails user a link to confirm their address.
+func (u Users) sendVerification(user *models.User) error {
+	verification, err := u.EmailVerificationService.Create(user.ID)
+	if err != nil {
+		return err
+	}
+	values := url.Values{
+		"token": {verification.Token},
+	}
+	verifyURL := u.BaseURL + "/verify-email?" + values.Encode()
+	return u.EmailService.VerifyEmail(user.Email, verifyURL)
+}
+
+// ResendVerification sends the current user a new verification email.
+func (u Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
-	fmt.Fprintf(w, "Current user: %s\n", user.Email)
+	if user.Verified() {
+		u.Flasher.Success(w, "Your email address is already verified.")
+		http.Redirect(w, r, "/users/me", http.StatusFound)
+		return
+	}
+	if err := u.sendVerification(user); err != nil {
+		log.Printf("resend verification email err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Email string
+	}
+	data.Email = user.Email
+	u.Templates.VerifyEmail.Execute(w, r, data)
+}
+
+func (u Users) ProcessVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	_, err := u.EmailVerificationService.Consume(r.FormValue("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Invalid verification link", http.StatusBadRequest)
+		case errors.Is(err, models.ErrTokenExpired):
+			http.Error(w, "This verification link has expired, please ask for a new one.", http.StatusBadRequest)
+		default:
+			log.Printf("verify email err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	u.Flasher.Success(w, "Thanks, your email address is verified.")
+	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
 func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
@@ -104,35 +318,40 @@ func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	deleteCookie(w, CookieSession)
+	u.Flasher.Success(w, "You have been signed out.")
 	http.Redirect(w, r, "/signin", http.StatusFound)
 }
 
 func (u Users) ForgotPassword(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Email string
+	data := userForm{
+		Email: r.FormValue("email"),
 	}
-	data.Email = r.FormValue("email")
 	u.Templates.ForgotPassword.Execute(w, r, data)
 }
 
 func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Email string
+	data := userForm{
+		Email: r.FormValue("email"),
 	}
-	data.Email = r.FormValue("email")
 	pwReset, err := u.PasswordService.Create(data.Email)
 	if err != nil {
-		fmt.Println(err)
+		// Unknown emails get the same answer as known ones, so the form can't
+		// be used to find out who has an account.
+		if errors.Is(err, models.ErrNotFound) {
+			u.Templates.CheckYourEmail.Execute(w, r, data)
+			return
+		}
+		log.Printf("forgot password err: %v", err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
 	values := url.Values{
 		"token": {pwReset.Token},
 	}
-	resetUrl := "https://www.lenslocked.com/reset-pw?" + values.Encode()
-	err = u.EmailService.ForgotPassword(data.Email, resetUrl)
+	resetURL := u.BaseURL + "/reset-pw?" + values.Encode()
+	err = u.EmailService.ForgotPassword(data.Email, resetURL)
 	if err != nil {
-		fmt.Println(err)
+		log.Printf("forgot password err: %v", err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
@@ -140,47 +359,327 @@ func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 }
 
 func (u Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Token string
+	data := userForm{
+		Token: r.FormValue("token"),
 	}
-	data.Token = r.FormValue("token")
 	u.Templates.ResetPassword.Execute(w, r, data)
 }
 
 func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Token    string
-		Password string
+	data := userForm{
+		Token: r.FormValue("token"),
 	}
-	data.Token = r.FormValue("token")
-	data.Password = r.FormValue("password")
+	password := r.FormValue("password")
 
 	user, err := u.PasswordService.Consume(data.Token)
 	if err != nil {
-		fmt.Println(err)
-		// TODO distingue types err
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			data.Token = ""
+			renderForm(w, r, u.Templates.ResetPassword, http.StatusBadRequest, data,
+				publicError("This reset link is invalid or was already used."))
+		case errors.Is(err, models.ErrTokenExpired):
+			data.Token = ""
+			renderForm(w, r, u.Templates.ResetPassword, http.StatusGone, data,
+				publicError("This reset link has expired, please ask for a new one."))
+		default:
+			log.Printf("reset password err: %v", err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	if err = u.UserService.UpdatePassword(user.ID, data.Password); err != nil {
-		fmt.Println(err)
+	if err = u.UserService.UpdatePassword(user.ID, password); err != nil {
+		var verr *models.ValidationError
+		if errors.As(err, &verr) {
+			u.retryResetPassword(w, r, user, verr)
+			return
+		}
+		log.Printf("reset password err: %v", err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
 
 	// Sign the user in now that their password has been reset.
 	// Any errors from this point onwards should redirect to the sign page
-	sess, err := u.SessionService.Create(user.ID)
+	pending, err := u.beginSignIn(w, r, user)
 	if err != nil {
-		fmt.Println(err)
+		log.Printf("reset password sign in err: %v", err)
+		u.Flasher.Success(w, "Your password has been reset, please sign in.")
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
-	setCookie(w, CookieSession, sess.Token)
+	if pending {
+		u.Flasher.Success(w, "Your password has been reset.")
+		http.Redirect(w, r, "/signin/2fa", http.StatusFound)
+		return
+	}
+	u.Flasher.Success(w, "Your password has been reset.")
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u Users) ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	data := userForm{
+		Email: r.FormValue("email"),
+	}
+	var err error
+	data.Reauth, err = u.newReauthForm(r, context.User(r.Context()), "/users/me/email")
+	if err != nil {
+		log.Printf("change email err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.ChangeEmail.Execute(w, r, data)
+}
+
+// ProcessChangeEmail checks the current password and sends a confirmation
+// link to the new address, the email is only changed once it is followed.
+func (u Users) ProcessChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	data := userForm{
+		Email: strings.TrimSpace(r.FormValue("email")),
+	}
+	var err error
+	data.Reauth, err = u.newReauthForm(r, user, "/users/me/email")
+	if err != nil {
+		log.Printf("change email err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case data.Email == "":
+		renderForm(w, r, u.Templates.ChangeEmail, http.StatusUnprocessableEntity, data,
+			publicError("Please enter your new email address."))
+		return
+	case strings.EqualFold(data.Email, user.Email):
+		renderForm(w, r, u.Templates.ChangeEmail, http.StatusUnprocessableEntity, data,
+			publicError("That is already your email address."))
+		return
+	}
+	if err = u.confirmOwner(r, user, r.FormValue("password")); err != nil {
+		var locked *models.LockedError
+		switch {
+		case errors.As(err, &locked):
+			retryAfter(w, locked)
+			renderForm(w, r, u.Templates.ChangeEmail, http.StatusTooManyRequests, data, locked)
+		case errors.Is(err, models.ErrInvalidPassword):
+			renderForm(w, r, u.Templates.ChangeEmail, http.StatusUnprocessableEntity, data,
+				publicError("Your current password is incorrect."))
+		case errors.Is(err, errReauthRequired):
+			renderForm(w, r, u.Templates.ChangeEmail, http.StatusUnprocessableEntity, data, err)
+		default:
+			log.Printf("change email err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	change, err := u.EmailChangeService.Create(user.ID, data.Email)
+	if err != nil {
+		if !errors.Is(err, models.ErrEmailTaken) {
+			log.Printf("change email err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+			return
+		}
+		renderForm(w, r, u.Templates.ChangeEmail, http.StatusConflict, data,
+			publicError("That email address is already used by another account."))
+		return
+	}
+	values := url.Values{
+		"token": {change.Token},
+	}
+	confirmURL := u.BaseURL + "/confirm-email?" + values.Encode()
+	if err = u.EmailService.ConfirmEmailChange(change.NewEmail, confirmURL); err != nil {
+		log.Printf("change email err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	if err = u.EmailService.EmailChangeNotice(user.Email, change.NewEmail); err != nil {
+		// The change can't happen without the new address anyway.
+		log.Printf("email change notice err: %v", err)
+	}
+	data.Email = change.NewEmail
+	u.Templates.VerifyEmail.Execute(w, r, data)
+}
+
+func (u Users) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	_, err := u.EmailChangeService.Consume(r.FormValue("token"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Invalid confirmation link", http.StatusBadRequest)
+		case errors.Is(err, models.ErrTokenExpired):
+			http.Error(w, "This confirmation link has expired, please change your email again.", http.StatusBadRequest)
+		case errors.Is(err, models.ErrEmailTaken):
+			http.Error(w, "That email address is already used by another account.", http.StatusConflict)
+		default:
+			log.Printf("confirm email change err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	u.Flasher.Success(w, "Your email address was changed.")
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
+func (u Users) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var data userForm
+	var err error
+	data.Reauth, err = u.newReauthForm(r, context.User(r.Context()), "/users/me/password")
+	if err != nil {
+		log.Printf("change password err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Templates.ChangePassword.Execute(w, r, data)
+}
+
+// ProcessChangePassword replaces the password of the current user after
+// checking the current one, then signs every other device out. Accounts
+// without a password set their first one after signing in again at a
+// linked provider.
+func (u Users) ProcessChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data userForm
+	var err error
+	data.Reauth, err = u.newReauthForm(r, user, "/users/me/password")
+	if err != nil {
+		log.Printf("change password err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	if err = u.confirmOwner(r, user, r.FormValue("current_password")); err != nil {
+		var locked *models.LockedError
+		switch {
+		case errors.As(err, &locked):
+			retryAfter(w, locked)
+			renderForm(w, r, u.Templates.ChangePassword, http.StatusTooManyRequests, data, locked)
+		case errors.Is(err, models.ErrInvalidPassword):
+			renderForm(w, r, u.Templates.ChangePassword, http.StatusUnprocessableEntity, data,
+				publicError("Your current password is incorrect."))
+		case errors.Is(err, errReauthRequired):
+			renderForm(w, r, u.Templates.ChangePassword, http.StatusUnprocessableEntity, data, err)
+		default:
+			log.Printf("change password err: %v", err)
+			http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err = u.UserService.UpdatePassword(user.ID, r.FormValue("password")); err != nil {
+		var verr *models.ValidationError
+		if errors.As(err, &verr) {
+			data.PasswordError = verr.Message
+			renderForm(w, r, u.Templates.ChangePassword, http.StatusUnprocessableEntity, data)
+			return
+		}
+		log.Printf("change password err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	token, err := readCookie(r, CookieSession)
+	if err == nil {
+		err = u.SessionService.DeleteOthers(token)
+	}
+	if err != nil {
+		log.Printf("change password, sign out other sessions err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	if err = u.EmailService.PasswordChanged(user.Email); err != nil {
+		log.Printf("password changed email err: %v", err)
+	}
+	u.Flasher.Success(w, "Your password was changed, your other devices have been signed out.")
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// retryResetPassword renders the reset form again when the new password was
+// rejected. The token was consumed already, so a fresh one is issued to let
+// the user try again without going back to their inbox.
+func (u Users) retryResetPassword(w http.ResponseWriter, r *http.Request, user *models.User,
+	verr *models.ValidationError) {
+	pwReset, err := u.PasswordService.Create(user.Email)
+	if err != nil {
+		log.Printf("reset password err: %v", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data := userForm{
+		Token:         pwReset.Token,
+		PasswordError: verr.Message,
+	}
+	renderForm(w, r, u.Templates.ResetPassword, http.StatusUnprocessableEntity, data)
+}
+
+// signIn starts a new session for userID on the requesting device and sets
+// the session cookie.
+func (u Users) signIn(w http.ResponseWriter, r *http.Request, userID uint) error {
+	session, err := u.SessionService.Create(userID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, session)
+	return nil
+}
+
+// Sessions lists the devices the current user is signed in on.
+func (u Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	sessions, err := u.SessionService.List(token)
+	if err != nil {
+		log.Printf("list sessions err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Sessions []models.Session
+	}
+	data.Sessions = sessions
+	u.Templates.Sessions.Execute(w, r, data)
+}
+
+func (u Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || id <= 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err = u.SessionService.Revoke(token, uint(id)); err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("revoke session err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Flasher.Success(w, "The device has been signed out.")
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
+// RevokeOtherSessions signs the current user out everywhere but here.
+func (u Users) RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	token, err := readCookie(r, CookieSession)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	if err = u.SessionService.DeleteOthers(token); err != nil {
+		log.Printf("revoke other sessions err: %v", err)
+		http.Error(w, "Something was wrong.", http.StatusInternalServerError)
+		return
+	}
+	u.Flasher.Success(w, "Every other device has been signed out.")
+	http.Redirect(w, r, "/users/me/sessions", http.StatusFound)
+}
+
 type UserMiddleware struct {
 	SessionService models.SessionService
 }
@@ -194,6 +693,9 @@ func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 		}
 		user, err := umw.SessionService.User(token)
 		if err != nil {
+			if errors.Is(err, models.ErrTokenExpired) || errors.Is(err, models.ErrNotFound) {
+				deleteCookie(w, CookieSession)
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// post sends form to path with the given cookies.
+func (o *oidcTest) post(path string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	o.router.ServeHTTP(rec, r)
+	return rec
+}
+
+// sessionCookie signs the user in on a new device.
+func (o *oidcTest) sessionCookie(t *testing.T) *http.Cookie {
+	t.Helper()
+	session, err := o.users.SessionService.Create(o.user.ID, "test", "192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: CookieSession, Value: session.Token}
+}
+
+func (o *oidcTest) changePassword(t *testing.T, current, password string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	return o.post("/users/me/password", url.Values{
+		"current_password": {current},
+		"password":         {password},
+	}, append(cookies, o.sessionCookie(t))...)
+}
+
+func TestChangePassword(t *testing.T) {
+	test := newOIDCTest(t)
+	test.signedIn = test.user
+	rec := test.changePassword(t, "wrong password", "a brand new passphrase")
+	if rec.Code != http.StatusUnprocessableEntity || test.throttle.Failures[test.user.Email] != 1 {
+		t.Fatalf("wrong current password: status = %d, failures = %d", rec.Code, test.throttle.Failures[test.user.Email])
+	}
+	rec = test.changePassword(t, "correct horse battery", "a brand new passphrase")
+	assertRedirect(t, rec, "/users/me")
+	if _, err := test.users.UserService.Authenticate(test.user.Email, "a brand new passphrase"); err != nil {
+		t.Errorf("sign in with the new password: %v", err)
+	}
+	if n := test.throttle.Failures[test.user.Email]; n != 0 {
+		t.Errorf("failures after the right password = %d, want 0", n)
+	}
+}
+
+func TestChangePasswordThrottled(t *testing.T) {
+	test := newOIDCTest(t)
+	test.signedIn = test.user
+	for i := 0; i < test.throttle.Max; i++ {
+		if rec := test.changePassword(t, "guess", "a brand new passphrase"); rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("guess %d: status = %d, want %d", i, rec.Code, http.StatusUnprocessableEntity)
+		}
+	}
+	// Once locked, even the right password is refused.
+	rec := test.changePassword(t, "correct horse battery", "a brand new passphrase")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("locked account: status = %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	var locked *models.LockedError
+	errs := test.pages["change password"].Errs
+	if len(errs) != 1 || !errors.As(errs[0], &locked) {
+		t.Errorf("errors = %v, want a *models.LockedError", errs)
+	}
+	if _, err := test.users.UserService.Authenticate(test.user.Email, "correct horse battery"); err != nil {
+		t.Errorf("the password changed while locked: %v", err)
+	}
+}
+
+func TestSetPasswordWithoutPassword(t *testing.T) {
+	test := newPasswordlessTest(t)
+	rec := httptest.NewRecorder()
+	test.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users/me/password", nil))
+	form := test.pages["change password"].Data.(userForm)
+	if !form.Reauth.Required || len(form.Reauth.Providers) != 1 || form.Reauth.Next != "/users/me/password" {
+		t.Fatalf("change password reauth = %+v, want the stub provider offered", form.Reauth)
+	}
+
+	rec = test.changePassword(t, "", "a brand new passphrase")
+	errs := test.pages["change password"].Errs
+	if rec.Code != http.StatusUnprocessableEntity || len(errs) != 1 || !errors.Is(errs[0], errReauthRequired) {
+		t.Fatalf("set password without signing in again: status = %d, errors = %v", rec.Code, errs)
+	}
+
+	query, state := test.authorize(t, http.MethodPost, "/users/me/reauth/stub?next=/users/me/password")
+	rec = test.callback(query, state)
+	assertRedirect(t, rec, "/users/me/password")
+	rec = test.changePassword(t, "", "a brand new passphrase", responseCookie(rec, CookieReauth))
+	assertRedirect(t, rec, "/users/me")
+	if _, err := test.users.UserService.Authenticate(test.user.Email, "a brand new passphrase"); err != nil {
+		t.Errorf("sign in with the new password: %v", err)
+	}
+}
+
+func TestForgotPasswordLink(t *testing.T) {
+	test := newOIDCTest(t)
+	rec := test.post("/forgot-pw", url.Values{"email": {test.user.Email}})
+	if rec.Code != http.StatusOK || len(test.emails.Sent) != 1 {
+		t.Fatalf("forgot password: status = %d, sent %v", rec.Code, test.emails.Sent)
+	}
+	want := test.user.Email + " https://photos.example.com/reset-pw?token="
+	if !strings.HasPrefix(test.emails.Sent[0], want) {
+		t.Errorf("sent %q, want a link starting with %q", test.emails.Sent[0], want)
+	}
+}
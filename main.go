@@ -1,29 +1,103 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/arkadiont/lenslocked/controllers"
+	"github.com/arkadiont/lenslocked/migrations"
 	"github.com/arkadiont/lenslocked/models"
 	"github.com/arkadiont/lenslocked/templates"
 	"github.com/arkadiont/lenslocked/views"
+	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
 	"github.com/joho/godotenv"
+	"golang.org/x/oauth2"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// shutdownTimeout bounds how long in-flight requests may take once the
+// server has been asked to stop.
+const shutdownTimeout = 10 * time.Second
+
+type oidcProviderConfig struct {
+	// Name is used in URLs, e.g. the redirect URL is BaseURL/oauth/Name/callback
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+}
+
 type config struct {
-	PSQL models.PostgresConfig
+	PSQL       models.PostgresConfig
+	Migrations struct {
+		// AutoApply applies the pending migrations at startup, otherwise they
+		// are applied with the migrate subcommand.
+		AutoApply bool
+	}
 	SMTP models.SMTPConfig
 	CSRF struct {
 		Key    string
 		Secure bool
 	}
+	Session struct {
+		Lifetime    time.Duration
+		IdleTimeout time.Duration
+	}
+	Login struct {
+		MaxAttempts      int
+		MaxAttemptsPerIP int
+		Lockout          time.Duration
+	}
+	RateLimit struct {
+		// Store is either "memory", the default, or "postgres" to share the
+		// limits between instances.
+		Store string
+	}
+	Account struct {
+		// DeletionGracePeriod is how long deleted accounts can still be recovered.
+		DeletionGracePeriod time.Duration
+	}
+	Janitor struct {
+		Interval time.Duration
+	}
+	Email struct {
+		// RequireVerified restricts sharing galleries to verified accounts.
+		RequireVerified bool
+	}
+	Password struct {
+		MinLength int
+		// BreachedFile lists the SHA-1 of breached passwords, see models.LoadBreachedPasswords
+		BreachedFile string
+	}
+	// OIDC lists the OpenID Connect providers users can sign in with.
+	OIDC   []oidcProviderConfig
+	Cookie struct {
+		// HashKey authenticates the signed cookies, see securecookie.New
+		HashKey string
+	}
 	Server struct {
 		Address string
+		BaseURL string
+	}
+	Images struct {
+		Dir           string
+		MaxFileSize   int64
+		MaxUploadSize int64
+		Workers       int
+		QueueSize     int
 	}
 }
 
@@ -37,12 +111,91 @@ func loadEnvConfig() (cfg config, err error) {
 	cfg.PSQL.User = os.Getenv("PSQL_USERNAME")
 	cfg.PSQL.Password = os.Getenv("PSQL_PASSWORD")
 
+	cfg.Migrations.AutoApply = true
+	if v := os.Getenv("MIGRATIONS_AUTO_APPLY"); v != "" {
+		if cfg.Migrations.AutoApply, err = strconv.ParseBool(v); err != nil {
+			return
+		}
+	}
+
 	cfg.CSRF.Key = os.Getenv("CSRF_KEY")
 	if cfg.CSRF.Secure, err = strconv.ParseBool(os.Getenv("CSRF_SECURE")); err != nil {
 		return
 	}
 
+	cfg.Cookie.HashKey = os.Getenv("COOKIE_HASH_KEY")
+
+	if cfg.Session.Lifetime, err = parseDurationEnv("SESSION_LIFETIME"); err != nil {
+		return
+	}
+	if cfg.Session.IdleTimeout, err = parseDurationEnv("SESSION_IDLE_TIMEOUT"); err != nil {
+		return
+	}
+
+	if v := os.Getenv("EMAIL_VERIFICATION_REQUIRED"); v != "" {
+		if cfg.Email.RequireVerified, err = strconv.ParseBool(v); err != nil {
+			return
+		}
+	}
+
+	if cfg.Password.MinLength, err = parseIntEnv("PASSWORD_MIN_LENGTH"); err != nil {
+		return
+	}
+	cfg.Password.BreachedFile = os.Getenv("PASSWORD_BREACHED_FILE")
+
+	if cfg.Login.MaxAttempts, err = parseIntEnv("LOGIN_MAX_ATTEMPTS"); err != nil {
+		return
+	}
+	if cfg.Login.MaxAttemptsPerIP, err = parseIntEnv("LOGIN_MAX_ATTEMPTS_PER_IP"); err != nil {
+		return
+	}
+	if cfg.Login.Lockout, err = parseDurationEnv("LOGIN_LOCKOUT"); err != nil {
+		return
+	}
+
+	cfg.RateLimit.Store = os.Getenv("RATE_LIMIT_STORE")
+
+	// Each provider of OIDC_PROVIDERS=google,... is configured by the
+	// OIDC_GOOGLE_* variables.
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		cfg.OIDC = append(cfg.OIDC, oidcProviderConfig{
+			Name:         strings.ToLower(name),
+			DisplayName:  os.Getenv(prefix + "DISPLAY_NAME"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		})
+	}
+
+	if cfg.Account.DeletionGracePeriod, err = parseDurationEnv("ACCOUNT_DELETION_GRACE_PERIOD"); err != nil {
+		return
+	}
+
+	if cfg.Janitor.Interval, err = parseDurationEnv("JANITOR_INTERVAL"); err != nil {
+		return
+	}
+
 	cfg.Server.Address = os.Getenv("SERVER_ADDRESS")
+	cfg.Server.BaseURL = strings.TrimSuffix(os.Getenv("SERVER_BASE_URL"), "/")
+
+	cfg.Images.Dir = os.Getenv("IMAGES_DIR")
+	if cfg.Images.MaxFileSize, err = parseInt64Env("IMAGES_MAX_FILE_SIZE"); err != nil {
+		return
+	}
+	if cfg.Images.MaxUploadSize, err = parseInt64Env("IMAGES_MAX_UPLOAD_SIZE"); err != nil {
+		return
+	}
+	if cfg.Images.Workers, err = parseIntEnv("IMAGES_WORKERS"); err != nil {
+		return
+	}
+	if cfg.Images.QueueSize, err = parseIntEnv("IMAGES_QUEUE_SIZE"); err != nil {
+		return
+	}
 
 	if cfg.SMTP.Port, err = strconv.Atoi(os.Getenv("SMTP_PORT")); err != nil {
 		return
@@ -54,6 +207,155 @@ func loadEnvConfig() (cfg config, err error) {
 	return
 }
 
+// parseInt64Env reads an optional integer env var, returning 0 when unset so
+// the consumer falls back to its default.
+func parseInt64Env(key string) (int64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func parseIntEnv(key string) (int, error) {
+	v, err := parseInt64Env(key)
+	return int(v), err
+}
+
+// parseDurationEnv reads an optional duration env var such as "72h".
+func parseDurationEnv(key string) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// newSecureCookie builds the signer shared by every signed cookie. Without a
+// configured key a random one is used, so those cookies won't survive a restart.
+func newSecureCookie(hashKey string) *securecookie.SecureCookie {
+	key := []byte(hashKey)
+	if len(key) == 0 {
+		log.Println("COOKIE_HASH_KEY is not set, using a random key")
+		key = securecookie.GenerateRandomKey(64)
+	}
+	return securecookie.New(key, nil)
+}
+
+// newIdentityProvider reads the endpoints of the provider from its discovery
+// document, the provider must be reachable at startup.
+func newIdentityProvider(ctx context.Context, cfg oidcProviderConfig, baseURL string) (*controllers.IdentityProvider, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("identity provider %s: %w", cfg.Name, err)
+	}
+	displayName := cfg.DisplayName
+	if displayName == "" {
+		displayName = cfg.Name
+	}
+	return &controllers.IdentityProvider{
+		Name:        cfg.Name,
+		DisplayName: displayName,
+		OAuth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  baseURL + "/oauth/" + cfg.Name + "/callback",
+			Scopes:       []string{oidc.ScopeOpenID, "email"},
+		},
+		Verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+// newRelyingParty configures WebAuthn for the site at baseURL, passkeys are
+// bound to its host name.
+func newRelyingParty(baseURL string) (*webauthn.WebAuthn, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("relying party: %w", err)
+	}
+	timeout := webauthn.TimeoutConfig{
+		Enforce: true,
+		Timeout: 5 * time.Minute,
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: "Lenslocked",
+		RPOrigins:     []string{baseURL},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	})
+}
+
+// runMigrate implements the migrate subcommand:
+//
+//	lenslocked migrate [up | down [N] | status | baseline N]
+//
+// baseline is meant for databases created from the SQL files before
+// migrations were tracked, e.g. "baseline 3" for users, session and
+// password_reset.
+func runMigrate(migrator models.Migrator, args []string) error {
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	switch cmd {
+	case "up":
+		applied, err := migrator.Up()
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no pending migrations")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+			steps = n
+		}
+		reverted, err := migrator.Down(steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		status, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, m := range status {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = "applied " + m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-24s %s\n", m.Version, m.Name, applied)
+		}
+		return nil
+	case "baseline":
+		if len(args) < 2 {
+			return errors.New("baseline needs the version the database is at")
+		}
+		version, err := strconv.ParseUint(args[1], 10, 0)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		recorded, err := migrator.Baseline(uint(version))
+		for _, m := range recorded {
+			fmt.Printf("recorded %04d_%s as applied\n", m.Version, m.Name)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown command %q, usage: migrate [up | down [N] | status | baseline N]", cmd)
+	}
+}
+
 func main() {
 	cfg, err := loadEnvConfig()
 	if err != nil {
@@ -69,12 +371,130 @@ func main() {
 			log.Printf("err closing db %v", err)
 		}
 	}()
+	migrator, err := models.NewMigratorPostgres(db, migrations.FS)
+	if err != nil {
+		panic(err)
+	}
+	if len(os.Args) > 1 {
+		if os.Args[1] != "migrate" {
+			fmt.Fprintf(os.Stderr, "unknown command %q, usage: %s [migrate]\n", os.Args[1], os.Args[0])
+			os.Exit(2)
+		}
+		if err = runMigrate(migrator, os.Args[2:]); err != nil {
+			log.Printf("migrate err: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.Migrations.AutoApply {
+		applied, err := migrator.Up()
+		if errors.Is(err, models.ErrUntrackedSchema) {
+			log.Fatalf("The database was created before migrations were tracked. Record the migrations "+
+				"it already has with \"%s migrate baseline N\", e.g. N = 3 for a database created from "+
+				"the users, session and password_reset scripts, then start the server again.", os.Args[0])
+		}
+		if err != nil {
+			panic(err)
+		}
+		for _, m := range applied {
+			log.Printf("applied migration %04d_%s", m.Version, m.Name)
+		}
+	}
 
 	// services
-	userSrv := models.NewUserServicePostgres(db)
-	sessionSrv := models.NewSessionServicePostgres(db)
+	var breached models.BreachedPasswords
+	if cfg.Password.BreachedFile != "" {
+		if breached, err = models.LoadBreachedPasswordsFile(cfg.Password.BreachedFile); err != nil {
+			panic(err)
+		}
+	}
+	passwordPolicy := models.NewPasswordPolicy(
+		models.WithMinPasswordLength(cfg.Password.MinLength),
+		models.WithBreachedPasswords(breached),
+	)
+	userSrv := models.NewUserServicePostgres(db, models.WithPasswordPolicy(passwordPolicy))
+	sessionSrv := models.NewSessionServicePostgres(
+		db,
+		models.WithSessionLifetime(cfg.Session.Lifetime),
+		models.WithSessionIdleTimeout(cfg.Session.IdleTimeout),
+	)
 	passSrv := models.NewPasswordResetService(db)
 	emailSrv := models.NewEmailService(cfg.SMTP)
+	verificationSrv := models.NewEmailVerificationService(db)
+	emailChangeSrv := models.NewEmailChangeService(db)
+	loginThrottle := models.NewLoginThrottlePostgres(
+		db,
+		models.WithMaxLoginAttempts(cfg.Login.MaxAttempts),
+		models.WithMaxLoginAttemptsPerIP(cfg.Login.MaxAttemptsPerIP),
+		models.WithLoginLockout(cfg.Login.Lockout),
+	)
+	twoFactorSrv := models.NewTwoFactorServicePostgres(db)
+	// Passkeys are bound to the host name of the site, without it they can't
+	// be registered.
+	var passkeySrv models.PasskeyService
+	if cfg.Server.BaseURL == "" {
+		log.Println("SERVER_BASE_URL is not set, passkeys are disabled")
+	} else {
+		relyingParty, err := newRelyingParty(cfg.Server.BaseURL)
+		if err != nil {
+			panic(err)
+		}
+		passkeySrv = models.NewPasskeyServicePostgres(db, relyingParty)
+	}
+	identitySrv := models.NewIdentityServicePostgres(db)
+	magicLinkSrv := models.NewMagicLinkService(db)
+	var identityProviders []*controllers.IdentityProvider
+	for _, providerCfg := range cfg.OIDC {
+		provider, err := newIdentityProvider(context.Background(), providerCfg, cfg.Server.BaseURL)
+		if err != nil {
+			panic(err)
+		}
+		identityProviders = append(identityProviders, provider)
+	}
+	gallerySrv := models.NewGalleryServicePostgres(db, models.WithGalleryPasswordPolicy(passwordPolicy))
+	imageStore := models.NewImageStoreDisk(cfg.Images.Dir)
+	imageProcessor := models.NewImageProcessor(
+		imageStore,
+		models.WithImageWorkers(cfg.Images.Workers),
+		models.WithImageQueueSize(cfg.Images.QueueSize),
+	)
+	defer imageProcessor.Close()
+	imageSrv := models.NewImageService(
+		imageStore,
+		models.WithMaxImageSize(cfg.Images.MaxFileSize),
+		models.WithImageProcessor(imageProcessor),
+		models.WithImageMetadata(models.NewImageMetadataServicePostgres(db)),
+	)
+
+	var rateLimitStore models.RateLimitStore
+	switch cfg.RateLimit.Store {
+	case "", "memory":
+		rateLimitStore = models.NewRateLimitStoreMemory()
+	case "postgres":
+		rateLimitStore = models.NewRateLimitStorePostgres(db)
+	default:
+		panic(fmt.Sprintf("unknown RATE_LIMIT_STORE %q", cfg.RateLimit.Store))
+	}
+
+	accountDeletionSrv := models.NewAccountDeletionService(
+		db,
+		imageSrv,
+		models.WithDeletionGracePeriod(cfg.Account.DeletionGracePeriod),
+	)
+
+	janitor := models.NewJanitor(
+		models.WithJanitorInterval(cfg.Janitor.Interval),
+		models.WithJanitorTask("sessions", sessionSrv),
+		models.WithJanitorTask("password resets", passSrv),
+		models.WithJanitorTask("magic links", magicLinkSrv),
+		models.WithJanitorTask("email verifications", verificationSrv),
+		models.WithJanitorTask("email changes", emailChangeSrv),
+		models.WithJanitorTask("login attempts", loginThrottle),
+		models.WithJanitorTask("rate limits", rateLimitStore),
+		models.WithJanitorTask("account deletions", accountDeletionSrv),
+		models.WithJanitorTask("passkey challenges", passkeySrv),
+	)
+	defer janitor.Close()
 
 	// middlewares
 	CSRF := csrf.Protect(
@@ -82,13 +502,29 @@ func main() {
 		csrf.Secure(cfg.CSRF.Secure),
 	)
 	userMiddleware := controllers.UserMiddleware{SessionService: sessionSrv}
+	secureCookie := newSecureCookie(cfg.Cookie.HashKey)
+	flasher := controllers.Flasher{SecureCookie: secureCookie}
 
 	// controllers
 	usersC := controllers.Users{
-		UserService:     userSrv,
-		SessionService:  sessionSrv,
-		PasswordService: passSrv,
-		EmailService:    emailSrv,
+		UserService:              userSrv,
+		SessionService:           sessionSrv,
+		PasswordService:          passSrv,
+		EmailService:             emailSrv,
+		EmailVerificationService: verificationSrv,
+		EmailChangeService:       emailChangeSrv,
+		LoginThrottle:            loginThrottle,
+		TwoFactorService:         twoFactorSrv,
+		PasskeyService:           passkeySrv,
+		IdentityService:          identitySrv,
+		MagicLinkService:         magicLinkSrv,
+		AccountDeletionService:   accountDeletionSrv,
+		GalleryService:           gallerySrv,
+		ImageService:             imageSrv,
+		IdentityProviders:        identityProviders,
+		BaseURL:                  cfg.Server.BaseURL,
+		Flasher:                  flasher,
+		SecureCookie:             secureCookie,
 	}
 	usersC.Templates.New = views.Must(views.ParseFS(
 		templates.FS,
@@ -110,11 +546,143 @@ func main() {
 		templates.FS,
 		"reset-pw.gohtml", "tailwind.gohtml",
 	))
+	usersC.Templates.Sessions = views.Must(views.ParseFS(
+		templates.FS,
+		"sessions.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.VerifyEmail = views.Must(views.ParseFS(
+		templates.FS,
+		"verify-email.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.ChangeEmail = views.Must(views.ParseFS(
+		templates.FS,
+		"change-email.gohtml", "reauth.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.ChangePassword = views.Must(views.ParseFS(
+		templates.FS,
+		"change-pw.gohtml", "reauth.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.Account = views.Must(views.ParseFS(
+		templates.FS,
+		"account.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.SignInTwoFactor = views.Must(views.ParseFS(
+		templates.FS,
+		"signin-2fa.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.TwoFactor = views.Must(views.ParseFS(
+		templates.FS,
+		"two-factor.gohtml", "reauth.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.RecoveryCodes = views.Must(views.ParseFS(
+		templates.FS,
+		"recovery-codes.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.Passkeys = views.Must(views.ParseFS(
+		templates.FS,
+		"passkeys.gohtml", "webauthn.gohtml", "reauth.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.SignInPasskey = views.Must(views.ParseFS(
+		templates.FS,
+		"signin-passkey.gohtml", "webauthn.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.Identities = views.Must(views.ParseFS(
+		templates.FS,
+		"identities.gohtml", "reauth.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.MagicLinkSent = views.Must(views.ParseFS(
+		templates.FS,
+		"magic-link-sent.gohtml", "tailwind.gohtml",
+	))
+	usersC.Templates.DeleteAccount = views.Must(views.ParseFS(
+		templates.FS,
+		"delete-account.gohtml", "reauth.gohtml", "tailwind.gohtml",
+	))
+	galleriesC := controllers.Galleries{
+		GalleryService:       gallerySrv,
+		ImageService:         imageSrv,
+		MaxUploadSize:        cfg.Images.MaxUploadSize,
+		BaseURL:              cfg.Server.BaseURL,
+		SecureCookie:         secureCookie,
+		RequireVerifiedEmail: cfg.Email.RequireVerified,
+		Flasher:              flasher,
+	}
+	galleriesC.Templates.New = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/new.gohtml", "tailwind.gohtml",
+	))
+	galleriesC.Templates.Index = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/index.gohtml", "tailwind.gohtml",
+	))
+	galleriesC.Templates.Show = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/show.gohtml", "tailwind.gohtml",
+	))
+	galleriesC.Templates.Edit = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/edit.gohtml", "tailwind.gohtml",
+	))
+	galleriesC.Templates.Image = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/image.gohtml", "tailwind.gohtml",
+	))
+	galleriesC.Templates.Unlock = views.Must(views.ParseFS(
+		templates.FS,
+		"galleries/unlock.gohtml", "tailwind.gohtml",
+	))
+
+	// rate limits
+	signUpLimit := controllers.RateLimiter{
+		Store: rateLimitStore,
+		Name:  "signup",
+		Limit: models.PerHour(10),
+		Keys:  []controllers.RateLimitKey{controllers.ByIP},
+	}
+	signInLimit := controllers.RateLimiter{
+		Store: rateLimitStore,
+		Name:  "signin",
+		Limit: models.PerMinute(10),
+		Keys:  []controllers.RateLimitKey{controllers.ByIP},
+	}
+	// Every request of these routes sends an email, so they're also limited
+	// per recipient to keep them from being used to spam someone.
+	forgotPasswordLimit := controllers.RateLimiter{
+		Store: rateLimitStore,
+		Name:  "forgot-pw",
+		Limit: models.PerHour(5),
+		Keys:  []controllers.RateLimitKey{controllers.ByIP, controllers.ByFormValue("email")},
+	}
+	magicLinkLimit := controllers.RateLimiter{
+		Store: rateLimitStore,
+		Name:  "magic-link",
+		Limit: models.PerHour(5),
+		Keys:  []controllers.RateLimitKey{controllers.ByIP, controllers.ByFormValue("email")},
+	}
+	accountEmailLimit := controllers.RateLimiter{
+		Store: rateLimitStore,
+		Name:  "account-email",
+		Limit: models.PerHour(5),
+		Keys:  []controllers.RateLimitKey{controllers.ByUser, controllers.ByFormValue("email")},
+	}
+	// Gallery passwords are limited per gallery as well, so they can't be
+	// guessed from many addresses.
+	galleryUnlockLimit := controllers.RateLimiter{
+		Store: rateLimitStore,
+		Name:  "gallery-unlock",
+		Limit: models.PerMinute(10),
+		Keys: []controllers.RateLimitKey{
+			controllers.ByIP,
+			controllers.ByURLParam("id"),
+			controllers.ByURLParam("token"),
+		},
+	}
 
 	// build router
 	r := chi.NewRouter()
 	r.Use(
 		CSRF,
+		flasher.Middleware,
 		userMiddleware.SetUser,
 	)
 	r.Get("/", controllers.StaticHandler(
@@ -124,26 +692,108 @@ func main() {
 	r.Get("/faq", controllers.FAQ(
 		views.Must(views.ParseFS(templates.FS, "faq.gohtml", "tailwind.gohtml"))))
 	r.Get("/signup", usersC.New)
-	r.Post("/users", usersC.Create)
+	r.With(signUpLimit.Middleware).Post("/users", usersC.Create)
 	r.Get("/signin", usersC.SignIn)
-	r.Post("/signin", usersC.ProcessSignIn)
+	r.With(signInLimit.Middleware).Post("/signin", usersC.ProcessSignIn)
+	r.Get("/signin/2fa", usersC.SignInTwoFactor)
+	r.With(signInLimit.Middleware).Post("/signin/2fa", usersC.ProcessSignInTwoFactor)
+	if passkeySrv != nil {
+		r.Get("/signin/passkey", usersC.SignInPasskey)
+		r.With(signInLimit.Middleware).Post("/signin/passkey", usersC.ProcessSignInPasskey)
+	}
+	r.With(magicLinkLimit.Middleware).Post("/signin/magic-link", usersC.ProcessMagicLink)
+	r.Get("/signin/magic-link", usersC.MagicLinkSignIn)
+	r.Get("/oauth/{provider}", usersC.OAuthSignIn)
+	r.With(signInLimit.Middleware).Get("/oauth/{provider}/callback", usersC.OAuthCallback)
 	r.Post("/signout", usersC.ProcessSignOut)
 	r.Get("/forgot-pw", usersC.ForgotPassword)
-	r.Post("/forgot-pw", usersC.ProcessForgotPassword)
+	r.With(forgotPasswordLimit.Middleware).Post("/forgot-pw", usersC.ProcessForgotPassword)
 	r.Get("/reset-pw", usersC.ResetPassword)
 	r.Post("/reset-pw", usersC.ProcessResetPassword)
+	r.Get("/verify-email", usersC.ProcessVerifyEmail)
+	r.Get("/confirm-email", usersC.ConfirmEmailChange)
+	r.Get("/unlock-account", usersC.UnlockAccount)
+	r.Get("/cancel-deletion", usersC.CancelDeletion)
 
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(userMiddleware.RequireUser)
 		r.Get("/", usersC.CurrentUser)
+		r.Get("/sessions", usersC.Sessions)
+		r.Post("/sessions/{id}/delete", usersC.RevokeSession)
+		r.Post("/sessions/delete-others", usersC.RevokeOtherSessions)
+		r.With(accountEmailLimit.Middleware).Post("/verify-email", usersC.ResendVerification)
+		r.Get("/email", usersC.ChangeEmail)
+		r.With(accountEmailLimit.Middleware).Post("/email", usersC.ProcessChangeEmail)
+		r.Get("/password", usersC.ChangePassword)
+		// The current password can't be guessed faster than at sign in.
+		r.With(signInLimit.Middleware).Post("/password", usersC.ProcessChangePassword)
+		r.Get("/2fa", usersC.TwoFactor)
+		r.Post("/2fa", usersC.ProcessEnableTwoFactor)
+		r.Post("/2fa/disable", usersC.ProcessDisableTwoFactor)
+		if passkeySrv != nil {
+			r.Get("/passkeys", usersC.Passkeys)
+			r.Post("/passkeys/new", usersC.BeginPasskey)
+			r.Post("/passkeys", usersC.ProcessCreatePasskey)
+			r.Post("/passkeys/{id}/delete", usersC.DeletePasskey)
+		}
+		r.Get("/identities", usersC.Identities)
+		r.Post("/identities/{provider}/link", usersC.LinkIdentity)
+		r.Post("/identities/{id}/delete", usersC.UnlinkIdentity)
+		r.Post("/reauth/{provider}", usersC.Reauthenticate)
+		r.Get("/export", usersC.ExportAccount)
+		r.Get("/delete", usersC.DeleteAccount)
+		r.Post("/delete", usersC.ProcessDeleteAccount)
+		r.Post("/delete/cancel", usersC.ProcessCancelDeletion)
+	})
+	r.Route("/galleries", func(r chi.Router) {
+		r.Get("/{id}", galleriesC.Show)
+		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.Get("/{id}/images/{filename}/details", galleriesC.ImageDetails)
+		r.With(galleryUnlockLimit.Middleware).Post("/{id}/unlock", galleriesC.Unlock)
+		r.Group(func(r chi.Router) {
+			r.Use(userMiddleware.RequireUser)
+			r.Get("/", galleriesC.Index)
+			r.Get("/new", galleriesC.New)
+			r.Post("/", galleriesC.Create)
+			r.Get("/{id}/edit", galleriesC.Edit)
+			r.Post("/{id}", galleriesC.Update)
+			r.Post("/{id}/delete", galleriesC.Delete)
+			r.Post("/{id}/share", galleriesC.RegenerateShareLink)
+			r.Post("/{id}/share/revoke", galleriesC.RevokeShareLink)
+			r.Post("/{id}/password", galleriesC.SetPassword)
+			r.Post("/{id}/password/remove", galleriesC.RemovePassword)
+			r.Post("/{id}/images", galleriesC.UploadImage)
+			r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+		})
+	})
+	r.Route("/share/{token}", func(r chi.Router) {
+		r.Get("/", galleriesC.Show)
+		r.Get("/images/{filename}", galleriesC.Image)
+		r.Get("/images/{filename}/details", galleriesC.ImageDetails)
+		r.With(galleryUnlockLimit.Middleware).Post("/unlock", galleriesC.Unlock)
 	})
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Page not found", http.StatusNotFound)
 	})
 
 	// run server
+	srv := http.Server{
+		Addr:    cfg.Server.Address,
+		Handler: r,
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("shutdown err: %v", err)
+		}
+	}()
 	fmt.Printf("Starting server on %s...\n", cfg.Server.Address)
-	if err = http.ListenAndServe(cfg.Server.Address, r); err != nil {
+	if err = srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		panic(err)
 	}
+	fmt.Println("Server stopped")
 }
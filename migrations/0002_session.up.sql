@@ -2,4 +2,4 @@ CREATE TABLE session (
    id SERIAL PRIMARY KEY,
    user_id INT UNIQUE REFERENCES users(id) ON DELETE CASCADE,
    token_hash TEXT UNIQUE NOT NULL
-);
\ No newline at end of file
+);
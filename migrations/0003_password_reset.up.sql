@@ -3,4 +3,4 @@ CREATE TABLE password_reset (
      user_id INT UNIQUE REFERENCES users(id) ON DELETE CASCADE,
      token_hash TEXT UNIQUE NOT NULL,
      expires_at timestamptz NOT NULL
-);
\ No newline at end of file
+);
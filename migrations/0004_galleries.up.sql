@@ -0,0 +1,13 @@
+CREATE TABLE galleries (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    title TEXT NOT NULL,
+    visibility TEXT NOT NULL DEFAULT 'private' CHECK (visibility IN ('private', 'unlisted', 'public')),
+    share_token_hash TEXT UNIQUE,
+    password_hash TEXT,
+    keep_location BOOLEAN NOT NULL DEFAULT false,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX galleries_user_id_idx ON galleries (user_id);
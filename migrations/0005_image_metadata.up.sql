@@ -0,0 +1,15 @@
+CREATE TABLE image_metadata (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries(id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    camera_make TEXT NOT NULL DEFAULT '',
+    camera_model TEXT NOT NULL DEFAULT '',
+    lens_model TEXT NOT NULL DEFAULT '',
+    exposure_time TEXT NOT NULL DEFAULT '',
+    f_number REAL NOT NULL DEFAULT 0,
+    iso INT NOT NULL DEFAULT 0,
+    focal_length REAL NOT NULL DEFAULT 0,
+    taken_at timestamptz,
+    has_location BOOLEAN NOT NULL DEFAULT false,
+    UNIQUE (gallery_id, filename)
+);
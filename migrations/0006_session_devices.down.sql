@@ -0,0 +1,11 @@
+DROP INDEX session_user_id_idx;
+
+ALTER TABLE session
+    DROP COLUMN user_agent,
+    DROP COLUMN ip_address,
+    DROP COLUMN created_at,
+    DROP COLUMN last_seen_at;
+ALTER TABLE session ALTER COLUMN user_id DROP NOT NULL;
+-- Only the most recent session of each user can be kept.
+DELETE FROM session s USING session newer WHERE s.user_id = newer.user_id AND s.id < newer.id;
+ALTER TABLE session ADD CONSTRAINT session_user_id_key UNIQUE (user_id);
@@ -0,0 +1,10 @@
+-- Users may be signed in on several devices at once.
+ALTER TABLE session DROP CONSTRAINT session_user_id_key;
+ALTER TABLE session ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE session
+    ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN ip_address TEXT NOT NULL DEFAULT '',
+    ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+    ADD COLUMN last_seen_at timestamptz NOT NULL DEFAULT now();
+
+CREATE INDEX session_user_id_idx ON session (user_id);
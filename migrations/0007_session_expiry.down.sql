@@ -0,0 +1 @@
+ALTER TABLE session DROP COLUMN expires_at;
@@ -0,0 +1,3 @@
+-- Sessions created before expiry was tracked get the default lifetime.
+ALTER TABLE session ADD COLUMN expires_at timestamptz NOT NULL DEFAULT now() + interval '30 days';
+ALTER TABLE session ALTER COLUMN expires_at DROP DEFAULT;
@@ -0,0 +1,8 @@
+ALTER TABLE users ADD COLUMN email_verified_at timestamptz;
+
+CREATE TABLE email_verification (
+     id SERIAL PRIMARY KEY,
+     user_id INT UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+     token_hash TEXT UNIQUE NOT NULL,
+     expires_at timestamptz NOT NULL
+);
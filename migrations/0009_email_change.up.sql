@@ -0,0 +1,7 @@
+CREATE TABLE email_change (
+     id SERIAL PRIMARY KEY,
+     user_id INT UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+     new_email TEXT NOT NULL,
+     token_hash TEXT UNIQUE NOT NULL,
+     expires_at timestamptz NOT NULL
+);
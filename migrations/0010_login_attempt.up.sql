@@ -0,0 +1,7 @@
+CREATE TABLE login_attempt (
+    key TEXT PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at timestamptz NOT NULL,
+    locked_until timestamptz,
+    unlock_token_hash TEXT UNIQUE
+);
@@ -0,0 +1,6 @@
+CREATE TABLE rate_limit (
+    key TEXT PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at timestamptz NOT NULL,
+    full_at timestamptz NOT NULL
+);
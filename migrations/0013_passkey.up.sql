@@ -0,0 +1,11 @@
+CREATE TABLE passkey (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    credential_id BYTEA UNIQUE NOT NULL,
+    -- credential is the webauthn.Credential, including its public key and
+    -- signature counter.
+    credential JSONB NOT NULL,
+    name TEXT NOT NULL,
+    created_at timestamptz NOT NULL,
+    last_used_at timestamptz
+);
@@ -0,0 +1,11 @@
+-- users.password_hash is left empty for users who signed up with an
+-- identity provider.
+CREATE TABLE identities (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL,
+    created_at timestamptz NOT NULL,
+    UNIQUE (provider, subject)
+);
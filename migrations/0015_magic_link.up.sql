@@ -0,0 +1,7 @@
+CREATE TABLE magic_link (
+     id SERIAL PRIMARY KEY,
+     user_id INT UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+     token_hash TEXT UNIQUE NOT NULL,
+     browser_hash TEXT NOT NULL,
+     expires_at timestamptz NOT NULL
+);
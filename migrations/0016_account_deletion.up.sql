@@ -0,0 +1,7 @@
+CREATE TABLE account_deletion (
+     id SERIAL PRIMARY KEY,
+     user_id INT UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+     token_hash TEXT UNIQUE NOT NULL,
+     requested_at timestamptz NOT NULL,
+     delete_at timestamptz NOT NULL
+);
@@ -0,0 +1,7 @@
+-- passkey_challenge holds the challenges of the passkey ceremonies in
+-- progress, a challenge is deleted by the step finishing its ceremony.
+CREATE TABLE passkey_challenge (
+    challenge TEXT PRIMARY KEY,
+    ceremony TEXT NOT NULL,
+    expires_at timestamptz NOT NULL
+);
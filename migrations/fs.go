@@ -0,0 +1,9 @@
+// Package migrations embeds the numbered SQL migrations of the database
+// schema. Each version has a NNNN_name.up.sql file applying it and a
+// NNNN_name.down.sql file reverting it, see models.Migrator.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
@@ -0,0 +1,360 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/rand"
+	"log"
+	"time"
+)
+
+const (
+	DefaultDeletionGracePeriod = 7 * 24 * time.Hour
+)
+
+// AccountDeletion is a scheduled deletion of a user and everything they own.
+type AccountDeletion struct {
+	ID     int
+	UserID uint
+	// Token cancels the deletion, it is only set when the deletion is scheduled
+	Token       string
+	TokenHash   string
+	RequestedAt time.Time
+	DeleteAt    time.Time
+}
+
+// AccountDeletionService deletes accounts once a grace period, during which
+// the user can change their mind, is over. Deleting a user cascades to every
+// row they own, DeleteExpired also removes their image files.
+type AccountDeletionService interface {
+	// Schedule returns the existing deletion of the user when there's one.
+	Schedule(userID uint) (*AccountDeletion, error)
+	// ByUserID returns ErrNotFound when no deletion is scheduled for the user.
+	ByUserID(userID uint) (*AccountDeletion, error)
+	// Cancel returns the user whose deletion was cancelled, or ErrNotFound
+	// for unknown tokens.
+	Cancel(token string) (*User, error)
+	// CancelByUserID returns ErrNotFound when no deletion is scheduled for the user.
+	CancelByUserID(userID uint) error
+	Expirer
+}
+
+type accountDeletionOption func(*accountDeletionConfig)
+
+// WithDeletionGracePeriod sets how long accounts are kept after the user
+// asked for their deletion.
+func WithDeletionGracePeriod(gracePeriod time.Duration) accountDeletionOption {
+	return func(s *accountDeletionConfig) {
+		if gracePeriod > 0 {
+			s.GracePeriod = gracePeriod
+		}
+	}
+}
+
+func NewAccountDeletionService(db *sql.DB, images ImageService, opts ...accountDeletionOption) AccountDeletionService {
+	return &accountDeletionService{
+		DB:                    db,
+		ImageService:          images,
+		accountDeletionConfig: newAccountDeletionConfig(opts),
+	}
+}
+
+// accountDeletionConfig holds the settings shared by the Postgres and
+// in-memory account deletion services.
+type accountDeletionConfig struct {
+	BytesPerToken int
+	GracePeriod   time.Duration
+}
+
+func newAccountDeletionConfig(opts []accountDeletionOption) accountDeletionConfig {
+	c := accountDeletionConfig{
+		BytesPerToken: MinBytesPerToken,
+		GracePeriod:   DefaultDeletionGracePeriod,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// hash is shared by both services, only the hashes of cancel tokens are stored.
+func (c accountDeletionConfig) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+type accountDeletionService struct {
+	DB *sql.DB
+	// ImageService removes the images of the deleted galleries.
+	ImageService ImageService
+	accountDeletionConfig
+}
+
+func (s accountDeletionService) Schedule(userID uint) (*AccountDeletion, error) {
+	token, err := rand.String(s.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("schedule account deletion: %w", err)
+	}
+	now := time.Now()
+	deletion := AccountDeletion{
+		UserID:      userID,
+		Token:       token,
+		TokenHash:   s.hash(token),
+		RequestedAt: now,
+		DeleteAt:    now.Add(s.GracePeriod),
+	}
+	// Asking again sends a new cancel link but doesn't delay the deletion.
+	row := s.DB.QueryRow(`
+		INSERT INTO account_deletion (user_id, token_hash, requested_at, delete_at)
+		VALUES ($1, $2, $3, $4) ON CONFLICT(user_id) DO
+		UPDATE SET token_hash = $2 RETURNING id, requested_at, delete_at;`,
+		deletion.UserID, deletion.TokenHash, deletion.RequestedAt, deletion.DeleteAt)
+	if err = row.Scan(&deletion.ID, &deletion.RequestedAt, &deletion.DeleteAt); err != nil {
+		return nil, fmt.Errorf("schedule account deletion: %w", err)
+	}
+	return &deletion, nil
+}
+
+func (s accountDeletionService) ByUserID(userID uint) (*AccountDeletion, error) {
+	deletion := AccountDeletion{
+		UserID: userID,
+	}
+	row := s.DB.QueryRow(`
+		SELECT id, token_hash, requested_at, delete_at FROM account_deletion
+		WHERE user_id = $1;`, userID)
+	err := row.Scan(&deletion.ID, &deletion.TokenHash, &deletion.RequestedAt, &deletion.DeleteAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("account deletion: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("account deletion: %w", err)
+	}
+	return &deletion, nil
+}
+
+func (s accountDeletionService) Cancel(token string) (*User, error) {
+	var user User
+	row := s.DB.QueryRow(`
+		DELETE FROM account_deletion d USING users u
+		WHERE u.id = d.user_id AND d.token_hash = $1
+		RETURNING u.id, u.email, u.email_verified_at;`, s.hash(token))
+	if err := row.Scan(&user.ID, &user.Email, &user.EmailVerifiedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("cancel account deletion: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("cancel account deletion: %w", err)
+	}
+	return &user, nil
+}
+
+func (s accountDeletionService) CancelByUserID(userID uint) error {
+	res, err := s.DB.Exec(`DELETE FROM account_deletion WHERE user_id = $1;`, userID)
+	if err != nil {
+		return fmt.Errorf("cancel account deletion: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("cancel account deletion: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("cancel account deletion: %w", ErrNotFound)
+	}
+	return nil
+}
+
+// DeleteExpired deletes the accounts whose grace period is over, returning
+// how many were deleted.
+func (s accountDeletionService) DeleteExpired(now time.Time) (int64, error) {
+	rows, err := s.DB.Query(`SELECT user_id FROM account_deletion WHERE delete_at <= $1;`, now)
+	if err != nil {
+		return 0, fmt.Errorf("delete accounts: %w", err)
+	}
+	var userIDs []uint
+	for rows.Next() {
+		var userID uint
+		if err = rows.Scan(&userID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("delete accounts: %w", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("delete accounts: %w", err)
+	}
+	var deleted int64
+	for _, userID := range userIDs {
+		// One failing account must not keep the others around.
+		if err = s.deleteUser(userID); err != nil {
+			log.Printf("delete account %d err: %v", userID, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// deleteUser removes the image files first: if that fails the user is kept,
+// and the next run tries again instead of leaving orphan files behind.
+func (s accountDeletionService) deleteUser(userID uint) error {
+	rows, err := s.DB.Query(`SELECT id FROM galleries WHERE user_id = $1;`, userID)
+	if err != nil {
+		return err
+	}
+	var galleryIDs []uint
+	for rows.Next() {
+		var galleryID uint
+		if err = rows.Scan(&galleryID); err != nil {
+			rows.Close()
+			return err
+		}
+		galleryIDs = append(galleryIDs, galleryID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, galleryID := range galleryIDs {
+		if err = s.ImageService.DeleteAll(galleryID); err != nil {
+			return err
+		}
+	}
+	// Every table referencing users cascades.
+	_, err = s.DB.Exec(`DELETE FROM users WHERE id = $1;`, userID)
+	return err
+}
+
+// NewAccountDeletionServiceMemory keeps scheduled deletions in db, it takes
+// the same options as NewAccountDeletionService.
+func NewAccountDeletionServiceMemory(db *MemoryDB, images ImageService, opts ...accountDeletionOption) AccountDeletionService {
+	return &accountDeletionServiceMemory{
+		DB:                    db,
+		ImageService:          images,
+		accountDeletionConfig: newAccountDeletionConfig(opts),
+	}
+}
+
+type accountDeletionServiceMemory struct {
+	DB *MemoryDB
+	// ImageService removes the images of the deleted galleries.
+	ImageService ImageService
+	accountDeletionConfig
+}
+
+func (s accountDeletionServiceMemory) Schedule(userID uint) (*AccountDeletion, error) {
+	token, err := rand.String(s.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("schedule account deletion: %w", err)
+	}
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	if _, ok := s.DB.users[userID]; !ok {
+		return nil, fmt.Errorf("schedule account deletion: %w", ErrNotFound)
+	}
+	deletion, ok := s.DB.accountDeletionByUserID(userID)
+	if !ok {
+		now := time.Now()
+		deletion = &AccountDeletion{
+			ID:          int(s.DB.nextID()),
+			UserID:      userID,
+			RequestedAt: now,
+			DeleteAt:    now.Add(s.GracePeriod),
+		}
+		s.DB.accountDeletions[deletion.ID] = deletion
+	}
+	// Asking again sends a new cancel link but doesn't delay the deletion.
+	deletion.TokenHash = s.hash(token)
+	scheduled := *deletion
+	scheduled.Token = token
+	return &scheduled, nil
+}
+
+func (s accountDeletionServiceMemory) ByUserID(userID uint) (*AccountDeletion, error) {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	deletion, ok := s.DB.accountDeletionByUserID(userID)
+	if !ok {
+		return nil, fmt.Errorf("account deletion: %w", ErrNotFound)
+	}
+	found := *deletion
+	return &found, nil
+}
+
+func (s accountDeletionServiceMemory) Cancel(token string) (*User, error) {
+	hash := s.hash(token)
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	for id, deletion := range s.DB.accountDeletions {
+		if deletion.TokenHash != hash {
+			continue
+		}
+		user, ok := s.DB.users[deletion.UserID]
+		if !ok {
+			break
+		}
+		delete(s.DB.accountDeletions, id)
+		found := *user
+		return &found, nil
+	}
+	return nil, fmt.Errorf("cancel account deletion: %w", ErrNotFound)
+}
+
+func (s accountDeletionServiceMemory) CancelByUserID(userID uint) error {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	deletion, ok := s.DB.accountDeletionByUserID(userID)
+	if !ok {
+		return fmt.Errorf("cancel account deletion: %w", ErrNotFound)
+	}
+	delete(s.DB.accountDeletions, deletion.ID)
+	return nil
+}
+
+// DeleteExpired deletes the accounts whose grace period is over, returning
+// how many were deleted.
+func (s accountDeletionServiceMemory) DeleteExpired(now time.Time) (int64, error) {
+	s.DB.mu.Lock()
+	var userIDs []uint
+	for _, deletion := range s.DB.accountDeletions {
+		if !now.Before(deletion.DeleteAt) {
+			userIDs = append(userIDs, deletion.UserID)
+		}
+	}
+	s.DB.mu.Unlock()
+	var deleted int64
+	for _, userID := range userIDs {
+		// One failing account must not keep the others around.
+		if err := s.deleteUser(userID); err != nil {
+			log.Printf("delete account %d err: %v", userID, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// deleteUser removes the image files first, like
+// accountDeletionService.deleteUser. The image service is called without
+// holding mu.
+func (s accountDeletionServiceMemory) deleteUser(userID uint) error {
+	s.DB.mu.Lock()
+	var galleryIDs []uint
+	for _, gallery := range s.DB.galleries {
+		if gallery.UserID == userID {
+			galleryIDs = append(galleryIDs, gallery.ID)
+		}
+	}
+	s.DB.mu.Unlock()
+	for _, galleryID := range galleryIDs {
+		if err := s.ImageService.DeleteAll(galleryID); err != nil {
+			return err
+		}
+	}
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	s.DB.deleteUser(userID)
+	return nil
+}
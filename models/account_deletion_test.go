@@ -0,0 +1,224 @@
+package models_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// deletionServices are the services involved in deleting an account, sharing
+// the same storage.
+type deletionServices struct {
+	Users     models.UserService
+	Sessions  models.SessionService
+	Galleries models.GalleryService
+	// Deletions builds the service under test around images.
+	Deletions func(images models.ImageService, opts ...models.AccountDeletionOption) models.AccountDeletionService
+}
+
+func memoryDeletionServices() deletionServices {
+	db := models.NewMemoryDB()
+	return deletionServices{
+		Users:     models.NewUserServiceMemory(db),
+		Sessions:  models.NewSessionServiceMemory(db),
+		Galleries: models.NewGalleryServiceMemory(db),
+		Deletions: func(images models.ImageService, opts ...models.AccountDeletionOption) models.AccountDeletionService {
+			return models.NewAccountDeletionServiceMemory(db, images, opts...)
+		},
+	}
+}
+
+// deletionUser is a user owning a session and a gallery holding an image.
+type deletionUser struct {
+	Email, Password string
+	ID              uint
+	SessionToken    string
+	GalleryID       uint
+	Image           string
+}
+
+func newDeletionUser(t *testing.T, s deletionServices, images models.ImageService) deletionUser {
+	t.Helper()
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+	u := deletionUser{
+		Email:    "delete-" + token + "@example.com",
+		Password: "pw-" + token,
+	}
+	user, err := s.Users.Create(u.Email, u.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.ID = user.ID
+	session, err := s.Sessions.Create(user.ID, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.SessionToken = session.Token
+	gallery, err := s.Galleries.Create("to delete", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.GalleryID = gallery.ID
+	image, err := images.Create(gallery, "photo.png", bytes.NewReader(encodeTestImage(t, 8, 8, "png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Image = image.Filename
+	return u
+}
+
+// exists reports whether the user can still sign in.
+func (u deletionUser) exists(t *testing.T, users models.UserService) bool {
+	t.Helper()
+	_, err := users.Authenticate(u.Email, u.Password)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+// orderedImages checks that the image files are removed while the user is
+// still there, failing instead when err is set.
+type orderedImages struct {
+	models.ImageService
+	t     *testing.T
+	users models.UserService
+	user  *deletionUser
+	err   error
+	calls int
+}
+
+func (i *orderedImages) DeleteAll(galleryID uint) error {
+	i.calls++
+	if !i.user.exists(i.t, i.users) {
+		i.t.Errorf("DeleteAll(%d) called after the user was deleted", galleryID)
+	}
+	if i.err != nil {
+		return i.err
+	}
+	return i.ImageService.DeleteAll(galleryID)
+}
+
+func TestAccountDeletionGracePeriod(t *testing.T) {
+	s := memoryDeletionServices()
+	images := models.NewImageService(models.NewImageStoreDisk(t.TempDir()))
+	deletions := s.Deletions(images, models.WithDeletionGracePeriod(time.Hour))
+	user := newDeletionUser(t, s, images)
+
+	deletion, err := deletions.Schedule(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := deletion.DeleteAt.Sub(deletion.RequestedAt); got != time.Hour {
+		t.Errorf("DeleteAt is %v after RequestedAt, want the grace period of 1h", got)
+	}
+	for _, now := range []time.Time{time.Now(), deletion.DeleteAt.Add(-time.Second)} {
+		if n, err := deletions.DeleteExpired(now); err != nil || n != 0 {
+			t.Errorf("DeleteExpired(%v) during the grace period: %d deleted, err = %v", now, n, err)
+		}
+	}
+	if !user.exists(t, s.Users) {
+		t.Fatalf("the user was deleted during the grace period")
+	}
+
+	// Cancelled deletions are forgotten, even once their date passed.
+	if _, err = deletions.Cancel(deletion.Token); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	if n, err := deletions.DeleteExpired(deletion.DeleteAt.Add(time.Hour)); err != nil || n != 0 {
+		t.Errorf("DeleteExpired after Cancel: %d deleted, err = %v", n, err)
+	}
+	if _, err = deletions.Schedule(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = deletions.CancelByUserID(user.ID); err != nil {
+		t.Fatalf("CancelByUserID: %v", err)
+	}
+	if n, err := deletions.DeleteExpired(deletion.DeleteAt.Add(time.Hour)); err != nil || n != 0 {
+		t.Errorf("DeleteExpired after CancelByUserID: %d deleted, err = %v", n, err)
+	}
+	if !user.exists(t, s.Users) {
+		t.Fatalf("the user was deleted after cancelling")
+	}
+
+	// Scheduling again starts a new grace period.
+	deletion, err = deletions.Schedule(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := deletions.DeleteExpired(deletion.DeleteAt); err != nil || n != 1 {
+		t.Errorf("DeleteExpired once the grace period is over: %d deleted, err = %v, want 1", n, err)
+	}
+	if user.exists(t, s.Users) {
+		t.Errorf("the user wasn't deleted once the grace period was over")
+	}
+}
+
+func testDeleteUser(t *testing.T, s deletionServices) {
+	images := &orderedImages{
+		ImageService: models.NewImageService(models.NewImageStoreDisk(t.TempDir())),
+		t:            t,
+		users:        s.Users,
+	}
+	deletions := s.Deletions(images, models.WithDeletionGracePeriod(time.Nanosecond))
+	user := newDeletionUser(t, s, images)
+	images.user = &user
+	if _, err := deletions.Schedule(user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The user is kept when the images can't be removed, the next run tries
+	// again.
+	images.err = errors.New("disk unavailable")
+	if _, err := deletions.DeleteExpired(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if images.calls == 0 {
+		t.Fatalf("DeleteExpired didn't remove the images of the gallery")
+	}
+	if !user.exists(t, s.Users) {
+		t.Fatalf("the user was deleted although their images are still there")
+	}
+	if _, err := s.Galleries.ByID(user.GalleryID); err != nil {
+		t.Errorf("the gallery of a kept user: %v", err)
+	}
+
+	images.err = nil
+	if _, err := deletions.DeleteExpired(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if user.exists(t, s.Users) {
+		t.Errorf("the user wasn't deleted")
+	}
+	if _, err := s.Sessions.User(user.SessionToken); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Sessions.User of a deleted user: err = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Galleries.ByID(user.GalleryID); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Galleries.ByID of a deleted user: err = %v, want ErrNotFound", err)
+	}
+	if _, _, err := images.Open(user.GalleryID, user.Image); err == nil {
+		t.Errorf("the image of a deleted user can still be opened")
+	}
+	if _, err := deletions.ByUserID(user.ID); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("ByUserID of a deleted user: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAccountDeletionDeleteUser(t *testing.T) {
+	testDeleteUser(t, memoryDeletionServices())
+}
+
+func TestAccountDeletionPostgresDeleteUser(t *testing.T) {
+	db := openTestDB(t)
+	testDeleteUser(t, deletionServices{
+		Users:     models.NewUserServicePostgres(db),
+		Sessions:  models.NewSessionServicePostgres(db),
+		Galleries: models.NewGalleryServicePostgres(db),
+		Deletions: func(images models.ImageService, opts ...models.AccountDeletionOption) models.AccountDeletionService {
+			return models.NewAccountDeletionService(db, images, opts...)
+		},
+	})
+}
@@ -3,6 +3,8 @@ package models
 import (
 	"fmt"
 	"github.com/go-mail/mail/v2"
+	"html"
+	"time"
 )
 
 const (
@@ -20,6 +22,20 @@ type Email struct {
 type EmailService interface {
 	Send(email Email) error
 	ForgotPassword(to, resetURL string) error
+	// MagicLink sends a link signing the user in without their password.
+	MagicLink(to, signInURL string) error
+	VerifyEmail(to, verifyURL string) error
+	// ConfirmEmailChange asks the new address to confirm it should replace the old one.
+	ConfirmEmailChange(to, confirmURL string) error
+	// EmailChangeNotice warns the old address that a change to newEmail was requested.
+	EmailChangeNotice(to, newEmail string) error
+	// PasswordChanged lets the user know their password was changed.
+	PasswordChanged(to string) error
+	// AccountLocked warns the user about failed sign ins, unlockURL lifts the lock.
+	AccountLocked(to, unlockURL string) error
+	// AccountDeletionScheduled confirms the account is deleted at deleteAt,
+	// unless cancelURL is visited before.
+	AccountDeletionScheduled(to string, deleteAt time.Time, cancelURL string) error
 }
 
 type emailService struct {
@@ -77,6 +93,116 @@ func (es *emailService) ForgotPassword(to, resetURL string) error {
 	return nil
 }
 
+func (es *emailService) MagicLink(to, signInURL string) error {
+	msg := "To sign in to your account, please visit the following link from the browser you asked for it:"
+	email := Email{
+		To:        to,
+		Subject:   "Your sign-in link",
+		PlainText: fmt.Sprintf("%s %s", msg, signInURL),
+		Html:      fmt.Sprintf(`<p>%s <a href="%s">%s</a></p>`, msg, signInURL, signInURL),
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("magic link: %w", err)
+	}
+	return nil
+}
+
+func (es *emailService) VerifyEmail(to, verifyURL string) error {
+	msg := "To confirm your email address, please visit the following link:"
+	email := Email{
+		To:        to,
+		Subject:   "Confirm your email address",
+		PlainText: fmt.Sprintf("%s %s", msg, verifyURL),
+		Html:      fmt.Sprintf(`<p>%s <a href="%s">%s</a></p>`, msg, verifyURL, verifyURL),
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("verify email: %w", err)
+	}
+	return nil
+}
+
+func (es *emailService) ConfirmEmailChange(to, confirmURL string) error {
+	msg := "To use this address for your account, please visit the following link:"
+	email := Email{
+		To:        to,
+		Subject:   "Confirm your new email address",
+		PlainText: fmt.Sprintf("%s %s", msg, confirmURL),
+		Html:      fmt.Sprintf(`<p>%s <a href="%s">%s</a></p>`, msg, confirmURL, confirmURL),
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("confirm email change: %w", err)
+	}
+	return nil
+}
+
+func (es *emailService) EmailChangeNotice(to, newEmail string) error {
+	msg := fmt.Sprintf("A request was made to change the email address of your account to %s.", newEmail)
+	warn := "If it wasn't you, please reset your password right away."
+	email := Email{
+		To:        to,
+		Subject:   "Your email address is being changed",
+		PlainText: fmt.Sprintf("%s %s", msg, warn),
+		Html:      fmt.Sprintf(`<p>%s</p><p>%s</p>`, html.EscapeString(msg), warn),
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("email change notice: %w", err)
+	}
+	return nil
+}
+
+func (es *emailService) PasswordChanged(to string) error {
+	msg := "The password of your account was just changed, you have been signed out of your other devices."
+	warn := "If it wasn't you, please reset your password right away."
+	email := Email{
+		To:        to,
+		Subject:   "Your password was changed",
+		PlainText: fmt.Sprintf("%s %s", msg, warn),
+		Html:      fmt.Sprintf(`<p>%s</p><p>%s</p>`, msg, warn),
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("password changed: %w", err)
+	}
+	return nil
+}
+
+func (es *emailService) AccountLocked(to, unlockURL string) error {
+	msg := "Signing in to your account was temporarily locked after too many failed attempts."
+	unlock := "If it was you, you can unlock it right away by visiting the following link:"
+	email := Email{
+		To:        to,
+		Subject:   "Your account was locked",
+		PlainText: fmt.Sprintf("%s %s %s", msg, unlock, unlockURL),
+		Html:      fmt.Sprintf(`<p>%s</p><p>%s <a href="%s">%s</a></p>`, msg, unlock, unlockURL, unlockURL),
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("account locked: %w", err)
+	}
+	return nil
+}
+
+func (es *emailService) AccountDeletionScheduled(to string, deleteAt time.Time, cancelURL string) error {
+	msg := fmt.Sprintf("Your account and all your galleries will be deleted on %s.",
+		deleteAt.Format("January 2, 2006 at 15:04 MST"))
+	cancel := "Changed your mind? Keep your account by visiting the following link:"
+	email := Email{
+		To:        to,
+		Subject:   "Your account will be deleted",
+		PlainText: fmt.Sprintf("%s %s %s", msg, cancel, cancelURL),
+		Html:      fmt.Sprintf(`<p>%s</p><p>%s <a href="%s">%s</a></p>`, msg, cancel, cancelURL, cancelURL),
+	}
+	err := es.Send(email)
+	if err != nil {
+		return fmt.Errorf("account deletion scheduled: %w", err)
+	}
+	return nil
+}
+
 func (es *emailService) setFrom(msg *mail.Message, email Email) {
 	var from string
 	switch {
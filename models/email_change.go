@@ -0,0 +1,148 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/rand"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultEmailChangeDuration = 24 * time.Hour
+)
+
+type EmailChange struct {
+	ID       int
+	UserID   uint
+	NewEmail string
+	// Token is only set when an EmailChange is being created
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type EmailChangeService interface {
+	// Create records a pending change of the user's email to newEmail,
+	// replacing any previous one. It returns ErrEmailTaken when another
+	// account already uses newEmail.
+	Create(userID uint, newEmail string) (*EmailChange, error)
+	// Consume swaps the user's email for the pending one, which counts as
+	// verified since the token was sent there.
+	Consume(token string) (*User, error)
+	Expirer
+}
+
+type emailChangeOption func(*emailChangeService)
+
+func WithBytesPerTokenEmailChange(bytesPerToken int) emailChangeOption {
+	return func(s *emailChangeService) {
+		if bytesPerToken > s.BytesPerToken {
+			s.BytesPerToken = bytesPerToken
+		}
+	}
+}
+
+func NewEmailChangeService(db *sql.DB, opts ...emailChangeOption) EmailChangeService {
+	s := &emailChangeService{
+		DB:            db,
+		BytesPerToken: MinBytesPerToken,
+		Duration:      DefaultEmailChangeDuration,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+type emailChangeService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each confirmation token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be used.
+	BytesPerToken int
+	// Duration is the amount of time that an EmailChange is valid for. Default DefaultEmailChangeDuration
+	Duration time.Duration
+}
+
+func (ec emailChangeService) Create(userID uint, newEmail string) (*EmailChange, error) {
+	newEmail = strings.ToLower(newEmail)
+	var taken bool
+	row := ec.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email = $1);`, newEmail)
+	if err := row.Scan(&taken); err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	if taken {
+		return nil, ErrEmailTaken
+	}
+	token, err := rand.String(ec.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	change := EmailChange{
+		UserID:    userID,
+		NewEmail:  newEmail,
+		Token:     token,
+		TokenHash: ec.hash(token),
+		ExpiresAt: time.Now().Add(ec.Duration),
+	}
+	row = ec.DB.QueryRow(`
+		INSERT INTO email_change (user_id, new_email, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4) ON CONFLICT(user_id) DO
+		UPDATE SET new_email = $2, token_hash = $3, expires_at = $4 RETURNING id;`,
+		change.UserID, change.NewEmail, change.TokenHash, change.ExpiresAt)
+	if err = row.Scan(&change.ID); err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	return &change, nil
+}
+
+func (ec emailChangeService) Consume(token string) (*User, error) {
+	var user User
+	var change EmailChange
+	row := ec.DB.QueryRow(`SELECT c.id, c.new_email, c.expires_at, u.id, u.password_hash
+	FROM users u, email_change c
+	WHERE u.id = c.user_id AND c.token_hash = $1;`, ec.hash(token))
+	err := row.Scan(&change.ID, &change.NewEmail, &change.ExpiresAt, &user.ID, &user.PasswordHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("consume email change: %w", err)
+	}
+	if time.Now().After(change.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	now := time.Now()
+	_, err = ec.DB.Exec(`UPDATE users SET email = $2, email_verified_at = $3 WHERE id = $1;`,
+		user.ID, change.NewEmail, now)
+	if err != nil {
+		// Someone may have signed up with the address since the change was requested.
+		if isUniqueViolation(err) {
+			return nil, ErrEmailTaken
+		}
+		return nil, fmt.Errorf("consume email change: %w", err)
+	}
+	user.Email = change.NewEmail
+	user.EmailVerifiedAt = &now
+	if _, err = ec.DB.Exec(`DELETE FROM email_change WHERE id = $1;`, change.ID); err != nil {
+		return nil, fmt.Errorf("consume email change: %w", err)
+	}
+	return &user, nil
+}
+
+func (ec emailChangeService) DeleteExpired(now time.Time) (int64, error) {
+	res, err := ec.DB.Exec(`DELETE FROM email_change WHERE expires_at <= $1;`, now)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired email changes: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+func (ec emailChangeService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
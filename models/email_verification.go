@@ -0,0 +1,230 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/rand"
+	"time"
+)
+
+const (
+	DefaultVerificationDuration = 24 * time.Hour
+)
+
+type EmailVerification struct {
+	ID     int
+	UserID uint
+	// Token is only set when an EmailVerification is being created
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type EmailVerificationService interface {
+	// Create issues a new verification token for the user, replacing any
+	// previous one.
+	Create(userID uint) (*EmailVerification, error)
+	// Consume marks the email of the token's user as verified.
+	Consume(token string) (*User, error)
+	Expirer
+}
+
+type emailVerificationOption func(*emailVerificationConfig)
+
+func WithBytesPerTokenVerification(bytesPerToken int) emailVerificationOption {
+	return func(s *emailVerificationConfig) {
+		if bytesPerToken > s.BytesPerToken {
+			s.BytesPerToken = bytesPerToken
+		}
+	}
+}
+
+func WithVerificationDuration(duration time.Duration) emailVerificationOption {
+	return func(s *emailVerificationConfig) {
+		if duration > 0 {
+			s.Duration = duration
+		}
+	}
+}
+
+func NewEmailVerificationService(db *sql.DB, opts ...emailVerificationOption) EmailVerificationService {
+	return &emailVerificationService{
+		DB:                      db,
+		emailVerificationConfig: newEmailVerificationConfig(opts),
+	}
+}
+
+// emailVerificationConfig holds the settings shared by the Postgres and
+// in-memory email verification services.
+type emailVerificationConfig struct {
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each verification token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be used.
+	BytesPerToken int
+	// Duration is the amount of time that an EmailVerification is valid for. Default DefaultVerificationDuration
+	Duration time.Duration
+}
+
+func newEmailVerificationConfig(opts []emailVerificationOption) emailVerificationConfig {
+	c := emailVerificationConfig{
+		BytesPerToken: MinBytesPerToken,
+		Duration:      DefaultVerificationDuration,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// hash is shared by both services, only the hashes of tokens are stored.
+func (c emailVerificationConfig) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+type emailVerificationService struct {
+	DB *sql.DB
+	emailVerificationConfig
+}
+
+func (ev emailVerificationService) Create(userID uint) (*EmailVerification, error) {
+	token, err := rand.String(ev.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create email verification: %w", err)
+	}
+	verification := EmailVerification{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: ev.hash(token),
+		ExpiresAt: time.Now().Add(ev.Duration),
+	}
+	row := ev.DB.QueryRow(`
+		INSERT INTO email_verification (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3) ON CONFLICT(user_id) DO
+		UPDATE SET token_hash = $2, expires_at = $3 RETURNING id;`,
+		verification.UserID, verification.TokenHash, verification.ExpiresAt)
+	if err = row.Scan(&verification.ID); err != nil {
+		return nil, fmt.Errorf("create email verification: %w", err)
+	}
+	return &verification, nil
+}
+
+func (ev emailVerificationService) Consume(token string) (*User, error) {
+	var user User
+	var verification EmailVerification
+	row := ev.DB.QueryRow(`SELECT v.id, v.expires_at, u.id, u.email, u.password_hash
+	FROM users u, email_verification v
+	WHERE u.id = v.user_id AND v.token_hash = $1;`, ev.hash(token))
+	err := row.Scan(&verification.ID, &verification.ExpiresAt, &user.ID, &user.Email, &user.PasswordHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("consume email verification: %w", err)
+	}
+	if time.Now().After(verification.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	now := time.Now()
+	if _, err = ev.DB.Exec(`UPDATE users SET email_verified_at = $2 WHERE id = $1;`, user.ID, now); err != nil {
+		return nil, fmt.Errorf("consume email verification: %w", err)
+	}
+	user.EmailVerifiedAt = &now
+	if _, err = ev.DB.Exec(`DELETE FROM email_verification WHERE id = $1;`, verification.ID); err != nil {
+		return nil, fmt.Errorf("consume email verification: %w", err)
+	}
+	return &user, nil
+}
+
+func (ev emailVerificationService) DeleteExpired(now time.Time) (int64, error) {
+	res, err := ev.DB.Exec(`DELETE FROM email_verification WHERE expires_at <= $1;`, now)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired email verifications: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// NewEmailVerificationServiceMemory keeps email verifications in db, it takes
+// the same options as NewEmailVerificationService.
+func NewEmailVerificationServiceMemory(db *MemoryDB, opts ...emailVerificationOption) EmailVerificationService {
+	return &emailVerificationServiceMemory{
+		DB:                      db,
+		emailVerificationConfig: newEmailVerificationConfig(opts),
+	}
+}
+
+type emailVerificationServiceMemory struct {
+	DB *MemoryDB
+	emailVerificationConfig
+}
+
+func (ev emailVerificationServiceMemory) Create(userID uint) (*EmailVerification, error) {
+	token, err := rand.String(ev.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create email verification: %w", err)
+	}
+	verification := EmailVerification{
+		UserID:    userID,
+		TokenHash: ev.hash(token),
+		ExpiresAt: time.Now().Add(ev.Duration),
+	}
+	ev.DB.mu.Lock()
+	defer ev.DB.mu.Unlock()
+	if _, ok := ev.DB.users[userID]; !ok {
+		return nil, fmt.Errorf("create email verification: %w", ErrNotFound)
+	}
+	// Like the ON CONFLICT(user_id) of emailVerificationService, a new token
+	// replaces the previous one.
+	for id, existing := range ev.DB.emailVerifications {
+		if existing.UserID == userID {
+			verification.ID = id
+		}
+	}
+	if verification.ID == 0 {
+		verification.ID = int(ev.DB.nextID())
+	}
+	ev.DB.emailVerifications[verification.ID] = &verification
+	created := verification
+	created.Token = token
+	return &created, nil
+}
+
+func (ev emailVerificationServiceMemory) Consume(token string) (*User, error) {
+	hash := ev.hash(token)
+	ev.DB.mu.Lock()
+	defer ev.DB.mu.Unlock()
+	for id, verification := range ev.DB.emailVerifications {
+		if verification.TokenHash != hash {
+			continue
+		}
+		user, ok := ev.DB.users[verification.UserID]
+		if !ok {
+			break
+		}
+		if time.Now().After(verification.ExpiresAt) {
+			return nil, ErrTokenExpired
+		}
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+		delete(ev.DB.emailVerifications, id)
+		found := *user
+		return &found, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (ev emailVerificationServiceMemory) DeleteExpired(now time.Time) (int64, error) {
+	ev.DB.mu.Lock()
+	defer ev.DB.mu.Unlock()
+	var n int64
+	for id, verification := range ev.DB.emailVerifications {
+		if !now.Before(verification.ExpiresAt) {
+			delete(ev.DB.emailVerifications, id)
+			n++
+		}
+	}
+	return n, nil
+}
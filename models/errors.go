@@ -0,0 +1,45 @@
+package models
+
+import (
+	"errors"
+	"github.com/jackc/pgconn"
+)
+
+// pgUniqueViolation is the postgres error code raised by unique constraints.
+const pgUniqueViolation = "23505"
+
+var (
+	// ErrNotFound is returned when a resource cannot be found in the database,
+	// including unknown or already used tokens.
+	ErrNotFound = errors.New("models: resource could not be found")
+	// ErrInvalidPassword is returned when a password doesn't match its hash.
+	ErrInvalidPassword = errors.New("models: invalid password")
+	// ErrTokenExpired is returned when a token is used past its expiration.
+	ErrTokenExpired = errors.New("models: token expired")
+	// ErrWrongBrowser is returned when a token bound to a browser is used from another one.
+	ErrWrongBrowser = errors.New("models: token was requested from another browser")
+	// ErrEmailTaken is returned when an email address already belongs to another account.
+	ErrEmailTaken = errors.New("models: email address is already taken")
+	// ErrInvalidCode is returned when a two-factor code is wrong or already used.
+	ErrInvalidCode = errors.New("models: invalid two-factor code")
+	// ErrTwoFactorEnabled is returned when enrolling a user who already has 2FA.
+	ErrTwoFactorEnabled = errors.New("models: two-factor authentication is already enabled")
+	// ErrInvalidPasskey is returned when a passkey registration or assertion
+	// can't be verified.
+	ErrInvalidPasskey = errors.New("models: invalid passkey")
+	// ErrEmailNotVerified is returned when signing up with an identity whose
+	// email address wasn't verified by its provider.
+	ErrEmailNotVerified = errors.New("models: email address is not verified")
+	// ErrIdentityTaken is returned when linking an external identity that
+	// belongs to another account.
+	ErrIdentityTaken = errors.New("models: identity is linked to another account")
+	// ErrUntrackedSchema is returned when migrating a database which has
+	// tables but no record of the migrations applied, see Migrator.Baseline.
+	ErrUntrackedSchema = errors.New("models: the database schema predates tracked migrations")
+)
+
+// isUniqueViolation reports whether err was caused by a unique constraint.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolation
+}
@@ -0,0 +1,413 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// The EXIF reader below only understands what we need from JPEG files: a
+// handful of camera tags and the location of the GPS IFD so it can be wiped.
+
+var errNoExif = errors.New("no exif data")
+
+const (
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagExposureTime       = 0x829A
+	tagFNumber            = 0x829D
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920A
+	tagLensModel          = 0xA434
+
+	jpegSOI  = 0xD8
+	jpegAPP1 = 0xE1
+	jpegSOS  = 0xDA
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// exifTypeSizes holds the size in bytes of each TIFF field type.
+var exifTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+type exifEntry struct {
+	// offset of the 12 bytes entry inside the tiff block
+	offset uint32
+	tag    uint16
+	typ    uint16
+	count  uint32
+	// value is the offset of the value inside the tiff block
+	value uint32
+	size  uint32
+}
+
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTiffReader(data []byte) (*tiffReader, error) {
+	if len(data) < 8 {
+		return nil, errNoExif
+	}
+	t := tiffReader{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid tiff byte order")
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, fmt.Errorf("invalid tiff header")
+	}
+	return &t, nil
+}
+
+func (t tiffReader) firstIFD() uint32 {
+	return t.order.Uint32(t.data[4:])
+}
+
+// entries returns the entries of the IFD starting at offset.
+func (t tiffReader) entries(offset uint32) ([]exifEntry, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, fmt.Errorf("ifd offset out of range")
+	}
+	n := uint32(t.order.Uint16(t.data[offset:]))
+	if uint64(offset)+2+uint64(n)*12 > uint64(len(t.data)) {
+		return nil, fmt.Errorf("ifd entries out of range")
+	}
+	entries := make([]exifEntry, 0, n)
+	for i := uint32(0); i < n; i++ {
+		at := offset + 2 + i*12
+		e := exifEntry{
+			offset: at,
+			tag:    t.order.Uint16(t.data[at:]),
+			typ:    t.order.Uint16(t.data[at+2:]),
+			count:  t.order.Uint32(t.data[at+4:]),
+		}
+		size, ok := exifTypeSizes[e.typ]
+		if !ok || uint64(size)*uint64(e.count) > uint64(len(t.data)) {
+			continue
+		}
+		e.size = size * e.count
+		if e.size <= 4 {
+			e.value = at + 8
+		} else {
+			e.value = t.order.Uint32(t.data[at+8:])
+		}
+		if uint64(e.value)+uint64(e.size) > uint64(len(t.data)) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (t tiffReader) ascii(e exifEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	s := string(t.data[e.value : e.value+e.size])
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func (t tiffReader) rational(e exifEntry) (num, den uint32, ok bool) {
+	if e.typ != 5 || e.count < 1 {
+		return 0, 0, false
+	}
+	num = t.order.Uint32(t.data[e.value:])
+	den = t.order.Uint32(t.data[e.value+4:])
+	return num, den, den != 0
+}
+
+func (t tiffReader) uint(e exifEntry) (uint32, bool) {
+	if e.count < 1 {
+		return 0, false
+	}
+	switch e.typ {
+	case 3:
+		return uint32(t.order.Uint16(t.data[e.value:])), true
+	case 4:
+		return t.order.Uint32(t.data[e.value:]), true
+	}
+	return 0, false
+}
+
+// jpegSegment is a marker segment found before the image data.
+type jpegSegment struct {
+	marker byte
+	// start and end delimit the whole segment, marker included.
+	start, end int
+	// payload excludes the marker and length bytes.
+	payload []byte
+}
+
+// jpegSegments lists the marker segments of a jpeg up to the start of scan.
+func jpegSegments(data []byte) ([]jpegSegment, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+	var segments []jpegSegment
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return nil, fmt.Errorf("invalid jpeg marker at %d", pos)
+		}
+		marker := data[pos+1]
+		if marker == 0xFF {
+			// fill byte
+			pos++
+			continue
+		}
+		if marker == jpegSOS {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, fmt.Errorf("invalid jpeg segment length at %d", pos)
+		}
+		segments = append(segments, jpegSegment{
+			marker:  marker,
+			start:   pos,
+			end:     end,
+			payload: data[pos+4 : end],
+		})
+		pos = end
+	}
+	return segments, nil
+}
+
+// jpegExif returns the tiff block of the EXIF segment of a jpeg.
+func jpegExif(data []byte) ([]byte, error) {
+	segments, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		if seg.marker == jpegAPP1 && bytes.HasPrefix(seg.payload, exifHeader) {
+			return seg.payload[len(exifHeader):], nil
+		}
+	}
+	return nil, errNoExif
+}
+
+// parseExif reads the camera details from the EXIF data of a jpeg. It
+// returns errNoExif when the file carries no EXIF segment.
+func parseExif(data []byte) (*ImageMetadata, error) {
+	block, err := jpegExif(data)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTiffReader(block)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, err := t.entries(t.firstIFD())
+	if err != nil {
+		return nil, err
+	}
+	var md ImageMetadata
+	var exifEntries []exifEntry
+	for _, e := range ifd0 {
+		switch e.tag {
+		case tagMake:
+			md.CameraMake = t.ascii(e)
+		case tagModel:
+			md.CameraModel = t.ascii(e)
+		case tagExifIFD:
+			if offset, ok := t.uint(e); ok {
+				// A broken sub IFD shouldn't discard what we already have.
+				exifEntries, _ = t.entries(offset)
+			}
+		case tagGPSIFD:
+			md.HasLocation = true
+		}
+	}
+	var dateTime, offsetTime string
+	for _, e := range exifEntries {
+		switch e.tag {
+		case tagExposureTime:
+			if num, den, ok := t.rational(e); ok {
+				md.ExposureTime = formatExposure(num, den)
+			}
+		case tagFNumber:
+			if num, den, ok := t.rational(e); ok {
+				md.FNumber = roundTenth(float64(num) / float64(den))
+			}
+		case tagISO:
+			if iso, ok := t.uint(e); ok {
+				md.ISO = int(iso)
+			}
+		case tagFocalLength:
+			if num, den, ok := t.rational(e); ok {
+				md.FocalLength = roundTenth(float64(num) / float64(den))
+			}
+		case tagLensModel:
+			md.LensModel = t.ascii(e)
+		case tagDateTimeOriginal:
+			dateTime = t.ascii(e)
+		case tagOffsetTimeOriginal:
+			offsetTime = t.ascii(e)
+		}
+	}
+	if dateTime != "" {
+		md.TakenAt = parseExifTime(dateTime, offsetTime)
+	}
+	return &md, nil
+}
+
+// parseExifTime parses DateTimeOriginal, the time is taken as UTC when the
+// camera didn't record its offset.
+func parseExifTime(dateTime, offset string) *time.Time {
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", dateTime+offset); err == nil {
+			return &t
+		}
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", dateTime)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+func formatExposure(num, den uint32) string {
+	if num == 0 {
+		return ""
+	}
+	if num >= den {
+		return fmt.Sprintf("%gs", roundTenth(float64(num)/float64(den)))
+	}
+	return fmt.Sprintf("1/%ds", int(math.Round(float64(den)/float64(num))))
+}
+
+func roundTenth(f float64) float64 {
+	return math.Round(f*10) / 10
+}
+
+// stripJPEGLocation returns a copy of a jpeg without location data: the GPS
+// IFD of the EXIF segment is wiped and unlinked, and XMP segments, which may
+// repeat the coordinates, are dropped altogether.
+func stripJPEGLocation(data []byte) ([]byte, error) {
+	segments, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	pos := 2
+	for _, seg := range segments {
+		out = append(out, data[pos:seg.start]...)
+		pos = seg.end
+		if seg.marker != jpegAPP1 {
+			out = append(out, data[seg.start:seg.end]...)
+			continue
+		}
+		switch {
+		case bytes.HasPrefix(seg.payload, xmpHeader):
+			continue
+		case bytes.HasPrefix(seg.payload, exifHeader):
+			stripped := append([]byte(nil), data[seg.start:seg.end]...)
+			block := stripped[4+len(exifHeader):]
+			if err = stripGPS(block); err != nil {
+				return nil, fmt.Errorf("strip gps: %w", err)
+			}
+			out = append(out, stripped...)
+		default:
+			out = append(out, data[seg.start:seg.end]...)
+		}
+	}
+	out = append(out, data[pos:]...)
+	return out, nil
+}
+
+// stripGPS modifies the tiff block in place, zeroing the GPS IFD and removing
+// its pointer from IFD0. A GPS IFD it can't locate or that overlaps IFD0 is an
+// error, rather than a location left in the file.
+func stripGPS(block []byte) error {
+	t, err := newTiffReader(block)
+	if err != nil {
+		return err
+	}
+	ifd0 := t.firstIFD()
+	entries, err := t.entries(ifd0)
+	if err != nil {
+		return err
+	}
+	n := uint32(t.order.Uint16(block[ifd0:]))
+	tableEnd := ifd0 + 2 + n*12 + 4
+	if uint64(tableEnd) > uint64(len(block)) {
+		return fmt.Errorf("ifd0 out of range")
+	}
+	for i := uint32(0); i < n; i++ {
+		at := ifd0 + 2 + i*12
+		if t.order.Uint16(block[at:]) != tagGPSIFD {
+			continue
+		}
+		var offset uint32
+		ok := false
+		for _, e := range entries {
+			if e.offset == at {
+				offset, ok = t.uint(e)
+			}
+		}
+		if !ok {
+			return fmt.Errorf("invalid gps ifd pointer")
+		}
+		gps, err := t.entries(offset)
+		if err != nil {
+			return fmt.Errorf("gps ifd: %w", err)
+		}
+		// entries checked the table fits, the next IFD pointer may not.
+		gpsEnd := offset + 2 + uint32(t.order.Uint16(block[offset:]))*12
+		if uint64(gpsEnd)+4 <= uint64(len(block)) {
+			gpsEnd += 4
+		}
+		if overlaps(offset, gpsEnd, ifd0, tableEnd) {
+			return fmt.Errorf("gps ifd overlaps ifd0")
+		}
+		for _, g := range gps {
+			if overlaps(g.value, g.value+g.size, ifd0, tableEnd) {
+				return fmt.Errorf("gps value overlaps ifd0")
+			}
+		}
+		for _, g := range gps {
+			zero(block[g.value : g.value+g.size])
+		}
+		zero(block[offset:gpsEnd])
+		// Shift the following entries and the next IFD pointer one slot up.
+		copy(block[at:], block[at+12:tableEnd])
+		zero(block[tableEnd-12 : tableEnd])
+		t.order.PutUint16(block[ifd0:], uint16(n-1))
+		// Look for another pointer, a crafted file could hold several.
+		return stripGPS(block)
+	}
+	return nil
+}
+
+// overlaps tells whether [start, end) and [otherStart, otherEnd) overlap.
+func overlaps(start, end, otherStart, otherEnd uint32) bool {
+	return start < otherEnd && otherStart < end
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,391 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+// exifFixture is a tiff block holding IFD0 with the camera make, an Exif IFD
+// with the ISO and f-number, and optionally a GPS IFD with a latitude.
+type exifFixture struct {
+	order binary.ByteOrder
+	block []byte
+	ifd0  uint32
+	// gpsEntry is the offset of the GPS pointer entry in IFD0.
+	gpsEntry uint32
+	gpsIFD   uint32
+	// latitude is the offset of the GPS latitude rationals.
+	latitude uint32
+}
+
+// testLatitude is recognizable in the output, it must not survive stripping.
+var testLatitude = []uint32{48, 1, 51, 1, 2911, 100}
+
+func newExifFixture(order binary.ByteOrder, gps bool) *exifFixture {
+	f := exifFixture{order: order, ifd0: 8}
+	n := uint32(2)
+	if gps {
+		n = 3
+	}
+	exifIFD := f.ifd0 + 2 + n*12 + 4
+	data := exifIFD + 2 + 2*12 + 4
+	if gps {
+		f.gpsIFD = data
+		data += 2 + 2*12 + 4
+	}
+	makeAt, fNumberAt := data, data+6
+	f.latitude = fNumberAt + 8
+	size := f.latitude
+	if gps {
+		size += 24
+	}
+	b := make([]byte, size)
+	f.block = b
+	if order == binary.LittleEndian {
+		copy(b, "II")
+	} else {
+		copy(b, "MM")
+	}
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], f.ifd0)
+
+	order.PutUint16(b[f.ifd0:], uint16(n))
+	f.entry(f.ifd0+2, tagMake, 2, 6, makeAt)
+	f.entry(f.ifd0+14, tagExifIFD, 4, 1, exifIFD)
+	if gps {
+		f.gpsEntry = f.ifd0 + 26
+		f.entry(f.gpsEntry, tagGPSIFD, 4, 1, f.gpsIFD)
+	}
+	copy(b[makeAt:], "Canon\x00")
+
+	order.PutUint16(b[exifIFD:], 2)
+	f.entry(exifIFD+2, tagISO, 3, 1, 0)
+	order.PutUint16(b[exifIFD+2+8:], 400)
+	f.entry(exifIFD+14, tagFNumber, 5, 1, fNumberAt)
+	order.PutUint32(b[fNumberAt:], 28)
+	order.PutUint32(b[fNumberAt+4:], 10)
+
+	if gps {
+		order.PutUint16(b[f.gpsIFD:], 2)
+		// GPSLatitudeRef "N", inline.
+		f.entry(f.gpsIFD+2, 0x0001, 2, 2, 0)
+		copy(b[f.gpsIFD+2+8:], "N\x00")
+		// GPSLatitude, three rationals.
+		f.entry(f.gpsIFD+14, 0x0002, 5, 3, f.latitude)
+		for i, v := range testLatitude {
+			order.PutUint32(b[f.latitude+uint32(i)*4:], v)
+		}
+	}
+	return &f
+}
+
+func (f *exifFixture) entry(at uint32, tag, typ uint16, count, value uint32) {
+	f.order.PutUint16(f.block[at:], tag)
+	f.order.PutUint16(f.block[at+2:], typ)
+	f.order.PutUint32(f.block[at+4:], count)
+	f.order.PutUint32(f.block[at+8:], value)
+}
+
+func (f *exifFixture) latitudeBytes() []byte {
+	b := make([]byte, 24)
+	for i, v := range testLatitude {
+		f.order.PutUint32(b[i*4:], v)
+	}
+	return b
+}
+
+// testJPEG encodes a small image, it carries no APP1 segment.
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withAPP1 inserts an APP1 segment holding payload right after the SOI
+// marker of a jpeg.
+func withAPP1(data, payload []byte) []byte {
+	segment := []byte{0xFF, jpegAPP1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+	out := append([]byte(nil), data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func withExif(data, block []byte) []byte {
+	return withAPP1(data, append(append([]byte(nil), exifHeader...), block...))
+}
+
+// finishes fails the test when fn doesn't return in time, e.g. because it
+// follows a loop of IFDs.
+func finishes(t *testing.T, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("didn't finish, it may be looping")
+	}
+}
+
+var byteOrders = []struct {
+	name  string
+	order binary.ByteOrder
+}{
+	{"II", binary.LittleEndian},
+	{"MM", binary.BigEndian},
+}
+
+func TestParseExif(t *testing.T) {
+	for _, bo := range byteOrders {
+		for _, gps := range []bool{false, true} {
+			f := newExifFixture(bo.order, gps)
+			md, err := parseExif(withExif(testJPEG(t), f.block))
+			if err != nil {
+				t.Fatalf("%s gps=%v: parseExif: %v", bo.name, gps, err)
+			}
+			if md.CameraMake != "Canon" || md.ISO != 400 || md.FNumber != 2.8 || md.HasLocation != gps {
+				t.Errorf("%s gps=%v: parseExif = %+v", bo.name, gps, md)
+			}
+		}
+	}
+}
+
+func TestParseExifNoAPP1(t *testing.T) {
+	if _, err := parseExif(testJPEG(t)); !errors.Is(err, errNoExif) {
+		t.Errorf("parseExif without APP1: err = %v, want errNoExif", err)
+	}
+}
+
+func TestStripJPEGLocation(t *testing.T) {
+	for _, bo := range byteOrders {
+		f := newExifFixture(bo.order, true)
+		original := testJPEG(t)
+		data := withExif(original, f.block)
+		input := append([]byte(nil), data...)
+		out, err := stripJPEGLocation(data)
+		if err != nil {
+			t.Fatalf("%s: stripJPEGLocation: %v", bo.name, err)
+		}
+		if !bytes.Equal(data, input) {
+			t.Errorf("%s: stripJPEGLocation modified its input", bo.name)
+		}
+		if bytes.Contains(out, f.latitudeBytes()) {
+			t.Errorf("%s: the latitude is still in the output", bo.name)
+		}
+		// The segment keeps its size, everything around the tiff block is
+		// the same.
+		start := 4 + len(exifHeader) + 2
+		end := start + len(f.block)
+		if len(out) != len(data) || !bytes.Equal(out[:start], data[:start]) || !bytes.Equal(out[end:], data[end:]) {
+			t.Fatalf("%s: stripJPEGLocation changed bytes outside the EXIF data", bo.name)
+		}
+		// Within the block, only IFD0 and the GPS IFD change.
+		block := out[start:end]
+		for i := range block {
+			inIFD0 := uint32(i) >= f.ifd0 && uint32(i) < f.ifd0+2+3*12+4
+			inGPS := uint32(i) >= f.gpsIFD && uint32(i) < f.gpsIFD+2+2*12+4 ||
+				uint32(i) >= f.latitude && uint32(i) < f.latitude+24
+			if inGPS && block[i] != 0 {
+				t.Fatalf("%s: GPS byte %d = %#x, want 0", bo.name, i, block[i])
+			}
+			if !inIFD0 && !inGPS && block[i] != f.block[i] {
+				t.Fatalf("%s: byte %d of the EXIF data changed", bo.name, i)
+			}
+		}
+		md, err := parseExif(out)
+		if err != nil {
+			t.Fatalf("%s: parseExif after stripping: %v", bo.name, err)
+		}
+		if md.HasLocation || md.CameraMake != "Canon" || md.ISO != 400 || md.FNumber != 2.8 {
+			t.Errorf("%s: parseExif after stripping = %+v", bo.name, md)
+		}
+	}
+}
+
+func TestStripJPEGLocationUnchanged(t *testing.T) {
+	tests := map[string][]byte{
+		"no APP1": testJPEG(t),
+		"no GPS":  withExif(testJPEG(t), newExifFixture(binary.BigEndian, false).block),
+	}
+	for name, data := range tests {
+		out, err := stripJPEGLocation(data)
+		if err != nil {
+			t.Fatalf("%s: stripJPEGLocation: %v", name, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s: stripJPEGLocation changed the file", name)
+		}
+	}
+}
+
+func TestStripJPEGLocationXMP(t *testing.T) {
+	original := testJPEG(t)
+	xmp := append(append([]byte(nil), xmpHeader...), `<exif:GPSLatitude>48,51.2911N</exif:GPSLatitude>`...)
+	out, err := stripJPEGLocation(withAPP1(original, xmp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, original) {
+		t.Errorf("the XMP segment wasn't dropped")
+	}
+}
+
+func TestStripJPEGLocationMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(f *exifFixture)
+		// jpeg builds the file from the fixture, withExif when nil.
+		jpeg func(t *testing.T, f *exifFixture) []byte
+	}{
+		{
+			name: "first IFD out of range",
+			mutate: func(f *exifFixture) {
+				f.order.PutUint32(f.block[4:], uint32(len(f.block)))
+			},
+		},
+		{
+			name: "first IFD far out of range",
+			mutate: func(f *exifFixture) {
+				f.order.PutUint32(f.block[4:], 0xFFFFFFFF)
+			},
+		},
+		{
+			name: "IFD0 entries truncated",
+			mutate: func(f *exifFixture) {
+				f.order.PutUint16(f.block[f.ifd0:], 0xFFFF)
+			},
+		},
+		{
+			name: "block truncated",
+			mutate: func(f *exifFixture) {
+				f.block = f.block[:f.ifd0+10]
+			},
+		},
+		{
+			name: "GPS IFD out of range",
+			mutate: func(f *exifFixture) {
+				f.order.PutUint32(f.block[f.gpsEntry+8:], 0xFFFFFFF0)
+			},
+		},
+		{
+			name: "GPS IFD entries truncated",
+			mutate: func(f *exifFixture) {
+				f.order.PutUint16(f.block[f.gpsIFD:], 0x0FFF)
+			},
+		},
+		{
+			name: "GPS pointer of the wrong type",
+			mutate: func(f *exifFixture) {
+				f.order.PutUint16(f.block[f.gpsEntry+2:], 0xFF)
+			},
+		},
+		{
+			name: "GPS IFD pointing back at IFD0",
+			mutate: func(f *exifFixture) {
+				f.order.PutUint32(f.block[f.gpsEntry+8:], f.ifd0)
+			},
+		},
+		{
+			name: "GPS IFD inside IFD0",
+			mutate: func(f *exifFixture) {
+				f.order.PutUint32(f.block[f.gpsEntry+8:], f.ifd0+14)
+			},
+		},
+		{
+			name: "GPS value inside IFD0",
+			mutate: func(f *exifFixture) {
+				f.order.PutUint32(f.block[f.gpsIFD+14+8:], f.ifd0)
+			},
+		},
+		{
+			name: "invalid byte order",
+			mutate: func(f *exifFixture) {
+				copy(f.block, "XX")
+			},
+		},
+		{
+			name: "APP1 longer than the file",
+			jpeg: func(t *testing.T, f *exifFixture) []byte {
+				data := withExif(testJPEG(t), f.block)
+				binary.BigEndian.PutUint16(data[4:], 0xFFFF)
+				return data[:len(f.block)]
+			},
+		},
+	}
+	for _, bo := range byteOrders {
+		for _, tt := range tests {
+			f := newExifFixture(bo.order, true)
+			if tt.mutate != nil {
+				tt.mutate(f)
+			}
+			var data []byte
+			if tt.jpeg != nil {
+				data = tt.jpeg(t, f)
+			} else {
+				data = withExif(testJPEG(t), f.block)
+			}
+			var err error
+			finishes(t, func() {
+				// parseExif may fail or not, it must just return.
+				parseExif(data)
+				_, err = stripJPEGLocation(data)
+			})
+			if err == nil {
+				t.Errorf("%s %s: stripJPEGLocation succeeded, want an error", bo.name, tt.name)
+			}
+		}
+	}
+}
+
+func TestStripJPEGLocationExifLoop(t *testing.T) {
+	// The Exif IFD points back at IFD0, which holds the pointer to it.
+	for _, bo := range byteOrders {
+		f := newExifFixture(bo.order, true)
+		f.order.PutUint32(f.block[f.ifd0+14+8:], f.ifd0)
+		data := withExif(testJPEG(t), f.block)
+		var out []byte
+		var err error
+		finishes(t, func() {
+			parseExif(data)
+			out, err = stripJPEGLocation(data)
+		})
+		if err != nil {
+			t.Fatalf("%s: stripJPEGLocation: %v", bo.name, err)
+		}
+		if bytes.Contains(out, f.latitudeBytes()) {
+			t.Errorf("%s: the latitude is still in the output", bo.name)
+		}
+	}
+}
+
+func TestStripJPEGLocationTwoGPSPointers(t *testing.T) {
+	for _, bo := range byteOrders {
+		f := newExifFixture(bo.order, true)
+		// Replace the Make entry by a second pointer to the GPS IFD.
+		f.entry(f.ifd0+2, tagGPSIFD, 4, 1, f.gpsIFD)
+		out, err := stripJPEGLocation(withExif(testJPEG(t), f.block))
+		if err != nil {
+			t.Fatalf("%s: stripJPEGLocation: %v", bo.name, err)
+		}
+		md, err := parseExif(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if md.HasLocation || bytes.Contains(out, f.latitudeBytes()) {
+			t.Errorf("%s: a GPS pointer survived stripping", bo.name)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package models
+
+// Exported for the tests of package models_test, which need valid codes.
+var (
+	TOTPCode     = totpCode
+	MatchTOTP    = matchTOTP
+	TOTPEncoding = totpEncoding
+)
+
+// AccountDeletionOption lets tests build the Postgres and in-memory account
+// deletion services the same way.
+type AccountDeletionOption = accountDeletionOption
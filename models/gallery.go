@@ -0,0 +1,456 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/rand"
+	"golang.org/x/crypto/bcrypt"
+	"sort"
+	"time"
+)
+
+type Visibility string
+
+const (
+	// VisibilityPrivate galleries can only be seen by their owner.
+	VisibilityPrivate Visibility = "private"
+	// VisibilityUnlisted galleries can be seen by anyone holding their share link.
+	VisibilityUnlisted Visibility = "unlisted"
+	// VisibilityPublic galleries can be seen by anyone.
+	VisibilityPublic Visibility = "public"
+)
+
+func (v Visibility) Valid() bool {
+	switch v {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
+}
+
+type Gallery struct {
+	ID         uint
+	UserID     uint
+	Title      string
+	Visibility Visibility
+	// ShareTokenHash is empty when the gallery has no share link. The token
+	// itself is only known when calling GalleryService.RegenerateShareToken
+	ShareTokenHash string
+	// PasswordHash is empty unless visitors must enter a password to see the gallery.
+	PasswordHash string
+	// KeepLocation opts the gallery out of stripping GPS data from uploaded photos.
+	KeepLocation bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+type GalleryService interface {
+	Create(title string, userID uint) (*Gallery, error)
+	ByID(id uint) (*Gallery, error)
+	ByUserID(userID uint) ([]Gallery, error)
+	// ByShareToken returns the gallery a share link points to, private
+	// galleries are never returned.
+	ByShareToken(token string) (*Gallery, error)
+	Update(gallery *Gallery) error
+	// RegenerateShareToken creates a new share link for the gallery,
+	// invalidating the previous one.
+	RegenerateShareToken(id uint) (string, error)
+	RevokeShareToken(id uint) error
+	// SetPassword protects the gallery with password. It returns a
+	// *ValidationError when password breaks the password policy.
+	SetPassword(id uint, password string) error
+	// RemovePassword lets anyone allowed to see the gallery in again.
+	RemovePassword(id uint) error
+	// CheckPassword returns ErrInvalidPassword unless password unlocks gallery.
+	CheckPassword(gallery *Gallery, password string) error
+	Delete(id uint) error
+}
+
+type galleryOption func(*galleryConfig)
+
+// WithGalleryClock overrides the function used to obtain the current time,
+// used to stamp CreatedAt and UpdatedAt.
+func WithGalleryClock(now func() time.Time) galleryOption {
+	return func(s *galleryConfig) {
+		if now != nil {
+			s.now = now
+		}
+	}
+}
+
+func WithBytesPerShareToken(bytesPerToken int) galleryOption {
+	return func(s *galleryConfig) {
+		if bytesPerToken > s.BytesPerToken {
+			s.BytesPerToken = bytesPerToken
+		}
+	}
+}
+
+// WithGalleryPasswordPolicy replaces the default policy of gallery
+// passwords, NewPasswordPolicy().
+func WithGalleryPasswordPolicy(policy PasswordPolicy) galleryOption {
+	return func(s *galleryConfig) {
+		if policy != nil {
+			s.PasswordPolicy = policy
+		}
+	}
+}
+
+func NewGalleryServicePostgres(db *sql.DB, opts ...galleryOption) GalleryService {
+	return &galleryServicePostgres{
+		DB:            db,
+		galleryConfig: newGalleryConfig(opts),
+	}
+}
+
+// galleryConfig holds the settings shared by the Postgres and in-memory
+// gallery services.
+type galleryConfig struct {
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each share token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be used.
+	BytesPerToken  int
+	PasswordPolicy PasswordPolicy
+	now            func() time.Time
+}
+
+func newGalleryConfig(opts []galleryOption) galleryConfig {
+	c := galleryConfig{
+		BytesPerToken:  MinBytesPerToken,
+		PasswordPolicy: NewPasswordPolicy(),
+		now:            time.Now,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// hashPassword validates and hashes a new gallery password.
+func (c galleryConfig) hashPassword(password string) (string, error) {
+	if err := c.PasswordPolicy.Validate("", password); err != nil {
+		return "", err
+	}
+	return generateFromPassword(password)
+}
+
+// CheckPassword doesn't need the storage, both services share it.
+func (c galleryConfig) CheckPassword(gallery *Gallery, password string) error {
+	if gallery.PasswordHash == "" {
+		return nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(gallery.PasswordHash), []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrInvalidPassword
+		}
+		return fmt.Errorf("check gallery password: %w", err)
+	}
+	return nil
+}
+
+// hash is shared by both services, only the hashes of share tokens are stored.
+func (c galleryConfig) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+type galleryServicePostgres struct {
+	DB *sql.DB
+	galleryConfig
+}
+
+const galleryColumns = `id, user_id, title, visibility, COALESCE(share_token_hash, ''),
+	COALESCE(password_hash, ''), keep_location, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanGallery(row rowScanner) (*Gallery, error) {
+	var gallery Gallery
+	err := row.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &gallery.Visibility, &gallery.ShareTokenHash,
+		&gallery.PasswordHash, &gallery.KeepLocation, &gallery.CreatedAt, &gallery.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &gallery, nil
+}
+
+func (gs galleryServicePostgres) Create(title string, userID uint) (*Gallery, error) {
+	now := gs.now()
+	gallery := Gallery{
+		UserID:     userID,
+		Title:      title,
+		Visibility: VisibilityPrivate,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	row := gs.DB.QueryRow(`
+		INSERT INTO galleries (user_id, title, visibility, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id;`,
+		gallery.UserID, gallery.Title, gallery.Visibility, gallery.CreatedAt, gallery.UpdatedAt)
+	if err := row.Scan(&gallery.ID); err != nil {
+		return nil, fmt.Errorf("create gallery: %w", err)
+	}
+	return &gallery, nil
+}
+
+func (gs galleryServicePostgres) ByID(id uint) (*Gallery, error) {
+	row := gs.DB.QueryRow(`SELECT `+galleryColumns+` FROM galleries WHERE id = $1;`, id)
+	gallery, err := scanGallery(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("gallery by id: %w", err)
+	}
+	return gallery, nil
+}
+
+func (gs galleryServicePostgres) ByUserID(userID uint) ([]Gallery, error) {
+	rows, err := gs.DB.Query(`SELECT `+galleryColumns+` FROM galleries
+		WHERE user_id = $1 ORDER BY id;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("galleries by user: %w", err)
+	}
+	defer rows.Close()
+	var galleries []Gallery
+	for rows.Next() {
+		gallery, err := scanGallery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("galleries by user: %w", err)
+		}
+		galleries = append(galleries, *gallery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("galleries by user: %w", err)
+	}
+	return galleries, nil
+}
+
+func (gs galleryServicePostgres) ByShareToken(token string) (*Gallery, error) {
+	row := gs.DB.QueryRow(`SELECT `+galleryColumns+` FROM galleries
+		WHERE share_token_hash = $1 AND visibility <> $2;`, gs.hash(token), VisibilityPrivate)
+	gallery, err := scanGallery(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("gallery by share token: %w", err)
+	}
+	return gallery, nil
+}
+
+func (gs galleryServicePostgres) Update(gallery *Gallery) error {
+	if !gallery.Visibility.Valid() {
+		return fmt.Errorf("update gallery: invalid visibility %q", gallery.Visibility)
+	}
+	gallery.UpdatedAt = gs.now()
+	_, err := gs.DB.Exec(`
+		UPDATE galleries SET title = $2, visibility = $3, keep_location = $4, updated_at = $5
+		WHERE id = $1;`, gallery.ID, gallery.Title, gallery.Visibility, gallery.KeepLocation, gallery.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("update gallery: %w", err)
+	}
+	return nil
+}
+
+func (gs galleryServicePostgres) RegenerateShareToken(id uint) (string, error) {
+	token, err := rand.String(gs.BytesPerToken)
+	if err != nil {
+		return "", fmt.Errorf("regenerate share token: %w", err)
+	}
+	res, err := gs.DB.Exec(`
+		UPDATE galleries SET share_token_hash = $2 WHERE id = $1;`, id, gs.hash(token))
+	if err != nil {
+		return "", fmt.Errorf("regenerate share token: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return "", ErrNotFound
+	}
+	return token, nil
+}
+
+func (gs galleryServicePostgres) RevokeShareToken(id uint) error {
+	_, err := gs.DB.Exec(`UPDATE galleries SET share_token_hash = NULL WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("revoke share token: %w", err)
+	}
+	return nil
+}
+
+func (gs galleryServicePostgres) SetPassword(id uint, password string) error {
+	hash, err := gs.hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("set gallery password: %w", err)
+	}
+	_, err = gs.DB.Exec(`UPDATE galleries SET password_hash = $2 WHERE id = $1;`, id, hash)
+	if err != nil {
+		return fmt.Errorf("set gallery password: %w", err)
+	}
+	return nil
+}
+
+func (gs galleryServicePostgres) RemovePassword(id uint) error {
+	_, err := gs.DB.Exec(`UPDATE galleries SET password_hash = NULL WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("remove gallery password: %w", err)
+	}
+	return nil
+}
+
+func (gs galleryServicePostgres) Delete(id uint) error {
+	_, err := gs.DB.Exec(`DELETE FROM galleries WHERE id = $1;`, id)
+	if err != nil {
+		return fmt.Errorf("delete gallery: %w", err)
+	}
+	return nil
+}
+
+// NewGalleryServiceMemory keeps galleries in db, it takes the same options
+// as NewGalleryServicePostgres.
+func NewGalleryServiceMemory(db *MemoryDB, opts ...galleryOption) GalleryService {
+	return &galleryServiceMemory{
+		DB:            db,
+		galleryConfig: newGalleryConfig(opts),
+	}
+}
+
+type galleryServiceMemory struct {
+	DB *MemoryDB
+	galleryConfig
+}
+
+func (gs galleryServiceMemory) Create(title string, userID uint) (*Gallery, error) {
+	now := gs.now()
+	gallery := Gallery{
+		UserID:     userID,
+		Title:      title,
+		Visibility: VisibilityPrivate,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	gs.DB.mu.Lock()
+	defer gs.DB.mu.Unlock()
+	if _, ok := gs.DB.users[userID]; !ok {
+		return nil, fmt.Errorf("create gallery: %w", ErrNotFound)
+	}
+	gallery.ID = gs.DB.nextID()
+	stored := gallery
+	gs.DB.galleries[gallery.ID] = &stored
+	return &gallery, nil
+}
+
+func (gs galleryServiceMemory) ByID(id uint) (*Gallery, error) {
+	gs.DB.mu.Lock()
+	defer gs.DB.mu.Unlock()
+	stored, ok := gs.DB.galleries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	gallery := *stored
+	return &gallery, nil
+}
+
+func (gs galleryServiceMemory) ByUserID(userID uint) ([]Gallery, error) {
+	gs.DB.mu.Lock()
+	defer gs.DB.mu.Unlock()
+	var galleries []Gallery
+	for _, gallery := range gs.DB.galleries {
+		if gallery.UserID == userID {
+			galleries = append(galleries, *gallery)
+		}
+	}
+	sort.Slice(galleries, func(i, j int) bool {
+		return galleries[i].ID < galleries[j].ID
+	})
+	return galleries, nil
+}
+
+func (gs galleryServiceMemory) ByShareToken(token string) (*Gallery, error) {
+	hash := gs.hash(token)
+	gs.DB.mu.Lock()
+	defer gs.DB.mu.Unlock()
+	for _, stored := range gs.DB.galleries {
+		if stored.ShareTokenHash == hash && stored.Visibility != VisibilityPrivate {
+			gallery := *stored
+			return &gallery, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (gs galleryServiceMemory) Update(gallery *Gallery) error {
+	if !gallery.Visibility.Valid() {
+		return fmt.Errorf("update gallery: invalid visibility %q", gallery.Visibility)
+	}
+	gallery.UpdatedAt = gs.now()
+	gs.DB.mu.Lock()
+	defer gs.DB.mu.Unlock()
+	// Like the UPDATE of galleryServicePostgres, a missing gallery is not an
+	// error.
+	if stored, ok := gs.DB.galleries[gallery.ID]; ok {
+		stored.Title = gallery.Title
+		stored.Visibility = gallery.Visibility
+		stored.KeepLocation = gallery.KeepLocation
+		stored.UpdatedAt = gallery.UpdatedAt
+	}
+	return nil
+}
+
+func (gs galleryServiceMemory) RegenerateShareToken(id uint) (string, error) {
+	token, err := rand.String(gs.BytesPerToken)
+	if err != nil {
+		return "", fmt.Errorf("regenerate share token: %w", err)
+	}
+	gs.DB.mu.Lock()
+	defer gs.DB.mu.Unlock()
+	stored, ok := gs.DB.galleries[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+	stored.ShareTokenHash = gs.hash(token)
+	return token, nil
+}
+
+func (gs galleryServiceMemory) RevokeShareToken(id uint) error {
+	gs.DB.mu.Lock()
+	defer gs.DB.mu.Unlock()
+	if stored, ok := gs.DB.galleries[id]; ok {
+		stored.ShareTokenHash = ""
+	}
+	return nil
+}
+
+func (gs galleryServiceMemory) SetPassword(id uint, password string) error {
+	hash, err := gs.hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("set gallery password: %w", err)
+	}
+	gs.DB.mu.Lock()
+	defer gs.DB.mu.Unlock()
+	if stored, ok := gs.DB.galleries[id]; ok {
+		stored.PasswordHash = hash
+	}
+	return nil
+}
+
+func (gs galleryServiceMemory) RemovePassword(id uint) error {
+	gs.DB.mu.Lock()
+	defer gs.DB.mu.Unlock()
+	if stored, ok := gs.DB.galleries[id]; ok {
+		stored.PasswordHash = ""
+	}
+	return nil
+}
+
+func (gs galleryServiceMemory) Delete(id uint) error {
+	gs.DB.mu.Lock()
+	defer gs.DB.mu.Unlock()
+	delete(gs.DB.galleries, id)
+	return nil
+}
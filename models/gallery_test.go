@@ -0,0 +1,59 @@
+package models_test
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGalleryServicePostgresPassword(t *testing.T) {
+	db := openTestDB(t)
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+	user, err := models.NewUserServicePostgres(db).Create("gallery-"+token+"@example.com", "pw-"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	galleries := models.NewGalleryServicePostgres(db)
+	gallery, err := galleries.Create("Holidays", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{"", "short", strings.Repeat("x", models.MaxPasswordBytes+1)} {
+		var verr *models.ValidationError
+		if err = galleries.SetPassword(gallery.ID, password); !errors.As(err, &verr) {
+			t.Errorf("SetPassword(%q): err = %v, want a *ValidationError", password, err)
+		}
+	}
+	if gallery, err = galleries.ByID(gallery.ID); err != nil {
+		t.Fatal(err)
+	}
+	if gallery.PasswordHash != "" {
+		t.Fatalf("an invalid password was saved")
+	}
+
+	if err = galleries.SetPassword(gallery.ID, "open sesame"); err != nil {
+		t.Fatal(err)
+	}
+	if gallery, err = galleries.ByID(gallery.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = galleries.CheckPassword(gallery, "open sesame"); err != nil {
+		t.Errorf("CheckPassword with the right password: %v", err)
+	}
+	if err = galleries.CheckPassword(gallery, "open sesame!"); !errors.Is(err, models.ErrInvalidPassword) {
+		t.Errorf("CheckPassword with a wrong password: err = %v, want ErrInvalidPassword", err)
+	}
+
+	if err = galleries.RemovePassword(gallery.ID); err != nil {
+		t.Fatal(err)
+	}
+	if gallery, err = galleries.ByID(gallery.ID); err != nil {
+		t.Fatal(err)
+	}
+	if gallery.PasswordHash != "" {
+		t.Errorf("RemovePassword kept the password")
+	}
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Identity links a user to their account at an external OpenID Connect
+// provider, Subject is the provider's ID for that account.
+type Identity struct {
+	ID        uint
+	UserID    uint
+	Provider  string
+	Subject   string
+	Email     string
+	CreatedAt time.Time
+}
+
+type IdentityService interface {
+	// SignIn returns the user linked to the identity, signing them up when
+	// there's none. It returns ErrEmailTaken when the email already belongs
+	// to an account: its owner has to link the identity from their settings,
+	// or anybody controlling the email at the provider would get in. Signing
+	// up requires an email verified by the provider, ErrEmailNotVerified is
+	// returned otherwise and nothing is created.
+	SignIn(provider, subject, email string, emailVerified bool) (*User, error)
+	// Link returns ErrIdentityTaken when the identity belongs to another user.
+	Link(userID uint, provider, subject, email string) (*Identity, error)
+	List(userID uint) ([]Identity, error)
+	// Unlink returns ErrNotFound when the identity doesn't belong to the user.
+	Unlink(userID, identityID uint) error
+}
+
+func NewIdentityServicePostgres(db *sql.DB) IdentityService {
+	return &identityServicePostgres{
+		DB: db,
+	}
+}
+
+type identityServicePostgres struct {
+	DB *sql.DB
+}
+
+func (s identityServicePostgres) SignIn(provider, subject, email string, emailVerified bool) (*User, error) {
+	var user User
+	row := s.DB.QueryRow(`
+		SELECT users.id, users.email, users.email_verified_at FROM identities
+		JOIN users ON users.id = identities.user_id
+		WHERE identities.provider = $1 AND identities.subject = $2;`, provider, subject)
+	err := row.Scan(&user.ID, &user.Email, &user.EmailVerifiedAt)
+	if err == nil {
+		return &user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("identity sign in: %w", err)
+	}
+
+	// Anybody can claim any address at some providers, the account would
+	// then be held by someone who doesn't own its email.
+	if !emailVerified {
+		return nil, fmt.Errorf("identity sign in: %w", ErrEmailNotVerified)
+	}
+	now := time.Now()
+	user.Email = strings.ToLower(email)
+	user.EmailVerifiedAt = &now
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("identity sign in: %w", err)
+	}
+	defer tx.Rollback()
+	// The account has no password, one can be set with a password reset.
+	row = tx.QueryRow(`
+		INSERT INTO users (email, password_hash, email_verified_at)
+		VALUES ($1, '', $2) RETURNING id;`, user.Email, user.EmailVerifiedAt)
+	if err = row.Scan(&user.ID); err != nil {
+		if isUniqueViolation(err) {
+			return nil, fmt.Errorf("identity sign in: %w", ErrEmailTaken)
+		}
+		return nil, fmt.Errorf("identity sign in: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO identities (user_id, provider, subject, email, created_at)
+		VALUES ($1, $2, $3, $4, $5);`, user.ID, provider, subject, email, now)
+	if err != nil {
+		return nil, fmt.Errorf("identity sign in: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("identity sign in: %w", err)
+	}
+	return &user, nil
+}
+
+func (s identityServicePostgres) Link(userID uint, provider, subject, email string) (*Identity, error) {
+	identity := Identity{
+		UserID:    userID,
+		Provider:  provider,
+		Subject:   subject,
+		Email:     email,
+		CreatedAt: time.Now(),
+	}
+	// Linking an identity twice to the same user is a no-op.
+	row := s.DB.QueryRow(`
+		INSERT INTO identities (user_id, provider, subject, email, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (provider, subject) DO UPDATE SET email = $4
+		WHERE identities.user_id = $1
+		RETURNING id, created_at;`,
+		identity.UserID, identity.Provider, identity.Subject, identity.Email, identity.CreatedAt)
+	if err := row.Scan(&identity.ID, &identity.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("link identity: %w", ErrIdentityTaken)
+		}
+		return nil, fmt.Errorf("link identity: %w", err)
+	}
+	return &identity, nil
+}
+
+func (s identityServicePostgres) List(userID uint) ([]Identity, error) {
+	rows, err := s.DB.Query(`
+		SELECT id, provider, subject, email, created_at FROM identities
+		WHERE user_id = $1 ORDER BY created_at;`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("list identities: %w", err)
+	}
+	defer rows.Close()
+	var identities []Identity
+	for rows.Next() {
+		identity := Identity{
+			UserID: userID,
+		}
+		err = rows.Scan(&identity.ID, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("list identities: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("list identities: %w", err)
+	}
+	return identities, nil
+}
+
+func (s identityServicePostgres) Unlink(userID, identityID uint) error {
+	res, err := s.DB.Exec(`DELETE FROM identities WHERE id = $1 AND user_id = $2;`, identityID, userID)
+	if err != nil {
+		return fmt.Errorf("unlink identity: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unlink identity: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("unlink identity: %w", ErrNotFound)
+	}
+	return nil
+}
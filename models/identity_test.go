@@ -0,0 +1,39 @@
+package models_test
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIdentityServicePostgresSignIn(t *testing.T) {
+	identities := models.NewIdentityServicePostgres(openTestDB(t))
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+	email := "identity-" + token + "@example.com"
+
+	_, err := identities.SignIn("stub", "unverified-"+token, email, false)
+	if !errors.Is(err, models.ErrEmailNotVerified) {
+		t.Fatalf("SignIn with an unverified email: err = %v, want ErrEmailNotVerified", err)
+	}
+	// Nothing was created, so the owner of the address can still sign up.
+	user, err := identities.SignIn("stub", "subject-"+token, email, true)
+	if err != nil {
+		t.Fatalf("SignIn with a verified email: %v", err)
+	}
+	if user.EmailVerifiedAt == nil {
+		t.Errorf("SignIn with a verified email didn't verify the account")
+	}
+	again, err := identities.SignIn("stub", "subject-"+token, "changed-"+email, false)
+	if err != nil {
+		t.Fatalf("SignIn with a linked identity: %v", err)
+	}
+	if again.ID != user.ID {
+		t.Errorf("SignIn with a linked identity = user %d, want %d", again.ID, user.ID)
+	}
+	_, err = identities.SignIn("stub", "other-"+token, email, true)
+	if !errors.Is(err, models.ErrEmailTaken) {
+		t.Errorf("SignIn with the email of another account: err = %v, want ErrEmailTaken", err)
+	}
+}
@@ -0,0 +1,338 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaxImageSize is the largest file, in bytes, accepted by ImageService.Create
+	DefaultMaxImageSize = 10 << 20
+	// sniffLen is the number of bytes http.DetectContentType looks at.
+	sniffLen = 512
+)
+
+var (
+	ErrInvalidImage  = errors.New("models: file is not a supported image")
+	ErrImageTooLarge = errors.New("models: image is too large")
+)
+
+// imageExtensions maps every accepted content type to the extension used to store it.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+type Image struct {
+	GalleryID uint
+	Filename  string
+	Size      int64
+	ModTime   time.Time
+	Status    ImageStatus
+	// Variants lists the generated variants, empty until Status is ImageReady.
+	Variants []ImageVariant
+}
+
+// ImageStore persists the raw bytes of gallery images. Filenames reaching a
+// store have already been sanitized by ImageService.
+type ImageStore interface {
+	Create(galleryID uint, filename string, contents io.Reader) (*Image, error)
+	List(galleryID uint) ([]Image, error)
+	Open(galleryID uint, filename string) (io.ReadSeekCloser, *Image, error)
+	// Delete removes the image together with all its variants.
+	Delete(galleryID uint, filename string) error
+	DeleteAll(galleryID uint) error
+	CreateVariant(galleryID uint, filename, variant string, contents io.Reader) error
+	OpenVariant(galleryID uint, filename, variant string) (io.ReadSeekCloser, *Image, error)
+	// ListVariants returns the stored variant filenames of an image.
+	ListVariants(galleryID uint, filename string) ([]string, error)
+}
+
+type ImageService interface {
+	// Create validates contents by sniffing its first bytes and stores it under
+	// a sanitized version of filename, returning the stored Image. Location
+	// data is removed from jpegs unless the gallery opted in to keep it.
+	Create(gallery *Gallery, filename string, contents io.Reader) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	Open(galleryID uint, filename string) (io.ReadSeekCloser, *Image, error)
+	// OpenVariant opens the named variant of an image, falling back to the
+	// original while the variant has not been generated yet.
+	OpenVariant(galleryID uint, filename, variant string) (io.ReadSeekCloser, *Image, error)
+	// Metadata returns the EXIF details recorded when the image was uploaded.
+	Metadata(galleryID uint, filename string) (*ImageMetadata, error)
+	Delete(galleryID uint, filename string) error
+	DeleteAll(galleryID uint) error
+}
+
+type imageOption func(*imageService)
+
+// WithMaxImageSize sets the largest file, in bytes, that can be stored.
+func WithMaxImageSize(maxSize int64) imageOption {
+	return func(s *imageService) {
+		if maxSize > 0 {
+			s.MaxSize = maxSize
+		}
+	}
+}
+
+// WithImageProcessor generates the variants of every image created through
+// the service. Without a processor only the originals are available.
+func WithImageProcessor(processor ImageProcessor) imageOption {
+	return func(s *imageService) {
+		s.Processor = processor
+	}
+}
+
+// WithImageMetadata records the EXIF details of uploaded jpegs.
+func WithImageMetadata(metadata ImageMetadataService) imageOption {
+	return func(s *imageService) {
+		s.MetadataService = metadata
+	}
+}
+
+func NewImageService(store ImageStore, opts ...imageOption) ImageService {
+	s := imageService{
+		Store:   store,
+		MaxSize: DefaultMaxImageSize,
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return &s
+}
+
+type imageService struct {
+	Store ImageStore
+	// MaxSize is the largest file, in bytes, accepted by Create. Default DefaultMaxImageSize
+	MaxSize         int64
+	Processor       ImageProcessor
+	MetadataService ImageMetadataService
+}
+
+func (is imageService) Create(gallery *Gallery, filename string, contents io.Reader) (*Image, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(contents, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("create image: %w", err)
+	}
+	head = head[:n]
+	ext, ok := imageExtensions[http.DetectContentType(head)]
+	if !ok {
+		return nil, ErrInvalidImage
+	}
+	filename = sanitizeImageFilename(filename, ext)
+
+	// Read one byte past the limit so we can tell a file of exactly MaxSize
+	// bytes apart from a bigger one.
+	limited := &io.LimitedReader{
+		R: io.MultiReader(bytes.NewReader(head), contents),
+		N: is.MaxSize + 1,
+	}
+	var md *ImageMetadata
+	var body io.Reader = limited
+	if ext == ".jpg" {
+		// jpegs are rewritten before they touch the store, so the whole file
+		// is read up front.
+		data, err := io.ReadAll(limited)
+		if err != nil {
+			return nil, fmt.Errorf("create image: %w", err)
+		}
+		if limited.N == 0 {
+			return nil, ErrImageTooLarge
+		}
+		if md, err = parseExif(data); err != nil && !errors.Is(err, errNoExif) {
+			log.Printf("parse exif of %q: %v", filename, err)
+		}
+		if !gallery.KeepLocation {
+			if data, err = stripJPEGLocation(data); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+			}
+		}
+		body = bytes.NewReader(data)
+	}
+	image, err := is.Store.Create(gallery.ID, filename, body)
+	if err != nil {
+		return nil, fmt.Errorf("create image: %w", err)
+	}
+	if limited.N == 0 {
+		if err = is.Store.Delete(gallery.ID, image.Filename); err != nil {
+			return nil, fmt.Errorf("create image: %w", err)
+		}
+		return nil, ErrImageTooLarge
+	}
+	if md != nil && is.MetadataService != nil {
+		md.GalleryID = gallery.ID
+		md.Filename = image.Filename
+		if err = is.MetadataService.Create(md); err != nil {
+			return nil, fmt.Errorf("create image: %w", err)
+		}
+	}
+	if is.Processor != nil {
+		image.Status = ImageProcessing
+		is.Processor.Enqueue(gallery.ID, image.Filename)
+	}
+	return image, nil
+}
+
+func (is imageService) ByGalleryID(galleryID uint) ([]Image, error) {
+	images, err := is.Store.List(galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("images by gallery: %w", err)
+	}
+	for i := range images {
+		if err = is.setVariants(&images[i]); err != nil {
+			return nil, fmt.Errorf("images by gallery: %w", err)
+		}
+	}
+	return images, nil
+}
+
+// setVariants fills the Status and Variants of image. Images missing some
+// variant, e.g. because the queue was full or the server restarted before
+// they were processed, are enqueued again. Failed images are only retried
+// once the processor forgot the failure, not on every view.
+func (is imageService) setVariants(image *Image) error {
+	image.Status = ImageReady
+	if is.Processor == nil {
+		return nil
+	}
+	stored, err := is.Store.ListVariants(image.GalleryID, image.Filename)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(stored))
+	for _, name := range stored {
+		have[name] = true
+	}
+	image.Variants = nil
+	complete := true
+	for _, variant := range is.Processor.Variants() {
+		if !have[variantFilename(image.Filename, variant.Name)] {
+			complete = false
+			break
+		}
+		image.Variants = append(image.Variants, variant)
+	}
+	status := is.Processor.Status(image.GalleryID, image.Filename)
+	switch {
+	case complete && status != ImageProcessing:
+		image.Status = ImageReady
+	case status == ImageFailed:
+		image.Status = ImageFailed
+		image.Variants = nil
+	default:
+		image.Status = ImageProcessing
+		image.Variants = nil
+		is.Processor.Enqueue(image.GalleryID, image.Filename)
+	}
+	return nil
+}
+
+func (is imageService) Open(galleryID uint, filename string) (io.ReadSeekCloser, *Image, error) {
+	if !validImageFilename(filename) {
+		return nil, nil, ErrNotFound
+	}
+	return is.Store.Open(galleryID, filename)
+}
+
+func (is imageService) OpenVariant(galleryID uint, filename, variant string) (io.ReadSeekCloser, *Image, error) {
+	if !validImageFilename(filename) {
+		return nil, nil, ErrNotFound
+	}
+	if is.Processor == nil || !is.knownVariant(variant) {
+		return nil, nil, ErrNotFound
+	}
+	file, image, err := is.Store.OpenVariant(galleryID, filename, variantFilename(filename, variant))
+	if errors.Is(err, ErrNotFound) {
+		return is.Store.Open(galleryID, filename)
+	}
+	return file, image, err
+}
+
+func (is imageService) knownVariant(name string) bool {
+	for _, variant := range is.Processor.Variants() {
+		if variant.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (is imageService) Metadata(galleryID uint, filename string) (*ImageMetadata, error) {
+	if is.MetadataService == nil || !validImageFilename(filename) {
+		return nil, ErrNotFound
+	}
+	return is.MetadataService.ByImage(galleryID, filename)
+}
+
+func (is imageService) Delete(galleryID uint, filename string) error {
+	if !validImageFilename(filename) {
+		return ErrNotFound
+	}
+	if err := is.Store.Delete(galleryID, filename); err != nil {
+		return fmt.Errorf("delete image: %w", err)
+	}
+	if is.MetadataService != nil {
+		if err := is.MetadataService.Delete(galleryID, filename); err != nil {
+			return fmt.Errorf("delete image: %w", err)
+		}
+	}
+	return nil
+}
+
+func (is imageService) DeleteAll(galleryID uint) error {
+	if err := is.Store.DeleteAll(galleryID); err != nil {
+		return fmt.Errorf("delete images: %w", err)
+	}
+	return nil
+}
+
+// sanitizeImageFilename strips any directory component from name, replaces
+// every character outside [A-Za-z0-9._-] and forces ext as its extension,
+// so the stored name always matches the sniffed content type.
+func sanitizeImageFilename(name, ext string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.TrimSuffix(name, path.Ext(name))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	name = strings.Trim(name, "_")
+	if name == "" {
+		name = "image"
+	}
+	return name + ext
+}
+
+// validImageFilename reports whether name could have been produced by
+// sanitizeImageFilename. It guards stores against path traversal.
+func validImageFilename(name string) bool {
+	ext := path.Ext(name)
+	if ext == "" || strings.HasPrefix(name, ".") {
+		return false
+	}
+	validExt := false
+	for _, e := range imageExtensions {
+		if e == ext {
+			validExt = true
+			break
+		}
+	}
+	if !validExt {
+		return false
+	}
+	return sanitizeImageFilename(name, ext) == name
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ImageMetadata holds the camera details read from the EXIF data of an
+// image. Location is never stored, HasLocation only tells whether the
+// uploaded file carried any.
+type ImageMetadata struct {
+	GalleryID    uint
+	Filename     string
+	CameraMake   string
+	CameraModel  string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	TakenAt      *time.Time
+	HasLocation  bool
+}
+
+type ImageMetadataService interface {
+	Create(md *ImageMetadata) error
+	ByImage(galleryID uint, filename string) (*ImageMetadata, error)
+	Delete(galleryID uint, filename string) error
+}
+
+func NewImageMetadataServicePostgres(db *sql.DB) ImageMetadataService {
+	return &imageMetadataServicePostgres{
+		DB: db,
+	}
+}
+
+type imageMetadataServicePostgres struct {
+	DB *sql.DB
+}
+
+func (ms imageMetadataServicePostgres) Create(md *ImageMetadata) error {
+	_, err := ms.DB.Exec(`
+		INSERT INTO image_metadata (gallery_id, filename, camera_make, camera_model, lens_model,
+			exposure_time, f_number, iso, focal_length, taken_at, has_location)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (gallery_id, filename) DO UPDATE SET
+			camera_make = $3, camera_model = $4, lens_model = $5, exposure_time = $6,
+			f_number = $7, iso = $8, focal_length = $9, taken_at = $10, has_location = $11;`,
+		md.GalleryID, md.Filename, md.CameraMake, md.CameraModel, md.LensModel,
+		md.ExposureTime, md.FNumber, md.ISO, md.FocalLength, md.TakenAt, md.HasLocation)
+	if err != nil {
+		return fmt.Errorf("create image metadata: %w", err)
+	}
+	return nil
+}
+
+func (ms imageMetadataServicePostgres) ByImage(galleryID uint, filename string) (*ImageMetadata, error) {
+	md := ImageMetadata{
+		GalleryID: galleryID,
+		Filename:  filename,
+	}
+	row := ms.DB.QueryRow(`
+		SELECT camera_make, camera_model, lens_model, exposure_time, f_number, iso,
+			focal_length, taken_at, has_location
+		FROM image_metadata WHERE gallery_id = $1 AND filename = $2;`, galleryID, filename)
+	err := row.Scan(&md.CameraMake, &md.CameraModel, &md.LensModel, &md.ExposureTime, &md.FNumber,
+		&md.ISO, &md.FocalLength, &md.TakenAt, &md.HasLocation)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("image metadata: %w", err)
+	}
+	return &md, nil
+}
+
+func (ms imageMetadataServicePostgres) Delete(galleryID uint, filename string) error {
+	_, err := ms.DB.Exec(`
+		DELETE FROM image_metadata WHERE gallery_id = $1 AND filename = $2;`, galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("delete image metadata: %w", err)
+	}
+	return nil
+}
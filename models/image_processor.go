@@ -0,0 +1,330 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultImageWorkers   = 2
+	DefaultImageQueueSize = 64
+	// DefaultImageRetryAfter is how long an image stays failed before a
+	// view enqueues it again.
+	DefaultImageRetryAfter = 15 * time.Minute
+	// MaxImagePixels guards the decoder against decompression bombs, images
+	// with more pixels than this are rejected without being decoded.
+	MaxImagePixels = 50_000_000
+)
+
+type ImageStatus string
+
+const (
+	ImageProcessing ImageStatus = "processing"
+	ImageReady      ImageStatus = "ready"
+	ImageFailed     ImageStatus = "failed"
+)
+
+// ImageVariant describes a resized copy generated for every uploaded image.
+type ImageVariant struct {
+	Name  string
+	Width int
+	// Square crops the center of the image before scaling, used for thumbnails.
+	Square bool
+}
+
+var DefaultImageVariants = []ImageVariant{
+	{Name: "thumb", Width: 200, Square: true},
+	{Name: "w320", Width: 320},
+	{Name: "w800", Width: 800},
+	{Name: "w1600", Width: 1600},
+}
+
+// ImageProcessor generates the variants of uploaded images in the background.
+type ImageProcessor interface {
+	// Enqueue schedules variant generation for an image, it never blocks and
+	// reports false when the queue is full or the processor is closed.
+	Enqueue(galleryID uint, filename string) bool
+	// Status reports ImageProcessing while a job is queued or running,
+	// ImageFailed when the last attempt failed less than RetryAfter ago and
+	// ImageReady otherwise.
+	Status(galleryID uint, filename string) ImageStatus
+	Variants() []ImageVariant
+	// Close stops accepting jobs and waits for the running ones to finish.
+	Close()
+}
+
+type imageProcessorOption func(*imageProcessor)
+
+func WithImageWorkers(workers int) imageProcessorOption {
+	return func(p *imageProcessor) {
+		if workers > 0 {
+			p.Workers = workers
+		}
+	}
+}
+
+func WithImageQueueSize(size int) imageProcessorOption {
+	return func(p *imageProcessor) {
+		if size > 0 {
+			p.QueueSize = size
+		}
+	}
+}
+
+// WithImageRetryAfter sets how long failures are remembered, failed images
+// aren't enqueued again until then.
+func WithImageRetryAfter(retryAfter time.Duration) imageProcessorOption {
+	return func(p *imageProcessor) {
+		if retryAfter > 0 {
+			p.RetryAfter = retryAfter
+		}
+	}
+}
+
+func WithImageVariants(variants ...ImageVariant) imageProcessorOption {
+	return func(p *imageProcessor) {
+		if len(variants) > 0 {
+			p.variants = variants
+		}
+	}
+}
+
+func NewImageProcessor(store ImageStore, opts ...imageProcessorOption) ImageProcessor {
+	p := imageProcessor{
+		Store:      store,
+		Workers:    DefaultImageWorkers,
+		QueueSize:  DefaultImageQueueSize,
+		RetryAfter: DefaultImageRetryAfter,
+		variants:   DefaultImageVariants,
+		state:      make(map[imageJob]ImageStatus),
+		failedAt:   make(map[imageJob]time.Time),
+	}
+	for _, opt := range opts {
+		opt(&p)
+	}
+	p.jobs = make(chan imageJob, p.QueueSize)
+	for i := 0; i < p.Workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return &p
+}
+
+type imageJob struct {
+	GalleryID uint
+	Filename  string
+}
+
+type imageProcessor struct {
+	Store ImageStore
+	// Workers is the number of goroutines generating variants. Default DefaultImageWorkers
+	Workers int
+	// QueueSize is how many images may wait for a worker. Default DefaultImageQueueSize
+	QueueSize int
+	// RetryAfter is how long failures are remembered. Default DefaultImageRetryAfter
+	RetryAfter time.Duration
+	variants   []ImageVariant
+
+	jobs   chan imageJob
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	closed bool
+	// state only holds queued, running and failed jobs.
+	state map[imageJob]ImageStatus
+	// failedAt holds when the failed jobs of state failed, they are evicted
+	// after RetryAfter.
+	failedAt map[imageJob]time.Time
+}
+
+func (p *imageProcessor) Enqueue(galleryID uint, filename string) bool {
+	job := imageJob{GalleryID: galleryID, Filename: filename}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	if p.status(job) == ImageProcessing {
+		return true
+	}
+	select {
+	case p.jobs <- job:
+		p.state[job] = ImageProcessing
+		delete(p.failedAt, job)
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *imageProcessor) Status(galleryID uint, filename string) ImageStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status(imageJob{GalleryID: galleryID, Filename: filename})
+}
+
+// status evicts the failure of job once it's older than RetryAfter, p.mu
+// must be held.
+func (p *imageProcessor) status(job imageJob) ImageStatus {
+	status, ok := p.state[job]
+	if !ok {
+		return ImageReady
+	}
+	if status == ImageFailed && time.Since(p.failedAt[job]) >= p.RetryAfter {
+		delete(p.state, job)
+		delete(p.failedAt, job)
+		return ImageReady
+	}
+	return status
+}
+
+func (p *imageProcessor) Variants() []ImageVariant {
+	return p.variants
+}
+
+func (p *imageProcessor) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.jobs)
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (p *imageProcessor) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		err := p.process(job)
+		p.mu.Lock()
+		if err != nil {
+			log.Printf("processing image %d/%s err: %v", job.GalleryID, job.Filename, err)
+			p.evictFailures()
+			p.state[job] = ImageFailed
+			p.failedAt[job] = time.Now()
+		} else {
+			delete(p.state, job)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// evictFailures forgets the failures older than RetryAfter, so images which
+// are never viewed again don't stay in memory. p.mu must be held.
+func (p *imageProcessor) evictFailures() {
+	for job := range p.failedAt {
+		p.status(job)
+	}
+}
+
+func (p *imageProcessor) process(job imageJob) error {
+	file, _, err := p.Store.Open(job.GalleryID, job.Filename)
+	if err != nil {
+		return fmt.Errorf("process image: %w", err)
+	}
+	src, err := decodeImage(file)
+	_ = file.Close()
+	if err != nil {
+		return fmt.Errorf("process image: %w", err)
+	}
+	for _, variant := range p.variants {
+		var buf bytes.Buffer
+		if err = encodeImage(&buf, resizeImage(src, variant), job.Filename); err != nil {
+			return fmt.Errorf("process image %s: %w", variant.Name, err)
+		}
+		name := variantFilename(job.Filename, variant.Name)
+		if err = p.Store.CreateVariant(job.GalleryID, job.Filename, name, &buf); err != nil {
+			return fmt.Errorf("process image %s: %w", variant.Name, err)
+		}
+	}
+	// The image may have been deleted while we were working on it, in that
+	// case drop the variants we have just written.
+	file, _, err = p.Store.Open(job.GalleryID, job.Filename)
+	if errors.Is(err, ErrNotFound) {
+		if err = p.Store.Delete(job.GalleryID, job.Filename); err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("process image: %w", err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("process image: %w", err)
+	}
+	return file.Close()
+}
+
+func decodeImage(r io.ReadSeeker) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("decode config: %w", err)
+	}
+	if cfg.Width*cfg.Height > MaxImagePixels {
+		return nil, fmt.Errorf("image of %dx%d exceeds %d pixels", cfg.Width, cfg.Height, MaxImagePixels)
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return img, nil
+}
+
+// resizeImage scales src down to the variant width keeping its aspect ratio.
+// Images are never scaled up.
+func resizeImage(src image.Image, variant ImageVariant) image.Image {
+	bounds := src.Bounds()
+	if variant.Square {
+		side := bounds.Dx()
+		if bounds.Dy() < side {
+			side = bounds.Dy()
+		}
+		x0 := bounds.Min.X + (bounds.Dx()-side)/2
+		y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+		bounds = image.Rect(x0, y0, x0+side, y0+side)
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > variant.Width {
+		height = height * variant.Width / width
+		width = variant.Width
+	}
+	if height < 1 {
+		height = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	return dst
+}
+
+// encodeImage keeps png and gif sources lossless, everything else becomes a jpeg.
+func encodeImage(w io.Writer, img image.Image, filename string) error {
+	if variantExt(filename) == ".png" {
+		return png.Encode(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+}
+
+func variantExt(filename string) string {
+	switch path.Ext(filename) {
+	case ".png", ".gif":
+		return ".png"
+	default:
+		return ".jpg"
+	}
+}
+
+func variantFilename(filename, variant string) string {
+	return variant + variantExt(filename)
+}
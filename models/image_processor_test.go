@@ -0,0 +1,223 @@
+package models_test
+
+import (
+	"bytes"
+	"github.com/arkadiont/lenslocked/models"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStore counts how many times each image was opened, the processor
+// opens an image once per attempt before decoding it.
+type countingStore struct {
+	models.ImageStore
+	mu     sync.Mutex
+	opened map[string]int
+}
+
+func (s *countingStore) Open(galleryID uint, filename string) (io.ReadSeekCloser, *models.Image, error) {
+	s.mu.Lock()
+	s.opened[filename]++
+	s.mu.Unlock()
+	return s.ImageStore.Open(galleryID, filename)
+}
+
+func (s *countingStore) Opened(filename string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.opened[filename]
+}
+
+func newCountingStore(t *testing.T) *countingStore {
+	return &countingStore{
+		ImageStore: models.NewImageStoreDisk(t.TempDir()),
+		opened:     make(map[string]int),
+	}
+}
+
+func encodeTestImage(t *testing.T, width, height int, format string) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		img.Set(x, height/2, color.RGBA{R: 200, A: 255})
+	}
+	var buf bytes.Buffer
+	var err error
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// waitProcessed waits for the processor to finish with an image and
+// returns its status.
+func waitProcessed(t *testing.T, processor models.ImageProcessor, galleryID uint, filename string) models.ImageStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if status := processor.Status(galleryID, filename); status != models.ImageProcessing {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s is still processing", filename)
+	return ""
+}
+
+func TestImageProcessorVariants(t *testing.T) {
+	tests := []struct {
+		filename string
+		contents []byte
+		// want are the sizes of the variants by filename.
+		want map[string]image.Point
+	}{
+		{"landscape.png", encodeTestImage(t, 1000, 500, "png"), map[string]image.Point{
+			"thumb.png": {200, 200},
+			"w320.png":  {320, 160},
+			"w800.png":  {800, 400},
+			// Images are never scaled up.
+			"w1600.png": {1000, 500},
+		}},
+		{"portrait.jpg", encodeTestImage(t, 300, 900, "jpeg"), map[string]image.Point{
+			"thumb.jpg": {200, 200},
+			"w320.jpg":  {300, 900},
+			"w800.jpg":  {300, 900},
+			"w1600.jpg": {300, 900},
+		}},
+	}
+	store := newCountingStore(t)
+	processor := models.NewImageProcessor(store)
+	defer processor.Close()
+	for _, tt := range tests {
+		stored, err := store.Create(1, tt.filename, bytes.NewReader(tt.contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !processor.Enqueue(1, stored.Filename) {
+			t.Fatalf("Enqueue(%s) = false", stored.Filename)
+		}
+		if status := waitProcessed(t, processor, 1, stored.Filename); status != models.ImageReady {
+			t.Fatalf("%s: status = %s, want %s", tt.filename, status, models.ImageReady)
+		}
+		for name, want := range tt.want {
+			file, _, err := store.OpenVariant(1, stored.Filename, name)
+			if err != nil {
+				t.Errorf("%s: open %s: %v", tt.filename, name, err)
+				continue
+			}
+			cfg, format, err := image.DecodeConfig(file)
+			file.Close()
+			if err != nil {
+				t.Errorf("%s: decode %s: %v", tt.filename, name, err)
+				continue
+			}
+			if got := (image.Point{X: cfg.Width, Y: cfg.Height}); got != want || !strings.HasSuffix(name, "."+strings.Replace(format, "jpeg", "jpg", 1)) {
+				t.Errorf("%s: %s is a %s of %v, want %v", tt.filename, name, format, got, want)
+			}
+		}
+	}
+}
+
+func TestImageProcessorFailure(t *testing.T) {
+	store := newCountingStore(t)
+	processor := models.NewImageProcessor(store)
+	defer processor.Close()
+	broken, err := store.Create(1, "broken.png", strings.NewReader("not a png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	processor.Enqueue(1, broken.Filename)
+	if status := waitProcessed(t, processor, 1, broken.Filename); status != models.ImageFailed {
+		t.Fatalf("status = %s, want %s", status, models.ImageFailed)
+	}
+
+	// Viewing the gallery shows the failure without trying again.
+	images := models.NewImageService(store, models.WithImageProcessor(processor))
+	for i := 0; i < 3; i++ {
+		list, err := images.ByGalleryID(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Status != models.ImageFailed || list[0].Variants != nil {
+			t.Fatalf("ByGalleryID = %+v, want the failed image without variants", list)
+		}
+	}
+	if n := store.Opened(broken.Filename); n != 1 {
+		t.Errorf("the failed image was processed %d times, want once", n)
+	}
+}
+
+func TestImageProcessorRetryAfter(t *testing.T) {
+	store := newCountingStore(t)
+	processor := models.NewImageProcessor(store, models.WithImageRetryAfter(50*time.Millisecond))
+	defer processor.Close()
+	broken, err := store.Create(1, "broken.png", strings.NewReader("not a png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	processor.Enqueue(1, broken.Filename)
+	if status := waitProcessed(t, processor, 1, broken.Filename); status != models.ImageFailed {
+		t.Fatalf("status = %s, want %s", status, models.ImageFailed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	// The failure is forgotten, the next view enqueues the image again.
+	if status := processor.Status(1, broken.Filename); status != models.ImageReady {
+		t.Fatalf("status after RetryAfter = %s, want %s", status, models.ImageReady)
+	}
+	images := models.NewImageService(store, models.WithImageProcessor(processor))
+	if _, err = images.ByGalleryID(1); err != nil {
+		t.Fatal(err)
+	}
+	if status := waitProcessed(t, processor, 1, broken.Filename); status != models.ImageFailed {
+		t.Fatalf("status after retrying = %s, want %s", status, models.ImageFailed)
+	}
+	if n := store.Opened(broken.Filename); n != 2 {
+		t.Errorf("the failed image was processed %d times, want twice", n)
+	}
+}
+
+func TestImageServiceRequeue(t *testing.T) {
+	store := newCountingStore(t)
+	// The image was stored while the queue was full.
+	stored, err := store.Create(1, "photo.png", bytes.NewReader(encodeTestImage(t, 400, 300, "png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	processor := models.NewImageProcessor(store)
+	defer processor.Close()
+	images := models.NewImageService(store, models.WithImageProcessor(processor))
+	list, err := images.ByGalleryID(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Status != models.ImageProcessing {
+		t.Fatalf("ByGalleryID = %+v, want the image processing", list)
+	}
+	waitProcessed(t, processor, 1, stored.Filename)
+	// Processing opens the image twice, once to decode it and once to check
+	// it wasn't deleted meanwhile.
+	opened := store.Opened(stored.Filename)
+	for i := 0; i < 3; i++ {
+		if list, err = images.ByGalleryID(1); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 1 || list[0].Status != models.ImageReady || len(list[0].Variants) != len(models.DefaultImageVariants) {
+			t.Fatalf("ByGalleryID = %+v, want the image ready with its variants", list)
+		}
+	}
+	if n := store.Opened(stored.Filename); n != opened {
+		t.Errorf("the complete image was processed again on view, opened %d times instead of %d", n, opened)
+	}
+}
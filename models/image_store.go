@@ -0,0 +1,231 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultImagesDir = "images"
+)
+
+// NewImageStoreDisk returns an ImageStore keeping every gallery in its own
+// directory below dir.
+func NewImageStoreDisk(dir string) ImageStore {
+	if dir == "" {
+		dir = DefaultImagesDir
+	}
+	return &imageStoreDisk{
+		Dir: dir,
+	}
+}
+
+type imageStoreDisk struct {
+	Dir string
+}
+
+func (s imageStoreDisk) Create(galleryID uint, filename string, contents io.Reader) (*Image, error) {
+	dir := s.galleryDir(galleryID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create image dir: %w", err)
+	}
+	f, name, err := s.createUnique(dir, filename)
+	if err != nil {
+		return nil, fmt.Errorf("create image file: %w", err)
+	}
+	if _, err = io.Copy(f, contents); err != nil {
+		_ = f.Close()
+		_ = os.Remove(filepath.Join(dir, name))
+		return nil, fmt.Errorf("write image: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return nil, fmt.Errorf("write image: %w", err)
+	}
+	return s.stat(galleryID, name)
+}
+
+// createUnique opens a new file named filename in dir, adding a numeric
+// suffix when that name is already taken so uploads never overwrite each other.
+func (s imageStoreDisk) createUnique(dir, filename string) (*os.File, string, error) {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	name := filename
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return f, name, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, "", err
+		}
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
+
+func (s imageStoreDisk) List(galleryID uint) ([]Image, error) {
+	entries, err := os.ReadDir(s.galleryDir(galleryID))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list images: %w", err)
+	}
+	var images []Image
+	for _, entry := range entries {
+		if entry.IsDir() || !validImageFilename(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("list images: %w", err)
+		}
+		images = append(images, Image{
+			GalleryID: galleryID,
+			Filename:  entry.Name(),
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+		})
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].ModTime.Before(images[j].ModTime)
+	})
+	return images, nil
+}
+
+func (s imageStoreDisk) Open(galleryID uint, filename string) (io.ReadSeekCloser, *Image, error) {
+	image, err := s.stat(galleryID, filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(s.imagePath(galleryID, filename))
+	if err != nil {
+		return nil, nil, fmt.Errorf("open image: %w", err)
+	}
+	return f, image, nil
+}
+
+func (s imageStoreDisk) Delete(galleryID uint, filename string) error {
+	if err := os.RemoveAll(s.variantsDir(galleryID, filename)); err != nil {
+		return fmt.Errorf("delete image variants: %w", err)
+	}
+	err := os.Remove(s.imagePath(galleryID, filename))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("delete image: %w", err)
+	}
+	return nil
+}
+
+func (s imageStoreDisk) DeleteAll(galleryID uint) error {
+	if err := os.RemoveAll(s.galleryDir(galleryID)); err != nil {
+		return fmt.Errorf("delete gallery images: %w", err)
+	}
+	return nil
+}
+
+func (s imageStoreDisk) CreateVariant(galleryID uint, filename, variant string, contents io.Reader) error {
+	dir := s.variantsDir(galleryID, filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("create variant dir: %w", err)
+	}
+	// Write to a temporary file first so readers never see a partial variant.
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create variant: %w", err)
+	}
+	if _, err = io.Copy(tmp, contents); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("write variant: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("write variant: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(dir, filepath.Base(variant))); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("write variant: %w", err)
+	}
+	return nil
+}
+
+func (s imageStoreDisk) OpenVariant(galleryID uint, filename, variant string) (io.ReadSeekCloser, *Image, error) {
+	variantPath := filepath.Join(s.variantsDir(galleryID, filename), filepath.Base(variant))
+	image, err := s.statPath(variantPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	image.GalleryID = galleryID
+	image.Filename = filepath.Base(variant)
+	f, err := os.Open(variantPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open variant: %w", err)
+	}
+	return f, image, nil
+}
+
+func (s imageStoreDisk) ListVariants(galleryID uint, filename string) ([]string, error) {
+	entries, err := os.ReadDir(s.variantsDir(galleryID, filename))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("list variants: %w", err)
+	}
+	var variants []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		variants = append(variants, entry.Name())
+	}
+	return variants, nil
+}
+
+func (s imageStoreDisk) stat(galleryID uint, filename string) (*Image, error) {
+	image, err := s.statPath(s.imagePath(galleryID, filename))
+	if err != nil {
+		return nil, err
+	}
+	image.GalleryID = galleryID
+	image.Filename = filename
+	return image, nil
+}
+
+func (s imageStoreDisk) statPath(name string) (*Image, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("stat image: %w", err)
+	}
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+	return &Image{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+func (s imageStoreDisk) galleryDir(galleryID uint) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("gallery-%d", galleryID))
+}
+
+// variantsDir keeps the variants of an image next to it, in a directory List ignores.
+func (s imageStoreDisk) variantsDir(galleryID uint, filename string) string {
+	return filepath.Join(s.galleryDir(galleryID), "variants", filepath.Base(filename))
+}
+
+func (s imageStoreDisk) imagePath(galleryID uint, filename string) string {
+	return filepath.Join(s.galleryDir(galleryID), filepath.Base(filename))
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultJanitorInterval = 15 * time.Minute
+)
+
+// Expirer is implemented by the services owning time-bound rows, such as
+// sessions or password resets.
+type Expirer interface {
+	// DeleteExpired removes every row no longer valid at now and returns how
+	// many rows were removed.
+	DeleteExpired(now time.Time) (int64, error)
+}
+
+// Janitor periodically purges expired rows in the background.
+type Janitor interface {
+	// Run purges every registered Expirer once, returning the number of rows
+	// removed by each of them.
+	Run() map[string]int64
+	// Close stops the janitor and waits for a running purge to finish.
+	Close()
+}
+
+type janitorOption func(*janitor)
+
+func WithJanitorInterval(interval time.Duration) janitorOption {
+	return func(j *janitor) {
+		if interval > 0 {
+			j.Interval = interval
+		}
+	}
+}
+
+// WithJanitorTask registers an Expirer, name is used when logging the purge.
+// A nil expirer, e.g. of a disabled service, is ignored.
+func WithJanitorTask(name string, expirer Expirer) janitorOption {
+	return func(j *janitor) {
+		if expirer == nil {
+			return
+		}
+		j.Tasks = append(j.Tasks, janitorTask{name: name, expirer: expirer})
+	}
+}
+
+// NewJanitor starts a janitor purging the registered tasks every interval,
+// the first purge happens right away.
+func NewJanitor(opts ...janitorOption) Janitor {
+	j := janitor{
+		Interval: DefaultJanitorInterval,
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&j)
+	}
+	j.wg.Add(1)
+	go j.loop()
+	return &j
+}
+
+type janitorTask struct {
+	name    string
+	expirer Expirer
+}
+
+type janitor struct {
+	// Interval is the time between two purges. Default DefaultJanitorInterval
+	Interval time.Duration
+	Tasks    []janitorTask
+
+	// mu serializes purges, so Run can be called while the loop is running.
+	mu        sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func (j *janitor) loop() {
+	defer j.wg.Done()
+	ticker := time.NewTicker(j.Interval)
+	defer ticker.Stop()
+	for {
+		j.Run()
+		select {
+		case <-j.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *janitor) Run() map[string]int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	removed := make(map[string]int64, len(j.Tasks))
+	now := time.Now()
+	for _, task := range j.Tasks {
+		n, err := task.expirer.DeleteExpired(now)
+		if err != nil {
+			log.Printf("janitor %s err: %v", task.name, err)
+			continue
+		}
+		removed[task.name] = n
+		if n > 0 {
+			log.Printf("janitor: removed %d expired %s", n, task.name)
+		}
+	}
+	return removed
+}
+
+func (j *janitor) Close() {
+	j.closeOnce.Do(func() {
+		close(j.done)
+	})
+	j.wg.Wait()
+}
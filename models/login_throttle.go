@@ -0,0 +1,423 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/rand"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultMaxLoginAttempts is the number of failed sign ins allowed for an
+	// account before it gets locked.
+	DefaultMaxLoginAttempts = 5
+	// DefaultMaxLoginAttemptsPerIP is higher than the per account limit since
+	// many users may share an address.
+	DefaultMaxLoginAttemptsPerIP = 20
+	// DefaultLoginLockout is the duration of the first lockout, every failure
+	// past the limit doubles it up to DefaultMaxLoginLockout.
+	DefaultLoginLockout    = 1 * time.Minute
+	DefaultMaxLoginLockout = 24 * time.Hour
+	// DefaultLoginAttemptWindow is how long failures are remembered once the
+	// last one, or the lockout that followed it, is over.
+	DefaultLoginAttemptWindow = 1 * time.Hour
+)
+
+// LockedError is returned when sign in attempts are temporarily refused.
+type LockedError struct {
+	Until time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("models: sign in locked until %s", e.Until.Format(time.RFC3339))
+}
+
+func (e *LockedError) Public() string {
+	wait := time.Until(e.Until).Round(time.Minute)
+	if wait < time.Minute {
+		return "Too many failed sign in attempts, please try again in a minute."
+	}
+	return fmt.Sprintf("Too many failed sign in attempts, please try again in %s.", formatWait(wait))
+}
+
+func formatWait(d time.Duration) string {
+	if d < time.Hour {
+		return fmt.Sprintf("%d minutes", int(d.Minutes()))
+	}
+	return fmt.Sprintf("%.0f hours", math.Ceil(d.Hours()))
+}
+
+// LoginThrottle tracks failed sign ins per account and per IP address,
+// locking them out for an exponentially growing time.
+type LoginThrottle interface {
+	// Allowed returns a *LockedError when sign ins for email or from ip are
+	// locked. Otherwise the attempt is counted as failed right away, until
+	// Succeeded says otherwise, so concurrent attempts can't go past the limits.
+	Allowed(email, ip string) error
+	// Failed completes a failed sign in. When the account got locked it
+	// returns a token that lifts the lock through Unlock.
+	Failed(email, ip string) (unlockToken string, err error)
+	// Succeeded forgets the failures of the account and gives the attempt
+	// back to ip.
+	Succeeded(email, ip string) error
+	// Unlock lifts the lock of the account the token was issued for.
+	Unlock(token string) error
+	Expirer
+}
+
+type loginThrottleOption func(*loginThrottleConfig)
+
+func WithMaxLoginAttempts(attempts int) loginThrottleOption {
+	return func(t *loginThrottleConfig) {
+		if attempts > 0 {
+			t.MaxAttempts = attempts
+		}
+	}
+}
+
+func WithMaxLoginAttemptsPerIP(attempts int) loginThrottleOption {
+	return func(t *loginThrottleConfig) {
+		if attempts > 0 {
+			t.MaxAttemptsPerIP = attempts
+		}
+	}
+}
+
+func WithLoginLockout(lockout time.Duration) loginThrottleOption {
+	return func(t *loginThrottleConfig) {
+		if lockout > 0 {
+			t.Lockout = lockout
+		}
+	}
+}
+
+func NewLoginThrottlePostgres(db *sql.DB, opts ...loginThrottleOption) LoginThrottle {
+	return &loginThrottle{
+		DB:                  db,
+		loginThrottleConfig: newLoginThrottleConfig(opts),
+	}
+}
+
+// loginThrottleConfig holds the settings shared by the Postgres and in-memory
+// throttles.
+type loginThrottleConfig struct {
+	MaxAttempts      int
+	MaxAttemptsPerIP int
+	// Lockout is the duration of the first lockout. Default DefaultLoginLockout
+	Lockout    time.Duration
+	MaxLockout time.Duration
+	Window     time.Duration
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each unlock token.
+	BytesPerToken int
+}
+
+func newLoginThrottleConfig(opts []loginThrottleOption) loginThrottleConfig {
+	c := loginThrottleConfig{
+		MaxAttempts:      DefaultMaxLoginAttempts,
+		MaxAttemptsPerIP: DefaultMaxLoginAttemptsPerIP,
+		Lockout:          DefaultLoginLockout,
+		MaxLockout:       DefaultMaxLoginLockout,
+		Window:           DefaultLoginAttemptWindow,
+		BytesPerToken:    MinBytesPerToken,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// lockout returns how long a key is locked after failures, max being the
+// limit it was reached at.
+func (c loginThrottleConfig) lockout(failures, max int) time.Duration {
+	if exp := failures - max; exp < 32 {
+		if d := c.Lockout << exp; d > 0 && d < c.MaxLockout {
+			return d
+		}
+	}
+	return c.MaxLockout
+}
+
+// hash is shared by both throttles, only the hashes of unlock tokens are stored.
+func (c loginThrottleConfig) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+type loginThrottle struct {
+	DB *sql.DB
+	loginThrottleConfig
+}
+
+func emailKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func (t loginThrottle) Allowed(email, ip string) error {
+	now := time.Now()
+	tx, err := t.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("login allowed: %w", err)
+	}
+	defer tx.Rollback()
+	ipAllowed, err := t.reserve(tx, ipKey(ip), t.MaxAttemptsPerIP, now)
+	if err != nil {
+		return fmt.Errorf("login allowed: %w", err)
+	}
+	emailAllowed, err := t.reserve(tx, emailKey(email), t.MaxAttempts, now)
+	if err != nil {
+		return fmt.Errorf("login allowed: %w", err)
+	}
+	if ipAllowed && emailAllowed {
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("login allowed: %w", err)
+		}
+		return nil
+	}
+	// Refused attempts are not counted.
+	if err = tx.Rollback(); err != nil {
+		return fmt.Errorf("login allowed: %w", err)
+	}
+	var until sql.NullTime
+	row := t.DB.QueryRow(`
+		SELECT MAX(locked_until) FROM login_attempt
+		WHERE key IN ($1, $2) AND locked_until > $3;`, emailKey(email), ipKey(ip), now)
+	if err = row.Scan(&until); err != nil {
+		return fmt.Errorf("login allowed: %w", err)
+	}
+	if !until.Valid {
+		// The lock ended in the meantime.
+		until.Time = now
+	}
+	return &LockedError{Until: until.Time}
+}
+
+// reserve counts an attempt for key unless it is locked, locking it once max
+// is reached, each attempt past max doubling the lockout. The row stays
+// locked until tx ends, so concurrent attempts are counted one at a time.
+func (t loginThrottle) reserve(tx *sql.Tx, key string, max int, now time.Time) (bool, error) {
+	var failures int
+	row := tx.QueryRow(`
+		INSERT INTO login_attempt (key, failures, last_failure_at) VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_attempt.last_failure_at < $3
+					AND (login_attempt.locked_until IS NULL OR login_attempt.locked_until < $3) THEN 1
+				ELSE login_attempt.failures + 1
+			END,
+			last_failure_at = $2
+		WHERE login_attempt.locked_until IS NULL OR login_attempt.locked_until <= $2
+		RETURNING failures;`, key, now, now.Add(-t.Window))
+	if err := row.Scan(&failures); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if failures < max {
+		return true, nil
+	}
+	// This attempt goes on, the lock applies to the next ones and is lifted
+	// by Succeeded if it turns out right.
+	_, err := tx.Exec(`
+		UPDATE login_attempt SET locked_until = $2, unlock_token_hash = NULL
+		WHERE key = $1;`, key, now.Add(t.lockout(failures, max)))
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (t loginThrottle) Failed(email, ip string) (string, error) {
+	token, err := rand.String(t.BytesPerToken)
+	if err != nil {
+		return "", fmt.Errorf("login failed: %w", err)
+	}
+	// The failure was counted by Allowed, only the first failure after the
+	// account got locked hands out an unlock token.
+	res, err := t.DB.Exec(`
+		UPDATE login_attempt SET unlock_token_hash = $2
+		WHERE key = $1 AND locked_until > $3 AND unlock_token_hash IS NULL;`,
+		emailKey(email), t.hash(token), time.Now())
+	if err != nil {
+		return "", fmt.Errorf("login failed: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", fmt.Errorf("login failed: %w", err)
+	}
+	if n == 0 {
+		return "", nil
+	}
+	return token, nil
+}
+
+func (t loginThrottle) Succeeded(email, ip string) error {
+	_, err := t.DB.Exec(`DELETE FROM login_attempt WHERE key = $1;`, emailKey(email))
+	if err != nil {
+		return fmt.Errorf("login succeeded: %w", err)
+	}
+	_, err = t.DB.Exec(`
+		UPDATE login_attempt SET
+			failures = GREATEST(failures - 1, 0),
+			locked_until = CASE WHEN failures - 1 < $2 THEN NULL ELSE locked_until END
+		WHERE key = $1;`, ipKey(ip), t.MaxAttemptsPerIP)
+	if err != nil {
+		return fmt.Errorf("login succeeded: %w", err)
+	}
+	return nil
+}
+
+func (t loginThrottle) Unlock(token string) error {
+	res, err := t.DB.Exec(`DELETE FROM login_attempt WHERE unlock_token_hash = $1;`, t.hash(token))
+	if err != nil {
+		return fmt.Errorf("unlock login: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (t loginThrottle) DeleteExpired(now time.Time) (int64, error) {
+	cutoff := now.Add(-t.Window)
+	res, err := t.DB.Exec(`
+		DELETE FROM login_attempt
+		WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $1);`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired login attempts: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// NewLoginThrottleMemory keeps sign in attempts in db, it takes the same
+// options as NewLoginThrottlePostgres.
+func NewLoginThrottleMemory(db *MemoryDB, opts ...loginThrottleOption) LoginThrottle {
+	return &loginThrottleMemory{
+		DB:                  db,
+		loginThrottleConfig: newLoginThrottleConfig(opts),
+	}
+}
+
+type loginThrottleMemory struct {
+	DB *MemoryDB
+	loginThrottleConfig
+}
+
+// loginAttempt is a row of the login_attempt table, zero times and an empty
+// hash stand for NULL.
+type loginAttempt struct {
+	Failures        int
+	LastFailureAt   time.Time
+	LockedUntil     time.Time
+	UnlockTokenHash string
+}
+
+func (t loginThrottleMemory) Allowed(email, ip string) error {
+	now := time.Now()
+	t.DB.mu.Lock()
+	defer t.DB.mu.Unlock()
+	// Refused attempts are not counted, so both keys are checked before
+	// either is reserved.
+	var until time.Time
+	for _, key := range []string{ipKey(ip), emailKey(email)} {
+		if attempt, ok := t.DB.loginAttempts[key]; ok && attempt.LockedUntil.After(now) {
+			if attempt.LockedUntil.After(until) {
+				until = attempt.LockedUntil
+			}
+		}
+	}
+	if !until.IsZero() {
+		return &LockedError{Until: until}
+	}
+	t.reserve(ipKey(ip), t.MaxAttemptsPerIP, now)
+	t.reserve(emailKey(email), t.MaxAttempts, now)
+	return nil
+}
+
+// reserve counts an attempt for key, which isn't locked, like
+// loginThrottle.reserve. mu must be held.
+func (t loginThrottleMemory) reserve(key string, max int, now time.Time) {
+	attempt, ok := t.DB.loginAttempts[key]
+	if !ok {
+		attempt = &loginAttempt{}
+		t.DB.loginAttempts[key] = attempt
+	}
+	cutoff := now.Add(-t.Window)
+	if attempt.LastFailureAt.Before(cutoff) && attempt.LockedUntil.Before(cutoff) {
+		attempt.Failures = 1
+	} else {
+		attempt.Failures++
+	}
+	attempt.LastFailureAt = now
+	if attempt.Failures >= max {
+		attempt.LockedUntil = now.Add(t.lockout(attempt.Failures, max))
+		attempt.UnlockTokenHash = ""
+	}
+}
+
+func (t loginThrottleMemory) Failed(email, ip string) (string, error) {
+	token, err := rand.String(t.BytesPerToken)
+	if err != nil {
+		return "", fmt.Errorf("login failed: %w", err)
+	}
+	t.DB.mu.Lock()
+	defer t.DB.mu.Unlock()
+	attempt, ok := t.DB.loginAttempts[emailKey(email)]
+	if !ok || !attempt.LockedUntil.After(time.Now()) || attempt.UnlockTokenHash != "" {
+		return "", nil
+	}
+	attempt.UnlockTokenHash = t.hash(token)
+	return token, nil
+}
+
+func (t loginThrottleMemory) Succeeded(email, ip string) error {
+	t.DB.mu.Lock()
+	defer t.DB.mu.Unlock()
+	delete(t.DB.loginAttempts, emailKey(email))
+	if attempt, ok := t.DB.loginAttempts[ipKey(ip)]; ok {
+		if attempt.Failures-1 < t.MaxAttemptsPerIP {
+			attempt.LockedUntil = time.Time{}
+		}
+		if attempt.Failures > 0 {
+			attempt.Failures--
+		}
+	}
+	return nil
+}
+
+func (t loginThrottleMemory) Unlock(token string) error {
+	hash := t.hash(token)
+	t.DB.mu.Lock()
+	defer t.DB.mu.Unlock()
+	for key, attempt := range t.DB.loginAttempts {
+		if attempt.UnlockTokenHash == hash {
+			delete(t.DB.loginAttempts, key)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (t loginThrottleMemory) DeleteExpired(now time.Time) (int64, error) {
+	cutoff := now.Add(-t.Window)
+	t.DB.mu.Lock()
+	defer t.DB.mu.Unlock()
+	var n int64
+	for key, attempt := range t.DB.loginAttempts {
+		if attempt.LastFailureAt.Before(cutoff) && attempt.LockedUntil.Before(cutoff) {
+			delete(t.DB.loginAttempts, key)
+			n++
+		}
+	}
+	return n, nil
+}
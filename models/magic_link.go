@@ -0,0 +1,170 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/rand"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMagicLinkDuration = 15 * time.Minute
+)
+
+type MagicLink struct {
+	ID     int
+	UserID uint
+	// Token is only set when a MagicLink is being created
+	Token     string
+	TokenHash string
+	// BrowserHash is the hash of a secret kept by the browser which asked for
+	// the link, the link only works in that browser.
+	BrowserHash string
+	ExpiresAt   time.Time
+}
+
+type MagicLinkService interface {
+	// Create returns ErrNotFound when no user has the given email. browser is
+	// a secret only known by the browser asking for the link.
+	Create(email, browser string) (*MagicLink, error)
+	// Consume returns ErrNotFound for unknown tokens, ErrTokenExpired for
+	// expired ones and ErrWrongBrowser when browser isn't the one the link
+	// was created for, the link can still be used from the right browser
+	// then. Using a link verifies the email address of the user.
+	Consume(token, browser string) (*User, error)
+	Expirer
+}
+
+type magicLinkOption func(service *magicLinkService)
+
+func WithBytesPerTokenMagicLink(bytesPerToken int) magicLinkOption {
+	return func(s *magicLinkService) {
+		if bytesPerToken > s.BytesPerToken {
+			s.BytesPerToken = bytesPerToken
+		}
+	}
+}
+
+func WithMagicLinkDuration(duration time.Duration) magicLinkOption {
+	return func(s *magicLinkService) {
+		if duration > 0 {
+			s.Duration = duration
+		}
+	}
+}
+
+func NewMagicLinkService(db *sql.DB, opts ...magicLinkOption) MagicLinkService {
+	s := &magicLinkService{
+		DB:            db,
+		BytesPerToken: MinBytesPerToken,
+		Duration:      DefaultMagicLinkDuration,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+type magicLinkService struct {
+	DB *sql.DB
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each magic link token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be used.
+	BytesPerToken int
+	// Duration is the amount of time that a MagicLink is valid for. Default DefaultMagicLinkDuration
+	Duration time.Duration
+}
+
+func (m magicLinkService) Create(email, browser string) (*MagicLink, error) {
+	email = strings.ToLower(email)
+	var userId uint
+	row := m.DB.QueryRow(`SELECT id FROM users WHERE email = $1;`, email)
+	err := row.Scan(&userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("create magic link: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+	token, err := rand.String(m.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+	link := MagicLink{
+		UserID:      userId,
+		Token:       token,
+		TokenHash:   m.hash(token),
+		BrowserHash: m.hash(browser),
+		ExpiresAt:   time.Now().Add(m.Duration),
+	}
+
+	row = m.DB.QueryRow(`
+		INSERT INTO magic_link (user_id, token_hash, browser_hash, expires_at)
+		VALUES ($1, $2, $3, $4) ON CONFLICT(user_id) DO
+		UPDATE SET token_hash = $2, browser_hash = $3, expires_at = $4 RETURNING id;`,
+		link.UserID, link.TokenHash, link.BrowserHash, link.ExpiresAt)
+	err = row.Scan(&link.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+	return &link, nil
+}
+
+func (m magicLinkService) Consume(token, browser string) (*User, error) {
+	var user User
+	// Deleting the link is what uses it, so concurrent requests with the same
+	// link can't both get a session.
+	row := m.DB.QueryRow(`
+		DELETE FROM magic_link m USING users u
+		WHERE u.id = m.user_id AND m.token_hash = $1 AND m.browser_hash = $2 AND m.expires_at > $3
+		RETURNING u.id, u.email, u.email_verified_at;`, m.hash(token), m.hash(browser), time.Now())
+	err := row.Scan(&user.ID, &user.Email, &user.EmailVerifiedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("consume magic link: %w", m.unusable(token))
+		}
+		return nil, fmt.Errorf("consume magic link: %w", err)
+	}
+	if user.EmailVerifiedAt == nil {
+		now := time.Now()
+		_, err = m.DB.Exec(`UPDATE users SET email_verified_at = $2 WHERE id = $1;`, user.ID, now)
+		if err != nil {
+			return nil, fmt.Errorf("consume magic link: %w", err)
+		}
+		user.EmailVerifiedAt = &now
+	}
+	return &user, nil
+}
+
+// unusable tells why the link of token can't be used.
+func (m magicLinkService) unusable(token string) error {
+	var expiresAt time.Time
+	row := m.DB.QueryRow(`SELECT expires_at FROM magic_link WHERE token_hash = $1;`, m.hash(token))
+	if err := row.Scan(&expiresAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if !time.Now().Before(expiresAt) {
+		return ErrTokenExpired
+	}
+	return ErrWrongBrowser
+}
+
+func (m magicLinkService) DeleteExpired(now time.Time) (int64, error) {
+	res, err := m.DB.Exec(`DELETE FROM magic_link WHERE expires_at <= $1;`, now)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired magic links: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+func (m magicLinkService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,84 @@
+package models_test
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMagicLinkServiceConsume(t *testing.T) {
+	db := openTestDB(t)
+	links := models.NewMagicLinkService(db)
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+	user, err := models.NewUserServicePostgres(db).Create("magic-"+token+"@example.com", "pw-"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := links.Create(user.Email, "browser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The link keeps working from the browser which asked for it.
+	if _, err = links.Consume(link.Token, "another browser"); !errors.Is(err, models.ErrWrongBrowser) {
+		t.Fatalf("Consume from another browser: err = %v, want ErrWrongBrowser", err)
+	}
+	signedIn, err := links.Consume(link.Token, "browser")
+	if err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+	if signedIn.ID != user.ID || signedIn.EmailVerifiedAt == nil {
+		t.Errorf("Consume = %+v, want the verified user %d", signedIn, user.ID)
+	}
+	if _, err = links.Consume(link.Token, "browser"); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Consume twice: err = %v, want ErrNotFound", err)
+	}
+
+	expired, err := models.NewMagicLinkService(db, models.WithMagicLinkDuration(time.Nanosecond)).Create(user.Email, "browser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = links.Consume(expired.Token, "browser"); !errors.Is(err, models.ErrTokenExpired) {
+		t.Errorf("Consume an expired link: err = %v, want ErrTokenExpired", err)
+	}
+}
+
+func TestMagicLinkServiceConsumeConcurrently(t *testing.T) {
+	db := openTestDB(t)
+	links := models.NewMagicLinkService(db)
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+	user, err := models.NewUserServicePostgres(db).Create("magic-race-"+token+"@example.com", "pw-"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := links.Create(user.Email, "browser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const requests = 8
+	errs := make([]error, requests)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = links.Consume(link.Token, "browser")
+		}(i)
+	}
+	wg.Wait()
+	used := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			used++
+		case !errors.Is(err, models.ErrNotFound):
+			t.Errorf("Consume: %v", err)
+		}
+	}
+	if used != 1 {
+		t.Errorf("the link was used %d times, want once", used)
+	}
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDB holds the rows of the in-memory services, which are meant for
+// tests and need no database. Services sharing a MemoryDB see each other's
+// rows, like the Postgres services sharing a *sql.DB do.
+type MemoryDB struct {
+	mu             sync.Mutex
+	users          map[uint]*User
+	sessions       map[uint]*Session
+	passwordResets map[int]*PasswordReset
+	passkeys       map[uint]*Passkey
+	// passkeyChallenges is keyed by challenge.
+	passkeyChallenges  map[string]passkeyChallenge
+	galleries          map[uint]*Gallery
+	emailVerifications map[int]*EmailVerification
+	// loginAttempts is keyed by emailKey or ipKey.
+	loginAttempts map[string]*loginAttempt
+	// totps and recoveryCodes are keyed by user id.
+	totps            map[uint]*totpSecret
+	recoveryCodes    map[uint][]recoveryCode
+	accountDeletions map[int]*AccountDeletion
+	// lastID is shared by every table, ids only have to be unique per table.
+	lastID uint
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		users:          make(map[uint]*User),
+		sessions:       make(map[uint]*Session),
+		passwordResets: make(map[int]*PasswordReset),
+		passkeys:       make(map[uint]*Passkey),
+
+		passkeyChallenges:  make(map[string]passkeyChallenge),
+		galleries:          make(map[uint]*Gallery),
+		emailVerifications: make(map[int]*EmailVerification),
+		loginAttempts:      make(map[string]*loginAttempt),
+		totps:              make(map[uint]*totpSecret),
+		recoveryCodes:      make(map[uint][]recoveryCode),
+		accountDeletions:   make(map[int]*AccountDeletion),
+	}
+}
+
+type passkeyChallenge struct {
+	Ceremony  string
+	ExpiresAt time.Time
+}
+
+// nextID returns a new id, the same way a SERIAL column does. mu must be held.
+func (db *MemoryDB) nextID() uint {
+	db.lastID++
+	return db.lastID
+}
+
+// userByEmail looks email up ignoring its case. mu must be held.
+func (db *MemoryDB) userByEmail(email string) (*User, bool) {
+	email = strings.ToLower(email)
+	for _, user := range db.users {
+		if user.Email == email {
+			return user, true
+		}
+	}
+	return nil, false
+}
+
+// accountDeletionByUserID returns the deletion scheduled for the user. mu
+// must be held.
+func (db *MemoryDB) accountDeletionByUserID(userID uint) (*AccountDeletion, bool) {
+	for _, deletion := range db.accountDeletions {
+		if deletion.UserID == userID {
+			return deletion, true
+		}
+	}
+	return nil, false
+}
+
+// deleteUser removes the user along with every row referencing them, like
+// the ON DELETE CASCADE of the Postgres tables. mu must be held.
+func (db *MemoryDB) deleteUser(userID uint) {
+	delete(db.users, userID)
+	for id, session := range db.sessions {
+		if session.UserId == userID {
+			delete(db.sessions, id)
+		}
+	}
+	for id, pwReset := range db.passwordResets {
+		if pwReset.UserID == userID {
+			delete(db.passwordResets, id)
+		}
+	}
+	for id, passkey := range db.passkeys {
+		if passkey.UserID == userID {
+			delete(db.passkeys, id)
+		}
+	}
+	for id, gallery := range db.galleries {
+		if gallery.UserID == userID {
+			delete(db.galleries, id)
+		}
+	}
+	for id, verification := range db.emailVerifications {
+		if verification.UserID == userID {
+			delete(db.emailVerifications, id)
+		}
+	}
+	delete(db.totps, userID)
+	delete(db.recoveryCodes, userID)
+	for id, deletion := range db.accountDeletions {
+		if deletion.UserID == userID {
+			delete(db.accountDeletions, id)
+		}
+	}
+}
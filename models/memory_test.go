@@ -0,0 +1,31 @@
+package models_test
+
+import (
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/arkadiont/lenslocked/models/modelstest"
+	"testing"
+	"time"
+)
+
+func TestMemoryServices(t *testing.T) {
+	db := models.NewMemoryDB()
+	images := models.NewImageService(models.NewImageStoreDisk(t.TempDir()))
+	err := modelstest.TestServices(modelstest.Services{
+		Users:                 models.NewUserServiceMemory(db),
+		Sessions:              models.NewSessionServiceMemory(db),
+		PasswordResets:        models.NewPasswordResetServiceMemory(db),
+		ExpiredSessions:       models.NewSessionServiceMemory(db, models.WithSessionLifetime(time.Nanosecond)),
+		ExpiredPasswordResets: models.NewPasswordResetServiceMemory(db, models.WithResetDuration(time.Nanosecond)),
+
+		Galleries:                 models.NewGalleryServiceMemory(db),
+		EmailVerifications:        models.NewEmailVerificationServiceMemory(db),
+		ExpiredEmailVerifications: models.NewEmailVerificationServiceMemory(db, models.WithVerificationDuration(time.Nanosecond)),
+		LoginThrottle:             models.NewLoginThrottleMemory(db),
+		TwoFactor:                 models.NewTwoFactorServiceMemory(db),
+		AccountDeletions:          models.NewAccountDeletionServiceMemory(db, images),
+		ExpiredAccountDeletions:   models.NewAccountDeletionServiceMemory(db, images, models.WithDeletionGracePeriod(time.Nanosecond)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
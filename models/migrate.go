@@ -0,0 +1,287 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationLockID identifies the advisory lock held while migrating, so
+// instances starting together don't apply the same migration twice.
+const migrationLockID int64 = 7_243_911_530
+
+var migrationFileRE = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a numbered change of the database schema.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      string
+	Down    string
+	// AppliedAt is nil while the migration is pending.
+	AppliedAt *time.Time
+}
+
+// Migrator applies and reverts migrations, recording the applied versions in
+// the schema_migrations table.
+type Migrator interface {
+	// Up applies every pending migration in order and returns them. It
+	// returns ErrUntrackedSchema for databases created before migrations
+	// were tracked, until they are baselined.
+	Up() ([]Migration, error)
+	// Down reverts the last steps applied migrations, newest first, and
+	// returns them.
+	Down(steps int) ([]Migration, error)
+	// Status returns every known migration, telling whether it was applied.
+	Status() ([]Migration, error)
+	// Baseline records the migrations up to version as applied without
+	// running them, for databases created before migrations were tracked.
+	Baseline(version uint) ([]Migration, error)
+}
+
+// NewMigratorPostgres reads the migrations of fsys, named
+// NNNN_name.up.sql and NNNN_name.down.sql, see migrations.FS
+func NewMigratorPostgres(db *sql.DB, fsys fs.FS) (Migrator, error) {
+	migrations, err := readMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{DB: db, Migrations: migrations}, nil
+}
+
+type migrator struct {
+	DB *sql.DB
+	// Migrations is sorted by version.
+	Migrations []Migration
+}
+
+func (m *migrator) Up() ([]Migration, error) {
+	var applied []Migration
+	err := m.locked(func(conn *sql.Conn, status []Migration) error {
+		if err := m.checkTracked(conn, status); err != nil {
+			return err
+		}
+		for _, migration := range status {
+			if migration.AppliedAt != nil {
+				continue
+			}
+			err := m.apply(conn, migration.Up,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2);`,
+				migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("migrate up %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+func (m *migrator) Down(steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.locked(func(conn *sql.Conn, status []Migration) error {
+		for i := len(status) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := status[i]
+			if migration.AppliedAt == nil {
+				continue
+			}
+			err := m.apply(conn, migration.Down,
+				`DELETE FROM schema_migrations WHERE version = $1;`, migration.Version)
+			if err != nil {
+				return fmt.Errorf("migrate down %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+func (m *migrator) Status() ([]Migration, error) {
+	var status []Migration
+	err := m.locked(func(conn *sql.Conn, s []Migration) error {
+		status = s
+		return nil
+	})
+	return status, err
+}
+
+func (m *migrator) Baseline(version uint) ([]Migration, error) {
+	known := false
+	for _, migration := range m.Migrations {
+		known = known || migration.Version == version
+	}
+	if !known {
+		return nil, fmt.Errorf("migrate baseline: unknown version %d", version)
+	}
+	var recorded []Migration
+	err := m.locked(func(conn *sql.Conn, status []Migration) error {
+		for _, migration := range status {
+			if migration.Version > version || migration.AppliedAt != nil {
+				continue
+			}
+			_, err := conn.ExecContext(context.Background(), `
+				INSERT INTO schema_migrations (version, name) VALUES ($1, $2);`,
+				migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("migrate baseline %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			recorded = append(recorded, migration)
+		}
+		return nil
+	})
+	return recorded, err
+}
+
+// locked runs fn while holding the migration lock, along with the current
+// status of the migrations.
+func (m *migrator) locked(fn func(conn *sql.Conn, status []Migration) error) error {
+	ctx := context.Background()
+	// Advisory locks belong to a connection, so the same one is used until
+	// the lock is released.
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1);`, migrationLockID); err != nil {
+		return fmt.Errorf("migrate lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1);`, migrationLockID)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		);`)
+	if err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	status, err := m.status(ctx, conn)
+	if err != nil {
+		return err
+	}
+	return fn(conn, status)
+}
+
+func (m *migrator) status(ctx context.Context, conn *sql.Conn) ([]Migration, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations;`)
+	if err != nil {
+		return nil, fmt.Errorf("migration status: %w", err)
+	}
+	defer rows.Close()
+	applied := make(map[uint]time.Time)
+	for rows.Next() {
+		var version uint
+		var appliedAt time.Time
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("migration status: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("migration status: %w", err)
+	}
+	status := make([]Migration, len(m.Migrations))
+	for i, migration := range m.Migrations {
+		if appliedAt, ok := applied[migration.Version]; ok {
+			migration.AppliedAt = &appliedAt
+		}
+		status[i] = migration
+	}
+	return status, nil
+}
+
+// checkTracked returns ErrUntrackedSchema when no migration was recorded but
+// the users table, created by the first one, exists already: running the
+// migrations would fail halfway through.
+func (m *migrator) checkTracked(conn *sql.Conn, status []Migration) error {
+	for _, migration := range status {
+		if migration.AppliedAt != nil {
+			return nil
+		}
+	}
+	var exists bool
+	row := conn.QueryRowContext(context.Background(), `SELECT to_regclass('users') IS NOT NULL;`)
+	if err := row.Scan(&exists); err != nil {
+		return fmt.Errorf("migrate: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("migrate: %w", ErrUntrackedSchema)
+	}
+	return nil
+}
+
+// apply runs script and records it with query in a single transaction, a
+// failing migration leaves the schema untouched.
+func (m *migrator) apply(conn *sql.Conn, script, query string, args ...any) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// readMigrations pairs the up and down files of fsys by version.
+func readMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("read migrations: %w", err)
+	}
+	byVersion := make(map[uint]*Migration)
+	for _, entry := range entries {
+		match := migrationFileRE.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(match[1], 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("read migration %s: %w", entry.Name(), err)
+		}
+		script, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("read migration %s: %w", entry.Name(), err)
+		}
+		migration, ok := byVersion[uint(version)]
+		if !ok {
+			migration = &Migration{Version: uint(version), Name: match[2]}
+			byVersion[uint(version)] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("read migration %s: version %d is also named %s",
+				entry.Name(), version, migration.Name)
+		}
+		if match[3] == "up" {
+			migration.Up = string(script)
+		} else {
+			migration.Down = string(script)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("read migration %04d_%s: both up and down files are required",
+				migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
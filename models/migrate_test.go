@@ -0,0 +1,206 @@
+package models_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/models"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// testMigrations are named out of order on purpose, 10 comes after 2.
+var testMigrations = fstest.MapFS{
+	"1_users.up.sql":      {Data: []byte(`CREATE TABLE users (id SERIAL PRIMARY KEY);`)},
+	"1_users.down.sql":    {Data: []byte(`DROP TABLE users;`)},
+	"10_notes.up.sql":     {Data: []byte(`CREATE TABLE notes (id SERIAL PRIMARY KEY, user_id INT REFERENCES users(id));`)},
+	"10_notes.down.sql":   {Data: []byte(`DROP TABLE notes;`)},
+	"2_email.up.sql":      {Data: []byte(`ALTER TABLE users ADD COLUMN email TEXT;`)},
+	"2_email.down.sql":    {Data: []byte(`ALTER TABLE users DROP COLUMN email;`)},
+	"README.md":           {Data: []byte(`not a migration`)},
+	"20_broken.up.sql.bk": {Data: []byte(`not a migration either`)},
+}
+
+// openTestSchema returns a connection to a new, empty schema of the test
+// database, dropped at the end of the test.
+func openTestSchema(t *testing.T) *sql.DB {
+	t.Helper()
+	db := openTestDB(t)
+	schema := "migrate_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := db.Exec(`CREATE SCHEMA ` + schema + `;`); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DROP SCHEMA ` + schema + ` CASCADE;`)
+	})
+	scoped, err := sql.Open("pgx", os.Getenv("LENSLOCKED_TEST_DSN")+" search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { scoped.Close() })
+	return scoped
+}
+
+func versions(migrations []models.Migration) string {
+	var s []uint
+	for _, m := range migrations {
+		s = append(s, m.Version)
+	}
+	return fmt.Sprint(s)
+}
+
+func TestNewMigratorInvalidFiles(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"missing down": {
+			"1_users.up.sql": {Data: []byte(`SELECT 1;`)},
+		},
+		"missing up": {
+			"1_users.down.sql": {Data: []byte(`SELECT 1;`)},
+		},
+		"two names for a version": {
+			"1_users.up.sql":    {Data: []byte(`SELECT 1;`)},
+			"1_users.down.sql":  {Data: []byte(`SELECT 1;`)},
+			"01_other.up.sql":   {Data: []byte(`SELECT 1;`)},
+			"01_other.down.sql": {Data: []byte(`SELECT 1;`)},
+		},
+	}
+	for name, fsys := range tests {
+		if _, err := models.NewMigratorPostgres(nil, fsys); err == nil {
+			t.Errorf("%s: NewMigratorPostgres succeeded, want an error", name)
+		}
+	}
+	if _, err := models.NewMigratorPostgres(nil, testMigrations); err != nil {
+		t.Errorf("NewMigratorPostgres ignoring other files: %v", err)
+	}
+}
+
+func TestMigratorPostgres(t *testing.T) {
+	db := openTestSchema(t)
+	migrator, err := models.NewMigratorPostgres(db, testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	if got := versions(applied); got != "[1 2 10]" {
+		t.Fatalf("Up applied %s, want [1 2 10]", got)
+	}
+	if applied, err = migrator.Up(); err != nil || len(applied) != 0 {
+		t.Errorf("Up again: applied %s, err = %v, want nothing", versions(applied), err)
+	}
+	if _, err = db.Exec(`INSERT INTO users (email) VALUES ('a@example.com');`); err != nil {
+		t.Errorf("the schema isn't migrated: %v", err)
+	}
+
+	reverted, err := migrator.Down(2)
+	if err != nil {
+		t.Fatalf("Down: %v", err)
+	}
+	if got := versions(reverted); got != "[10 2]" {
+		t.Errorf("Down(2) reverted %s, want [10 2]", got)
+	}
+	status, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != 3 || status[0].AppliedAt == nil || status[1].AppliedAt != nil || status[2].AppliedAt != nil {
+		t.Errorf("Status after Down(2) = %+v, want only 1 applied", status)
+	}
+	if applied, err = migrator.Up(); err != nil || versions(applied) != "[2 10]" {
+		t.Errorf("Up after Down: applied %s, err = %v, want [2 10]", versions(applied), err)
+	}
+}
+
+func TestMigratorPostgresFailure(t *testing.T) {
+	db := openTestSchema(t)
+	fsys := fstest.MapFS{
+		"1_users.up.sql":    testMigrations["1_users.up.sql"],
+		"1_users.down.sql":  testMigrations["1_users.down.sql"],
+		"2_broken.up.sql":   {Data: []byte(`CREATE TABLE half (id INT); SELECT * FROM missing;`)},
+		"2_broken.down.sql": {Data: []byte(`DROP TABLE half;`)},
+	}
+	migrator, err := models.NewMigratorPostgres(db, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrator.Up()
+	if err == nil || versions(applied) != "[1]" {
+		t.Fatalf("Up: applied %s, err = %v, want [1] and an error", versions(applied), err)
+	}
+	// The failing migration left nothing behind.
+	var half sql.NullString
+	if err = db.QueryRow(`SELECT to_regclass('half')::text;`).Scan(&half); err != nil || half.Valid {
+		t.Errorf("the failed migration created table half: %v, err = %v", half, err)
+	}
+	status, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status[1].AppliedAt != nil {
+		t.Errorf("the failed migration was recorded")
+	}
+}
+
+func TestMigratorPostgresBaseline(t *testing.T) {
+	db := openTestSchema(t)
+	// The database was created from the first script by hand.
+	if _, err := db.Exec(string(testMigrations["1_users.up.sql"].Data)); err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := models.NewMigratorPostgres(db, testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); !errors.Is(err, models.ErrUntrackedSchema) {
+		t.Fatalf("Up on an untracked schema: err = %v, want ErrUntrackedSchema", err)
+	}
+	if _, err = migrator.Baseline(3); err == nil {
+		t.Errorf("Baseline to an unknown version succeeded")
+	}
+	recorded, err := migrator.Baseline(1)
+	if err != nil || versions(recorded) != "[1]" {
+		t.Fatalf("Baseline(1): recorded %s, err = %v, want [1]", versions(recorded), err)
+	}
+	applied, err := migrator.Up()
+	if err != nil || versions(applied) != "[2 10]" {
+		t.Errorf("Up after Baseline: applied %s, err = %v, want [2 10]", versions(applied), err)
+	}
+}
+
+func TestMigratorPostgresConcurrentUp(t *testing.T) {
+	db := openTestSchema(t)
+	// Instances starting together share the database, the advisory lock
+	// makes them take turns.
+	const instances = 4
+	applied := make([][]models.Migration, instances)
+	errs := make([]error, instances)
+	var wg sync.WaitGroup
+	for i := 0; i < instances; i++ {
+		migrator, err := models.NewMigratorPostgres(db, testMigrations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			applied[i], errs[i] = migrator.Up()
+		}(i)
+	}
+	wg.Wait()
+	total := 0
+	for i := range applied {
+		if errs[i] != nil {
+			t.Errorf("instance %d: %v", i, errs[i])
+		}
+		total += len(applied[i])
+	}
+	if total != 3 {
+		t.Errorf("the instances applied %d migrations, want each of the 3 once", total)
+	}
+}
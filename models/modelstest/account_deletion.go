@@ -0,0 +1,118 @@
+package modelstest
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"time"
+)
+
+func (t *tester) checkAccountDeletions() {
+	email, password, user, ok := t.newUser()
+	if !ok {
+		return
+	}
+	replaced, err := t.s.AccountDeletions.Schedule(user.ID)
+	if err != nil {
+		t.errorf("AccountDeletions.Schedule: %v", err)
+		return
+	}
+	deletion, err := t.s.AccountDeletions.Schedule(user.ID)
+	if err != nil {
+		t.errorf("AccountDeletions.Schedule: %v", err)
+		return
+	}
+	if deletion.Token == "" || deletion.Token == replaced.Token {
+		t.errorf("AccountDeletions.Schedule: tokens %q and %q, want distinct tokens", replaced.Token, deletion.Token)
+	}
+	if deletion.ID != replaced.ID || !deletion.DeleteAt.Equal(replaced.DeleteAt) {
+		t.errorf("AccountDeletions.Schedule twice: deletion %d at %v, want %d at %v, not delayed",
+			deletion.ID, deletion.DeleteAt, replaced.ID, replaced.DeleteAt)
+	}
+	if !deletion.DeleteAt.After(deletion.RequestedAt) {
+		t.errorf("AccountDeletions.Schedule: DeleteAt %v, want a grace period after %v", deletion.DeleteAt, deletion.RequestedAt)
+	}
+	if got, err := t.s.AccountDeletions.ByUserID(user.ID); err != nil {
+		t.errorf("AccountDeletions.ByUserID: %v", err)
+	} else if got.ID != deletion.ID {
+		t.errorf("AccountDeletions.ByUserID: deletion %d, want %d", got.ID, deletion.ID)
+	}
+
+	// Deletions still in their grace period are kept.
+	if _, err = t.s.AccountDeletions.DeleteExpired(time.Now()); err != nil {
+		t.errorf("AccountDeletions.DeleteExpired: %v", err)
+	}
+	if _, err = t.s.Users.Authenticate(email, password); err != nil {
+		t.errorf("Users.Authenticate during the grace period: %v", err)
+	}
+
+	if _, err = t.s.AccountDeletions.Cancel(replaced.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("AccountDeletions.Cancel of a replaced token: err = %v, want ErrNotFound", err)
+	}
+	if got, err := t.s.AccountDeletions.Cancel(deletion.Token); err != nil {
+		t.errorf("AccountDeletions.Cancel: %v", err)
+	} else if got.ID != user.ID {
+		t.errorf("AccountDeletions.Cancel: user %d, want %d", got.ID, user.ID)
+	}
+	if _, err = t.s.AccountDeletions.ByUserID(user.ID); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("AccountDeletions.ByUserID after Cancel: err = %v, want ErrNotFound", err)
+	}
+	if err = t.s.AccountDeletions.CancelByUserID(user.ID); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("AccountDeletions.CancelByUserID without a deletion: err = %v, want ErrNotFound", err)
+	}
+	if _, err = t.s.AccountDeletions.Schedule(user.ID); err != nil {
+		t.errorf("AccountDeletions.Schedule: %v", err)
+		return
+	}
+	if err = t.s.AccountDeletions.CancelByUserID(user.ID); err != nil {
+		t.errorf("AccountDeletions.CancelByUserID: %v", err)
+	}
+
+	if t.s.ExpiredAccountDeletions != nil {
+		t.checkExpiredAccountDeletions()
+	}
+}
+
+// checkExpiredAccountDeletions deletes a user, along with their sessions and
+// galleries.
+func (t *tester) checkExpiredAccountDeletions() {
+	email, password, user, ok := t.newUser()
+	if !ok {
+		return
+	}
+	session, err := t.s.Sessions.Create(user.ID, "modelstest", "127.0.0.1")
+	if err != nil {
+		t.errorf("Sessions.Create: %v", err)
+		return
+	}
+	var gallery *models.Gallery
+	if t.s.Galleries != nil {
+		if gallery, err = t.s.Galleries.Create("modelstest", user.ID); err != nil {
+			t.errorf("Galleries.Create: %v", err)
+			return
+		}
+	}
+	if _, err = t.s.ExpiredAccountDeletions.Schedule(user.ID); err != nil {
+		t.errorf("ExpiredAccountDeletions.Schedule: %v", err)
+		return
+	}
+	n, err := t.s.ExpiredAccountDeletions.DeleteExpired(time.Now())
+	if err != nil {
+		t.errorf("AccountDeletions.DeleteExpired: %v", err)
+	} else if n < 1 {
+		t.errorf("AccountDeletions.DeleteExpired: %d accounts deleted, want at least 1", n)
+	}
+	if _, err = t.s.Users.Authenticate(email, password); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Users.Authenticate of a deleted account: err = %v, want ErrNotFound", err)
+	}
+	if _, err = t.s.Sessions.User(session.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Sessions.User of a deleted account: err = %v, want ErrNotFound", err)
+	}
+	if gallery != nil {
+		if _, err = t.s.Galleries.ByID(gallery.ID); !errors.Is(err, models.ErrNotFound) {
+			t.errorf("Galleries.ByID of a deleted account: err = %v, want ErrNotFound", err)
+		}
+	}
+	if _, err = t.s.ExpiredAccountDeletions.ByUserID(user.ID); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("AccountDeletions.ByUserID of a deleted account: err = %v, want ErrNotFound", err)
+	}
+}
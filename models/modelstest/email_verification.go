@@ -0,0 +1,70 @@
+package modelstest
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"time"
+)
+
+func (t *tester) checkEmailVerifications() {
+	_, _, user, ok := t.newUser()
+	if !ok {
+		return
+	}
+	if user.Verified() {
+		t.errorf("Users.Create: the email of a new user is verified")
+	}
+	replaced, err := t.s.EmailVerifications.Create(user.ID)
+	if err != nil {
+		t.errorf("EmailVerifications.Create: %v", err)
+		return
+	}
+	verification, err := t.s.EmailVerifications.Create(user.ID)
+	if err != nil {
+		t.errorf("EmailVerifications.Create: %v", err)
+		return
+	}
+	if verification.UserID != user.ID {
+		t.errorf("EmailVerifications.Create: UserID = %d, want %d", verification.UserID, user.ID)
+	}
+	if verification.Token == "" || verification.TokenHash == "" || verification.TokenHash == verification.Token {
+		t.errorf("EmailVerifications.Create: Token %q, TokenHash %q, want a token and its hash",
+			verification.Token, verification.TokenHash)
+	}
+	if _, err = t.s.EmailVerifications.Consume(replaced.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("EmailVerifications.Consume of a replaced token: err = %v, want ErrNotFound", err)
+	}
+	got, err := t.s.EmailVerifications.Consume(verification.Token)
+	if err != nil {
+		t.errorf("EmailVerifications.Consume: %v", err)
+	} else if got.ID != user.ID || !got.Verified() {
+		t.errorf("EmailVerifications.Consume: user %d verified %t, want %d verified", got.ID, got.Verified(), user.ID)
+	}
+	if _, err = t.s.EmailVerifications.Consume(verification.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("EmailVerifications.Consume of a used token: err = %v, want ErrNotFound", err)
+	}
+
+	if t.s.ExpiredEmailVerifications != nil {
+		t.checkExpiredEmailVerifications(user.ID)
+	}
+}
+
+func (t *tester) checkExpiredEmailVerifications(userID uint) {
+	verification, err := t.s.ExpiredEmailVerifications.Create(userID)
+	if err != nil {
+		t.errorf("ExpiredEmailVerifications.Create: %v", err)
+		return
+	}
+	if _, err = t.s.ExpiredEmailVerifications.Consume(verification.Token); !errors.Is(err, models.ErrTokenExpired) {
+		t.errorf("EmailVerifications.Consume of an expired token: err = %v, want ErrTokenExpired", err)
+	}
+	n, err := t.s.ExpiredEmailVerifications.DeleteExpired(time.Now())
+	if err != nil {
+		t.errorf("EmailVerifications.DeleteExpired: %v", err)
+	} else if n < 1 {
+		t.errorf("EmailVerifications.DeleteExpired: %d verifications deleted, want at least 1", n)
+	}
+	if _, err = t.s.ExpiredEmailVerifications.Consume(verification.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("EmailVerifications.Consume of a token deleted by DeleteExpired: err = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,144 @@
+package modelstest
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+)
+
+func (t *tester) checkGalleries() {
+	_, password, user, ok := t.newUser()
+	if !ok {
+		return
+	}
+	_, _, other, ok := t.newUser()
+	if !ok {
+		return
+	}
+	gallery, err := t.s.Galleries.Create("modelstest", user.ID)
+	if err != nil {
+		t.errorf("Galleries.Create: %v", err)
+		return
+	}
+	if gallery.ID == 0 || gallery.UserID != user.ID || gallery.Visibility != models.VisibilityPrivate {
+		t.errorf("Galleries.Create: %+v, want a private gallery of user %d", gallery, user.ID)
+	}
+	second, err := t.s.Galleries.Create("modelstest second", user.ID)
+	if err != nil {
+		t.errorf("Galleries.Create: %v", err)
+		return
+	}
+	if _, err = t.s.Galleries.Create("modelstest other", other.ID); err != nil {
+		t.errorf("Galleries.Create: %v", err)
+		return
+	}
+	galleries, err := t.s.Galleries.ByUserID(user.ID)
+	if err != nil {
+		t.errorf("Galleries.ByUserID: %v", err)
+	} else if len(galleries) != 2 || galleries[0].ID != gallery.ID || galleries[1].ID != second.ID {
+		t.errorf("Galleries.ByUserID: %+v, want galleries %d and %d", galleries, gallery.ID, second.ID)
+	}
+
+	gallery.Title = "modelstest renamed"
+	gallery.Visibility = models.VisibilityUnlisted
+	if err = t.s.Galleries.Update(gallery); err != nil {
+		t.errorf("Galleries.Update: %v", err)
+	}
+	got, err := t.s.Galleries.ByID(gallery.ID)
+	if err != nil {
+		t.errorf("Galleries.ByID: %v", err)
+		return
+	}
+	if got.Title != gallery.Title || got.Visibility != gallery.Visibility {
+		t.errorf("Galleries.ByID after Update: %q %s, want %q %s", got.Title, got.Visibility, gallery.Title, gallery.Visibility)
+	}
+	invalid := *got
+	invalid.Visibility = "everyone"
+	if err = t.s.Galleries.Update(&invalid); err == nil {
+		t.errorf("Galleries.Update with visibility %q succeeded", invalid.Visibility)
+	}
+
+	t.checkShareTokens(gallery)
+
+	if err = t.s.Galleries.SetPassword(gallery.ID, ""); !errors.As(err, new(*models.ValidationError)) {
+		t.errorf("Galleries.SetPassword with an empty password: err = %v, want a *ValidationError", err)
+	}
+	if err = t.s.Galleries.SetPassword(gallery.ID, password); err != nil {
+		t.errorf("Galleries.SetPassword: %v", err)
+	}
+	if got, err = t.s.Galleries.ByID(gallery.ID); err != nil {
+		t.errorf("Galleries.ByID: %v", err)
+		return
+	}
+	if err = t.s.Galleries.CheckPassword(got, password); err != nil {
+		t.errorf("Galleries.CheckPassword: %v", err)
+	}
+	if err = t.s.Galleries.CheckPassword(got, password+"-wrong"); !errors.Is(err, models.ErrInvalidPassword) {
+		t.errorf("Galleries.CheckPassword with a wrong password: err = %v, want ErrInvalidPassword", err)
+	}
+	if err = t.s.Galleries.RemovePassword(gallery.ID); err != nil {
+		t.errorf("Galleries.RemovePassword: %v", err)
+	}
+	if got, err = t.s.Galleries.ByID(gallery.ID); err != nil {
+		t.errorf("Galleries.ByID: %v", err)
+		return
+	}
+	if err = t.s.Galleries.CheckPassword(got, ""); err != nil {
+		t.errorf("Galleries.CheckPassword after RemovePassword: %v", err)
+	}
+
+	if err = t.s.Galleries.Delete(gallery.ID); err != nil {
+		t.errorf("Galleries.Delete: %v", err)
+	}
+	if _, err = t.s.Galleries.ByID(gallery.ID); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Galleries.ByID of a deleted gallery: err = %v, want ErrNotFound", err)
+	}
+	if _, err = t.s.Galleries.RegenerateShareToken(gallery.ID); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Galleries.RegenerateShareToken of a deleted gallery: err = %v, want ErrNotFound", err)
+	}
+}
+
+// checkShareTokens checks the share links of gallery, which must be
+// unlisted.
+func (t *tester) checkShareTokens(gallery *models.Gallery) {
+	replaced, err := t.s.Galleries.RegenerateShareToken(gallery.ID)
+	if err != nil {
+		t.errorf("Galleries.RegenerateShareToken: %v", err)
+		return
+	}
+	token, err := t.s.Galleries.RegenerateShareToken(gallery.ID)
+	if err != nil {
+		t.errorf("Galleries.RegenerateShareToken: %v", err)
+		return
+	}
+	if token == "" || token == replaced {
+		t.errorf("Galleries.RegenerateShareToken: tokens %q and %q, want distinct tokens", replaced, token)
+	}
+	if got, err := t.s.Galleries.ByShareToken(token); err != nil {
+		t.errorf("Galleries.ByShareToken: %v", err)
+	} else if got.ID != gallery.ID {
+		t.errorf("Galleries.ByShareToken: gallery %d, want %d", got.ID, gallery.ID)
+	}
+	if _, err = t.s.Galleries.ByShareToken(replaced); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Galleries.ByShareToken of a replaced token: err = %v, want ErrNotFound", err)
+	}
+
+	private := *gallery
+	private.Visibility = models.VisibilityPrivate
+	if err = t.s.Galleries.Update(&private); err != nil {
+		t.errorf("Galleries.Update: %v", err)
+		return
+	}
+	if _, err = t.s.Galleries.ByShareToken(token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Galleries.ByShareToken of a private gallery: err = %v, want ErrNotFound", err)
+	}
+	if err = t.s.Galleries.Update(gallery); err != nil {
+		t.errorf("Galleries.Update: %v", err)
+		return
+	}
+	if err = t.s.Galleries.RevokeShareToken(gallery.ID); err != nil {
+		t.errorf("Galleries.RevokeShareToken: %v", err)
+	}
+	if _, err = t.s.Galleries.ByShareToken(token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Galleries.ByShareToken of a revoked token: err = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,93 @@
+package modelstest
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/arkadiont/lenslocked/rand"
+	"strings"
+	"time"
+)
+
+func (t *tester) checkLoginThrottle() {
+	token, err := rand.String(12)
+	if err != nil {
+		t.errorf("random email: %v", err)
+		return
+	}
+	// Every run uses its own address, so the per IP limit isn't reached.
+	email, ip := "Throttle-"+token+"@example.com", "modelstest-"+token
+	throttle := t.s.LoginThrottle
+
+	// fail counts a failed sign in, returning the unlock token if any.
+	fail := func() (string, bool) {
+		if err := throttle.Allowed(email, ip); err != nil {
+			t.errorf("LoginThrottle.Allowed: %v", err)
+			return "", false
+		}
+		unlockToken, err := throttle.Failed(email, ip)
+		if err != nil {
+			t.errorf("LoginThrottle.Failed: %v", err)
+			return "", false
+		}
+		return unlockToken, true
+	}
+	for i := 1; i < models.DefaultMaxLoginAttempts; i++ {
+		unlockToken, ok := fail()
+		if !ok {
+			return
+		}
+		if unlockToken != "" {
+			t.errorf("LoginThrottle.Failed: failure %d locked the account", i)
+			return
+		}
+	}
+	unlockToken, ok := fail()
+	if !ok {
+		return
+	}
+	if unlockToken == "" {
+		t.errorf("LoginThrottle.Failed: the last allowed failure didn't hand out an unlock token")
+		return
+	}
+	var lerr *models.LockedError
+	if err = throttle.Allowed(strings.ToLower(email), ip); !errors.As(err, &lerr) {
+		t.errorf("LoginThrottle.Allowed of a locked account: err = %v, want a *LockedError", err)
+	} else if wait := time.Until(lerr.Until); wait <= 0 || wait > models.DefaultLoginLockout {
+		t.errorf("LoginThrottle.Allowed: locked for %v, want %v", wait, models.DefaultLoginLockout)
+	}
+	// Other accounts signing in from the same address aren't locked.
+	if err = throttle.Allowed("other-"+email, ip); err != nil {
+		t.errorf("LoginThrottle.Allowed of another account: %v", err)
+	} else if err = throttle.Succeeded("other-"+email, ip); err != nil {
+		t.errorf("LoginThrottle.Succeeded: %v", err)
+	}
+
+	if err = throttle.Unlock(unlockToken); err != nil {
+		t.errorf("LoginThrottle.Unlock: %v", err)
+		return
+	}
+	if err = throttle.Unlock(unlockToken); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("LoginThrottle.Unlock twice: err = %v, want ErrNotFound", err)
+	}
+	if err = throttle.Allowed(email, ip); err != nil {
+		t.errorf("LoginThrottle.Allowed after Unlock: %v", err)
+		return
+	}
+	if err = throttle.Succeeded(email, ip); err != nil {
+		t.errorf("LoginThrottle.Succeeded: %v", err)
+	}
+	// Succeeded forgot the failures, the count starts over.
+	for i := 1; i < models.DefaultMaxLoginAttempts; i++ {
+		unlockToken, ok := fail()
+		if !ok {
+			return
+		}
+		if unlockToken != "" {
+			t.errorf("LoginThrottle.Failed: failure %d after signing in locked the account", i)
+			return
+		}
+	}
+	if _, err = throttle.DeleteExpired(time.Now()); err != nil {
+		t.errorf("LoginThrottle.DeleteExpired: %v", err)
+	}
+}
@@ -0,0 +1,421 @@
+// Package modelstest checks implementations of the models services against
+// the behaviour documented by their interfaces, in the way testing/fstest
+// checks file systems. The same checks run against the in-memory and the
+// Postgres services, e.g. from a test:
+//
+//	db := models.NewMemoryDB()
+//	err := modelstest.TestServices(modelstest.Services{
+//		Users:          models.NewUserServiceMemory(db),
+//		Sessions:       models.NewSessionServiceMemory(db),
+//		PasswordResets: models.NewPasswordResetServiceMemory(db),
+//		Galleries:      models.NewGalleryServiceMemory(db),
+//	})
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+package modelstest
+
+import (
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/arkadiont/lenslocked/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Services are the implementations under test, they must share the same
+// storage. The checks only create users with new random emails, so they can
+// run against a database holding other rows, but DeleteExpired does purge
+// every expired row as the janitor would.
+type Services struct {
+	Users          models.UserService
+	Sessions       models.SessionService
+	PasswordResets models.PasswordResetService
+	// ExpiredSessions is configured so sessions expire right after being
+	// created, e.g. with models.WithSessionLifetime(time.Nanosecond). The
+	// expiry checks of sessions are skipped when it is nil.
+	ExpiredSessions models.SessionService
+	// ExpiredPasswordResets is configured so tokens expire right after
+	// being created, e.g. with models.WithResetDuration(time.Nanosecond).
+	// The expiry checks of password resets are skipped when it is nil.
+	ExpiredPasswordResets models.PasswordResetService
+
+	// The services below are optional, their checks are skipped when nil.
+	Galleries          models.GalleryService
+	EmailVerifications models.EmailVerificationService
+	// ExpiredEmailVerifications is configured so tokens expire right after
+	// being created, e.g. with models.WithVerificationDuration(time.Nanosecond).
+	ExpiredEmailVerifications models.EmailVerificationService
+	// LoginThrottle must use the default limits.
+	LoginThrottle models.LoginThrottle
+	TwoFactor     models.TwoFactorService
+	// AccountDeletions and ExpiredAccountDeletions must remove the images of
+	// the galleries they delete. ExpiredAccountDeletions is configured so
+	// accounts can be deleted right after being scheduled, e.g. with
+	// models.WithDeletionGracePeriod(time.Nanosecond).
+	AccountDeletions        models.AccountDeletionService
+	ExpiredAccountDeletions models.AccountDeletionService
+}
+
+// TestServices runs every check against s and returns an error listing the
+// ones that failed.
+func TestServices(s Services) error {
+	t := tester{s: s}
+	t.checkUsers()
+	t.checkSessions()
+	t.checkPasswordResets()
+	if s.Galleries != nil {
+		t.checkGalleries()
+	}
+	if s.EmailVerifications != nil {
+		t.checkEmailVerifications()
+	}
+	if s.LoginThrottle != nil {
+		t.checkLoginThrottle()
+	}
+	if s.TwoFactor != nil {
+		t.checkTwoFactor()
+	}
+	if s.AccountDeletions != nil {
+		t.checkAccountDeletions()
+	}
+	return errors.Join(t.errs...)
+}
+
+type tester struct {
+	s    Services
+	errs []error
+}
+
+func (t *tester) errorf(format string, args ...any) {
+	t.errs = append(t.errs, fmt.Errorf(format, args...))
+}
+
+// newUser creates a user with a random email address, written in mixed case
+// to check it is normalized.
+func (t *tester) newUser() (email, password string, user *models.User, ok bool) {
+	token, err := rand.String(12)
+	if err != nil {
+		t.errorf("random email: %v", err)
+		return "", "", nil, false
+	}
+	email = "ModelsTest-" + token + "@Example.com"
+	password = "pw-" + token
+	user, err = t.s.Users.Create(email, password)
+	if err != nil {
+		t.errorf("Users.Create(%q): %v", email, err)
+		return "", "", nil, false
+	}
+	return email, password, user, true
+}
+
+func (t *tester) checkUsers() {
+	email, password, user, ok := t.newUser()
+	if !ok {
+		return
+	}
+	if user.ID == 0 {
+		t.errorf("Users.Create(%q): ID not set", email)
+	}
+	if user.Email != strings.ToLower(email) {
+		t.errorf("Users.Create(%q): Email = %q, want it lowercased", email, user.Email)
+	}
+	if user.PasswordHash == "" || user.PasswordHash == password {
+		t.errorf("Users.Create(%q): PasswordHash = %q, want a hash of the password", email, user.PasswordHash)
+	}
+
+	if _, err := t.s.Users.Create(strings.ToUpper(email), password); !errors.Is(err, models.ErrEmailTaken) {
+		t.errorf("Users.Create(%q) of a taken email: err = %v, want ErrEmailTaken", strings.ToUpper(email), err)
+	}
+	var validationErr *models.ValidationError
+	if _, err := t.s.Users.Create("weak-"+email, ""); !errors.As(err, &validationErr) {
+		t.errorf("Users.Create with an empty password: err = %v, want a *ValidationError", err)
+	}
+
+	got, err := t.s.Users.Authenticate(strings.ToUpper(email), password)
+	if err != nil {
+		t.errorf("Users.Authenticate(%q): %v", strings.ToUpper(email), err)
+	} else if got.ID != user.ID {
+		t.errorf("Users.Authenticate(%q): ID = %d, want %d", strings.ToUpper(email), got.ID, user.ID)
+	}
+	if _, err = t.s.Users.Authenticate(email, password+"-wrong"); !errors.Is(err, models.ErrInvalidPassword) {
+		t.errorf("Users.Authenticate with a wrong password: err = %v, want ErrInvalidPassword", err)
+	}
+	if _, err = t.s.Users.Authenticate("unknown-"+email, password); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Users.Authenticate of an unknown email: err = %v, want ErrNotFound", err)
+	}
+
+	newPassword := password + "-new"
+	if err = t.s.Users.UpdatePassword(user.ID, newPassword); err != nil {
+		t.errorf("Users.UpdatePassword: %v", err)
+	} else {
+		if _, err = t.s.Users.Authenticate(email, newPassword); err != nil {
+			t.errorf("Users.Authenticate with the updated password: %v", err)
+		}
+		if _, err = t.s.Users.Authenticate(email, password); !errors.Is(err, models.ErrInvalidPassword) {
+			t.errorf("Users.Authenticate with the old password: err = %v, want ErrInvalidPassword", err)
+		}
+	}
+	if err = t.s.Users.UpdatePassword(user.ID, ""); !errors.As(err, &validationErr) {
+		t.errorf("Users.UpdatePassword with an empty password: err = %v, want a *ValidationError", err)
+	}
+
+	t.checkConcurrentCreate()
+}
+
+// checkConcurrentCreate signs the same email up from several goroutines,
+// exactly one of them must succeed.
+func (t *tester) checkConcurrentCreate() {
+	token, err := rand.String(12)
+	if err != nil {
+		t.errorf("random email: %v", err)
+		return
+	}
+	email := "modelstest-" + token + "@example.com"
+	const n = 4
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Vary the case, uniqueness must ignore it.
+			address := email
+			if i%2 == 1 {
+				address = strings.ToUpper(email)
+			}
+			_, errs[i] = t.s.Users.Create(address, "pw-"+token)
+		}(i)
+	}
+	wg.Wait()
+	created := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, models.ErrEmailTaken):
+			t.errorf("concurrent Users.Create(%q): %v", email, err)
+		}
+	}
+	if created != 1 {
+		t.errorf("concurrent Users.Create(%q): %d users created, want 1", email, created)
+	}
+}
+
+func (t *tester) checkSessions() {
+	_, _, user, ok := t.newUser()
+	if !ok {
+		return
+	}
+	_, _, other, ok := t.newUser()
+	if !ok {
+		return
+	}
+	first, err := t.s.Sessions.Create(user.ID, "modelstest", "127.0.0.1")
+	if err != nil {
+		t.errorf("Sessions.Create: %v", err)
+		return
+	}
+	second, err := t.s.Sessions.Create(user.ID, "modelstest", "127.0.0.1")
+	if err != nil {
+		t.errorf("Sessions.Create: %v", err)
+		return
+	}
+	otherSession, err := t.s.Sessions.Create(other.ID, "modelstest", "127.0.0.1")
+	if err != nil {
+		t.errorf("Sessions.Create: %v", err)
+		return
+	}
+	if first.Token == "" || first.Token == second.Token {
+		t.errorf("Sessions.Create: tokens %q and %q, want distinct tokens", first.Token, second.Token)
+	}
+	if first.TokenHash == "" || first.TokenHash == first.Token {
+		t.errorf("Sessions.Create: TokenHash = %q, want a hash of the token", first.TokenHash)
+	}
+
+	got, err := t.s.Sessions.User(first.Token)
+	if err != nil {
+		t.errorf("Sessions.User: %v", err)
+	} else if got.ID != user.ID || got.Email != user.Email {
+		t.errorf("Sessions.User: user %d %q, want %d %q", got.ID, got.Email, user.ID, user.Email)
+	}
+	if _, err = t.s.Sessions.User("unknown-" + first.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Sessions.User of an unknown token: err = %v, want ErrNotFound", err)
+	}
+
+	sessions, err := t.s.Sessions.List(first.Token)
+	if err != nil {
+		t.errorf("Sessions.List: %v", err)
+	} else {
+		t.checkList(sessions, first.ID, first.ID, second.ID)
+	}
+
+	if err = t.s.Sessions.Revoke(first.Token, otherSession.ID); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Sessions.Revoke of another user's session: err = %v, want ErrNotFound", err)
+	}
+	if _, err = t.s.Sessions.User(otherSession.Token); err != nil {
+		t.errorf("Sessions.User after a refused Revoke: %v", err)
+	}
+	if err = t.s.Sessions.Revoke(first.Token, second.ID); err != nil {
+		t.errorf("Sessions.Revoke: %v", err)
+	}
+	if _, err = t.s.Sessions.User(second.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Sessions.User of a revoked session: err = %v, want ErrNotFound", err)
+	}
+
+	third, err := t.s.Sessions.Create(user.ID, "modelstest", "127.0.0.1")
+	if err != nil {
+		t.errorf("Sessions.Create: %v", err)
+		return
+	}
+	if err = t.s.Sessions.DeleteOthers(first.Token); err != nil {
+		t.errorf("Sessions.DeleteOthers: %v", err)
+	}
+	if _, err = t.s.Sessions.User(third.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Sessions.User of a session deleted by DeleteOthers: err = %v, want ErrNotFound", err)
+	}
+	if _, err = t.s.Sessions.User(first.Token); err != nil {
+		t.errorf("Sessions.User of the session kept by DeleteOthers: %v", err)
+	}
+	if _, err = t.s.Sessions.User(otherSession.Token); err != nil {
+		t.errorf("Sessions.User of another user after DeleteOthers: %v", err)
+	}
+
+	if _, err = t.s.Sessions.DeleteExpired(time.Now()); err != nil {
+		t.errorf("Sessions.DeleteExpired: %v", err)
+	}
+	if _, err = t.s.Sessions.User(first.Token); err != nil {
+		t.errorf("Sessions.User of a valid session after DeleteExpired: %v", err)
+	}
+
+	if err = t.s.Sessions.Delete(first.Token); err != nil {
+		t.errorf("Sessions.Delete: %v", err)
+	}
+	if _, err = t.s.Sessions.User(first.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Sessions.User of a deleted session: err = %v, want ErrNotFound", err)
+	}
+
+	if t.s.ExpiredSessions != nil {
+		t.checkExpiredSessions(user.ID)
+	}
+}
+
+// checkList checks that sessions holds exactly the sessions ids, with
+// current flagged, most recently seen first.
+func (t *tester) checkList(sessions []models.Session, current uint, ids ...uint) {
+	if len(sessions) != len(ids) {
+		t.errorf("Sessions.List: %d sessions, want %d", len(sessions), len(ids))
+		return
+	}
+	want := make(map[uint]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+	for i, session := range sessions {
+		if !want[session.ID] {
+			t.errorf("Sessions.List: unexpected session %d", session.ID)
+		}
+		if session.Current != (session.ID == current) {
+			t.errorf("Sessions.List: session %d has Current = %t", session.ID, session.Current)
+		}
+		if session.Token != "" {
+			t.errorf("Sessions.List: session %d has its Token set", session.ID)
+		}
+		if i > 0 && session.LastSeenAt.After(sessions[i-1].LastSeenAt) {
+			t.errorf("Sessions.List: session %d listed after an older one", session.ID)
+		}
+	}
+}
+
+func (t *tester) checkExpiredSessions(userID uint) {
+	session, err := t.s.ExpiredSessions.Create(userID, "modelstest", "127.0.0.1")
+	if err != nil {
+		t.errorf("ExpiredSessions.Create: %v", err)
+		return
+	}
+	if _, err = t.s.ExpiredSessions.User(session.Token); !errors.Is(err, models.ErrTokenExpired) {
+		t.errorf("Sessions.User of an expired session: err = %v, want ErrTokenExpired", err)
+	}
+	if _, err = t.s.ExpiredSessions.User(session.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Sessions.User of an expired session used twice: err = %v, want ErrNotFound", err)
+	}
+
+	session, err = t.s.ExpiredSessions.Create(userID, "modelstest", "127.0.0.1")
+	if err != nil {
+		t.errorf("ExpiredSessions.Create: %v", err)
+		return
+	}
+	n, err := t.s.ExpiredSessions.DeleteExpired(time.Now())
+	if err != nil {
+		t.errorf("Sessions.DeleteExpired: %v", err)
+	} else if n < 1 {
+		t.errorf("Sessions.DeleteExpired: %d sessions deleted, want at least 1", n)
+	}
+	if _, err = t.s.ExpiredSessions.User(session.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("Sessions.User of a session deleted by DeleteExpired: err = %v, want ErrNotFound", err)
+	}
+}
+
+func (t *tester) checkPasswordResets() {
+	email, _, user, ok := t.newUser()
+	if !ok {
+		return
+	}
+	if _, err := t.s.PasswordResets.Create("unknown-" + email); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("PasswordResets.Create of an unknown email: err = %v, want ErrNotFound", err)
+	}
+	replaced, err := t.s.PasswordResets.Create(strings.ToUpper(email))
+	if err != nil {
+		t.errorf("PasswordResets.Create(%q): %v", strings.ToUpper(email), err)
+		return
+	}
+	reset, err := t.s.PasswordResets.Create(email)
+	if err != nil {
+		t.errorf("PasswordResets.Create(%q): %v", email, err)
+		return
+	}
+	if reset.UserID != user.ID {
+		t.errorf("PasswordResets.Create: UserID = %d, want %d", reset.UserID, user.ID)
+	}
+	if reset.Token == "" || reset.TokenHash == "" || reset.TokenHash == reset.Token {
+		t.errorf("PasswordResets.Create: Token %q, TokenHash %q, want a token and its hash", reset.Token, reset.TokenHash)
+	}
+	if _, err = t.s.PasswordResets.Consume(replaced.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("PasswordResets.Consume of a replaced token: err = %v, want ErrNotFound", err)
+	}
+	got, err := t.s.PasswordResets.Consume(reset.Token)
+	if err != nil {
+		t.errorf("PasswordResets.Consume: %v", err)
+	} else if got.ID != user.ID {
+		t.errorf("PasswordResets.Consume: user %d, want %d", got.ID, user.ID)
+	}
+	if _, err = t.s.PasswordResets.Consume(reset.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("PasswordResets.Consume of a used token: err = %v, want ErrNotFound", err)
+	}
+
+	if t.s.ExpiredPasswordResets != nil {
+		t.checkExpiredPasswordResets(email)
+	}
+}
+
+func (t *tester) checkExpiredPasswordResets(email string) {
+	reset, err := t.s.ExpiredPasswordResets.Create(email)
+	if err != nil {
+		t.errorf("ExpiredPasswordResets.Create: %v", err)
+		return
+	}
+	if _, err = t.s.ExpiredPasswordResets.Consume(reset.Token); !errors.Is(err, models.ErrTokenExpired) {
+		t.errorf("PasswordResets.Consume of an expired token: err = %v, want ErrTokenExpired", err)
+	}
+	n, err := t.s.ExpiredPasswordResets.DeleteExpired(time.Now())
+	if err != nil {
+		t.errorf("PasswordResets.DeleteExpired: %v", err)
+	} else if n < 1 {
+		t.errorf("PasswordResets.DeleteExpired: %d resets deleted, want at least 1", n)
+	}
+	if _, err = t.s.ExpiredPasswordResets.Consume(reset.Token); !errors.Is(err, models.ErrNotFound) {
+		t.errorf("PasswordResets.Consume of a token deleted by DeleteExpired: err = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,100 @@
+package modelstest
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/models"
+	"time"
+)
+
+func (t *tester) checkTwoFactor() {
+	email, _, user, ok := t.newUser()
+	if !ok {
+		return
+	}
+	twoFactor := t.s.TwoFactor
+	enrollment, err := twoFactor.Enroll(user.ID, email)
+	if err != nil {
+		t.errorf("TwoFactor.Enroll: %v", err)
+		return
+	}
+	if again, err := twoFactor.Enroll(user.ID, email); err != nil {
+		t.errorf("TwoFactor.Enroll twice: %v", err)
+	} else if again.Secret != enrollment.Secret {
+		t.errorf("TwoFactor.Enroll twice: the unconfirmed secret was replaced")
+	}
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	if err != nil {
+		t.errorf("TwoFactor.Enroll: secret %q: %v", enrollment.Secret, err)
+		return
+	}
+	if enabled, err := twoFactor.Enabled(user.ID); err != nil || enabled {
+		t.errorf("TwoFactor.Enabled before Confirm: %t, err = %v, want false", enabled, err)
+	}
+	step := time.Now().Unix() / 30
+	if err = twoFactor.Verify(user.ID, hotp(key, step)); !errors.Is(err, models.ErrInvalidCode) {
+		t.errorf("TwoFactor.Verify before Confirm: err = %v, want ErrInvalidCode", err)
+	}
+	if _, err = twoFactor.Confirm(user.ID, "abcdef"); !errors.Is(err, models.ErrInvalidCode) {
+		t.errorf("TwoFactor.Confirm with a wrong code: err = %v, want ErrInvalidCode", err)
+	}
+	codes, err := twoFactor.Confirm(user.ID, hotp(key, step))
+	if err != nil {
+		t.errorf("TwoFactor.Confirm: %v", err)
+		return
+	}
+	if len(codes) != models.RecoveryCodeCount {
+		t.errorf("TwoFactor.Confirm: %d recovery codes, want %d", len(codes), models.RecoveryCodeCount)
+		return
+	}
+	if enabled, err := twoFactor.Enabled(user.ID); err != nil || !enabled {
+		t.errorf("TwoFactor.Enabled after Confirm: %t, err = %v, want true", enabled, err)
+	}
+	if _, err = twoFactor.Enroll(user.ID, email); !errors.Is(err, models.ErrTwoFactorEnabled) {
+		t.errorf("TwoFactor.Enroll once enabled: err = %v, want ErrTwoFactorEnabled", err)
+	}
+	if _, err = twoFactor.Confirm(user.ID, hotp(key, step+1)); !errors.Is(err, models.ErrTwoFactorEnabled) {
+		t.errorf("TwoFactor.Confirm once enabled: err = %v, want ErrTwoFactorEnabled", err)
+	}
+
+	// Codes can't be used twice, the one confirming the enrollment included.
+	if err = twoFactor.Verify(user.ID, hotp(key, step)); !errors.Is(err, models.ErrInvalidCode) {
+		t.errorf("TwoFactor.Verify of the confirmation code: err = %v, want ErrInvalidCode", err)
+	}
+	if err = twoFactor.Verify(user.ID, hotp(key, step+1)); err != nil {
+		t.errorf("TwoFactor.Verify: %v", err)
+	}
+	if err = twoFactor.Verify(user.ID, codes[0]); err != nil {
+		t.errorf("TwoFactor.Verify of a recovery code: %v", err)
+	}
+	if err = twoFactor.Verify(user.ID, codes[0]); !errors.Is(err, models.ErrInvalidCode) {
+		t.errorf("TwoFactor.Verify of a used recovery code: err = %v, want ErrInvalidCode", err)
+	}
+
+	if err = twoFactor.Disable(user.ID); err != nil {
+		t.errorf("TwoFactor.Disable: %v", err)
+	}
+	if enabled, err := twoFactor.Enabled(user.ID); err != nil || enabled {
+		t.errorf("TwoFactor.Enabled after Disable: %t, err = %v, want false", enabled, err)
+	}
+	if err = twoFactor.Verify(user.ID, codes[1]); !errors.Is(err, models.ErrInvalidCode) {
+		t.errorf("TwoFactor.Verify of a recovery code after Disable: err = %v, want ErrInvalidCode", err)
+	}
+}
+
+// hotp computes the 6 digit code (RFC 4226) of key for a 30 seconds time
+// step, independently of the models package.
+func hotp(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1_000_000)
+}
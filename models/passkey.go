@@ -0,0 +1,507 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Passkey is a WebAuthn credential users sign in with instead of a password.
+type Passkey struct {
+	ID         uint
+	UserID     uint
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	Credential webauthn.Credential
+}
+
+// PasskeyService runs the WebAuthn registration and assertion ceremonies.
+// Each ceremony has a Begin step, returning the options for the browser and
+// the session data to keep until the Finish step. The challenge of the
+// session data can only be used by a single Finish step, which fails with
+// ErrInvalidPasskey afterwards.
+type PasskeyService interface {
+	BeginRegistration(user *User) (*protocol.CredentialCreation, *webauthn.SessionData, error)
+	FinishRegistration(user *User, name string, session webauthn.SessionData,
+		response *protocol.ParsedCredentialCreationData) (*Passkey, error)
+	// BeginLogin starts a discoverable login, the browser lets the user pick
+	// any passkey registered for the site.
+	BeginLogin() (*protocol.CredentialAssertion, *webauthn.SessionData, error)
+	// FinishLogin returns the owner of the passkey, or ErrInvalidPasskey
+	// when the assertion can't be verified.
+	FinishLogin(session webauthn.SessionData, response *protocol.ParsedCredentialAssertionData) (*User, error)
+	List(userID uint) ([]Passkey, error)
+	// Delete returns ErrNotFound when the passkey doesn't belong to the user.
+	Delete(userID, passkeyID uint) error
+	// DeleteExpired removes the challenges of unfinished ceremonies.
+	Expirer
+}
+
+func NewPasskeyServicePostgres(db *sql.DB, relyingParty *webauthn.WebAuthn) PasskeyService {
+	return &passkeyService{
+		RelyingParty: relyingParty,
+		Store:        passkeyStorePostgres{DB: db},
+	}
+}
+
+// NewPasskeyServiceMemory keeps passkeys and challenges in db, the users
+// must have been created by a UserService sharing db.
+func NewPasskeyServiceMemory(db *MemoryDB, relyingParty *webauthn.WebAuthn) PasskeyService {
+	return &passkeyService{
+		RelyingParty: relyingParty,
+		Store:        passkeyStoreMemory{DB: db},
+	}
+}
+
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+
+	// challengeDuration bounds the challenges of a relying party which
+	// doesn't enforce its timeouts.
+	challengeDuration = 5 * time.Minute
+)
+
+// passkeyStore keeps the rows of passkeyService, which runs the ceremonies
+// the same way whatever the storage.
+type passkeyStore interface {
+	// user returns ErrNotFound when there's no such user.
+	user(userID uint) (*User, error)
+	list(userID uint) ([]Passkey, error)
+	// insert sets the ID of passkey.
+	insert(passkey *Passkey) error
+	// update replaces the stored credential, e.g. with its new sign count.
+	update(credential webauthn.Credential, usedAt time.Time) error
+	// delete returns ErrNotFound when the passkey doesn't belong to the user.
+	delete(userID, passkeyID uint) error
+	addChallenge(ceremony, challenge string, expiresAt time.Time) error
+	// useChallenge removes the challenge, returning ErrNotFound when it is
+	// unknown, expired or issued for another ceremony.
+	useChallenge(ceremony, challenge string, now time.Time) error
+	Expirer
+}
+
+// passkeyService records every challenge it issues until it is used, so a
+// ceremony can't be finished twice, even with a copy of its session data.
+type passkeyService struct {
+	RelyingParty *webauthn.WebAuthn
+	Store        passkeyStore
+}
+
+func (s passkeyService) BeginRegistration(user *User) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	owner, err := s.owner(user)
+	if err != nil {
+		return nil, nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	// Exclude the registered passkeys, so the authenticator doesn't store a
+	// second one for the same account.
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(owner.credentials))
+	for _, credential := range owner.credentials {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	// Passkeys replace the password, so the authenticator must check it's
+	// the user, not only that someone is present.
+	creation, session, err := s.RelyingParty.BeginRegistration(owner,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			UserVerification:   protocol.VerificationRequired,
+		}),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	if err = s.addChallenge(ceremonyRegistration, session); err != nil {
+		return nil, nil, fmt.Errorf("begin passkey registration: %w", err)
+	}
+	return creation, session, nil
+}
+
+func (s passkeyService) FinishRegistration(user *User, name string, session webauthn.SessionData,
+	response *protocol.ParsedCredentialCreationData) (*Passkey, error) {
+	if err := s.useChallenge(ceremonyRegistration, session); err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	owner, err := s.owner(user)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	credential, err := s.RelyingParty.CreateCredential(owner, session, response)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w (%v)", ErrInvalidPasskey, err)
+	}
+	passkey := Passkey{
+		UserID:     user.ID,
+		Name:       strings.TrimSpace(name),
+		CreatedAt:  time.Now(),
+		Credential: *credential,
+	}
+	if passkey.Name == "" {
+		passkey.Name = "Passkey"
+	}
+	if err = s.Store.insert(&passkey); err != nil {
+		return nil, fmt.Errorf("finish passkey registration: %w", err)
+	}
+	return &passkey, nil
+}
+
+func (s passkeyService) BeginLogin() (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	// The passkey is the only factor of the sign in, it must prove the user
+	// was verified by the authenticator.
+	assertion, session, err := s.RelyingParty.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("begin passkey login: %w", err)
+	}
+	if err = s.addChallenge(ceremonyLogin, session); err != nil {
+		return nil, nil, fmt.Errorf("begin passkey login: %w", err)
+	}
+	return assertion, session, nil
+}
+
+func (s passkeyService) FinishLogin(session webauthn.SessionData,
+	response *protocol.ParsedCredentialAssertionData) (*User, error) {
+	if err := s.useChallenge(ceremonyLogin, session); err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+	var owner *passkeyOwner
+	credential, err := s.RelyingParty.ValidateDiscoverableLogin(
+		func(_, userHandle []byte) (webauthn.User, error) {
+			userID, err := strconv.ParseUint(string(userHandle), 10, 64)
+			if err != nil {
+				return nil, ErrNotFound
+			}
+			owner, err = s.owner(&User{ID: uint(userID)})
+			return owner, err
+		}, session, response)
+	if err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w (%v)", ErrInvalidPasskey, err)
+	}
+	// A signature counter going backwards means the passkey was cloned.
+	if credential.Authenticator.CloneWarning {
+		return nil, fmt.Errorf("finish passkey login: %w (cloned authenticator)", ErrInvalidPasskey)
+	}
+	if err = s.Store.update(*credential, time.Now()); err != nil {
+		return nil, fmt.Errorf("finish passkey login: %w", err)
+	}
+	return owner.user, nil
+}
+
+func (s passkeyService) List(userID uint) ([]Passkey, error) {
+	passkeys, err := s.Store.list(userID)
+	if err != nil {
+		return nil, fmt.Errorf("list passkeys: %w", err)
+	}
+	return passkeys, nil
+}
+
+func (s passkeyService) Delete(userID, passkeyID uint) error {
+	if err := s.Store.delete(userID, passkeyID); err != nil {
+		return fmt.Errorf("delete passkey: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpired removes the challenges of the ceremonies never finished.
+func (s passkeyService) DeleteExpired(now time.Time) (int64, error) {
+	n, err := s.Store.DeleteExpired(now)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired passkey challenges: %w", err)
+	}
+	return n, nil
+}
+
+func (s passkeyService) addChallenge(ceremony string, session *webauthn.SessionData) error {
+	expiresAt := session.Expires
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(challengeDuration)
+	}
+	return s.Store.addChallenge(ceremony, session.Challenge, expiresAt)
+}
+
+// useChallenge returns ErrInvalidPasskey when the challenge of session was
+// already used, has expired or was never issued.
+func (s passkeyService) useChallenge(ceremony string, session webauthn.SessionData) error {
+	err := s.Store.useChallenge(ceremony, session.Challenge, time.Now())
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("%w (unknown challenge)", ErrInvalidPasskey)
+	}
+	return err
+}
+
+// owner loads the user, when only the ID is set, and its passkeys.
+func (s passkeyService) owner(user *User) (*passkeyOwner, error) {
+	if user.Email == "" {
+		loaded, err := s.Store.user(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		user = loaded
+	}
+	passkeys, err := s.Store.list(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	owner := passkeyOwner{
+		user:        user,
+		credentials: make([]webauthn.Credential, 0, len(passkeys)),
+	}
+	for _, passkey := range passkeys {
+		owner.credentials = append(owner.credentials, passkey.Credential)
+	}
+	return &owner, nil
+}
+
+type passkeyStorePostgres struct {
+	DB *sql.DB
+}
+
+func (s passkeyStorePostgres) user(userID uint) (*User, error) {
+	user := User{ID: userID}
+	row := s.DB.QueryRow(`SELECT email, email_verified_at FROM users WHERE id = $1;`, userID)
+	if err := row.Scan(&user.Email, &user.EmailVerifiedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s passkeyStorePostgres) list(userID uint) ([]Passkey, error) {
+	rows, err := s.DB.Query(`
+		SELECT id, name, created_at, last_used_at, credential FROM passkey
+		WHERE user_id = $1 ORDER BY created_at;`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var passkeys []Passkey
+	for rows.Next() {
+		passkey := Passkey{
+			UserID: userID,
+		}
+		var encoded []byte
+		if err = rows.Scan(&passkey.ID, &passkey.Name, &passkey.CreatedAt, &passkey.LastUsedAt, &encoded); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(encoded, &passkey.Credential); err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, rows.Err()
+}
+
+func (s passkeyStorePostgres) insert(passkey *Passkey) error {
+	encoded, err := json.Marshal(passkey.Credential)
+	if err != nil {
+		return err
+	}
+	row := s.DB.QueryRow(`
+		INSERT INTO passkey (user_id, credential_id, credential, name, created_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id;`,
+		passkey.UserID, passkey.Credential.ID, encoded, passkey.Name, passkey.CreatedAt)
+	return row.Scan(&passkey.ID)
+}
+
+func (s passkeyStorePostgres) update(credential webauthn.Credential, usedAt time.Time) error {
+	encoded, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec(`
+		UPDATE passkey SET credential = $2, last_used_at = $3
+		WHERE credential_id = $1;`, credential.ID, encoded, usedAt)
+	return err
+}
+
+func (s passkeyStorePostgres) delete(userID, passkeyID uint) error {
+	res, err := s.DB.Exec(`DELETE FROM passkey WHERE id = $1 AND user_id = $2;`, passkeyID, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s passkeyStorePostgres) addChallenge(ceremony, challenge string, expiresAt time.Time) error {
+	_, err := s.DB.Exec(`
+		INSERT INTO passkey_challenge (challenge, ceremony, expires_at)
+		VALUES ($1, $2, $3);`, challenge, ceremony, expiresAt)
+	return err
+}
+
+func (s passkeyStorePostgres) useChallenge(ceremony, challenge string, now time.Time) error {
+	// Deleting the row is what marks the challenge as used, two requests
+	// racing with the same challenge can't both delete it.
+	res, err := s.DB.Exec(`
+		DELETE FROM passkey_challenge
+		WHERE challenge = $1 AND ceremony = $2 AND expires_at > $3;`, challenge, ceremony, now)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s passkeyStorePostgres) DeleteExpired(now time.Time) (int64, error) {
+	res, err := s.DB.Exec(`DELETE FROM passkey_challenge WHERE expires_at <= $1;`, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type passkeyStoreMemory struct {
+	DB *MemoryDB
+}
+
+func (s passkeyStoreMemory) user(userID uint) (*User, error) {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	stored, ok := s.DB.users[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &User{ID: stored.ID, Email: stored.Email, EmailVerifiedAt: stored.EmailVerifiedAt}, nil
+}
+
+func (s passkeyStoreMemory) list(userID uint) ([]Passkey, error) {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	var passkeys []Passkey
+	for _, passkey := range s.DB.passkeys {
+		if passkey.UserID == userID {
+			passkeys = append(passkeys, *passkey)
+		}
+	}
+	sort.Slice(passkeys, func(i, j int) bool {
+		return passkeys[i].ID < passkeys[j].ID
+	})
+	return passkeys, nil
+}
+
+func (s passkeyStoreMemory) insert(passkey *Passkey) error {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	if _, ok := s.DB.users[passkey.UserID]; !ok {
+		return ErrNotFound
+	}
+	for _, stored := range s.DB.passkeys {
+		if bytes.Equal(stored.Credential.ID, passkey.Credential.ID) {
+			return errors.New("duplicate credential id")
+		}
+	}
+	passkey.ID = s.DB.nextID()
+	stored := *passkey
+	s.DB.passkeys[passkey.ID] = &stored
+	return nil
+}
+
+func (s passkeyStoreMemory) update(credential webauthn.Credential, usedAt time.Time) error {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	for _, stored := range s.DB.passkeys {
+		if bytes.Equal(stored.Credential.ID, credential.ID) {
+			stored.Credential = credential
+			stored.LastUsedAt = &usedAt
+		}
+	}
+	return nil
+}
+
+func (s passkeyStoreMemory) delete(userID, passkeyID uint) error {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	passkey, ok := s.DB.passkeys[passkeyID]
+	if !ok || passkey.UserID != userID {
+		return ErrNotFound
+	}
+	delete(s.DB.passkeys, passkeyID)
+	return nil
+}
+
+func (s passkeyStoreMemory) addChallenge(ceremony, challenge string, expiresAt time.Time) error {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	if _, ok := s.DB.passkeyChallenges[challenge]; ok {
+		return errors.New("duplicate challenge")
+	}
+	s.DB.passkeyChallenges[challenge] = passkeyChallenge{Ceremony: ceremony, ExpiresAt: expiresAt}
+	return nil
+}
+
+func (s passkeyStoreMemory) useChallenge(ceremony, challenge string, now time.Time) error {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	stored, ok := s.DB.passkeyChallenges[challenge]
+	if !ok || stored.Ceremony != ceremony || !stored.ExpiresAt.After(now) {
+		return ErrNotFound
+	}
+	delete(s.DB.passkeyChallenges, challenge)
+	return nil
+}
+
+func (s passkeyStoreMemory) DeleteExpired(now time.Time) (int64, error) {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	var n int64
+	for challenge, stored := range s.DB.passkeyChallenges {
+		if !stored.ExpiresAt.After(now) {
+			delete(s.DB.passkeyChallenges, challenge)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// passkeyOwner adapts a User to webauthn.User. The user handle stored by
+// authenticators is the user ID, it doesn't reveal anything about them.
+type passkeyOwner struct {
+	user        *User
+	credentials []webauthn.Credential
+}
+
+func (o passkeyOwner) WebAuthnID() []byte {
+	return []byte(strconv.FormatUint(uint64(o.user.ID), 10))
+}
+
+func (o passkeyOwner) WebAuthnName() string {
+	return o.user.Email
+}
+
+func (o passkeyOwner) WebAuthnDisplayName() string {
+	return o.user.Email
+}
+
+func (o passkeyOwner) WebAuthnIcon() string {
+	return ""
+}
+
+func (o passkeyOwner) WebAuthnCredentials() []webauthn.Credential {
+	return o.credentials
+}
@@ -0,0 +1,322 @@
+package models_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	testOrigin = "http://localhost:3000"
+	testRPID   = "localhost"
+)
+
+func newTestRelyingParty(t *testing.T) *webauthn.WebAuthn {
+	t.Helper()
+	timeout := webauthn.TimeoutConfig{
+		Enforce: true,
+		Timeout: 5 * time.Minute,
+	}
+	relyingParty, err := webauthn.New(&webauthn.Config{
+		RPID:          testRPID,
+		RPDisplayName: "Lenslocked",
+		RPOrigins:     []string{testOrigin},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return relyingParty
+}
+
+func TestPasskeyServiceMemory(t *testing.T) {
+	db := models.NewMemoryDB()
+	testPasskeyService(t, models.NewUserServiceMemory(db),
+		models.NewPasskeyServiceMemory(db, newTestRelyingParty(t)))
+}
+
+func TestPasskeyServicePostgres(t *testing.T) {
+	db := openTestDB(t)
+	testPasskeyService(t, models.NewUserServicePostgres(db),
+		models.NewPasskeyServicePostgres(db, newTestRelyingParty(t)))
+}
+
+func testPasskeyService(t *testing.T, users models.UserService, passkeys models.PasskeyService) {
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+	user, err := users.Create("passkey-"+token+"@example.com", "pw-"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := newAuthenticator(t)
+
+	creation, session, err := passkeys.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := creation.Response.AuthenticatorSelection.UserVerification; got != protocol.VerificationRequired {
+		t.Errorf("registration user verification = %q, want %q", got, protocol.VerificationRequired)
+	}
+	attestation := authenticator.create(t, creation)
+	passkey, err := passkeys.FinishRegistration(user, " Laptop ", *session, attestation)
+	if err != nil {
+		t.Fatalf("FinishRegistration: %v", err)
+	}
+	if passkey.Name != "Laptop" || passkey.UserID != user.ID {
+		t.Errorf("FinishRegistration = %+v, want Laptop of user %d", passkey, user.ID)
+	}
+	_, err = passkeys.FinishRegistration(user, "Laptop", *session, authenticator.create(t, creation))
+	if !errors.Is(err, models.ErrInvalidPasskey) {
+		t.Errorf("FinishRegistration with a used challenge: err = %v, want ErrInvalidPasskey", err)
+	}
+	list, err := passkeys.List(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != passkey.ID {
+		t.Fatalf("List = %+v, want only passkey %d", list, passkey.ID)
+	}
+
+	assertion, session, err := passkeys.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := assertion.Response.UserVerification; got != protocol.VerificationRequired {
+		t.Errorf("login user verification = %q, want %q", got, protocol.VerificationRequired)
+	}
+	signCount := authenticator.signCount
+	response := authenticator.get(t, assertion)
+	signedIn, err := passkeys.FinishLogin(*session, response)
+	if err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if signedIn.ID != user.ID {
+		t.Errorf("FinishLogin signed in user %d, want %d", signedIn.ID, user.ID)
+	}
+	// Replaying the assertion must fail even though its signature is valid.
+	_, err = passkeys.FinishLogin(*session, authenticator.get(t, assertion))
+	if !errors.Is(err, models.ErrInvalidPasskey) {
+		t.Errorf("FinishLogin with a used challenge: err = %v, want ErrInvalidPasskey", err)
+	}
+	list, err = passkeys.List(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].LastUsedAt == nil || list[0].Credential.Authenticator.SignCount != signCount {
+		t.Errorf("List after sign in = %+v, want last use and sign count %d", list, signCount)
+	}
+
+	// A login challenge can't finish a registration.
+	_, session, err = passkeys.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = passkeys.FinishRegistration(user, "Laptop", *session, authenticator.create(t, creation))
+	if !errors.Is(err, models.ErrInvalidPasskey) {
+		t.Errorf("FinishRegistration with a login challenge: err = %v, want ErrInvalidPasskey", err)
+	}
+
+	assertion, session, err = passkeys.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator.verifyUser = false
+	_, err = passkeys.FinishLogin(*session, authenticator.get(t, assertion))
+	if !errors.Is(err, models.ErrInvalidPasskey) {
+		t.Errorf("FinishLogin without user verification: err = %v, want ErrInvalidPasskey", err)
+	}
+	authenticator.verifyUser = true
+
+	assertion, session, err = passkeys.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := passkeys.DeleteExpired(session.Expires.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Errorf("DeleteExpired after the ceremony timeout removed no challenge")
+	}
+	_, err = passkeys.FinishLogin(*session, authenticator.get(t, assertion))
+	if !errors.Is(err, models.ErrInvalidPasskey) {
+		t.Errorf("FinishLogin with an expired challenge: err = %v, want ErrInvalidPasskey", err)
+	}
+
+	if err = passkeys.Delete(user.ID+1, passkey.ID); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Delete by another user: err = %v, want ErrNotFound", err)
+	}
+	if err = passkeys.Delete(user.ID, passkey.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertion, session, err = passkeys.BeginLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = passkeys.FinishLogin(*session, authenticator.get(t, assertion))
+	if !errors.Is(err, models.ErrInvalidPasskey) {
+		t.Errorf("FinishLogin with a deleted passkey: err = %v, want ErrInvalidPasskey", err)
+	}
+}
+
+// authenticator is a software authenticator holding a single ES256 passkey,
+// it answers ceremonies the way a browser hands them to the server.
+type authenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+	// verifyUser sets the UV flag, as if the user entered their PIN.
+	verifyUser bool
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	if _, err = rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+	return &authenticator{
+		key:          key,
+		credentialID: credentialID,
+		signCount:    1,
+		verifyUser:   true,
+	}
+}
+
+// create returns the response of navigator.credentials.create, with the
+// "none" attestation format.
+func (a *authenticator) create(t *testing.T, creation *protocol.CredentialCreation) *protocol.ParsedCredentialCreationData {
+	t.Helper()
+	switch id := creation.Response.User.ID.(type) {
+	case []byte:
+		a.userHandle = id
+	case protocol.URLEncodedBase64:
+		a.userHandle = id
+	default:
+		t.Fatalf("unexpected user handle %T", id)
+	}
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authData := a.authData(protocol.FlagAttestedCredentialData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, publicKey...)
+	attestationObject, err := webauthncbor.Marshal(struct {
+		Format    string         `cbor:"fmt"`
+		Statement map[string]any `cbor:"attStmt"`
+		AuthData  []byte         `cbor:"authData"`
+	}{"none", map[string]any{}, authData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := a.response(t, map[string]string{
+		"clientDataJSON":    encode(a.clientData(t, protocol.CreateCeremony, creation.Response.Challenge)),
+		"attestationObject": encode(attestationObject),
+	})
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// get returns the response of navigator.credentials.get, signing the
+// challenge of assertion.
+func (a *authenticator) get(t *testing.T, assertion *protocol.CredentialAssertion) *protocol.ParsedCredentialAssertionData {
+	t.Helper()
+	authData := a.authData(0)
+	clientData := a.clientData(t, protocol.AssertCeremony, assertion.Response.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := a.response(t, map[string]string{
+		"clientDataJSON":    encode(clientData),
+		"authenticatorData": encode(authData),
+		"signature":         encode(signature),
+		"userHandle":        encode(a.userHandle),
+	})
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// authData starts the authenticator data, counting a new signature.
+func (a *authenticator) authData(flags protocol.AuthenticatorFlags) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	flags |= protocol.FlagUserPresent
+	if a.verifyUser {
+		flags |= protocol.FlagUserVerified
+	}
+	authData := append(rpIDHash[:], byte(flags))
+	authData = binary.BigEndian.AppendUint32(authData, a.signCount)
+	a.signCount++
+	return authData
+}
+
+func (a *authenticator) clientData(t *testing.T, ceremony protocol.CeremonyType, challenge protocol.URLEncodedBase64) []byte {
+	t.Helper()
+	clientData, err := json.Marshal(protocol.CollectedClientData{
+		Type:      ceremony,
+		Challenge: encode(challenge),
+		Origin:    testOrigin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientData
+}
+
+func (a *authenticator) response(t *testing.T, response map[string]string) []byte {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{
+		"id":       encode(a.credentialID),
+		"rawId":    encode(a.credentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,179 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DefaultMinPasswordLength = 8
+	// MaxPasswordBytes is the longest password bcrypt can hash, any byte past
+	// it would be silently ignored.
+	MaxPasswordBytes = 72
+	// breachedPrefixLen is the length of the hash prefix used to bucket
+	// breached passwords, the same the Pwned Passwords range API uses.
+	breachedPrefixLen = 5
+)
+
+// ValidationError reports user input breaking a rule. Field names the form
+// field at fault so the message can be shown next to it.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("models: invalid %s: %s", e.Field, e.Message)
+}
+
+// Public returns the message to show to the user, e.g. "Password must be at
+// least 8 characters long."
+func (e *ValidationError) Public() string {
+	field := e.Field
+	if field != "" {
+		field = strings.ToUpper(field[:1]) + field[1:]
+	}
+	return fmt.Sprintf("%s %s.", field, e.Message)
+}
+
+// PasswordPolicy decides which passwords users may choose.
+type PasswordPolicy interface {
+	// Validate returns a *ValidationError when password is not acceptable
+	// for the account identified by email.
+	Validate(email, password string) error
+}
+
+// BreachedPasswords tells whether a password appeared in a known data breach.
+type BreachedPasswords interface {
+	Breached(password string) (bool, error)
+}
+
+type passwordPolicyOption func(*passwordPolicy)
+
+func WithMinPasswordLength(length int) passwordPolicyOption {
+	return func(p *passwordPolicy) {
+		if length > 0 {
+			p.MinLength = length
+		}
+	}
+}
+
+// WithBreachedPasswords rejects the passwords found in breached.
+func WithBreachedPasswords(breached BreachedPasswords) passwordPolicyOption {
+	return func(p *passwordPolicy) {
+		p.Breached = breached
+	}
+}
+
+func NewPasswordPolicy(opts ...passwordPolicyOption) PasswordPolicy {
+	p := passwordPolicy{
+		MinLength: DefaultMinPasswordLength,
+	}
+	for _, opt := range opts {
+		opt(&p)
+	}
+	return &p
+}
+
+type passwordPolicy struct {
+	// MinLength is the minimum number of characters of a password. Default DefaultMinPasswordLength
+	MinLength int
+	Breached  BreachedPasswords
+}
+
+func (p passwordPolicy) Validate(email, password string) error {
+	switch {
+	case utf8.RuneCountInString(password) < p.MinLength:
+		return &ValidationError{
+			Field:   "password",
+			Message: fmt.Sprintf("must be at least %d characters long", p.MinLength),
+		}
+	case len(password) > MaxPasswordBytes:
+		return &ValidationError{
+			Field:   "password",
+			Message: fmt.Sprintf("must be at most %d bytes long", MaxPasswordBytes),
+		}
+	case email != "" && strings.EqualFold(strings.TrimSpace(password), strings.TrimSpace(email)):
+		return &ValidationError{
+			Field:   "password",
+			Message: "must not be your email address",
+		}
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Breached(password)
+		if err != nil {
+			return fmt.Errorf("check breached password: %w", err)
+		}
+		if breached {
+			return &ValidationError{
+				Field:   "password",
+				Message: "appears in a known data breach, please choose another one",
+			}
+		}
+	}
+	return nil
+}
+
+// LoadBreachedPasswords reads a list of breached passwords in the format of
+// the Pwned Passwords downloads: one uppercase hex SHA-1 per line, optionally
+// followed by ":" and a count. Hashes are bucketed by prefix, so a lookup
+// only ever compares a password against the handful of hashes sharing it.
+func LoadBreachedPasswords(r io.Reader) (BreachedPasswords, error) {
+	b := breachedPasswords{
+		ranges: make(map[string][]string),
+	}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		hash := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(hash, ':'); i >= 0 {
+			hash = hash[:i]
+		}
+		if hash == "" {
+			continue
+		}
+		hash = strings.ToUpper(hash)
+		if len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("load breached passwords: invalid hash on line %d", line)
+		}
+		prefix := hash[:breachedPrefixLen]
+		b.ranges[prefix] = append(b.ranges[prefix], hash[breachedPrefixLen:])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("load breached passwords: %w", err)
+	}
+	for _, suffixes := range b.ranges {
+		sort.Strings(suffixes)
+	}
+	return &b, nil
+}
+
+// LoadBreachedPasswordsFile is LoadBreachedPasswords reading from a file.
+func LoadBreachedPasswordsFile(name string) (BreachedPasswords, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("load breached passwords: %w", err)
+	}
+	defer f.Close()
+	return LoadBreachedPasswords(f)
+}
+
+type breachedPasswords struct {
+	// ranges maps the prefix of every hash to the sorted remaining characters.
+	ranges map[string][]string
+}
+
+func (b breachedPasswords) Breached(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes := b.ranges[hash[:breachedPrefixLen]]
+	suffix := hash[breachedPrefixLen:]
+	i := sort.SearchStrings(suffixes, suffix)
+	return i < len(suffixes) && suffixes[i] == suffix, nil
+}
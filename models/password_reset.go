@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/arkadiont/lenslocked/rand"
 	"strings"
@@ -24,34 +25,43 @@ type PasswordReset struct {
 }
 
 type PasswordResetService interface {
+	// Create returns ErrNotFound when no user has the given email.
 	Create(email string) (*PasswordReset, error)
+	// Consume returns ErrNotFound for unknown tokens and ErrTokenExpired for
+	// expired ones.
 	Consume(token string) (*User, error)
+	Expirer
 }
 
-type passResetOption func(service *passwordResetService)
+type passResetOption func(*passwordResetConfig)
 
 func WithBytesPerTokenReset(bytesPerToken int) passResetOption {
-	return func(s *passwordResetService) {
+	return func(s *passwordResetConfig) {
 		if bytesPerToken > s.BytesPerToken {
 			s.BytesPerToken = bytesPerToken
 		}
 	}
 }
 
-func NewPasswordResetService(db *sql.DB, opts ...passResetOption) PasswordResetService {
-	s := &passwordResetService{
-		DB:            db,
-		BytesPerToken: MinBytesPerToken,
-		Duration:      DefaultResetDuration,
+// WithResetDuration sets how long password reset tokens are valid for.
+func WithResetDuration(duration time.Duration) passResetOption {
+	return func(s *passwordResetConfig) {
+		if duration > 0 {
+			s.Duration = duration
+		}
 	}
-	for _, opt := range opts {
-		opt(s)
+}
+
+func NewPasswordResetService(db *sql.DB, opts ...passResetOption) PasswordResetService {
+	return &passwordResetService{
+		DB:                  db,
+		passwordResetConfig: newPasswordResetConfig(opts),
 	}
-	return s
 }
 
-type passwordResetService struct {
-	DB *sql.DB
+// passwordResetConfig holds the settings shared by the Postgres and
+// in-memory password reset services.
+type passwordResetConfig struct {
 	// BytesPerToken is used to determine how many bytes to use when generating
 	// each password reset token. If this value is not set or is less than the
 	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be used.
@@ -60,13 +70,31 @@ type passwordResetService struct {
 	Duration time.Duration
 }
 
+func newPasswordResetConfig(opts []passResetOption) passwordResetConfig {
+	c := passwordResetConfig{
+		BytesPerToken: MinBytesPerToken,
+		Duration:      DefaultResetDuration,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+type passwordResetService struct {
+	DB *sql.DB
+	passwordResetConfig
+}
+
 func (p passwordResetService) Create(email string) (*PasswordReset, error) {
 	email = strings.ToLower(email)
 	var userId uint
 	row := p.DB.QueryRow(`SELECT id FROM users WHERE email = $1;`, email)
 	err := row.Scan(&userId)
 	if err != nil {
-		// TODO consider return specific err when user not exists
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("create: %w", ErrNotFound)
+		}
 		return nil, fmt.Errorf("create: %w", err)
 	}
 	token, err := rand.String(p.BytesPerToken)
@@ -99,15 +127,19 @@ func (p passwordResetService) Consume(token string) (*User, error) {
 	var user User
 	var pwReset PasswordReset
 	hash := p.hash(token)
-	row := p.DB.QueryRow(`SELECT p.id, p.expires_at, u.id, u.email, u.password_hash
+	row := p.DB.QueryRow(`SELECT p.id, p.expires_at, u.id, u.email, u.password_hash, u.email_verified_at
 	FROM users u, password_reset p 
 	WHERE u.id = p.user_id and p.token_hash = $1;`, hash)
-	err := row.Scan(&pwReset.ID, &pwReset.ExpiresAt, &user.ID, &user.Email, &user.PasswordHash)
+	err := row.Scan(&pwReset.ID, &pwReset.ExpiresAt, &user.ID, &user.Email, &user.PasswordHash,
+		&user.EmailVerifiedAt)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("consume: %w", ErrNotFound)
+		}
 		return nil, fmt.Errorf("consume: %w", err)
 	}
 	if time.Now().After(pwReset.ExpiresAt) {
-		return nil, fmt.Errorf("token expired: %v", token)
+		return nil, fmt.Errorf("consume: %w", ErrTokenExpired)
 	}
 	err = p.delete(pwReset.ID)
 	if err != nil {
@@ -116,6 +148,14 @@ func (p passwordResetService) Consume(token string) (*User, error) {
 	return &user, nil
 }
 
+func (p passwordResetService) DeleteExpired(now time.Time) (int64, error) {
+	res, err := p.DB.Exec(`DELETE FROM password_reset WHERE expires_at <= $1;`, now)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired password resets: %w", err)
+	}
+	return res.RowsAffected()
+}
+
 func (p passwordResetService) delete(id int) error {
 	_, err := p.DB.Exec(`DELETE FROM password_reset WHERE id = $1;`, id)
 	if err != nil {
@@ -124,7 +164,89 @@ func (p passwordResetService) delete(id int) error {
 	return nil
 }
 
-func (p passwordResetService) hash(token string) string {
+// hash is shared by both services, only the hashes of tokens are stored.
+func (c passwordResetConfig) hash(token string) string {
 	tokenHash := sha256.Sum256([]byte(token))
 	return base64.URLEncoding.EncodeToString(tokenHash[:])
 }
+
+// NewPasswordResetServiceMemory keeps password resets in db, it takes the
+// same options as NewPasswordResetService.
+func NewPasswordResetServiceMemory(db *MemoryDB, opts ...passResetOption) PasswordResetService {
+	return &passwordResetServiceMemory{
+		DB:                  db,
+		passwordResetConfig: newPasswordResetConfig(opts),
+	}
+}
+
+type passwordResetServiceMemory struct {
+	DB *MemoryDB
+	passwordResetConfig
+}
+
+func (p passwordResetServiceMemory) Create(email string) (*PasswordReset, error) {
+	token, err := rand.String(p.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	p.DB.mu.Lock()
+	defer p.DB.mu.Unlock()
+	user, ok := p.DB.userByEmail(email)
+	if !ok {
+		return nil, fmt.Errorf("create: %w", ErrNotFound)
+	}
+	pwReset := PasswordReset{
+		UserID:    user.ID,
+		TokenHash: p.hash(token),
+		ExpiresAt: time.Now().Add(p.Duration),
+	}
+	// Like the ON CONFLICT(user_id) of passwordResetService, a new token
+	// replaces the previous one.
+	for id, existing := range p.DB.passwordResets {
+		if existing.UserID == user.ID {
+			pwReset.ID = id
+		}
+	}
+	if pwReset.ID == 0 {
+		pwReset.ID = int(p.DB.nextID())
+	}
+	p.DB.passwordResets[pwReset.ID] = &pwReset
+	created := pwReset
+	created.Token = token
+	return &created, nil
+}
+
+func (p passwordResetServiceMemory) Consume(token string) (*User, error) {
+	hash := p.hash(token)
+	p.DB.mu.Lock()
+	defer p.DB.mu.Unlock()
+	for id, pwReset := range p.DB.passwordResets {
+		if pwReset.TokenHash != hash {
+			continue
+		}
+		user, ok := p.DB.users[pwReset.UserID]
+		if !ok {
+			break
+		}
+		if time.Now().After(pwReset.ExpiresAt) {
+			return nil, fmt.Errorf("consume: %w", ErrTokenExpired)
+		}
+		delete(p.DB.passwordResets, id)
+		found := *user
+		return &found, nil
+	}
+	return nil, fmt.Errorf("consume: %w", ErrNotFound)
+}
+
+func (p passwordResetServiceMemory) DeleteExpired(now time.Time) (int64, error) {
+	p.DB.mu.Lock()
+	defer p.DB.mu.Unlock()
+	var n int64
+	for id, pwReset := range p.DB.passwordResets {
+		if !now.Before(pwReset.ExpiresAt) {
+			delete(p.DB.passwordResets, id)
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,181 @@
+package models_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/arkadiont/lenslocked/migrations"
+	"github.com/arkadiont/lenslocked/models"
+	"github.com/arkadiont/lenslocked/models/modelstest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestDB connects to the database of LENSLOCKED_TEST_DSN, e.g.
+// "host=localhost user=baloo password=junglebook dbname=lenslocked_test",
+// and migrates it. Tests using it are skipped when the variable is unset.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("LENSLOCKED_TEST_DSN")
+	if dsn == "" {
+		t.Skip("LENSLOCKED_TEST_DSN is not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	migrator, err := models.NewMigratorPostgres(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = migrator.Up(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestPostgresServices runs the same checks against the Postgres services,
+// they must behave like the in-memory ones.
+func TestPostgresServices(t *testing.T) {
+	db := openTestDB(t)
+	images := models.NewImageService(models.NewImageStoreDisk(t.TempDir()))
+	err := modelstest.TestServices(modelstest.Services{
+		Users:                 models.NewUserServicePostgres(db),
+		Sessions:              models.NewSessionServicePostgres(db),
+		PasswordResets:        models.NewPasswordResetService(db),
+		ExpiredSessions:       models.NewSessionServicePostgres(db, models.WithSessionLifetime(time.Nanosecond)),
+		ExpiredPasswordResets: models.NewPasswordResetService(db, models.WithResetDuration(time.Nanosecond)),
+
+		Galleries:                 models.NewGalleryServicePostgres(db),
+		EmailVerifications:        models.NewEmailVerificationService(db),
+		ExpiredEmailVerifications: models.NewEmailVerificationService(db, models.WithVerificationDuration(time.Nanosecond)),
+		LoginThrottle:             models.NewLoginThrottlePostgres(db),
+		TwoFactor:                 models.NewTwoFactorServicePostgres(db),
+		AccountDeletions:          models.NewAccountDeletionService(db, images),
+		ExpiredAccountDeletions:   models.NewAccountDeletionService(db, images, models.WithDeletionGracePeriod(time.Nanosecond)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expireLogin ends the lockout of key, as if its time passed.
+func expireLogin(t *testing.T, db *sql.DB, key string) {
+	t.Helper()
+	_, err := db.Exec(`UPDATE login_attempt SET locked_until = $2 WHERE key = $1;`, key, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginThrottlePostgres(t *testing.T) {
+	db := openTestDB(t)
+	throttle := models.NewLoginThrottlePostgres(db,
+		models.WithMaxLoginAttempts(3),
+		models.WithLoginLockout(time.Hour))
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+	email, ip := "Throttle-"+token+"@example.com", "192.0.2."+token
+
+	// fail counts a failed sign in, returning the unlock token if any.
+	fail := func() string {
+		t.Helper()
+		if err := throttle.Allowed(email, ip); err != nil {
+			t.Fatalf("Allowed: %v", err)
+		}
+		unlockToken, err := throttle.Failed(email, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return unlockToken
+	}
+	locked := func(want time.Duration) {
+		t.Helper()
+		err := throttle.Allowed(strings.ToLower(email), ip)
+		var lerr *models.LockedError
+		if !errors.As(err, &lerr) {
+			t.Fatalf("Allowed: err = %v, want a *LockedError", err)
+		}
+		if got := time.Until(lerr.Until); got < want-time.Minute || got > want {
+			t.Errorf("locked for %v, want %v", got, want)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if unlockToken := fail(); unlockToken != "" {
+			t.Fatalf("failure %d locked the account", i+1)
+		}
+	}
+	unlockToken := fail()
+	if unlockToken == "" {
+		t.Fatalf("the third failure didn't hand out an unlock token")
+	}
+	locked(time.Hour)
+	// Each failure past the limit doubles the lockout, the new lock comes
+	// with a new unlock token.
+	expireLogin(t, db, "email:"+strings.ToLower(email))
+	firstToken := unlockToken
+	if unlockToken = fail(); unlockToken == "" || unlockToken == firstToken {
+		t.Fatalf("the second lock handed out unlock token %q", unlockToken)
+	}
+	locked(2 * time.Hour)
+	if err := throttle.Unlock(firstToken); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Unlock with the token of the previous lock: err = %v, want ErrNotFound", err)
+	}
+
+	if err := throttle.Unlock(unlockToken); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := throttle.Unlock(unlockToken); !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Unlock twice: err = %v, want ErrNotFound", err)
+	}
+	// The count starts over once unlocked.
+	for i := 0; i < 2; i++ {
+		if unlockToken := fail(); unlockToken != "" {
+			t.Fatalf("failure %d after unlocking locked the account", i+1)
+		}
+	}
+	if err := throttle.Allowed(email, ip); err != nil {
+		t.Fatal(err)
+	}
+	if err := throttle.Succeeded(email, ip); err != nil {
+		t.Fatal(err)
+	}
+	// Succeeded forgot the failures, two more don't lock the account.
+	for i := 0; i < 2; i++ {
+		if unlockToken := fail(); unlockToken != "" {
+			t.Fatalf("failure %d after signing in locked the account", i+1)
+		}
+	}
+}
+
+func TestLoginThrottlePostgresPerIP(t *testing.T) {
+	db := openTestDB(t)
+	throttle := models.NewLoginThrottlePostgres(db,
+		models.WithMaxLoginAttempts(10),
+		models.WithMaxLoginAttemptsPerIP(3),
+		models.WithLoginLockout(time.Hour))
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+	ip := "198.51.100." + token
+	// Every attempt is for another account, only the address adds up.
+	for i := 0; i < 3; i++ {
+		email := fmt.Sprintf("ip-%d-%s@example.com", i, token)
+		if err := throttle.Allowed(email, ip); err != nil {
+			t.Fatalf("attempt %d: %v", i+1, err)
+		}
+		if _, err := throttle.Failed(email, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var lerr *models.LockedError
+	if err := throttle.Allowed("ip-next-"+token+"@example.com", ip); !errors.As(err, &lerr) {
+		t.Fatalf("Allowed past the limit of the address: err = %v, want a *LockedError", err)
+	}
+	// Other addresses aren't affected.
+	if err := throttle.Allowed("ip-next-"+token+"@example.com", ip+"1"); err != nil {
+		t.Errorf("Allowed from another address: %v", err)
+	}
+}
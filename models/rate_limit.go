@@ -0,0 +1,170 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit describes a token bucket: it holds up to Burst tokens and gets
+// Rate tokens back every second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// PerMinute allows n requests per minute, all of them at once if need be.
+func PerMinute(n int) RateLimit {
+	return RateLimit{Rate: float64(n) / 60, Burst: n}
+}
+
+// PerHour allows n requests per hour, all of them at once if need be.
+func PerHour(n int) RateLimit {
+	return RateLimit{Rate: float64(n) / 3600, Burst: n}
+}
+
+// RateLimitStore keeps the token buckets of the rate limiter.
+type RateLimitStore interface {
+	// Take removes a token from the bucket of key. When the bucket is empty
+	// it reports false along with the time until a token is available.
+	Take(key string, limit RateLimit) (ok bool, retryAfter time.Duration, err error)
+	// DeleteExpired forgets the buckets that are full again, which behave
+	// exactly as missing ones.
+	Expirer
+}
+
+// tokenBucket is the state shared by every RateLimitStore.
+type tokenBucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+	// FullAt is when the bucket will be full again, after which it can be
+	// forgotten.
+	FullAt time.Time
+}
+
+// take refills the bucket up to now and removes a token if there's one.
+func (b *tokenBucket) take(now time.Time, limit RateLimit) (bool, time.Duration) {
+	if elapsed := now.Sub(b.UpdatedAt).Seconds(); elapsed > 0 {
+		b.Tokens = math.Min(float64(limit.Burst), b.Tokens+elapsed*limit.Rate)
+	}
+	b.UpdatedAt = now
+	ok := b.Tokens >= 1
+	if ok {
+		b.Tokens--
+	}
+	var retryAfter time.Duration
+	if !ok && limit.Rate > 0 {
+		retryAfter = time.Duration((1 - b.Tokens) / limit.Rate * float64(time.Second))
+	}
+	b.FullAt = now
+	if limit.Rate > 0 {
+		missing := float64(limit.Burst) - b.Tokens
+		b.FullAt = now.Add(time.Duration(missing / limit.Rate * float64(time.Second)))
+	}
+	return ok, retryAfter
+}
+
+func newTokenBucket(now time.Time, limit RateLimit) tokenBucket {
+	return tokenBucket{
+		Tokens:    float64(limit.Burst),
+		UpdatedAt: now,
+	}
+}
+
+// NewRateLimitStoreMemory keeps buckets in memory, enough for a single
+// instance deployment.
+func NewRateLimitStoreMemory() RateLimitStore {
+	return &rateLimitStoreMemory{
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+type rateLimitStoreMemory struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func (s *rateLimitStoreMemory) Take(key string, limit RateLimit) (bool, time.Duration, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[key]
+	if !ok {
+		bucket := newTokenBucket(now, limit)
+		b = &bucket
+		s.buckets[key] = b
+	}
+	allowed, retryAfter := b.take(now, limit)
+	return allowed, retryAfter, nil
+}
+
+func (s *rateLimitStoreMemory) DeleteExpired(now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for key, b := range s.buckets {
+		if !b.FullAt.After(now) {
+			delete(s.buckets, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// NewRateLimitStorePostgres shares the buckets between every instance using
+// the same database.
+func NewRateLimitStorePostgres(db *sql.DB) RateLimitStore {
+	return &rateLimitStorePostgres{
+		DB: db,
+	}
+}
+
+type rateLimitStorePostgres struct {
+	DB *sql.DB
+}
+
+func (s rateLimitStorePostgres) Take(key string, limit RateLimit) (ok bool, retryAfter time.Duration, err error) {
+	now := time.Now()
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, 0, fmt.Errorf("take rate limit token: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	b := newTokenBucket(now, limit)
+	// Create the bucket if needed, then lock it so concurrent requests take
+	// their tokens one after the other.
+	_, err = tx.Exec(`
+		INSERT INTO rate_limit (key, tokens, updated_at, full_at) VALUES ($1, $2, $3, $3)
+		ON CONFLICT (key) DO NOTHING;`, key, b.Tokens, b.UpdatedAt)
+	if err != nil {
+		return false, 0, fmt.Errorf("take rate limit token: %w", err)
+	}
+	row := tx.QueryRow(`SELECT tokens, updated_at FROM rate_limit WHERE key = $1 FOR UPDATE;`, key)
+	if err = row.Scan(&b.Tokens, &b.UpdatedAt); err != nil {
+		return false, 0, fmt.Errorf("take rate limit token: %w", err)
+	}
+	ok, retryAfter = b.take(now, limit)
+	_, err = tx.Exec(`UPDATE rate_limit SET tokens = $2, updated_at = $3, full_at = $4 WHERE key = $1;`,
+		key, b.Tokens, b.UpdatedAt, b.FullAt)
+	if err != nil {
+		return false, 0, fmt.Errorf("take rate limit token: %w", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return false, 0, fmt.Errorf("take rate limit token: %w", err)
+	}
+	return ok, retryAfter, nil
+}
+
+func (s rateLimitStorePostgres) DeleteExpired(now time.Time) (int64, error) {
+	res, err := s.DB.Exec(`DELETE FROM rate_limit WHERE full_at <= $1;`, now)
+	if err != nil {
+		return 0, fmt.Errorf("delete expired rate limits: %w", err)
+	}
+	return res.RowsAffected()
+}
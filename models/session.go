@@ -4,13 +4,23 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/arkadiont/lenslocked/rand"
+	"sort"
+	"time"
 )
 
 const (
 	// The minimum number of bytes to be used for each session token.
 	MinBytesPerToken = 32
+	// DefaultSessionLifetime is how long a session lasts since the user signed in.
+	DefaultSessionLifetime = 30 * 24 * time.Hour
+	// DefaultSessionIdleTimeout ends sessions that haven't been used for this long.
+	DefaultSessionIdleTimeout = 7 * 24 * time.Hour
+	// DefaultSessionRenewInterval is the minimum time between two writes of
+	// last_seen_at for the same session.
+	DefaultSessionRenewInterval = 5 * time.Minute
 )
 
 type Session struct {
@@ -18,59 +28,132 @@ type Session struct {
 	UserId uint
 	// Token is only set when creating a new session. When look up a session this will be left empty,
 	// as we only store the hash(token) in db
-	Token     string
-	TokenHash string
+	Token      string
+	TokenHash  string
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	// Current is set by List on the session the list was requested with.
+	Current bool
 }
 
 type SessionService interface {
-	Create(userID uint) (*Session, error)
+	// Create signs the user in on a new device, leaving any other session untouched.
+	Create(userID uint, userAgent, ipAddress string) (*Session, error)
+	// User returns the user owning token, renewing the idle timeout of the
+	// session. Expired sessions are deleted and reported as ErrTokenExpired.
 	User(token string) (*User, error)
 	Delete(token string) error
+	// List returns every session of the user owning token, most recently seen first.
+	List(token string) ([]Session, error)
+	// Revoke deletes the session id as long as it belongs to the user owning token.
+	Revoke(token string, id uint) error
+	// DeleteOthers signs the user owning token out of every other session.
+	DeleteOthers(token string) error
+	Expirer
 }
 
-type sessionOption func(*sessionService)
+type sessionOption func(*sessionConfig)
 
 func WithBytesPerToken(bytesPerToken int) sessionOption {
-	return func(s *sessionService) {
+	return func(s *sessionConfig) {
 		if bytesPerToken > s.BytesPerToken {
 			s.BytesPerToken = bytesPerToken
 		}
 	}
 }
 
+// WithSessionLifetime sets the absolute lifetime of new sessions.
+func WithSessionLifetime(lifetime time.Duration) sessionOption {
+	return func(s *sessionConfig) {
+		if lifetime > 0 {
+			s.Lifetime = lifetime
+		}
+	}
+}
+
+// WithSessionIdleTimeout sets how long a session may go unused.
+func WithSessionIdleTimeout(timeout time.Duration) sessionOption {
+	return func(s *sessionConfig) {
+		if timeout > 0 {
+			s.IdleTimeout = timeout
+		}
+	}
+}
+
+// WithSessionRenewInterval sets how often last_seen_at is written, trading
+// precision of the idle timeout for fewer writes.
+func WithSessionRenewInterval(interval time.Duration) sessionOption {
+	return func(s *sessionConfig) {
+		if interval > 0 {
+			s.RenewInterval = interval
+		}
+	}
+}
+
 func NewSessionServicePostgres(db *sql.DB, opts ...sessionOption) SessionService {
-	s := sessionService{
+	return &sessionService{
 		DB:            db,
+		sessionConfig: newSessionConfig(opts),
+	}
+}
+
+// sessionConfig holds the settings shared by the Postgres and in-memory
+// session services.
+type sessionConfig struct {
+	// BytesPerToken is used to determine how many bytes to use when generating
+	// each session token. If this value is not set or is less than the
+	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be used.
+	BytesPerToken int
+	// Lifetime is the amount of time a session is valid for. Default DefaultSessionLifetime
+	Lifetime time.Duration
+	// IdleTimeout expires sessions unused for longer. Default DefaultSessionIdleTimeout
+	IdleTimeout time.Duration
+	// RenewInterval throttles the writes of last_seen_at. Default DefaultSessionRenewInterval
+	RenewInterval time.Duration
+}
+
+func newSessionConfig(opts []sessionOption) sessionConfig {
+	c := sessionConfig{
 		BytesPerToken: MinBytesPerToken,
+		Lifetime:      DefaultSessionLifetime,
+		IdleTimeout:   DefaultSessionIdleTimeout,
+		RenewInterval: DefaultSessionRenewInterval,
 	}
 	for _, opt := range opts {
-		opt(&s)
+		opt(&c)
 	}
-	return &s
+	return c
 }
 
 type sessionService struct {
 	DB *sql.DB
-	// BytesPerToken is used to determine how many bytes to use when generating
-	// each session token. If this value is not set or is less than the
-	// MinBytesPerToken const it will be ignored and MinBytesPerToken will be used.
-	BytesPerToken int
+	sessionConfig
 }
 
-func (ss sessionService) Create(userID uint) (*Session, error) {
+func (ss sessionService) Create(userID uint, userAgent, ipAddress string) (*Session, error) {
 	token, err := rand.String(ss.BytesPerToken)
 	if err != nil {
 		return nil, fmt.Errorf("create: %w", err)
 	}
+	now := time.Now()
 	session := Session{
-		UserId:    userID,
-		Token:     token,
-		TokenHash: ss.hash(token),
+		UserId:     userID,
+		Token:      token,
+		TokenHash:  ss.hash(token),
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ss.Lifetime),
 	}
 	row := ss.DB.QueryRow(`
-		INSERT INTO session (user_id, token_hash)
-		VALUES ($1, $2) ON CONFLICT(user_id) DO 
-		UPDATE SET token_hash = $2 RETURNING id;`, session.UserId, session.TokenHash)
+		INSERT INTO session (user_id, token_hash, user_agent, ip_address, created_at, last_seen_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id;`,
+		session.UserId, session.TokenHash, session.UserAgent, session.IPAddress,
+		session.CreatedAt, session.LastSeenAt, session.ExpiresAt)
 	err = row.Scan(&session.ID)
 	if err != nil {
 		return nil, fmt.Errorf("create session: %w", err)
@@ -89,16 +172,263 @@ func (ss sessionService) Delete(token string) error {
 
 func (ss sessionService) User(token string) (*User, error) {
 	var user User
+	var sessionID uint
+	var lastSeenAt, expiresAt time.Time
 	tokenHash := ss.hash(token)
-	row := ss.DB.QueryRow(`SELECT u.id, u.email, u.password_hash FROM users u, session s
-	WHERE u.id = s.user_id AND s.token_hash = $1`, tokenHash)
-	if err := row.Scan(&user.ID, &user.Email, &user.PasswordHash); err != nil {
+	row := ss.DB.QueryRow(`
+		SELECT u.id, u.email, u.password_hash, u.email_verified_at, s.id, s.last_seen_at, s.expires_at
+		FROM users u, session s
+		WHERE u.id = s.user_id AND s.token_hash = $1`, tokenHash)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.EmailVerifiedAt,
+		&sessionID, &lastSeenAt, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("user: %w", ErrNotFound)
+		}
 		return nil, fmt.Errorf("user: %w", err)
 	}
+	now := time.Now()
+	if now.After(expiresAt) || now.Sub(lastSeenAt) > ss.IdleTimeout {
+		if _, err = ss.DB.Exec(`DELETE FROM session WHERE id = $1`, sessionID); err != nil {
+			return nil, fmt.Errorf("user: %w", err)
+		}
+		return nil, ErrTokenExpired
+	}
+	if now.Sub(lastSeenAt) > ss.RenewInterval {
+		_, err = ss.DB.Exec(`UPDATE session SET last_seen_at = $2 WHERE id = $1`, sessionID, now)
+		if err != nil {
+			return nil, fmt.Errorf("user: %w", err)
+		}
+	}
 	return &user, nil
 }
 
-func (ss sessionService) hash(token string) string {
+func (ss sessionService) List(token string) ([]Session, error) {
+	tokenHash := ss.hash(token)
+	now := time.Now()
+	rows, err := ss.DB.Query(`
+		SELECT s.id, s.user_id, s.token_hash, s.user_agent, s.ip_address, s.created_at, s.last_seen_at,
+			s.expires_at
+		FROM session s, session cur
+		WHERE s.user_id = cur.user_id AND cur.token_hash = $1
+			AND s.expires_at > $2 AND s.last_seen_at > $3
+		ORDER BY s.last_seen_at DESC;`, tokenHash, now, now.Add(-ss.IdleTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		err = rows.Scan(&s.ID, &s.UserId, &s.TokenHash, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt,
+			&s.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("list sessions: %w", err)
+		}
+		s.Current = s.TokenHash == tokenHash
+		sessions = append(sessions, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+func (ss sessionService) Revoke(token string, id uint) error {
+	res, err := ss.DB.Exec(`
+		DELETE FROM session s USING session cur
+		WHERE s.id = $2 AND s.user_id = cur.user_id AND cur.token_hash = $1;`, ss.hash(token), id)
+	if err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("revoke session: %w", err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (ss sessionService) DeleteOthers(token string) error {
+	tokenHash := ss.hash(token)
+	_, err := ss.DB.Exec(`
+		DELETE FROM session s USING session cur
+		WHERE s.user_id = cur.user_id AND cur.token_hash = $1 AND s.token_hash <> $1;`, tokenHash)
+	if err != nil {
+		return fmt.Errorf("delete other sessions: %w", err)
+	}
+	return nil
+}
+
+// hash is shared by both services, only the hashes of tokens are stored.
+func (c sessionConfig) hash(token string) string {
 	tokenHash := sha256.Sum256([]byte(token))
 	return base64.URLEncoding.EncodeToString(tokenHash[:])
 }
+
+func (ss sessionService) DeleteExpired(now time.Time) (int64, error) {
+	res, err := ss.DB.Exec(`
+		DELETE FROM session WHERE expires_at <= $1 OR last_seen_at <= $2;`, now, now.Add(-ss.IdleTimeout))
+	if err != nil {
+		return 0, fmt.Errorf("delete expired sessions: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+// NewSessionServiceMemory keeps sessions in db, it takes the same options as
+// NewSessionServicePostgres.
+func NewSessionServiceMemory(db *MemoryDB, opts ...sessionOption) SessionService {
+	return &sessionServiceMemory{
+		DB:            db,
+		sessionConfig: newSessionConfig(opts),
+	}
+}
+
+type sessionServiceMemory struct {
+	DB *MemoryDB
+	sessionConfig
+}
+
+func (ss sessionServiceMemory) Create(userID uint, userAgent, ipAddress string) (*Session, error) {
+	token, err := rand.String(ss.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create: %w", err)
+	}
+	now := time.Now()
+	session := Session{
+		UserId:     userID,
+		TokenHash:  ss.hash(token),
+		UserAgent:  userAgent,
+		IPAddress:  ipAddress,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(ss.Lifetime),
+	}
+	ss.DB.mu.Lock()
+	defer ss.DB.mu.Unlock()
+	if _, ok := ss.DB.users[userID]; !ok {
+		return nil, fmt.Errorf("create session: %w", ErrNotFound)
+	}
+	session.ID = ss.DB.nextID()
+	ss.DB.sessions[session.ID] = &session
+	created := session
+	created.Token = token
+	return &created, nil
+}
+
+func (ss sessionServiceMemory) Delete(token string) error {
+	ss.DB.mu.Lock()
+	defer ss.DB.mu.Unlock()
+	if session, ok := ss.byToken(token); ok {
+		delete(ss.DB.sessions, session.ID)
+	}
+	return nil
+}
+
+func (ss sessionServiceMemory) User(token string) (*User, error) {
+	ss.DB.mu.Lock()
+	defer ss.DB.mu.Unlock()
+	session, ok := ss.byToken(token)
+	if !ok {
+		return nil, fmt.Errorf("user: %w", ErrNotFound)
+	}
+	user, ok := ss.DB.users[session.UserId]
+	if !ok {
+		return nil, fmt.Errorf("user: %w", ErrNotFound)
+	}
+	now := time.Now()
+	if ss.expired(session, now) {
+		delete(ss.DB.sessions, session.ID)
+		return nil, ErrTokenExpired
+	}
+	if now.Sub(session.LastSeenAt) > ss.RenewInterval {
+		session.LastSeenAt = now
+	}
+	found := *user
+	return &found, nil
+}
+
+func (ss sessionServiceMemory) List(token string) ([]Session, error) {
+	ss.DB.mu.Lock()
+	defer ss.DB.mu.Unlock()
+	current, ok := ss.byToken(token)
+	if !ok {
+		return nil, nil
+	}
+	now := time.Now()
+	var sessions []Session
+	for _, s := range ss.DB.sessions {
+		if s.UserId != current.UserId || ss.expired(s, now) {
+			continue
+		}
+		session := *s
+		session.Current = s.ID == current.ID
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+	return sessions, nil
+}
+
+func (ss sessionServiceMemory) Revoke(token string, id uint) error {
+	ss.DB.mu.Lock()
+	defer ss.DB.mu.Unlock()
+	current, ok := ss.byToken(token)
+	if !ok {
+		return ErrNotFound
+	}
+	session, ok := ss.DB.sessions[id]
+	if !ok || session.UserId != current.UserId {
+		return ErrNotFound
+	}
+	delete(ss.DB.sessions, id)
+	return nil
+}
+
+func (ss sessionServiceMemory) DeleteOthers(token string) error {
+	ss.DB.mu.Lock()
+	defer ss.DB.mu.Unlock()
+	current, ok := ss.byToken(token)
+	if !ok {
+		return nil
+	}
+	for id, session := range ss.DB.sessions {
+		if session.UserId == current.UserId && id != current.ID {
+			delete(ss.DB.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (ss sessionServiceMemory) DeleteExpired(now time.Time) (int64, error) {
+	ss.DB.mu.Lock()
+	defer ss.DB.mu.Unlock()
+	var n int64
+	for id, session := range ss.DB.sessions {
+		// DeleteExpired of sessionService removes sessions expiring exactly
+		// at now as well.
+		if !now.Before(session.ExpiresAt) || !session.LastSeenAt.After(now.Add(-ss.IdleTimeout)) {
+			delete(ss.DB.sessions, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// byToken looks the session of token up. DB.mu must be held.
+func (ss sessionServiceMemory) byToken(token string) (*Session, bool) {
+	tokenHash := ss.hash(token)
+	for _, session := range ss.DB.sessions {
+		if session.TokenHash == tokenHash {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
+func (ss sessionServiceMemory) expired(session *Session, now time.Time) bool {
+	return now.After(session.ExpiresAt) || now.Sub(session.LastSeenAt) > ss.IdleTimeout
+}
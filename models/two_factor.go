@@ -0,0 +1,434 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTOTPIssuer = "Lenslocked"
+	// RecoveryCodeCount is the number of recovery codes handed out when 2FA
+	// is enabled.
+	RecoveryCodeCount = 10
+
+	totpPeriod     = 30
+	totpDigits     = 6
+	totpSecretSize = 20
+	// totpSkew is the number of periods accepted before and after the
+	// current one, to cope with clocks drifting apart.
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment holds what an authenticator app needs to be set up.
+type TOTPEnrollment struct {
+	Secret string
+	// URL is the otpauth:// URL usually shown as a QR code.
+	URL string
+}
+
+// TwoFactorService manages time-based one-time passwords (RFC 6238) and the
+// recovery codes to use when the authenticator is lost.
+type TwoFactorService interface {
+	// Enroll generates a secret for the user, or returns the one not
+	// confirmed yet. 2FA is only enabled once the secret is confirmed with a
+	// first code.
+	Enroll(userID uint, email string) (*TOTPEnrollment, error)
+	// Confirm enables 2FA and returns the recovery codes, they can't be
+	// retrieved later.
+	Confirm(userID uint, code string) ([]string, error)
+	Enabled(userID uint) (bool, error)
+	// Verify checks a code from the authenticator app or an unused recovery
+	// code, returning ErrInvalidCode when neither matches.
+	Verify(userID uint, code string) error
+	Disable(userID uint) error
+}
+
+type twoFactorOption func(*twoFactorConfig)
+
+// WithTOTPIssuer sets the name authenticator apps show next to the account.
+func WithTOTPIssuer(issuer string) twoFactorOption {
+	return func(s *twoFactorConfig) {
+		if issuer != "" {
+			s.Issuer = issuer
+		}
+	}
+}
+
+func NewTwoFactorServicePostgres(db *sql.DB, opts ...twoFactorOption) TwoFactorService {
+	return &twoFactorService{
+		DB:              db,
+		twoFactorConfig: newTwoFactorConfig(opts),
+	}
+}
+
+// twoFactorConfig holds the settings shared by the Postgres and in-memory
+// two-factor services.
+type twoFactorConfig struct {
+	Issuer string
+	now    func() time.Time
+}
+
+func newTwoFactorConfig(opts []twoFactorOption) twoFactorConfig {
+	c := twoFactorConfig{
+		Issuer: DefaultTOTPIssuer,
+		now:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// enrollment returns what the authenticator app of email needs to use secret.
+func (c twoFactorConfig) enrollment(secret, email string) *TOTPEnrollment {
+	label := url.PathEscape(c.Issuer + ":" + email)
+	values := url.Values{
+		"secret":    {secret},
+		"issuer":    {c.Issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return &TOTPEnrollment{
+		Secret: secret,
+		URL:    "otpauth://totp/" + label + "?" + values.Encode(),
+	}
+}
+
+// matchStep returns the time step code was generated for with secret, or
+// ErrInvalidCode.
+func (c twoFactorConfig) matchStep(secret, code string) (int64, error) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, fmt.Errorf("verify totp: %w", err)
+	}
+	step, ok := matchTOTP(key, normalizeCode(code), c.now())
+	if !ok {
+		return 0, ErrInvalidCode
+	}
+	return step, nil
+}
+
+type twoFactorService struct {
+	DB *sql.DB
+	twoFactorConfig
+}
+
+func (s twoFactorService) Enroll(userID uint, email string) (*TOTPEnrollment, error) {
+	key := make([]byte, totpSecretSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("enroll totp: %w", err)
+	}
+	// An unconfirmed secret is kept, so reloading the enrollment page doesn't
+	// break an authenticator app already set up with it.
+	var secret string
+	var confirmed bool
+	row := s.DB.QueryRow(`
+		INSERT INTO totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET user_id = EXCLUDED.user_id
+		RETURNING secret, confirmed_at IS NOT NULL;`, userID, totpEncoding.EncodeToString(key))
+	if err := row.Scan(&secret, &confirmed); err != nil {
+		return nil, fmt.Errorf("enroll totp: %w", err)
+	}
+	if confirmed {
+		return nil, ErrTwoFactorEnabled
+	}
+	return s.enrollment(secret, email), nil
+}
+
+func (s twoFactorService) Confirm(userID uint, code string) ([]string, error) {
+	var secret string
+	var confirmed bool
+	row := s.DB.QueryRow(`SELECT secret, confirmed_at IS NOT NULL FROM totp WHERE user_id = $1;`, userID)
+	if err := row.Scan(&secret, &confirmed); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("confirm totp: %w", err)
+	}
+	if confirmed {
+		return nil, ErrTwoFactorEnabled
+	}
+	if err := s.useTOTP(userID, secret, code); err != nil {
+		return nil, err
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("confirm totp: %w", err)
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("confirm totp: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec(`UPDATE totp SET confirmed_at = $2 WHERE user_id = $1;`, userID, s.now()); err != nil {
+		return nil, fmt.Errorf("confirm totp: %w", err)
+	}
+	if _, err = tx.Exec(`DELETE FROM recovery_code WHERE user_id = $1;`, userID); err != nil {
+		return nil, fmt.Errorf("confirm totp: %w", err)
+	}
+	for _, hash := range hashes {
+		_, err = tx.Exec(`INSERT INTO recovery_code (user_id, code_hash) VALUES ($1, $2);`, userID, hash)
+		if err != nil {
+			return nil, fmt.Errorf("confirm totp: %w", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("confirm totp: %w", err)
+	}
+	return codes, nil
+}
+
+func (s twoFactorService) Enabled(userID uint) (bool, error) {
+	var enabled bool
+	row := s.DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM totp WHERE user_id = $1 AND confirmed_at IS NOT NULL);`, userID)
+	if err := row.Scan(&enabled); err != nil {
+		return false, fmt.Errorf("totp enabled: %w", err)
+	}
+	return enabled, nil
+}
+
+func (s twoFactorService) Verify(userID uint, code string) error {
+	var secret string
+	row := s.DB.QueryRow(`SELECT secret FROM totp WHERE user_id = $1 AND confirmed_at IS NOT NULL;`, userID)
+	if err := row.Scan(&secret); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidCode
+		}
+		return fmt.Errorf("verify totp: %w", err)
+	}
+	code = normalizeCode(code)
+	if len(code) == totpDigits {
+		return s.useTOTP(userID, secret, code)
+	}
+	res, err := s.DB.Exec(`
+		UPDATE recovery_code SET used_at = $3
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;`, userID, hashRecoveryCode(code), s.now())
+	if err != nil {
+		return fmt.Errorf("verify recovery code: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// useTOTP checks code against secret and records the period it belongs to,
+// so a code can't be used twice.
+func (s twoFactorService) useTOTP(userID uint, secret, code string) error {
+	step, err := s.matchStep(secret, code)
+	if err != nil {
+		return err
+	}
+	res, err := s.DB.Exec(`
+		UPDATE totp SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2;`, userID, step)
+	if err != nil {
+		return fmt.Errorf("verify totp: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (s twoFactorService) Disable(userID uint) error {
+	if _, err := s.DB.Exec(`DELETE FROM totp WHERE user_id = $1;`, userID); err != nil {
+		return fmt.Errorf("disable totp: %w", err)
+	}
+	if _, err := s.DB.Exec(`DELETE FROM recovery_code WHERE user_id = $1;`, userID); err != nil {
+		return fmt.Errorf("disable totp: %w", err)
+	}
+	return nil
+}
+
+// NewTwoFactorServiceMemory keeps TOTP secrets and recovery codes in db, it
+// takes the same options as NewTwoFactorServicePostgres.
+func NewTwoFactorServiceMemory(db *MemoryDB, opts ...twoFactorOption) TwoFactorService {
+	return &twoFactorServiceMemory{
+		DB:              db,
+		twoFactorConfig: newTwoFactorConfig(opts),
+	}
+}
+
+type twoFactorServiceMemory struct {
+	DB *MemoryDB
+	twoFactorConfig
+}
+
+// totpSecret is a row of the totp table.
+type totpSecret struct {
+	Secret       string
+	Confirmed    bool
+	LastUsedStep int64
+}
+
+// recoveryCode is a row of the recovery_code table.
+type recoveryCode struct {
+	Hash string
+	Used bool
+}
+
+func (s twoFactorServiceMemory) Enroll(userID uint, email string) (*TOTPEnrollment, error) {
+	key := make([]byte, totpSecretSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("enroll totp: %w", err)
+	}
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	if _, ok := s.DB.users[userID]; !ok {
+		return nil, fmt.Errorf("enroll totp: %w", ErrNotFound)
+	}
+	totp, ok := s.DB.totps[userID]
+	if !ok {
+		totp = &totpSecret{Secret: totpEncoding.EncodeToString(key)}
+		s.DB.totps[userID] = totp
+	}
+	if totp.Confirmed {
+		return nil, ErrTwoFactorEnabled
+	}
+	return s.enrollment(totp.Secret, email), nil
+}
+
+func (s twoFactorServiceMemory) Confirm(userID uint, code string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("confirm totp: %w", err)
+	}
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	totp, ok := s.DB.totps[userID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if totp.Confirmed {
+		return nil, ErrTwoFactorEnabled
+	}
+	if err = s.useTOTP(totp, code); err != nil {
+		return nil, err
+	}
+	totp.Confirmed = true
+	recoveryCodes := make([]recoveryCode, 0, len(hashes))
+	for _, hash := range hashes {
+		recoveryCodes = append(recoveryCodes, recoveryCode{Hash: hash})
+	}
+	s.DB.recoveryCodes[userID] = recoveryCodes
+	return codes, nil
+}
+
+func (s twoFactorServiceMemory) Enabled(userID uint) (bool, error) {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	totp, ok := s.DB.totps[userID]
+	return ok && totp.Confirmed, nil
+}
+
+func (s twoFactorServiceMemory) Verify(userID uint, code string) error {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	totp, ok := s.DB.totps[userID]
+	if !ok || !totp.Confirmed {
+		return ErrInvalidCode
+	}
+	code = normalizeCode(code)
+	if len(code) == totpDigits {
+		return s.useTOTP(totp, code)
+	}
+	hash := hashRecoveryCode(code)
+	for i, recovery := range s.DB.recoveryCodes[userID] {
+		if recovery.Hash == hash && !recovery.Used {
+			s.DB.recoveryCodes[userID][i].Used = true
+			return nil
+		}
+	}
+	return ErrInvalidCode
+}
+
+// useTOTP is twoFactorService.useTOTP for the in-memory rows. mu must be held.
+func (s twoFactorServiceMemory) useTOTP(totp *totpSecret, code string) error {
+	step, err := s.matchStep(totp.Secret, code)
+	if err != nil {
+		return err
+	}
+	if totp.LastUsedStep >= step {
+		return ErrInvalidCode
+	}
+	totp.LastUsedStep = step
+	return nil
+}
+
+func (s twoFactorServiceMemory) Disable(userID uint) error {
+	s.DB.mu.Lock()
+	defer s.DB.mu.Unlock()
+	delete(s.DB.totps, userID)
+	delete(s.DB.recoveryCodes, userID)
+	return nil
+}
+
+// matchTOTP returns the time step code was generated for, looking totpSkew
+// steps around now.
+func matchTOTP(key []byte, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode computes the HOTP value (RFC 4226) of key for the given step.
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// newRecoveryCodes returns RecoveryCodeCount codes formatted as xxxxx-xxxxx
+// along with the hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	hashes := make([]string, 0, RecoveryCodeCount)
+	buf := make([]byte, 6)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(buf))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeCode drops the separators users may type along with a code.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return base64.URLEncoding.EncodeToString(sum[:])
+}
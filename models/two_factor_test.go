@@ -0,0 +1,145 @@
+package models_test
+
+import (
+	"errors"
+	"github.com/arkadiont/lenslocked/models"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcKey is the SHA1 seed of the RFC 6238 Appendix B test vectors.
+var rfcKey = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B lists 8 digit codes, the last 6 digits are the
+	// codes of the same steps with 6 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		want := tt.want[2:]
+		if got := models.TOTPCode(rfcKey, tt.unix/30); got != want {
+			t.Errorf("TOTPCode at %d = %s, want %s", tt.unix, got, want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	current := now.Unix() / 30
+	for _, step := range []int64{current - 1, current, current + 1} {
+		got, ok := models.MatchTOTP(rfcKey, models.TOTPCode(rfcKey, step), now)
+		if !ok || got != step {
+			t.Errorf("the code of step %+d = %d, %v, want it accepted", step-current, got, ok)
+		}
+	}
+	for _, step := range []int64{current - 2, current + 2} {
+		if _, ok := models.MatchTOTP(rfcKey, models.TOTPCode(rfcKey, step), now); ok {
+			t.Errorf("the code of step %+d was accepted", step-current)
+		}
+	}
+	// Appendix B codes are 8 digits long, only 6 are accepted.
+	if _, ok := models.MatchTOTP(rfcKey, "07081804", now); ok {
+		t.Errorf("an 8 digit code was accepted")
+	}
+}
+
+// twoFactorUser is a user with 2FA enabled.
+type twoFactorUser struct {
+	ID  uint
+	Key []byte
+	// Step is the time step of the code which confirmed the enrollment.
+	Step  int64
+	Codes []string
+}
+
+func enrollTwoFactor(t *testing.T, twoFactor models.TwoFactorService, users models.UserService) twoFactorUser {
+	t.Helper()
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+	user, err := users.Create("totp-"+token+"@example.com", "pw-"+token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrollment, err := twoFactor.Enroll(user.ID, user.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := models.TOTPEncoding.DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := time.Now().Unix() / 30
+	if err = twoFactor.Verify(user.ID, models.TOTPCode(key, step)); !errors.Is(err, models.ErrInvalidCode) {
+		t.Fatalf("Verify before Confirm: err = %v, want ErrInvalidCode", err)
+	}
+	codes, err := twoFactor.Confirm(user.ID, models.TOTPCode(key, step))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != models.RecoveryCodeCount {
+		t.Fatalf("Confirm returned %d recovery codes, want %d", len(codes), models.RecoveryCodeCount)
+	}
+	return twoFactorUser{ID: user.ID, Key: key, Step: step, Codes: codes}
+}
+
+func TestTwoFactorServicePostgresReuse(t *testing.T) {
+	db := openTestDB(t)
+	twoFactor := models.NewTwoFactorServicePostgres(db)
+	user := enrollTwoFactor(t, twoFactor, models.NewUserServicePostgres(db))
+	userID, key, current := user.ID, user.Key, user.Step
+
+	// The code confirming the enrollment is used already.
+	if err := twoFactor.Verify(userID, models.TOTPCode(key, current)); !errors.Is(err, models.ErrInvalidCode) {
+		t.Errorf("Verify the confirmation code: err = %v, want ErrInvalidCode", err)
+	}
+	if err := twoFactor.Verify(userID, models.TOTPCode(key, current+1)); err != nil {
+		t.Fatalf("Verify the code of the next step: %v", err)
+	}
+	if err := twoFactor.Verify(userID, models.TOTPCode(key, current+1)); !errors.Is(err, models.ErrInvalidCode) {
+		t.Errorf("Verify a code twice: err = %v, want ErrInvalidCode", err)
+	}
+	// Codes older than the last one used can't be replayed either.
+	if err := twoFactor.Verify(userID, models.TOTPCode(key, current-1)); !errors.Is(err, models.ErrInvalidCode) {
+		t.Errorf("Verify the code of the previous step: err = %v, want ErrInvalidCode", err)
+	}
+}
+
+func TestTwoFactorServicePostgresRecoveryCodes(t *testing.T) {
+	db := openTestDB(t)
+	twoFactor := models.NewTwoFactorServicePostgres(db)
+	user := enrollTwoFactor(t, twoFactor, models.NewUserServicePostgres(db))
+	userID, codes := user.ID, user.Codes
+
+	if err := twoFactor.Verify(userID, codes[0]); err != nil {
+		t.Fatalf("Verify a recovery code: %v", err)
+	}
+	if err := twoFactor.Verify(userID, codes[0]); !errors.Is(err, models.ErrInvalidCode) {
+		t.Errorf("Verify a recovery code twice: err = %v, want ErrInvalidCode", err)
+	}
+	// Codes are typed back with other separators and case.
+	typed := strings.ToUpper(strings.Replace(codes[1], "-", " ", 1))
+	if err := twoFactor.Verify(userID, typed); err != nil {
+		t.Errorf("Verify %q: %v", typed, err)
+	}
+	if err := twoFactor.Verify(userID, "aaaaa-aaaaa"); !errors.Is(err, models.ErrInvalidCode) {
+		t.Errorf("Verify an unknown recovery code: err = %v, want ErrInvalidCode", err)
+	}
+
+	// Disabling 2FA drops the remaining codes.
+	if err := twoFactor.Disable(userID); err != nil {
+		t.Fatal(err)
+	}
+	if err := twoFactor.Verify(userID, codes[2]); !errors.Is(err, models.ErrInvalidCode) {
+		t.Errorf("Verify a recovery code after Disable: err = %v, want ErrInvalidCode", err)
+	}
+}
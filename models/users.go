@@ -2,31 +2,63 @@ package models
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"strings"
+	"time"
 )
 
 type User struct {
-	ID           uint
-	Email        string
+	ID    uint
+	Email string
+	// PasswordHash is empty for users who signed up with an identity provider.
 	PasswordHash string
+	// EmailVerifiedAt is nil until the user confirms their email address.
+	EmailVerifiedAt *time.Time
+}
+
+// Verified reports whether the user confirmed their email address.
+func (u User) Verified() bool {
+	return u.EmailVerifiedAt != nil
 }
 
 type UserService interface {
+	// Create returns a *ValidationError when password breaks the password
+	// policy and ErrEmailTaken when email already has an account.
 	Create(email, password string) (*User, error)
+	// Authenticate returns ErrNotFound for unknown emails and
+	// ErrInvalidPassword for wrong passwords.
 	Authenticate(email, password string) (*User, error)
+	// UpdatePassword returns a *ValidationError when password breaks the password policy.
 	UpdatePassword(userId uint, password string) error
 }
 
-func NewUserServicePostgres(db *sql.DB) UserService {
-	return &userServicePostgres{
-		DB: db,
+type userOption func(*userServicePostgres)
+
+// WithPasswordPolicy replaces the default policy, NewPasswordPolicy().
+func WithPasswordPolicy(policy PasswordPolicy) userOption {
+	return func(s *userServicePostgres) {
+		if policy != nil {
+			s.PasswordPolicy = policy
+		}
+	}
+}
+
+func NewUserServicePostgres(db *sql.DB, opts ...userOption) UserService {
+	s := userServicePostgres{
+		DB:             db,
+		PasswordPolicy: NewPasswordPolicy(),
+	}
+	for _, opt := range opts {
+		opt(&s)
 	}
+	return &s
 }
 
 type userServicePostgres struct {
-	DB *sql.DB
+	DB             *sql.DB
+	PasswordPolicy PasswordPolicy
 }
 
 func (us userServicePostgres) Authenticate(email, password string) (*User, error) {
@@ -34,14 +66,17 @@ func (us userServicePostgres) Authenticate(email, password string) (*User, error
 		Email: strings.ToLower(email), // postgres is not case sensitive,
 	}
 	row := us.DB.QueryRow(`
-		SELECT id, password_hash FROM users
+		SELECT id, password_hash, email_verified_at FROM users
 		WHERE email=$1`, user.Email)
 
-	err := row.Scan(&user.ID, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.PasswordHash, &user.EmailVerifiedAt)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("authenticate: %w", ErrNotFound)
+		}
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
-	if err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+	if err = comparePassword(user.PasswordHash, password); err != nil {
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
 	return &user, nil
@@ -52,6 +87,9 @@ func (us userServicePostgres) Create(email, password string) (*User, error) {
 	user := User{
 		Email: strings.ToLower(email), // postgres is not case sensitive
 	}
+	if err = us.PasswordPolicy.Validate(user.Email, password); err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
 	user.PasswordHash, err = us.generateFromPassword(password)
 	if err != nil {
 		return nil, fmt.Errorf("create user: %w", err)
@@ -61,12 +99,26 @@ func (us userServicePostgres) Create(email, password string) (*User, error) {
 		VALUES ($1, $2) RETURNING id`, user.Email, user.PasswordHash)
 	err = row.Scan(&user.ID)
 	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, fmt.Errorf("create user: %w", ErrEmailTaken)
+		}
 		return nil, fmt.Errorf("create user: %w", err)
 	}
 	return &user, nil
 }
 
 func (us userServicePostgres) UpdatePassword(userId uint, password string) error {
+	var email string
+	row := us.DB.QueryRow(`SELECT email FROM users WHERE id = $1;`, userId)
+	if err := row.Scan(&email); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("update password: %w", ErrNotFound)
+		}
+		return fmt.Errorf("update password: %w", err)
+	}
+	if err := us.PasswordPolicy.Validate(email, password); err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
 	hash, err := us.generateFromPassword(password)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
@@ -80,9 +132,116 @@ func (us userServicePostgres) UpdatePassword(userId uint, password string) error
 }
 
 func (us userServicePostgres) generateFromPassword(password string) (string, error) {
+	return generateFromPassword(password)
+}
+
+// NewUserServiceMemory keeps users in db, it takes the same options as
+// NewUserServicePostgres.
+func NewUserServiceMemory(db *MemoryDB, opts ...userOption) UserService {
+	s := userServicePostgres{
+		PasswordPolicy: NewPasswordPolicy(),
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return &userServiceMemory{
+		DB:             db,
+		PasswordPolicy: s.PasswordPolicy,
+	}
+}
+
+type userServiceMemory struct {
+	DB             *MemoryDB
+	PasswordPolicy PasswordPolicy
+}
+
+func (us userServiceMemory) Authenticate(email, password string) (*User, error) {
+	us.DB.mu.Lock()
+	stored, ok := us.DB.userByEmail(email)
+	var user User
+	if ok {
+		user = *stored
+	}
+	us.DB.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("authenticate: %w", ErrNotFound)
+	}
+	if err := comparePassword(user.PasswordHash, password); err != nil {
+		return nil, fmt.Errorf("authenticate: %w", err)
+	}
+	return &user, nil
+}
+
+func (us userServiceMemory) Create(email, password string) (*User, error) {
+	var err error
+	user := User{
+		Email: strings.ToLower(email),
+	}
+	if err = us.PasswordPolicy.Validate(user.Email, password); err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	user.PasswordHash, err = generateFromPassword(password)
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
+	us.DB.mu.Lock()
+	defer us.DB.mu.Unlock()
+	if _, taken := us.DB.userByEmail(user.Email); taken {
+		return nil, fmt.Errorf("create user: %w", ErrEmailTaken)
+	}
+	user.ID = us.DB.nextID()
+	stored := user
+	us.DB.users[user.ID] = &stored
+	return &user, nil
+}
+
+func (us userServiceMemory) UpdatePassword(userId uint, password string) error {
+	us.DB.mu.Lock()
+	user, ok := us.DB.users[userId]
+	var email string
+	if ok {
+		email = user.Email
+	}
+	us.DB.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("update password: %w", ErrNotFound)
+	}
+	if err := us.PasswordPolicy.Validate(email, password); err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	hash, err := generateFromPassword(password)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	us.DB.mu.Lock()
+	defer us.DB.mu.Unlock()
+	// The user may have been deleted while hashing, like the UPDATE of
+	// userServicePostgres this is not an error.
+	if user, ok = us.DB.users[userId]; ok {
+		user.PasswordHash = hash
+	}
+	return nil
+}
+
+// generateFromPassword returns the bcrypt hash of password, shared by every
+// service storing passwords.
+func generateFromPassword(password string) (string, error) {
 	binHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return "", err
 	}
 	return string(binHash), nil
 }
+
+// comparePassword returns ErrInvalidPassword when password doesn't match
+// hash. An empty hash matches no password.
+func comparePassword(hash, password string) error {
+	if hash == "" {
+		return ErrInvalidPassword
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrInvalidPassword
+	}
+	return err
+}
@@ -2,6 +2,7 @@ package views
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/arkadiont/lenslocked/context"
 	"github.com/arkadiont/lenslocked/models"
@@ -30,6 +31,12 @@ func ParseFS(fs fs.FS, pattern ...string) (Template, error) {
 			"currentUser": func() (template.HTML, error) {
 				return "", fmt.Errorf("currentUser not implemented")
 			},
+			"errors": func() []string {
+				return nil
+			},
+			"flashes": func() []context.Flash {
+				return nil
+			},
 		},
 	)
 	tpl, err := tpl.ParseFS(fs, pattern...)
@@ -46,7 +53,30 @@ type Template struct {
 	htmlTpl *template.Template
 }
 
-func (t Template) Execute(w http.ResponseWriter, r *http.Request, data interface{}) {
+// public is implemented by errors whose message is safe to show to users.
+type public interface {
+	Public() string
+}
+
+// errorMessages returns what to tell the user about errs, errors that aren't
+// public are replaced by a generic message so no internals leak.
+func errorMessages(errs []error) []string {
+	var msgs []string
+	for _, err := range errs {
+		var pubErr public
+		if errors.As(err, &pubErr) {
+			msgs = append(msgs, pubErr.Public())
+		} else {
+			log.Printf("template error: %v", err)
+			msgs = append(msgs, "Something went wrong.")
+		}
+	}
+	return msgs
+}
+
+// Execute renders the template with data. errs are made available to the
+// template through the errors function.
+func (t Template) Execute(w http.ResponseWriter, r *http.Request, data interface{}, errs ...error) {
 	tpl, err := t.htmlTpl.Clone()
 	if err != nil {
 		log.Printf("err cloning template %v", err)
@@ -61,6 +91,12 @@ func (t Template) Execute(w http.ResponseWriter, r *http.Request, data interface
 			"currentUser": func() *models.User {
 				return context.User(r.Context())
 			},
+			"errors": func() []string {
+				return errorMessages(errs)
+			},
+			"flashes": func() []context.Flash {
+				return context.Flashes(r.Context())
+			},
 		},
 	)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")